@@ -0,0 +1,249 @@
+// Package archive writes feeds to a portable archive file and reads them
+// back into a store, for moving messages between machines that share no
+// network.
+//
+// An archive is a tar file. Messages are kept in messages/NNNNNNNN.jsonl
+// entries, one signed message per line as compact JSON, with each feed's
+// messages in sequence order. The blobs the messages refer to may follow
+// as blobs/<sha256 in hex> entries.
+package archive
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/andyleap/go-ssb"
+	"github.com/andyleap/go-ssb/blobs"
+	"github.com/andyleap/go-ssb/links"
+)
+
+// chunkSize is how many messages go in each messages entry, and so are
+// imported in each transaction.
+const chunkSize = 1000
+
+// maxLine bounds the length of a message in an archive.
+const maxLine = 1 << 20
+
+// Options selects what Export writes.
+type Options struct {
+	// Feeds are the feeds to export, or every feed in the store if none
+	// are given.
+	Feeds []ssb.Ref
+
+	// Blobs is the blob store to include the blobs linked from the public
+	// content of the messages from, if set.
+	Blobs *blobs.BlobStore
+}
+
+// Stats counts what an export wrote or an import read. Skipped counts the
+// blobs an export did not have, and the messages and blobs an import
+// already had. Failed counts what an import could not verify.
+type Stats struct {
+	Feeds    int `json:"feeds"`
+	Messages int `json:"messages"`
+	Blobs    int `json:"blobs"`
+	Skipped  int `json:"skipped"`
+	Failed   int `json:"failed"`
+}
+
+func (st Stats) String() string {
+	return fmt.Sprintf("%d messages, %d blobs, skipped %d, failed %d", st.Messages, st.Blobs, st.Skipped, st.Failed)
+}
+
+// Export writes the messages of the feeds chosen by opts to w as an
+// archive.
+func Export(ds *ssb.DataStore, w io.Writer, opts Options) (st Stats, err error) {
+	feeds := opts.Feeds
+	if len(feeds) == 0 {
+		feeds = ds.Feeds()
+	}
+	tw := tar.NewWriter(w)
+	now := time.Now()
+
+	var chunk bytes.Buffer
+	lines, chunks := 0, 0
+	flush := func() error {
+		if lines == 0 {
+			return nil
+		}
+		chunks++
+		err := tw.WriteHeader(&tar.Header{
+			Name:    fmt.Sprintf("messages/%08d.jsonl", chunks),
+			Mode:    0644,
+			Size:    int64(chunk.Len()),
+			ModTime: now,
+		})
+		if err == nil {
+			_, err = tw.Write(chunk.Bytes())
+		}
+		chunk.Reset()
+		lines = 0
+		return err
+	}
+
+	seen := map[ssb.Ref]bool{}
+	var blobRefs []ssb.Ref
+	for _, feed := range feeds {
+		f := ds.GetFeed(feed)
+		if f == nil {
+			return st, fmt.Errorf("Cannot export %s, not a feed", feed)
+		}
+		st.Feeds++
+		ctx, cancel := context.WithCancel(context.Background())
+		for m := range f.LogContext(ctx, 0, false) {
+			if err = json.Compact(&chunk, m.Encode()); err != nil {
+				break
+			}
+			chunk.WriteByte('\n')
+			lines++
+			st.Messages++
+			if opts.Blobs != nil {
+				for _, l := range links.Extract(m) {
+					if l.Target.Type == ssb.RefBlob && !seen[l.Target] {
+						seen[l.Target] = true
+						blobRefs = append(blobRefs, l.Target)
+					}
+				}
+			}
+			if lines >= chunkSize {
+				if err = flush(); err != nil {
+					break
+				}
+			}
+		}
+		cancel()
+		if err != nil {
+			return
+		}
+	}
+	if err = flush(); err != nil {
+		return
+	}
+
+	for _, r := range blobRefs {
+		if err = writeBlob(tw, opts.Blobs, r, now); err == errMissingBlob {
+			st.Skipped++
+			continue
+		}
+		if err != nil {
+			return
+		}
+		st.Blobs++
+	}
+	return st, tw.Close()
+}
+
+var errMissingBlob = errors.New("Missing blob")
+
+func writeBlob(tw *tar.Writer, bs *blobs.BlobStore, r ssb.Ref, now time.Time) error {
+	size := bs.Size(r)
+	rc := bs.Get(r)
+	if size < 0 || rc == nil {
+		return errMissingBlob
+	}
+	defer rc.Close()
+	err := tw.WriteHeader(&tar.Header{
+		Name:    "blobs/" + hex.EncodeToString(r.Raw()),
+		Mode:    0644,
+		Size:    size,
+		ModTime: now,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, rc, size)
+	return err
+}
+
+// Import reads an archive from r into the store. Every message is verified
+// against its feed as replicated messages are, so a feed can only be
+// extended from where the store has it up to. Blobs are added to bs if it
+// is set and their contents match their names. progress, if set, is called
+// after each entry.
+func Import(ds *ssb.DataStore, r io.Reader, bs *blobs.BlobStore, progress func(st Stats)) (Stats, error) {
+	var st Stats
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return st, nil
+		}
+		if err != nil {
+			return st, err
+		}
+		switch {
+		case strings.HasPrefix(hdr.Name, "messages/"):
+			err = importMessages(ds, tr, &st)
+		case strings.HasPrefix(hdr.Name, "blobs/") && bs != nil:
+			err = importBlob(bs, strings.TrimPrefix(hdr.Name, "blobs/"), tr, &st)
+		default:
+			continue
+		}
+		if err != nil {
+			return st, err
+		}
+		if progress != nil {
+			progress(st)
+		}
+	}
+}
+
+func importMessages(ds *ssb.DataStore, r io.Reader, st *Stats) error {
+	var msgs []*ssb.SignedMessage
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLine)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var m *ssb.SignedMessage
+		if json.Unmarshal(line, &m) != nil {
+			m = nil
+		}
+		msgs = append(msgs, m)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	var p ssb.ImportProgress
+	err := ds.ImportMessages(msgs, &p)
+	if err != nil {
+		return err
+	}
+	st.Messages += p.Imported
+	st.Skipped += p.Skipped
+	st.Failed += p.Failed
+	return nil
+}
+
+func importBlob(bs *blobs.BlobStore, name string, r io.Reader, st *Stats) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(data)
+	if hex.EncodeToString(hash[:]) != name {
+		st.Failed++
+		return nil
+	}
+	ref, _ := ssb.NewRef(ssb.RefBlob, hash[:], ssb.RefAlgoSha256)
+	if bs.Has(ref) {
+		st.Skipped++
+		return nil
+	}
+	bs.Add(data)
+	st.Blobs++
+	return nil
+}
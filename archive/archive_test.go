@@ -0,0 +1,101 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+
+	"github.com/andyleap/go-ssb"
+	"github.com/andyleap/go-ssb/blobs"
+	"github.com/andyleap/go-ssb/ssbtest"
+)
+
+func newStore(t *testing.T, dir string) (*ssb.DataStore, *blobs.BlobStore) {
+	ds := ssbtest.NewStore(t)
+	return ds, blobs.New(dir, ds)
+}
+
+func TestExportImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src, srcBlobs := newStore(t, filepath.Join(dir, "src"))
+	defer src.Close()
+	blob := srcBlobs.Add([]byte("a picture"))
+	missing, _ := ssb.NewRef(ssb.RefBlob, make([]byte, 32), ssb.RefAlgoSha256)
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	other, _ := ssb.NewRef(ssb.RefFeed, pub, ssb.RefAlgoEd25519)
+	src.Keys[other] = &ssb.SignerEd25519{Private: priv}
+	for i := 0; i < 3; i++ {
+		for _, feed := range []ssb.Ref{src.PrimaryRef, other} {
+			_, err := src.GetFeed(feed).PublishMessage(map[string]interface{}{"type": "post", "text": "look at " + blob.String() + " and " + missing.String()})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	st, err := Export(src, &buf, Options{Blobs: srcBlobs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Feeds != 2 || st.Messages != 6 || st.Blobs != 1 || st.Skipped != 1 {
+		t.Fatalf("exported %+v", st)
+	}
+
+	dst, dstBlobs := newStore(t, filepath.Join(dir, "dst"))
+	defer dst.Close()
+	archive := buf.Bytes()
+	st, err = Import(dst, bytes.NewReader(archive), dstBlobs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Messages != 6 || st.Blobs != 1 || st.Skipped != 0 || st.Failed != 0 {
+		t.Fatalf("imported %+v", st)
+	}
+	for _, feed := range []ssb.Ref{src.PrimaryRef, other} {
+		if l := dst.GetFeed(feed).Latest(); l == nil || l.Key() != src.GetFeed(feed).Latest().Key() {
+			t.Errorf("feed %s imported up to %v", feed, l)
+		}
+	}
+	if !dstBlobs.Has(blob) {
+		t.Error("blob not imported")
+	}
+
+	st, err = Import(dst, bytes.NewReader(archive), dstBlobs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Messages != 0 || st.Skipped != 7 {
+		t.Errorf("imported again %+v", st)
+	}
+
+	// A message altered after it was signed is refused, and so is the
+	// rest of its feed after it.
+	buf.Reset()
+	if _, err := Export(src, &buf, Options{Feeds: []ssb.Ref{other}}); err != nil {
+		t.Fatal(err)
+	}
+	tampered := bytes.Replace(buf.Bytes(), []byte(`"look at`), []byte(`"LOOK AT`), 1)
+	fresh, _ := newStore(t, filepath.Join(dir, "fresh"))
+	defer fresh.Close()
+	st, err = Import(fresh, bytes.NewReader(tampered), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Messages != 0 || st.Failed != 3 {
+		t.Errorf("imported tampered archive %+v", st)
+	}
+	if fresh.GetFeed(other).Latest() != nil {
+		t.Error("tampered feed stored")
+	}
+}
@@ -0,0 +1,331 @@
+package ssb
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/andyleap/go-ssb/storage"
+)
+
+var (
+	ErrNoSnapshot = errors.New("Store cannot be snapshotted")
+	ErrNotBackup  = errors.New("Not a backup")
+)
+
+// A backup is a tar file. It starts with a backup.json entry holding its
+// BackupInfo, followed by a "db" entry with a copy of the database, a "log"
+// entry with the offset log of a flume store, and "dirs/<name>/..." entries
+// for the files of the directories modules registered with AddBackupDir.
+const (
+	backupManifest  = "backup.json"
+	backupDB        = "db"
+	backupLog       = "log"
+	backupDirPrefix = "dirs/"
+)
+
+// BackupOptions selects what Backup writes.
+type BackupOptions struct {
+	// Incremental leaves out the files of backup directories that have not
+	// changed since the last backup was taken. The database and log are
+	// always written in full, so restoring an incremental backup needs the
+	// backups before it only for their files.
+	Incremental bool
+}
+
+// BackupInfo describes a backup that was taken.
+type BackupInfo struct {
+	Time time.Time `json:"time"`
+
+	// Since is when the backup before an incremental backup was taken,
+	// files older than it were left out.
+	Since time.Time `json:"since,omitempty"`
+
+	DB      int64 `json:"db"`
+	Log     int64 `json:"log,omitempty"`
+	Files   int   `json:"files"`
+	Skipped int   `json:"skipped"`
+}
+
+func (bi BackupInfo) String() string {
+	kind := "full"
+	if !bi.Since.IsZero() {
+		kind = "incremental since " + bi.Since.Format(time.RFC3339)
+	}
+	return fmt.Sprintf("%s backup, %d byte database, %d byte log, %d files, skipped %d", kind, bi.DB, bi.Log, bi.Files, bi.Skipped)
+}
+
+func (ds *DataStore) registerBackupMethods() {
+	ds.RegisterMethod("backup.Create", func(path string, incremental bool) (BackupInfo, error) {
+		return ds.BackupFile(path, BackupOptions{Incremental: incremental})
+	})
+	ds.RegisterMethod("backup.Last", func() *BackupInfo {
+		return ds.LastBackup()
+	})
+}
+
+// AddBackupDir includes the files under dir in backups of the store, under
+// name. Modules that keep data outside the database call it from Init.
+func (ds *DataStore) AddBackupDir(name, dir string) {
+	ds.valuesLock.Lock()
+	defer ds.valuesLock.Unlock()
+	ds.backupDirs[name] = dir
+}
+
+// LastBackup returns the most recent backup taken of the store, or nil if
+// there has not been one.
+func (ds *DataStore) LastBackup() *BackupInfo {
+	var last *BackupInfo
+	ds.db.View(func(tx storage.Tx) error {
+		BackupsBucket := tx.Bucket([]byte("backups"))
+		if BackupsBucket == nil {
+			return nil
+		}
+		_, v := BackupsBucket.Cursor().Last()
+		if v != nil {
+			json.Unmarshal(v, &last)
+		}
+		return nil
+	})
+	return last
+}
+
+// Backup writes a consistent copy of the store to w while it stays open for
+// reading and writing. Writers are only held up while the snapshot is
+// taken, not while it is written.
+func (ds *DataStore) Backup(w io.Writer, opts BackupOptions) (BackupInfo, error) {
+	bi := BackupInfo{Time: time.Now()}
+	if opts.Incremental {
+		if last := ds.LastBackup(); last != nil {
+			bi.Since = last.Time
+		}
+	}
+
+	// Holding the writer while the read transaction begins means no
+	// message is half way between the log and the database.
+	wtx, err := ds.db.Begin(true)
+	if err != nil {
+		return bi, err
+	}
+	offsetLog, _ := ds.log.(*storage.OffsetLog)
+	logSize := 0
+	if offsetLog != nil {
+		logSize = offsetLog.Size()
+	}
+	tx, err := ds.db.Begin(false)
+	wtx.Rollback()
+	if err != nil {
+		return bi, err
+	}
+	defer tx.Rollback()
+	snap, ok := tx.(storage.Snapshotter)
+	if !ok {
+		return bi, ErrNoSnapshot
+	}
+	bi.DB = snap.Size()
+	bi.Log = int64(logSize)
+
+	tw := tar.NewWriter(w)
+	manifest, _ := json.Marshal(bi)
+	if err := writeBackupEntry(tw, backupManifest, int64(len(manifest)), bi.Time, func(w io.Writer) (int64, error) {
+		n, err := w.Write(manifest)
+		return int64(n), err
+	}); err != nil {
+		return bi, err
+	}
+	if err := writeBackupEntry(tw, backupDB, bi.DB, bi.Time, snap.WriteTo); err != nil {
+		return bi, err
+	}
+	if offsetLog != nil {
+		if err := writeBackupEntry(tw, backupLog, bi.Log, bi.Time, func(w io.Writer) (int64, error) {
+			return offsetLog.CopyTo(w, logSize)
+		}); err != nil {
+			return bi, err
+		}
+	}
+	tx.Rollback()
+
+	ds.valuesLock.Lock()
+	dirs := map[string]string{}
+	for name, dir := range ds.backupDirs {
+		dirs[name] = dir
+	}
+	ds.valuesLock.Unlock()
+	for name, dir := range dirs {
+		if err := backupDir(tw, name, dir, &bi); err != nil {
+			return bi, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return bi, err
+	}
+
+	err = ds.db.Update(func(tx storage.Tx) error {
+		BackupsBucket, err := tx.CreateBucketIfNotExists([]byte("backups"))
+		if err != nil {
+			return err
+		}
+		buf, _ := json.Marshal(bi)
+		return BackupsBucket.Put(itob(int(bi.Time.UnixNano())), buf)
+	})
+	return bi, err
+}
+
+// BackupFile writes a backup of the store to a new file at path, removing it
+// again if the backup fails.
+func (ds *DataStore) BackupFile(path string, opts BackupOptions) (BackupInfo, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	bi, err := ds.Backup(f, opts)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return bi, err
+}
+
+func writeBackupEntry(tw *tar.Writer, name string, size int64, mtime time.Time, write func(w io.Writer) (int64, error)) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    size,
+		ModTime: mtime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = write(tw)
+	return err
+}
+
+// backupDir writes the regular files under dir that have changed since
+// bi.Since.
+func backupDir(tw *tar.Writer, name, dir string, bi *BackupInfo) error {
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		if info.ModTime().Before(bi.Since) {
+			bi.Skipped++
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(p)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		// The size is taken from the open file, so a file being replaced
+		// while the backup runs is copied whole as either version.
+		info, err = f.Stat()
+		if err != nil {
+			return err
+		}
+		bi.Files++
+		return writeBackupEntry(tw, backupDirPrefix+name+"/"+filepath.ToSlash(rel), info.Size(), info.ModTime(), func(w io.Writer) (int64, error) {
+			return io.CopyN(w, f, info.Size())
+		})
+	})
+}
+
+// RestoreBackup writes the store held in the backup read from r to dbPath,
+// its offset log to logPath, and the files of its directories to the
+// directories in dirs by name. Directories missing from dirs are not
+// restored. The store must not be open. To restore from incremental
+// backups, restore the full backup they started from and then each of them
+// in the order they were taken.
+func RestoreBackup(r io.Reader, dbPath, logPath string, dirs map[string]string) (BackupInfo, error) {
+	var bi BackupInfo
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err == io.EOF || (err == nil && hdr.Name != backupManifest) {
+		return bi, ErrNotBackup
+	}
+	if err != nil {
+		return bi, err
+	}
+	if err := json.NewDecoder(tr).Decode(&bi); err != nil {
+		return bi, ErrNotBackup
+	}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return bi, nil
+		}
+		if err != nil {
+			return bi, err
+		}
+		switch {
+		case hdr.Name == backupDB:
+			err = restoreFile(dbPath, tr)
+		case hdr.Name == backupLog:
+			if logPath == "" {
+				return bi, fmt.Errorf("Backup has an offset log but no path was given for it")
+			}
+			err = restoreFile(logPath, tr)
+		case strings.HasPrefix(hdr.Name, backupDirPrefix):
+			parts := strings.SplitN(strings.TrimPrefix(hdr.Name, backupDirPrefix), "/", 2)
+			dir, ok := dirs[parts[0]]
+			if !ok || len(parts) != 2 {
+				continue
+			}
+			rel := path.Clean("/" + parts[1])[1:]
+			if rel == "" {
+				continue
+			}
+			err = restoreFile(filepath.Join(dir, filepath.FromSlash(rel)), tr)
+		}
+		if err != nil {
+			return bi, err
+		}
+	}
+}
+
+// restoreFile replaces the file at name with the contents of r.
+func restoreFile(name string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".restore")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
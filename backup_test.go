@@ -0,0 +1,119 @@
+package ssb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/andyleap/go-ssb/storage"
+)
+
+func TestBackupRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kp := newTestKey()
+
+	mem, err := NewDataStore(storage.NewMemory(), storage.NewBucketLog("log"), kp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mem.Backup(ioutil.Discard, BackupOptions{}); err != ErrNoSnapshot {
+		t.Errorf("memory store backed up, %v", err)
+	}
+	mem.Close()
+
+	for _, flume := range []bool{false, true} {
+		name := "bolt"
+		if flume {
+			name = "flume"
+		}
+		open := func(root string) (*DataStore, error) {
+			if flume {
+				return OpenFlumeDataStore(filepath.Join(root, "feeds.db"), filepath.Join(root, "log.offset"), kp)
+			}
+			return OpenDataStore(filepath.Join(root, "feeds.db"), kp)
+		}
+		src, dst := filepath.Join(dir, name, "src"), filepath.Join(dir, name, "dst")
+		os.MkdirAll(filepath.Join(src, "files"), 0700)
+		ds, err := open(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ds.AddBackupDir("files", filepath.Join(src, "files"))
+		publish := func() {
+			if _, err := ds.GetFeed(ds.PrimaryRef).PublishMessage(map[string]interface{}{"type": "post", "text": "hello"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		publish()
+		publish()
+		ioutil.WriteFile(filepath.Join(src, "files", "a"), []byte("first"), 0600)
+
+		var full, incr bytes.Buffer
+		bi, err := ds.Backup(&full, BackupOptions{Incremental: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bi.Since.IsZero() || bi.Files != 1 || (flume && bi.Log == 0) {
+			t.Errorf("%s: first backup %+v", name, bi)
+		}
+		if last := ds.LastBackup(); last == nil || !last.Time.Equal(bi.Time) {
+			t.Errorf("%s: last backup %+v", name, last)
+		}
+
+		time.Sleep(20 * time.Millisecond)
+		publish()
+		os.MkdirAll(filepath.Join(src, "files", "sub"), 0700)
+		ioutil.WriteFile(filepath.Join(src, "files", "sub", "b"), []byte("second"), 0600)
+		bi, err = ds.Backup(&incr, BackupOptions{Incremental: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bi.Since.IsZero() || bi.Files != 1 || bi.Skipped != 1 {
+			t.Errorf("%s: incremental backup %+v", name, bi)
+		}
+		ds.Close()
+
+		logPath := ""
+		if flume {
+			logPath = filepath.Join(dst, "log.offset")
+		}
+		dirs := map[string]string{"files": filepath.Join(dst, "files")}
+		for _, b := range []*bytes.Buffer{&full, &incr} {
+			if _, err := RestoreBackup(b, filepath.Join(dst, "feeds.db"), logPath, dirs); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ds, err = open(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l := ds.GetFeed(ds.PrimaryRef).Latest(); l == nil || l.Sequence != 3 {
+			t.Errorf("%s: restored feed up to %v", name, l)
+		}
+		n := 0
+		for range ds.LogStream(0, false, false, 0) {
+			n++
+		}
+		if n != 3 {
+			t.Errorf("%s: restored log has %d messages", name, n)
+		}
+		ds.Close()
+		for file, data := range map[string]string{"a": "first", "sub/b": "second"} {
+			buf, err := ioutil.ReadFile(filepath.Join(dst, "files", filepath.FromSlash(file)))
+			if err != nil || string(buf) != data {
+				t.Errorf("%s: restored file %s is %q, %v", name, file, buf, err)
+			}
+		}
+	}
+
+	if _, err := RestoreBackup(bytes.NewReader(nil), filepath.Join(dir, "none"), "", nil); err != ErrNotBackup {
+		t.Errorf("restored from nothing, %v", err)
+	}
+}
@@ -1,6 +1,8 @@
 package blobs
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
@@ -10,9 +12,11 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/andyleap/go-ssb"
 	"github.com/andyleap/go-ssb/muxrpcManager"
+	"github.com/andyleap/go-ssb/storage"
 	"github.com/andyleap/muxrpc"
 	"github.com/andyleap/muxrpc/codec"
 )
@@ -39,15 +43,18 @@ func (bl *BlobLink) UnmarshalJSON(b []byte) error {
 
 func New(root string, ds *ssb.DataStore) *BlobStore {
 	return &BlobStore{
-		ds:   ds,
-		Root: root,
-		wait: sync.NewCond(&sync.Mutex{}),
-		want: map[ssb.Ref]*want{},
+		ds:    ds,
+		Root:  root,
+		added: make(chan struct{}),
+		want:  map[ssb.Ref]*want{},
 	}
 }
 
+// Get returns the blob store of ds, or nil if Module is not registered on
+// it.
 func Get(ds *ssb.DataStore) *BlobStore {
-	return ds.ExtraData("blobStore").(*BlobStore)
+	bs, _ := ds.Value(key{}).(*BlobStore)
+	return bs
 }
 
 type want struct {
@@ -59,7 +66,11 @@ type want struct {
 type BlobStore struct {
 	ds   *ssb.DataStore
 	Root string
-	wait *sync.Cond
+
+	// added is closed and replaced whenever a blob is added, waking
+	// everything waiting for one.
+	added     chan struct{}
+	addedLock sync.Mutex
 
 	want     map[ssb.Ref]*want
 	wantLock sync.Mutex
@@ -70,11 +81,18 @@ func (bs *BlobStore) Add(data []byte) ssb.Ref {
 
 	hexhash := hex.EncodeToString(hash[:])
 	pre, hexhash := hexhash[:2], hexhash[2:]
+	stored := data
+	if s := bs.sealer(); s != nil {
+		stored = s.Seal(data)
+	}
 	os.MkdirAll(filepath.Join(bs.Root, pre), 0777)
-	ioutil.WriteFile(filepath.Join(bs.Root, pre, hexhash+".tmp"), data, 0777)
+	ioutil.WriteFile(filepath.Join(bs.Root, pre, hexhash+".tmp"), stored, 0777)
 	os.Rename(filepath.Join(bs.Root, pre, hexhash+".tmp"), filepath.Join(bs.Root, pre, hexhash))
 
-	bs.wait.Broadcast()
+	bs.addedLock.Lock()
+	close(bs.added)
+	bs.added = make(chan struct{})
+	bs.addedLock.Unlock()
 	r, _ := ssb.NewRef(ssb.RefBlob, hash[:], ssb.RefAlgoSha256)
 	return r
 }
@@ -100,19 +118,33 @@ func (bs *BlobStore) Size(r ssb.Ref) int64 {
 	}
 	pre, hexhash := hexhash[:2], hexhash[2:]
 	if s, err := os.Stat(filepath.Join(bs.Root, pre, hexhash)); !os.IsNotExist(err) {
+		if bs.sealer() != nil {
+			return s.Size() - storage.SealOverhead
+		}
 		return s.Size()
 	}
 	return -1
 }
 
 func (bs *BlobStore) WaitFor(r ssb.Ref) {
-	if bs.Has(r) {
-		return
-	}
-	bs.wait.L.Lock()
-	defer bs.wait.L.Unlock()
-	for !bs.Has(r) {
-		bs.wait.Wait()
+	bs.WaitForContext(context.Background(), r)
+}
+
+// WaitForContext blocks until the blob r has been added, or ctx is done in
+// which case the context's error is returned.
+func (bs *BlobStore) WaitForContext(ctx context.Context, r ssb.Ref) error {
+	for {
+		bs.addedLock.Lock()
+		added := bs.added
+		bs.addedLock.Unlock()
+		if bs.Has(r) {
+			return nil
+		}
+		select {
+		case <-added:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 }
 
@@ -122,10 +154,63 @@ func (bs *BlobStore) Get(r ssb.Ref) io.ReadCloser {
 	}
 	hexhash := hex.EncodeToString(r.Raw())
 	pre, hexhash := hexhash[:2], hexhash[2:]
+	if s := bs.sealer(); s != nil {
+		sealed, err := ioutil.ReadFile(filepath.Join(bs.Root, pre, hexhash))
+		if err != nil {
+			return nil
+		}
+		data, err := s.Open(sealed)
+		if err != nil {
+			log.Println("blob", r, "cannot be opened:", err)
+			return nil
+		}
+		return ioutil.NopCloser(bytes.NewReader(data))
+	}
 	f, _ := os.Open(filepath.Join(bs.Root, pre, hexhash))
 	return f
 }
 
+// sealer returns what blobs are sealed with, which is what the store they
+// belong to is sealed with.
+func (bs *BlobStore) sealer() *storage.Sealer {
+	if bs.ds == nil {
+		return nil
+	}
+	return bs.ds.Sealer()
+}
+
+// Stats counts the blobs in the store and the space they take. Day and Week
+// count those added over the last day and week.
+type Stats struct {
+	Count int        `json:"count"`
+	Bytes int64      `json:"bytes"`
+	Day   ssb.Growth `json:"day"`
+	Week  ssb.Growth `json:"week"`
+}
+
+// Stats walks the blob directory to count the blobs in it.
+func (bs *BlobStore) Stats() Stats {
+	var st Stats
+	now := time.Now()
+	filepath.Walk(bs.Root, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() || filepath.Ext(p) == ".tmp" {
+			return nil
+		}
+		st.Count++
+		st.Bytes += info.Size()
+		if age := now.Sub(info.ModTime()); age < 7*24*time.Hour {
+			st.Week.Count++
+			st.Week.Bytes += info.Size()
+			if age < 24*time.Hour {
+				st.Day.Count++
+				st.Day.Bytes += info.Size()
+			}
+		}
+		return nil
+	})
+	return st
+}
+
 func (bs *BlobStore) Want(r ssb.Ref) {
 	bs.wantLock.Lock()
 	defer bs.wantLock.Unlock()
@@ -158,8 +243,7 @@ func (bs *BlobStore) Want(r ssb.Ref) {
 		defer bs.wantLock.Unlock()
 		delete(bs.want, r)
 	}()
-	conns, ok := bs.ds.ExtraData("muxrpcConns").(*muxrpcManager.ExtraData)
-	if ok {
+	if conns := muxrpcManager.Get(bs.ds); conns != nil {
 		conns.Lock.Lock()
 		defer conns.Lock.Unlock()
 		for _, conn := range conns.Conns {
@@ -177,168 +261,168 @@ func (bs *BlobStore) Want(r ssb.Ref) {
 	}
 }
 
-func init() {
-	ssb.RegisterInit(func(ds *ssb.DataStore) {
-		bs := New("blobs", ds)
-		ds.SetExtraData("blobStore", bs)
+type key struct{}
 
-		handlers, ok := ds.ExtraData("muxrpcHandlers").(map[string]func(conn *muxrpc.Conn, req int32, args json.RawMessage))
-		if !ok {
-			handlers = map[string]func(conn *muxrpc.Conn, req int32, args json.RawMessage){}
-			ds.SetExtraData("muxrpcHandlers", handlers)
+// Module keeps the blobs of a store in the blobs directory, and serves
+// them to peers.
+var Module = &ssb.Module{
+	Name: "blobs",
+	Deps: []string{"muxrpc"},
+	Init: initBlobs,
+}
+
+func initBlobs(ds *ssb.DataStore) error {
+	bs := New("blobs", ds)
+	ds.SetValue(key{}, bs)
+	ds.AddBackupDir("blobs", bs.Root)
+	ds.RegisterMethod("blobs.Stats", bs.Stats)
+
+	muxrpcManager.Handle(ds, "blobs.has", func(conn *muxrpc.Conn, req int32, rm json.RawMessage) {
+		var r ssb.Ref
+		args := []interface{}{&r}
+		json.Unmarshal(rm, &args)
+		buf, _ := json.Marshal(bs.Has(r))
+		conn.Send(&codec.Packet{
+			Req:  -req,
+			Type: codec.JSON,
+			Body: buf,
+		})
+	})
+	muxrpcManager.Handle(ds, "blobs.get", func(conn *muxrpc.Conn, req int32, rm json.RawMessage) {
+		var arg1 json.RawMessage
+		args := []interface{}{&arg1}
+		json.Unmarshal(rm, &args)
+		var r ssb.Ref
+		err := json.Unmarshal(arg1, &r)
+		if err != nil {
+			var robj struct {
+				Hash ssb.Ref `json:"hash"`
+				Key  ssb.Ref `json:"key"`
+			}
+			json.Unmarshal(arg1, &robj)
+			if robj.Key.Type != ssb.RefInvalid {
+				r = robj.Key
+			} else if robj.Hash.Type != ssb.RefInvalid {
+				r = robj.Hash
+			}
 		}
-		handlers["blobs.has"] = func(conn *muxrpc.Conn, req int32, rm json.RawMessage) {
-			var r ssb.Ref
-			args := []interface{}{&r}
-			json.Unmarshal(rm, &args)
-			buf, _ := json.Marshal(bs.Has(r))
+
+		log.Println("Peer asking for ", r.String())
+		if !bs.Has(r) {
 			conn.Send(&codec.Packet{
-				Req:  -req,
-				Type: codec.JSON,
-				Body: buf,
+				Req:    -req,
+				Type:   codec.String,
+				Stream: true,
+				EndErr: true,
+				Body:   []byte("Blob does not exist"),
 			})
+			return
 		}
-		handlers["blobs.get"] = func(conn *muxrpc.Conn, req int32, rm json.RawMessage) {
-			var arg1 json.RawMessage
-			args := []interface{}{&arg1}
-			json.Unmarshal(rm, &args)
-			var r ssb.Ref
-			err := json.Unmarshal(arg1, &r)
-			if err != nil {
-				var robj struct {
-					Hash ssb.Ref `json:"hash"`
-					Key  ssb.Ref `json:"key"`
+		rc := bs.Get(r)
+		defer rc.Close()
+		buf := make([]byte, 1024)
+		log.Println("Sending", r.String())
+		for {
+			n, err := rc.Read(buf[:cap(buf)])
+			buf = buf[:n]
+			if n == 0 {
+				if err == nil {
+					continue
 				}
-				json.Unmarshal(arg1, &robj)
-				if robj.Key.Type != ssb.RefInvalid {
-					r = robj.Key
-				} else if robj.Hash.Type != ssb.RefInvalid {
-					r = robj.Hash
+				if err == io.EOF {
+					break
 				}
+				log.Fatal(err)
 			}
 
-			log.Println("Peer asking for ", r.String())
-			if !bs.Has(r) {
-				conn.Send(&codec.Packet{
-					Req:    -req,
-					Type:   codec.String,
-					Stream: true,
-					EndErr: true,
-					Body:   []byte("Blob does not exist"),
-				})
-				return
+			conn.Send(&codec.Packet{
+				Req:    -req,
+				Type:   codec.Buffer,
+				Stream: true,
+				Body:   buf,
+			})
+			if err != nil && err != io.EOF {
+				log.Fatal(err)
 			}
-			rc := bs.Get(r)
-			defer rc.Close()
-			buf := make([]byte, 1024)
-			log.Println("Sending", r.String())
-			for {
-				n, err := rc.Read(buf[:cap(buf)])
-				buf = buf[:n]
-				if n == 0 {
-					if err == nil {
-						continue
-					}
-					if err == io.EOF {
-						break
-					}
-					log.Fatal(err)
-				}
+		}
+		log.Println("Sent", r.String())
+		conn.Send(&codec.Packet{
+			Req:    -req,
+			Stream: true,
+			Type:   codec.JSON,
+			Body:   []byte("true"),
+			EndErr: true,
+		})
+	})
+	muxrpcManager.Handle(ds, "blobs.changes", func(conn *muxrpc.Conn, req int32, rm json.RawMessage) {
+	})
 
-				conn.Send(&codec.Packet{
-					Req:    -req,
-					Type:   codec.Buffer,
-					Stream: true,
-					Body:   buf,
-				})
-				if err != nil && err != io.EOF {
-					log.Fatal(err)
-				}
-			}
-			log.Println("Sent", r.String())
+	peerWants := map[*muxrpc.Conn]chan struct {
+		id  ssb.Ref
+		val int
+	}{}
+	var peerWantsLock sync.Mutex
+
+	muxrpcManager.Handle(ds, "blobs.createWants", func(conn *muxrpc.Conn, req int32, rm json.RawMessage) {
+		peerWantsLock.Lock()
+		c := peerWants[conn]
+		peerWantsLock.Unlock()
+
+		for ref := range c {
+			msg := map[string]int{}
+			msg[ref.id.String()] = ref.val
+			buf, _ := ssb.Encode(msg)
+			log.Println("Telling peer I have ", string(buf))
 			conn.Send(&codec.Packet{
 				Req:    -req,
-				Stream: true,
 				Type:   codec.JSON,
-				Body:   []byte("true"),
-				EndErr: true,
+				Stream: true,
+				Body:   buf,
 			})
 		}
-		handlers["blobs.changes"] = func(conn *muxrpc.Conn, req int32, rm json.RawMessage) {
-		}
-
-		peerWants := map[*muxrpc.Conn]chan struct {
+	})
+	muxrpcManager.OnConnect(ds, "blob", func(conn *muxrpc.Conn) {
+		bs.wantLock.Lock()
+		defer bs.wantLock.Unlock()
+		peerWantsLock.Lock()
+		c := make(chan struct {
 			id  ssb.Ref
 			val int
-		}{}
-		var peerWantsLock sync.Mutex
+		}, 10)
+		peerWants[conn] = c
+		peerWantsLock.Unlock()
 
-		handlers["blobs.createWants"] = func(conn *muxrpc.Conn, req int32, rm json.RawMessage) {
-			peerWantsLock.Lock()
-			c := peerWants[conn]
-			peerWantsLock.Unlock()
-
-			for ref := range c {
-				msg := map[string]int{}
-				msg[ref.id.String()] = ref.val
-				buf, _ := ssb.Encode(msg)
-				log.Println("Telling peer I have ", string(buf))
-				conn.Send(&codec.Packet{
-					Req:    -req,
-					Type:   codec.JSON,
-					Stream: true,
-					Body:   buf,
-				})
-			}
-		}
-		onConnects, ok := ds.ExtraData("muxrpcOnConnect").(map[string]func(conn *muxrpc.Conn))
-		if !ok {
-			onConnects = map[string]func(conn *muxrpc.Conn){}
-			ds.SetExtraData("muxrpcOnConnect", onConnects)
-		}
-		onConnects["blob"] = func(conn *muxrpc.Conn) {
-			bs.wantLock.Lock()
-			defer bs.wantLock.Unlock()
+		go func() {
+			conn.Source("blobs.createWants", func(p *codec.Packet) {
+				var want map[ssb.Ref]int
+				json.Unmarshal(p.Body, &want)
+				for id, hopsize := range want {
+					if bs.Has(id) && hopsize < 0 {
+						log.Println("I do have ", id, "asked at", hopsize)
+						c <- struct {
+							id  ssb.Ref
+							val int
+						}{id, int(bs.Size(id))}
+					}
+				}
+			})
 			peerWantsLock.Lock()
-			c := make(chan struct {
-				id  ssb.Ref
-				val int
-			}, 10)
-			peerWants[conn] = c
+			delete(peerWants, conn)
 			peerWantsLock.Unlock()
+		}()
 
-			go func() {
-				conn.Source("blobs.createWants", func(p *codec.Packet) {
-					var want map[ssb.Ref]int
-					json.Unmarshal(p.Body, &want)
-					for id, hopsize := range want {
-						if bs.Has(id) && hopsize < 0 {
-							log.Println("I do have ", id, "asked at", hopsize)
-							c <- struct {
-								id  ssb.Ref
-								val int
-							}{id, int(bs.Size(id))}
-						}
-					}
-				})
-				peerWantsLock.Lock()
-				delete(peerWants, conn)
-				peerWantsLock.Unlock()
-			}()
-
-			for r, w := range bs.want {
-				go func(r ssb.Ref, w *want) {
-					has := false
-					err := conn.Call("blobs.has", &has, r)
-					if err != nil {
-						return
-					}
-					if has {
-						w.resp <- conn
-					}
-				}(r, w)
-			}
+		for r, w := range bs.want {
+			go func(r ssb.Ref, w *want) {
+				has := false
+				err := conn.Call("blobs.has", &has, r)
+				if err != nil {
+					return
+				}
+				if has {
+					w.resp <- conn
+				}
+			}(r, w)
 		}
-
 	})
+	return nil
 }
@@ -0,0 +1,52 @@
+package blobs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andyleap/go-ssb"
+	"github.com/andyleap/go-ssb/ssbtest"
+)
+
+func TestSealedBlobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ds := ssbtest.NewStore(t, ssb.WithPassphrase([]byte("secret")))
+	defer ds.Close()
+	bs := New(filepath.Join(dir, "blobs"), ds)
+
+	data := []byte("a blob nobody else should read")
+	r := bs.Add(data)
+	hash := sha256.Sum256(data)
+	if want, _ := ssb.NewRef(ssb.RefBlob, hash[:], ssb.RefAlgoSha256); r != want {
+		t.Errorf("sealed blob added as %s, expected %s", r, want)
+	}
+	if size := bs.Size(r); size != int64(len(data)) {
+		t.Errorf("sealed blob has size %d", size)
+	}
+	rc := bs.Get(r)
+	if rc == nil {
+		t.Fatal("sealed blob not found")
+	}
+	got, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if !bytes.Equal(got, data) {
+		t.Errorf("sealed blob read as %q", got)
+	}
+
+	filepath.Walk(bs.Root, func(p string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			if stored, _ := ioutil.ReadFile(p); bytes.Contains(stored, data) {
+				t.Errorf("blob stored in the clear at %s", p)
+			}
+		}
+		return nil
+	})
+}
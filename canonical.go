@@ -0,0 +1,530 @@
+package ssb
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Messages are signed and hashed over JSON.stringify(msg, null, 2) as
+// produced by node, so anything that handles a message has to reproduce
+// V8's output byte for byte: its number formatting, its string escaping
+// and the order it keeps object keys in. Re-marshalling through Go
+// structs loses all three, so messages are canonicalized from the bytes
+// they arrived as instead.
+
+var ErrInvalidJSON = errors.New("Invalid JSON")
+
+type jsKind int
+
+const (
+	jsNull jsKind = iota
+	jsBool
+	jsNumber
+	jsString
+	jsArray
+	jsObject
+)
+
+// jsValue is a parsed JSON value as V8 would hold it. Strings are kept as
+// UTF-16 code units, since that is what JSON.stringify escapes.
+type jsValue struct {
+	kind  jsKind
+	b     bool
+	num   float64
+	str   []uint16
+	items []*jsValue
+	keys  [][]uint16
+}
+
+// CanonicalJSON returns buf as JSON.stringify(JSON.parse(buf), null, 2)
+// would in node.
+func CanonicalJSON(buf []byte) ([]byte, error) {
+	v, err := parseJS(buf)
+	if err != nil {
+		return nil, err
+	}
+	return v.stringify(), nil
+}
+
+// canonicalWithout canonicalizes a JSON object after deleting one of its
+// keys, as is done with the signature before it is checked.
+func canonicalWithout(buf []byte, key string) ([]byte, error) {
+	v, err := parseJS(buf)
+	if err != nil {
+		return nil, err
+	}
+	if v.kind != jsObject {
+		return nil, ErrInvalidJSON
+	}
+	v.delete(key)
+	return v.stringify(), nil
+}
+
+func parseJS(buf []byte) (*jsValue, error) {
+	p := &jsParser{buf: buf}
+	p.skipSpace()
+	v, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos != len(p.buf) {
+		return nil, ErrInvalidJSON
+	}
+	return v, nil
+}
+
+type jsParser struct {
+	buf []byte
+	pos int
+}
+
+func (p *jsParser) skipSpace() {
+	for p.pos < len(p.buf) {
+		switch p.buf[p.pos] {
+		case ' ', '\t', '\n', '\r':
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (p *jsParser) literal(s string) bool {
+	if strings.HasPrefix(string(p.buf[p.pos:]), s) {
+		p.pos += len(s)
+		return true
+	}
+	return false
+}
+
+func (p *jsParser) value() (*jsValue, error) {
+	if p.pos >= len(p.buf) {
+		return nil, ErrInvalidJSON
+	}
+	switch c := p.buf[p.pos]; {
+	case c == '{':
+		return p.object()
+	case c == '[':
+		return p.array()
+	case c == '"':
+		s, err := p.string()
+		if err != nil {
+			return nil, err
+		}
+		return &jsValue{kind: jsString, str: s}, nil
+	case c == '-' || (c >= '0' && c <= '9'):
+		return p.number()
+	case p.literal("true"):
+		return &jsValue{kind: jsBool, b: true}, nil
+	case p.literal("false"):
+		return &jsValue{kind: jsBool}, nil
+	case p.literal("null"):
+		return &jsValue{kind: jsNull}, nil
+	}
+	return nil, ErrInvalidJSON
+}
+
+func (p *jsParser) object() (*jsValue, error) {
+	v := &jsValue{kind: jsObject}
+	seen := map[string]int{}
+	p.pos++
+	p.skipSpace()
+	if p.pos < len(p.buf) && p.buf[p.pos] == '}' {
+		p.pos++
+		return v, nil
+	}
+	for {
+		if p.pos >= len(p.buf) || p.buf[p.pos] != '"' {
+			return nil, ErrInvalidJSON
+		}
+		key, err := p.string()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if p.pos >= len(p.buf) || p.buf[p.pos] != ':' {
+			return nil, ErrInvalidJSON
+		}
+		p.pos++
+		p.skipSpace()
+		item, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		// A repeated key keeps the position it was first seen at but
+		// takes the last value, as with JSON.parse.
+		if i, ok := seen[unitsKey(key)]; ok {
+			v.items[i] = item
+		} else {
+			seen[unitsKey(key)] = len(v.keys)
+			v.keys = append(v.keys, key)
+			v.items = append(v.items, item)
+		}
+		p.skipSpace()
+		if p.pos >= len(p.buf) {
+			return nil, ErrInvalidJSON
+		}
+		switch p.buf[p.pos] {
+		case ',':
+			p.pos++
+			p.skipSpace()
+		case '}':
+			p.pos++
+			v.orderKeys()
+			return v, nil
+		default:
+			return nil, ErrInvalidJSON
+		}
+	}
+}
+
+func (p *jsParser) array() (*jsValue, error) {
+	v := &jsValue{kind: jsArray}
+	p.pos++
+	p.skipSpace()
+	if p.pos < len(p.buf) && p.buf[p.pos] == ']' {
+		p.pos++
+		return v, nil
+	}
+	for {
+		item, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		v.items = append(v.items, item)
+		p.skipSpace()
+		if p.pos >= len(p.buf) {
+			return nil, ErrInvalidJSON
+		}
+		switch p.buf[p.pos] {
+		case ',':
+			p.pos++
+			p.skipSpace()
+		case ']':
+			p.pos++
+			return v, nil
+		default:
+			return nil, ErrInvalidJSON
+		}
+	}
+}
+
+func (p *jsParser) number() (*jsValue, error) {
+	start := p.pos
+	digits := func() int {
+		n := 0
+		for p.pos < len(p.buf) && p.buf[p.pos] >= '0' && p.buf[p.pos] <= '9' {
+			p.pos++
+			n++
+		}
+		return n
+	}
+	if p.buf[p.pos] == '-' {
+		p.pos++
+	}
+	if p.pos < len(p.buf) && p.buf[p.pos] == '0' {
+		p.pos++
+	} else if digits() == 0 {
+		return nil, ErrInvalidJSON
+	}
+	if p.pos < len(p.buf) && p.buf[p.pos] == '.' {
+		p.pos++
+		if digits() == 0 {
+			return nil, ErrInvalidJSON
+		}
+	}
+	if p.pos < len(p.buf) && (p.buf[p.pos] == 'e' || p.buf[p.pos] == 'E') {
+		p.pos++
+		if p.pos < len(p.buf) && (p.buf[p.pos] == '+' || p.buf[p.pos] == '-') {
+			p.pos++
+		}
+		if digits() == 0 {
+			return nil, ErrInvalidJSON
+		}
+	}
+	// Out of range values become Infinity or 0 just as in JS, so the
+	// range error can be ignored.
+	f, err := strconv.ParseFloat(string(p.buf[start:p.pos]), 64)
+	if err != nil && !errors.Is(err, strconv.ErrRange) {
+		return nil, ErrInvalidJSON
+	}
+	return &jsValue{kind: jsNumber, num: f}, nil
+}
+
+func (p *jsParser) string() ([]uint16, error) {
+	p.pos++
+	s := []uint16{}
+	for {
+		if p.pos >= len(p.buf) {
+			return nil, ErrInvalidJSON
+		}
+		c := p.buf[p.pos]
+		switch {
+		case c == '"':
+			p.pos++
+			return s, nil
+		case c < 0x20:
+			return nil, ErrInvalidJSON
+		case c == '\\':
+			if p.pos+1 >= len(p.buf) {
+				return nil, ErrInvalidJSON
+			}
+			p.pos += 2
+			switch p.buf[p.pos-1] {
+			case '"', '\\', '/':
+				s = append(s, uint16(p.buf[p.pos-1]))
+			case 'b':
+				s = append(s, '\b')
+			case 'f':
+				s = append(s, '\f')
+			case 'n':
+				s = append(s, '\n')
+			case 'r':
+				s = append(s, '\r')
+			case 't':
+				s = append(s, '\t')
+			case 'u':
+				if p.pos+4 > len(p.buf) {
+					return nil, ErrInvalidJSON
+				}
+				u, err := strconv.ParseUint(string(p.buf[p.pos:p.pos+4]), 16, 16)
+				if err != nil {
+					return nil, ErrInvalidJSON
+				}
+				s = append(s, uint16(u))
+				p.pos += 4
+			default:
+				return nil, ErrInvalidJSON
+			}
+		case c < utf8.RuneSelf:
+			s = append(s, uint16(c))
+			p.pos++
+		default:
+			// Invalid UTF-8 decodes to U+FFFD, as node does when
+			// turning a buffer into a string.
+			r, size := utf8.DecodeRune(p.buf[p.pos:])
+			s = appendRune(s, r)
+			p.pos += size
+		}
+	}
+}
+
+func appendRune(s []uint16, r rune) []uint16 {
+	if r1, r2 := utf16.EncodeRune(r); r1 != utf8.RuneError {
+		return append(s, uint16(r1), uint16(r2))
+	}
+	return append(s, uint16(r))
+}
+
+func unitsKey(s []uint16) string {
+	b := make([]byte, 0, 2*len(s))
+	for _, c := range s {
+		b = append(b, byte(c>>8), byte(c))
+	}
+	return string(b)
+}
+
+func equalUnits(a, b []uint16) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// arrayIndex reports whether key is an array index, which V8 stores
+// apart from other properties and always enumerates first, in ascending
+// order.
+func arrayIndex(key []uint16) (uint32, bool) {
+	if len(key) == 0 || len(key) > 10 || (key[0] == '0' && len(key) > 1) {
+		return 0, false
+	}
+	n := uint64(0)
+	for _, c := range key {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + uint64(c-'0')
+	}
+	if n > math.MaxUint32-1 {
+		return 0, false
+	}
+	return uint32(n), true
+}
+
+func (v *jsValue) orderKeys() {
+	sort.Stable(jsKeyOrder{v})
+}
+
+type jsKeyOrder struct {
+	*jsValue
+}
+
+func (o jsKeyOrder) Len() int {
+	return len(o.keys)
+}
+
+func (o jsKeyOrder) Less(i, j int) bool {
+	a, aok := arrayIndex(o.keys[i])
+	b, bok := arrayIndex(o.keys[j])
+	if aok && bok {
+		return a < b
+	}
+	return aok && !bok
+}
+
+func (o jsKeyOrder) Swap(i, j int) {
+	o.keys[i], o.keys[j] = o.keys[j], o.keys[i]
+	o.items[i], o.items[j] = o.items[j], o.items[i]
+}
+
+func (v *jsValue) delete(key string) {
+	k := utf16.Encode([]rune(key))
+	for i := range v.keys {
+		if equalUnits(v.keys[i], k) {
+			v.keys = append(v.keys[:i], v.keys[i+1:]...)
+			v.items = append(v.items[:i], v.items[i+1:]...)
+			return
+		}
+	}
+}
+
+func (v *jsValue) stringify() []byte {
+	var b strings.Builder
+	v.write(&b, "")
+	return []byte(b.String())
+}
+
+func (v *jsValue) write(b *strings.Builder, indent string) {
+	switch v.kind {
+	case jsNull:
+		b.WriteString("null")
+	case jsBool:
+		b.WriteString(strconv.FormatBool(v.b))
+	case jsNumber:
+		b.WriteString(formatJSNumber(v.num))
+	case jsString:
+		writeJSString(b, v.str)
+	case jsArray, jsObject:
+		start, end := "[", "]"
+		if v.kind == jsObject {
+			start, end = "{", "}"
+		}
+		b.WriteString(start)
+		if len(v.items) > 0 {
+			inner := indent + "  "
+			for i, item := range v.items {
+				if i > 0 {
+					b.WriteString(",")
+				}
+				b.WriteString("\n" + inner)
+				if v.kind == jsObject {
+					writeJSString(b, v.keys[i])
+					b.WriteString(": ")
+				}
+				item.write(b, inner)
+			}
+			b.WriteString("\n" + indent)
+		}
+		b.WriteString(end)
+	}
+}
+
+const hexDigits = "0123456789abcdef"
+
+// writeJSString quotes s as JSON.stringify does: only quotes, backslashes
+// and control characters are escaped, and unpaired surrogates are written
+// as \u escapes.
+func writeJSString(b *strings.Builder, s []uint16) {
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"':
+			b.WriteString(`\"`)
+		case c == '\\':
+			b.WriteString(`\\`)
+		case c == '\b':
+			b.WriteString(`\b`)
+		case c == '\f':
+			b.WriteString(`\f`)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c == '\r':
+			b.WriteString(`\r`)
+		case c == '\t':
+			b.WriteString(`\t`)
+		case c < 0x20:
+			b.WriteString(`\u00`)
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&0xf])
+		case c >= 0xd800 && c < 0xdc00 && i+1 < len(s) && s[i+1] >= 0xdc00 && s[i+1] < 0xe000:
+			b.WriteRune(utf16.DecodeRune(rune(c), rune(s[i+1])))
+			i++
+		case c >= 0xd800 && c < 0xe000:
+			b.WriteString(`\u`)
+			for shift := 12; shift >= 0; shift -= 4 {
+				b.WriteByte(hexDigits[(c>>uint(shift))&0xf])
+			}
+		default:
+			b.WriteRune(rune(c))
+		}
+	}
+	b.WriteByte('"')
+}
+
+// formatJSNumber formats f as ECMAScript's Number.prototype.toString does,
+// with the non-finite values JSON.stringify turns into null.
+func formatJSNumber(f float64) string {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return "null"
+	}
+	if f == 0 {
+		return "0"
+	}
+	sign := ""
+	if f < 0 {
+		sign = "-"
+		f = -f
+	}
+	// Go and V8 both pick the shortest digits that round trip, only the
+	// layout differs.
+	e := strconv.FormatFloat(f, 'e', -1, 64)
+	mant, exp := e[:strings.IndexByte(e, 'e')], e[strings.IndexByte(e, 'e')+1:]
+	digits := strings.Replace(mant, ".", "", 1)
+	x, _ := strconv.Atoi(exp)
+	k, n := len(digits), x+1
+	switch {
+	case k <= n && n <= 21:
+		return sign + digits + strings.Repeat("0", n-k)
+	case 0 < n && n <= 21:
+		return sign + digits[:n] + "." + digits[n:]
+	case -6 < n && n <= 0:
+		return sign + "0." + strings.Repeat("0", -n) + digits
+	}
+	expSign := "+"
+	if n-1 < 0 {
+		expSign = "-"
+	}
+	if k > 1 {
+		digits = digits[:1] + "." + digits[1:]
+	}
+	return sign + digits + "e" + expSign + strconv.Itoa(abs(n-1))
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
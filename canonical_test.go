@@ -0,0 +1,126 @@
+package ssb
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/andyleap/go-ssb/storage"
+)
+
+func TestFormatJSNumber(t *testing.T) {
+	// expected values are String(n) from node
+	for n, expected := range map[float64]string{
+		1e21:                           "1e+21",
+		1e20:                           "100000000000000000000",
+		1e-7:                           "1e-7",
+		-1e-7:                          "-1e-7",
+		0.000001:                       "0.000001",
+		123456789012345678901234567890: "1.2345678901234568e+29",
+		5e-324:                         "5e-324",
+		1.7976931348623157e308:         "1.7976931348623157e+308",
+		-1.5e-10:                       "-1.5e-10",
+		123e-20:                        "1.23e-18",
+		0.1:                            "0.1",
+		12345678.9:                     "12345678.9",
+		1.5e12:                         "1500000000000",
+		1500000000000.123:              "1500000000000.123",
+		-5e-7:                          "-5e-7",
+		0.30000000000000004:            "0.30000000000000004",
+		9007199254740992:               "9007199254740992",
+		1.0 / 3:                        "0.3333333333333333",
+		-123.456:                       "-123.456",
+		1e301:                          "1e+301",
+	} {
+		if got := formatJSNumber(n); got != expected {
+			t.Errorf("formatJSNumber(%v) = %q, expected %q", n, got, expected)
+		}
+	}
+}
+
+func TestCanonicalJSON(t *testing.T) {
+	for in, expected := range map[string]string{
+		`-0`:                        `0`,
+		`1e400`:                     `null`,
+		`" \/é\ud800"`:              "\" /é\\ud800\"",
+		`{"b":1,"1":2,"a":3,"0":4}`: "{\n  \"0\": 4,\n  \"1\": 2,\n  \"b\": 1,\n  \"a\": 3\n}",
+		`{"a":1,"b":2,"a":3}`:       "{\n  \"a\": 3,\n  \"b\": 2\n}",
+		`[ { } , [ ] ]`:             "[\n  {},\n  []\n]",
+	} {
+		got, err := CanonicalJSON([]byte(in))
+		if err != nil {
+			t.Errorf("CanonicalJSON(%s): %s", in, err)
+			continue
+		}
+		if string(got) != expected {
+			t.Errorf("CanonicalJSON(%s) = %q, expected %q", in, got, expected)
+		}
+	}
+	for _, in := range []string{`{"a":1,}`, `01`, `"\x"`, "\"\n\"", `[1 2]`, `1.`} {
+		if _, err := CanonicalJSON([]byte(in)); err == nil {
+			t.Errorf("CanonicalJSON(%s) should have failed", in)
+		}
+	}
+}
+
+// testdata/legacy_messages.json is a feed signed and hashed by node, whose
+// messages are written in ways that re-marshalling does not preserve.
+func TestLegacyMessages(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/legacy_messages.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vectors := struct {
+		Author   Ref
+		Messages []struct {
+			Raw       string
+			Key       Ref
+			Canonical string
+		}
+	}{}
+	if err := json.Unmarshal(buf, &vectors); err != nil {
+		t.Fatal(err)
+	}
+
+	ds := newTestStore(t)
+	defer ds.Close()
+
+	err = ds.db.Update(func(tx storage.Tx) error {
+		for i, v := range vectors.Messages {
+			var m *SignedMessage
+			if err := json.Unmarshal([]byte(v.Raw), &m); err != nil {
+				t.Fatalf("message %d: %s", i+1, err)
+			}
+			if string(m.Encode()) != v.Canonical {
+				t.Errorf("message %d encoded as\n%s\nexpected\n%s", i+1, m.Encode(), v.Canonical)
+			}
+			if m.Key() != v.Key {
+				t.Errorf("message %d has key %s, expected %s", i+1, m.Key(), v.Key)
+			}
+			if err := ds.importMessage(tx, m); err != nil {
+				t.Fatalf("message %d: %s", i+1, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// messages read back from storage must keep their keys
+	f := ds.GetFeed(vectors.Author)
+	for i, v := range vectors.Messages {
+		m := f.GetSeq(nil, i+1)
+		if m == nil || m.Key() != v.Key {
+			t.Errorf("stored message %d does not match %s", i+1, v.Key)
+		}
+	}
+
+	var m *SignedMessage
+	json.Unmarshal([]byte(vectors.Messages[0].Raw), &m)
+	m.raw = nil
+	m.Content = json.RawMessage(`{"type":"post","text":"tampered"}`)
+	if err := m.Verify(nil, f); err == nil {
+		t.Error("tampered message verified")
+	}
+}
@@ -6,8 +6,7 @@ import (
 
 	"github.com/andyleap/go-ssb"
 	"github.com/andyleap/go-ssb/social"
-
-	"github.com/boltdb/bolt"
+	"github.com/andyleap/go-ssb/storage"
 )
 
 func itob(v int) []byte {
@@ -22,52 +21,112 @@ type Channel struct {
 	Subscribed bool   `json:"subscribed"`
 }
 
-func init() {
-	ssb.MessageTypes["channel"] = func(mb ssb.MessageBody) interface{} { return &Channel{MessageBody: mb} }
-	ssb.RebuildClearHooks["channels"] = func(tx *bolt.Tx) error {
-		tx.DeleteBucket([]byte("channels"))
+// Module indexes the posts in each channel.
+var Module = &ssb.Module{
+	Name: "channels",
+	Deps: []string{"social"},
+	MessageTypes: map[string]func(mb ssb.MessageBody) interface{}{
+		"channel": func(mb ssb.MessageBody) interface{} { return &Channel{MessageBody: mb} },
+	},
+	Index: &ssb.Index{
+		// Version 1 records the keys of each post's entries in its
+		// channel, so a purge removes them directly. Version 2 leaves out
+		// private posts, as channel names are bucket names, which a sealed
+		// store does not seal.
+		Version: 2,
+		Add:     indexChannel,
+		Remove:  removeChannel,
+		Clear: func(tx storage.Tx) error {
+			tx.DeleteBucket([]byte("channels"))
+			return nil
+		},
+	},
+	Buckets: []string{"channels"},
+}
+
+func indexChannel(ds *ssb.DataStore, m *ssb.SignedMessage, tx storage.Tx) error {
+	if m.Private != nil {
 		return nil
 	}
-	ssb.AddMessageHooks["channels"] = func(m *ssb.SignedMessage, tx *bolt.Tx) error {
-		_, mb := m.DecodeMessage()
-		if mbr, ok := mb.(*social.Post); ok {
-			if mbr.Channel != "" {
-				channelsBucket, err := tx.CreateBucketIfNotExists([]byte("channels"))
-				if err != nil {
-					return err
-				}
-				channelBucket, err := channelsBucket.CreateBucketIfNotExists([]byte(mbr.Channel))
-				if err != nil {
-					return err
-				}
-				logBucket, err := channelBucket.CreateBucketIfNotExists([]byte("log"))
-				if err != nil {
-					return err
-				}
-				logBucket.FillPercent = 1
-				seq, err := logBucket.NextSequence()
-				if err != nil {
-					return err
-				}
-				logBucket.Put(itob(int(seq)), m.Key().DBKey())
+	_, mb := ds.DecodeMessage(m)
+	if mbr, ok := mb.(*social.Post); ok {
+		if mbr.Channel != "" {
+			channelsBucket, err := tx.CreateBucketIfNotExists([]byte("channels"))
+			if err != nil {
+				return err
+			}
+			channelBucket, err := channelsBucket.CreateBucketIfNotExists([]byte(mbr.Channel))
+			if err != nil {
+				return err
+			}
+			logBucket, err := channelBucket.CreateBucketIfNotExists([]byte("log"))
+			if err != nil {
+				return err
+			}
+			logBucket.SetFillPercent(1)
+			seq, err := logBucket.NextSequence()
+			if err != nil {
+				return err
+			}
+			logKeys, err := channelBucket.CreateBucketIfNotExists([]byte("logkeys"))
+			if err != nil {
+				return err
+			}
+			err = storage.PutEntry(logBucket, logKeys, itob(int(seq)), m.Key().DBKey())
+			if err != nil {
+				return err
+			}
 
-				timeBucket, err := channelBucket.CreateBucketIfNotExists([]byte("time"))
-				if err != nil {
-					return err
-				}
-				i := int(m.Timestamp * float64(time.Millisecond))
-				for timeBucket.Get(itob(i)) != nil {
-					i++
-				}
-				timeBucket.Put(itob(i), m.Key().DBKey())
+			timeBucket, err := channelBucket.CreateBucketIfNotExists([]byte("time"))
+			if err != nil {
+				return err
+			}
+			i := int(m.Timestamp * float64(time.Millisecond))
+			for timeBucket.Get(itob(i)) != nil {
+				i++
+			}
+			timeKeys, err := channelBucket.CreateBucketIfNotExists([]byte("timekeys"))
+			if err != nil {
+				return err
+			}
+			err = storage.PutEntry(timeBucket, timeKeys, itob(i), m.Key().DBKey())
+			if err != nil {
+				return err
 			}
 		}
+	}
+	return nil
+}
+
+func removeChannel(ds *ssb.DataStore, m *ssb.SignedMessage, tx storage.Tx) error {
+	if m.Private != nil {
 		return nil
 	}
+	_, mb := ds.DecodeMessage(m)
+	if mbr, ok := mb.(*social.Post); ok && mbr.Channel != "" {
+		channelsBucket := tx.Bucket([]byte("channels"))
+		if channelsBucket == nil {
+			return nil
+		}
+		channelBucket := channelsBucket.Bucket([]byte(mbr.Channel))
+		if channelBucket == nil {
+			return nil
+		}
+		key := m.Key().DBKey()
+		if logBucket, logKeys := channelBucket.Bucket([]byte("log")), channelBucket.Bucket([]byte("logkeys")); logBucket != nil && logKeys != nil {
+			if err := storage.RemoveEntry(logBucket, logKeys, key); err != nil {
+				return err
+			}
+		}
+		if timeBucket, timeKeys := channelBucket.Bucket([]byte("time")), channelBucket.Bucket([]byte("timekeys")); timeBucket != nil && timeKeys != nil {
+			return storage.RemoveEntry(timeBucket, timeKeys, key)
+		}
+	}
+	return nil
 }
 
 func GetChannelLatest(ds *ssb.DataStore, channel string, num int, start int) (msgs []*ssb.SignedMessage) {
-	ds.DB().View(func(tx *bolt.Tx) error {
+	ds.DB().View(func(tx storage.Tx) error {
 		channelsBucket := tx.Bucket([]byte("channels"))
 		if channelsBucket == nil {
 			return nil
@@ -6,6 +6,8 @@ import (
 	"cryptoscope.co/go/secretstream/secrethandshake"
 	"github.com/andyleap/go-ssb"
 	"github.com/andyleap/go-ssb/gossip"
+	"github.com/andyleap/go-ssb/graph"
+	"github.com/andyleap/go-ssb/muxrpcManager"
 )
 
 func main() {
@@ -15,7 +17,10 @@ func main() {
 		log.Println(err)
 	}
 
-	datastore, _ := ssb.OpenDataStore("feeds.db", keypair)
+	datastore, err := ssb.OpenDataStore("feeds.db", keypair, ssb.WithModules(muxrpcManager.Module, graph.Module, gossip.Module))
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	gossip.Replicate(datastore)
 
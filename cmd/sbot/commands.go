@@ -0,0 +1,243 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"time"
+
+	"github.com/andyleap/go-ssb"
+	"github.com/andyleap/go-ssb/archive"
+	"github.com/andyleap/go-ssb/blobs"
+	"github.com/andyleap/go-ssb/storage"
+)
+
+// runImport copies the messages of a JS sbot's flume log into the store,
+// defaulting to the log of the current user's ~/.ssb.
+func runImport(path string) {
+	if path == "" {
+		u, err := user.Current()
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		path = filepath.Join(u.HomeDir, ".ssb", "flume", "log.offset")
+	}
+	log.Println("Importing", path)
+	err := ssb.ImportFlumeLog(datastore, path, func(p ssb.ImportProgress) {
+		log.Println(p)
+	})
+	if err != nil {
+		log.Println("Import failed:", err)
+		return
+	}
+	log.Println("Import finished")
+}
+
+// runExport writes an archive of the feeds given, or of every feed, to the
+// file named by -o.
+func runExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	out := fs.String("o", "", "write the archive to this file")
+	withBlobs := fs.Bool("blobs", false, "include the blobs the messages link to")
+	fs.Parse(args)
+	if *out == "" {
+		log.Println("Usage: sbot export -o archive.tar [-blobs] [feed...]")
+		return
+	}
+	opts := archive.Options{}
+	for _, arg := range fs.Args() {
+		opts.Feeds = append(opts.Feeds, ssb.ParseRef(arg))
+	}
+	if *withBlobs {
+		opts.Blobs = blobs.Get(datastore)
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	st, err := archive.Export(datastore, f, opts)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Println("Export failed:", err)
+		return
+	}
+	log.Println("Exported", st.Feeds, "feeds,", st)
+}
+
+// runImportArchive verifies and stores the messages and blobs of an
+// archive written by export.
+func runImportArchive(path string) {
+	if path == "" {
+		log.Println("Usage: sbot import-archive archive.tar")
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer f.Close()
+	log.Println("Importing", path)
+	st, err := archive.Import(datastore, f, blobs.Get(datastore), func(st archive.Stats) {
+		log.Println(st)
+	})
+	if err != nil {
+		log.Println("Import failed:", err)
+		return
+	}
+	log.Println("Import finished,", st)
+}
+
+// runBackup writes a backup of the store to the file named by -o.
+func runBackup(args []string) {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	out := fs.String("o", "", "write the backup to this file")
+	incremental := fs.Bool("incremental", false, "only include the blobs added since the last backup")
+	fs.Parse(args)
+	if *out == "" {
+		log.Println("Usage: sbot backup -o backup.tar [-incremental]")
+		return
+	}
+	bi, err := datastore.BackupFile(*out, ssb.BackupOptions{Incremental: *incremental})
+	if err != nil {
+		log.Println("Backup failed:", err)
+		return
+	}
+	log.Println("Backup finished,", bi)
+}
+
+// runScheduledBackups writes a backup to dir every interval while sbot
+// runs. The first is a full backup if the store has never been backed up,
+// the rest are incremental.
+func runScheduledBackups(dir string, every time.Duration) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Println("Scheduled backups disabled:", err)
+		return
+	}
+	for {
+		if last := datastore.LastBackup(); last == nil || time.Since(last.Time) >= every {
+			name := filepath.Join(dir, "backup-"+time.Now().Format("20060102-150405")+".tar")
+			bi, err := datastore.BackupFile(name, ssb.BackupOptions{Incremental: last != nil})
+			if err != nil {
+				log.Println("Scheduled backup failed:", err)
+			} else {
+				log.Println("Scheduled backup written to", name+",", bi)
+			}
+		}
+		time.Sleep(time.Minute)
+	}
+}
+
+// runRestore restores the store from a full backup and the incremental
+// backups taken after it, in order. It runs before the store is opened.
+func runRestore(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	force := fs.Bool("force", false, "replace an existing store")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		log.Println("Usage: sbot restore [-force] full.tar [incremental.tar...]")
+		return
+	}
+	if _, err := os.Stat("feeds.db"); err == nil && !*force {
+		log.Println("A store already exists, use -force to replace it")
+		return
+	}
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		bi, err := ssb.RestoreBackup(f, "feeds.db", *offsetLog, map[string]string{"blobs": "blobs"})
+		f.Close()
+		if err != nil {
+			log.Println("Restoring", path, "failed:", err)
+			return
+		}
+		log.Println("Restored", path+",", bi)
+	}
+}
+
+// runRecompress trains a compression dictionary on the log if asked to, and
+// recompresses the stored messages with the current one.
+func runRecompress(args []string) {
+	fs := flag.NewFlagSet("recompress", flag.ExitOnError)
+	train := fs.Bool("train", false, "train a new dictionary first")
+	samples := fs.Int("samples", 0, "how many messages to train on")
+	size := fs.Int("size", 0, "the largest dictionary to train, in bytes")
+	fs.Parse(args)
+	if *train {
+		info, err := datastore.TrainDictionary(*samples, *size)
+		if err != nil {
+			log.Println("Training failed:", err)
+			return
+		}
+		log.Printf("Trained a %d byte dictionary on %d messages, held out messages take %d bytes instead of %d", info.Size, info.Samples, info.After, info.Before)
+	}
+	if err := datastore.Recompress(); err != nil {
+		log.Println(err)
+		return
+	}
+	for {
+		time.Sleep(time.Second)
+		st := datastore.CompressionStats()
+		if !st.Running {
+			if st.Error == "" {
+				log.Printf("Recompressed %d of %d messages, saved %d bytes", st.Rewritten, st.Entries, st.Saved())
+			}
+			return
+		}
+		log.Printf("Checked %d messages, saved %d bytes so far", st.Entries, st.Saved())
+	}
+}
+
+// runFsck checks the store is coherent, repairing what it can if asked to.
+func runFsck(args []string) {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "rewrite pointers that do not match the feeds")
+	fs.Parse(args)
+	r, err := datastore.Fsck(*repair)
+	if err != nil {
+		log.Println("Check failed:", err)
+		return
+	}
+	for _, p := range r.Problems {
+		log.Println(p)
+	}
+	if r.More > 0 {
+		log.Println("and", r.More, "more problems")
+	}
+	log.Printf("Checked %d feeds, %d messages, %d pointers and %d log entries, %d erased", r.Feeds, r.Messages, r.Pointers, r.LogEntries, r.Erased)
+	if r.OK() {
+		log.Println("Store is coherent")
+	} else if !*repair {
+		log.Println("Store has problems, run with -repair to fix what can be fixed")
+	} else {
+		log.Println("Store has problems that cannot be repaired")
+	}
+}
+
+// runCompact rewrites the bolt database into a fresh copy without its free
+// pages, replacing it once the copy is complete.
+func runCompact() {
+	tmp := "feeds.db.compact"
+	before, after, err := storage.CompactBolt("feeds.db", tmp)
+	if err == nil {
+		err = os.Rename(tmp, "feeds.db")
+	}
+	if err != nil {
+		os.Remove(tmp)
+		log.Println("Compaction failed:", err)
+		return
+	}
+	log.Printf("Compacted feeds.db from %d to %d bytes", before, after)
+}
@@ -1,63 +1,136 @@
 package main
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/base64"
+	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
-	//    "os"
+	"os"
+	"time"
 
 	"github.com/andyleap/go-ssb"
-	_ "github.com/andyleap/go-ssb/channels"
+	"github.com/andyleap/go-ssb/blobs"
+	"github.com/andyleap/go-ssb/channels"
 	"github.com/andyleap/go-ssb/cmd/sbot/rpc"
-	_ "github.com/andyleap/go-ssb/git"
+	"github.com/andyleap/go-ssb/git"
 	"github.com/andyleap/go-ssb/gossip"
 	"github.com/andyleap/go-ssb/graph"
+	"github.com/andyleap/go-ssb/links"
+	"github.com/andyleap/go-ssb/muxrpcManager"
+	"github.com/andyleap/go-ssb/query"
 	"github.com/andyleap/go-ssb/social"
 
 	"cryptoscope.co/go/secretstream/secrethandshake"
+	"golang.org/x/crypto/ed25519"
 
 	r "net/rpc"
 )
 
 var datastore *ssb.DataStore
 
+var offsetLog = flag.String("offsetlog", "", "store messages in a flumedb compatible offset log at this path")
+
+var keystore = flag.String("keystore", "keys", "keep identities other than the one in secret.json in this directory")
+
+var keyFile = flag.String("key-file", "", "open the store sealed with the passphrase in this file, or seal a new store with it, sealing secret.json too; the passphrase can also be given in $SBOT_PASSPHRASE")
+
+var (
+	backupDir   = flag.String("backup-dir", "", "write scheduled backups to this directory, each incremental on the last backup taken")
+	backupEvery = flag.Duration("backup-every", 24*time.Hour, "how often to write scheduled backups")
+)
+
 func main() {
+	flag.Parse()
+
+	// These need the store closed.
+	switch flag.Arg(0) {
+	case "restore":
+		runRestore(flag.Args()[1:])
+		return
+	case "compact":
+		runCompact()
+		return
+	}
 
-	keypair, err := secrethandshake.LoadSSBKeyPair("secret.json")
-	if err != nil {
-		keypair, err = secrethandshake.GenEdKeyPair(rand.Reader)
+	modules := ssb.WithModules(
+		muxrpcManager.Module,
+		blobs.Module,
+		graph.Module,
+		social.Module,
+		channels.Module,
+		gossip.Module,
+		git.Module,
+		links.Module,
+		query.Module,
+	)
+	open := func(passphrase []byte) (err error) {
+		priv, saved, err := loadSecret(passphrase)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
-
-		ref, _ := ssb.NewRef(ssb.RefFeed, keypair.Public[:], ssb.RefAlgoEd25519)
-		sbotKey := struct {
-			Curve   string `json:"curve"`
-			ID      string `json:"id"`
-			Private string `json:"private"`
-			Public  string `json:"public"`
-		}{
-			Curve:   "ed25519",
-			ID:      ref.String(),
-			Private: base64.StdEncoding.EncodeToString(keypair.Secret[:]) + ".ed25519",
-			Public:  base64.StdEncoding.EncodeToString(keypair.Public[:]) + ".ed25519",
+		keypair := &secrethandshake.EdKeyPair{}
+		copy(keypair.Public[:], priv.Public().(ed25519.PublicKey))
+		copy(keypair.Secret[:], priv)
+		opts := []ssb.Option{modules, ssb.WithKeystore(*keystore)}
+		if passphrase != nil {
+			opts = append(opts, ssb.WithPassphrase(passphrase))
+		}
+		if *offsetLog != "" {
+			datastore, err = ssb.OpenFlumeDataStore("feeds.db", *offsetLog, keypair, opts...)
+		} else {
+			datastore, err = ssb.OpenDataStore("feeds.db", keypair, opts...)
 		}
-		buf, _ := ssb.Encode(sbotKey)
-		err := ioutil.WriteFile("secret.json", buf, 0600)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
+		if !saved {
+			return saveSecret(priv, passphrase)
+		}
+		return nil
+	}
+	passphrase, err := loadPassphrase()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = open(passphrase)
+	if err == ssb.ErrStoreSealed && passphrase == nil && flag.Arg(0) == "" {
+		unlockWebui(open)
+		err = nil
 	}
-
-	datastore, err = ssb.OpenDataStore("feeds.db", keypair)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer datastore.Close()
 
+	switch flag.Arg(0) {
+	case "import":
+		runImport(flag.Arg(1))
+		return
+	case "export":
+		runExport(flag.Args()[1:])
+		return
+	case "import-archive":
+		runImportArchive(flag.Arg(1))
+		return
+	case "backup":
+		runBackup(flag.Args()[1:])
+		return
+	case "recompress":
+		runRecompress(flag.Args()[1:])
+		return
+	case "fsck":
+		runFsck(flag.Args()[1:])
+		return
+	}
+
 	gossip.Replicate(datastore)
+	if *backupDir != "" {
+		go runScheduledBackups(*backupDir, *backupEvery)
+	}
 
 	RegisterWebui()
 
@@ -71,6 +144,10 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	err = r.Register(&Identity{datastore})
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	l, _ := net.Listen("tcp", "localhost:9822")
 	if err != nil {
@@ -82,6 +159,80 @@ func main() {
 	select {}
 }
 
+// loadPassphrase returns the passphrase of a sealed store from -key-file or
+// $SBOT_PASSPHRASE, or nil if neither is given.
+func loadPassphrase() ([]byte, error) {
+	if *keyFile != "" {
+		buf, err := ioutil.ReadFile(*keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimRight(buf, "\r\n"), nil
+	}
+	if p := os.Getenv("SBOT_PASSPHRASE"); p != "" {
+		return []byte(p), nil
+	}
+	return nil, nil
+}
+
+// loadSecret reads the primary key from secret.json, opening it with
+// passphrase if it is sealed. saved is false for a new key, made when there
+// is no secret.json, and for one written in the clear that is to be sealed
+// with passphrase. Either is saved by saveSecret only once the store has
+// opened, so a sealed store never has its key written in the clear.
+func loadSecret(passphrase []byte) (priv ed25519.PrivateKey, saved bool, err error) {
+	buf, err := ioutil.ReadFile("secret.json")
+	if os.IsNotExist(err) {
+		_, priv, err = ed25519.GenerateKey(rand.Reader)
+		return priv, false, err
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if priv, err = ssb.ParseSecret(buf); err == nil {
+		return priv, passphrase == nil, nil
+	}
+	if passphrase == nil {
+		return nil, true, ssb.ErrStoreSealed
+	}
+	if buf, err = ssb.OpenSecret(passphrase, buf); err != nil {
+		return nil, true, err
+	}
+	priv, err = ssb.ParseSecret(buf)
+	return priv, true, err
+}
+
+// saveSecret writes the primary key to secret.json, sealed with passphrase
+// if there is one.
+func saveSecret(priv ed25519.PrivateKey, passphrase []byte) error {
+	pub := priv.Public().(ed25519.PublicKey)
+	ref, _ := ssb.NewRef(ssb.RefFeed, pub, ssb.RefAlgoEd25519)
+	sbotKey := struct {
+		Curve   string `json:"curve"`
+		ID      string `json:"id"`
+		Private string `json:"private"`
+		Public  string `json:"public"`
+	}{
+		Curve:   "ed25519",
+		ID:      ref.String(),
+		Private: base64.StdEncoding.EncodeToString(priv) + ".ed25519",
+		Public:  base64.StdEncoding.EncodeToString(pub) + ".ed25519",
+	}
+	buf, err := ssb.Encode(sbotKey)
+	if err != nil {
+		return err
+	}
+	if passphrase != nil {
+		if buf, err = ssb.SealSecret(passphrase, buf); err != nil {
+			return err
+		}
+	}
+	if err := ioutil.WriteFile("secret.json.tmp", buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename("secret.json.tmp", "secret.json")
+}
+
 type Gossip struct {
 	ds *ssb.DataStore
 }
@@ -99,11 +250,24 @@ type Feed struct {
 	ds *ssb.DataStore
 }
 
+// localFeed returns the feed of the local identity id, or of the primary
+// identity if id is empty.
+func localFeed(ds *ssb.DataStore, id string) (*ssb.Feed, error) {
+	if id == "" {
+		return ds.GetFeed(ds.PrimaryRef), nil
+	}
+	ref := ssb.ParseRef(id)
+	if !ds.IsIdentity(ref) {
+		return nil, fmt.Errorf("%s: %s", id, ssb.ErrUnknownIdentity)
+	}
+	return ds.GetFeed(ref), nil
+}
+
 func (f *Feed) Post(req rpc.PostReq, res *rpc.PostRes) error {
-	if req.Feed == "" {
-		req.Feed = f.ds.PrimaryRef.String()
+	feed, err := localFeed(f.ds, req.Feed)
+	if err != nil {
+		return err
 	}
-	feed := f.ds.GetFeed(ssb.ParseRef(req.Feed))
 
 	post := &social.Post{}
 
@@ -113,21 +277,21 @@ func (f *Feed) Post(req rpc.PostReq, res *rpc.PostRes) error {
 	post.Root = ssb.ParseRef(req.Root)
 	post.Type = "post"
 
-	err := feed.PublishMessage(post)
+	m, err := feed.PublishMessage(post)
 	if err != nil {
 		log.Println(err)
 	} else {
-		log.Println("Message ", post, " posted to feed ", feed.ID)
+		log.Println("Message ", m.Key(), " posted to feed ", feed.ID)
 	}
 
-	return nil
+	return err
 }
 
 func (f *Feed) Follow(req rpc.FollowReq, res *rpc.FollowRes) error {
-	if req.Feed == "" {
-		req.Feed = f.ds.PrimaryRef.String()
+	feed, err := localFeed(f.ds, req.Feed)
+	if err != nil {
+		return err
 	}
-	feed := f.ds.GetFeed(ssb.ParseRef(req.Feed))
 
 	follow := &graph.Contact{}
 
@@ -136,21 +300,21 @@ func (f *Feed) Follow(req rpc.FollowReq, res *rpc.FollowRes) error {
 	follow.Contact = ssb.ParseRef(req.Contact)
 	follow.Type = "contact"
 
-	err := feed.PublishMessage(follow)
+	m, err := feed.PublishMessage(follow)
 	if err != nil {
 		log.Println(err)
 	} else {
-		log.Println("Message ", follow, " posted to feed ", feed.ID)
+		log.Println("Message ", m.Key(), " posted to feed ", feed.ID)
 	}
 
-	return nil
+	return err
 }
 
 func (f *Feed) About(req rpc.AboutReq, res *rpc.AboutRes) error {
-	if req.Feed == "" {
-		req.Feed = f.ds.PrimaryRef.String()
+	feed, err := localFeed(f.ds, req.Feed)
+	if err != nil {
+		return err
 	}
-	feed := f.ds.GetFeed(ssb.ParseRef(req.Feed))
 
 	about := &social.About{}
 
@@ -158,12 +322,45 @@ func (f *Feed) About(req rpc.AboutReq, res *rpc.AboutRes) error {
 	about.About = feed.ID
 	about.Type = "about"
 
-	err := feed.PublishMessage(about)
+	m, err := feed.PublishMessage(about)
 	if err != nil {
 		log.Println(err)
 	} else {
-		log.Println("Message ", about, " posted to feed ", feed.ID)
+		log.Println("Message ", m.Key(), " posted to feed ", feed.ID)
 	}
 
+	return err
+}
+
+type Identity struct {
+	ds *ssb.DataStore
+}
+
+func (i *Identity) Create(req rpc.CreateIdentityReq, res *rpc.CreateIdentityRes) error {
+	id, err := i.ds.CreateIdentity()
+	if err != nil {
+		return err
+	}
+	res.ID = id.String()
 	return nil
 }
+
+func (i *Identity) Import(req rpc.ImportIdentityReq, res *rpc.ImportIdentityRes) error {
+	id, err := i.ds.ImportIdentity([]byte(req.Secret))
+	if err != nil {
+		return err
+	}
+	res.ID = id.String()
+	return nil
+}
+
+func (i *Identity) List(req rpc.ListIdentitiesReq, res *rpc.ListIdentitiesRes) error {
+	for _, id := range i.ds.Identities() {
+		res.IDs = append(res.IDs, id.String())
+	}
+	return nil
+}
+
+func (i *Identity) Delete(req rpc.DeleteIdentityReq, res *rpc.DeleteIdentityRes) error {
+	return i.ds.DeleteIdentity(ssb.ParseRef(req.ID))
+}
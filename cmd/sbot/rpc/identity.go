@@ -0,0 +1,27 @@
+package rpc
+
+type CreateIdentityReq struct{}
+
+type CreateIdentityRes struct {
+	ID string
+}
+
+type ImportIdentityReq struct {
+	Secret string
+}
+
+type ImportIdentityRes struct {
+	ID string
+}
+
+type ListIdentitiesReq struct{}
+
+type ListIdentitiesRes struct {
+	IDs []string
+}
+
+type DeleteIdentityReq struct {
+	ID string
+}
+
+type DeleteIdentityRes struct{}
@@ -4,6 +4,7 @@
 <br>
 <time><a href="/thread?id={{.Message.Key}}">{{RenderJSTime .Message.Timestamp}}</a><br></time>
 
+{{if .Message.IsBoxed}}<span class="label label-default">private</span><br>{{end}}
 {{if ne .Content.Channel ""}}<a href="/channel?channel={{urlquery .Content.Channel}}">#{{.Content.Channel}}</a>{{end}}
 
 </div>
@@ -1,20 +1,119 @@
 <html>
 <head>
 {{template "header.tpl"}}
+{{if .Running}}<meta http-equiv="refresh" content="5">{{end}}
 </head>
 <body>
 <div class="container">
 {{template "navbar.tpl"}}
 <table class="table table-striped table-bordered table-hover">
+<tr><th></th><th>count</th><th>stored bytes</th><th>json bytes</th><th>last day</th><th>last week</th></tr>
+<tr><td>messages</td><td style="text-align: right;">{{.Stats.Messages}}</td><td style="text-align: right;">{{.Stats.Compressed}}</td><td style="text-align: right;">{{.Stats.Uncompressed}}</td>
+<td style="text-align: right;">{{.Stats.Day.Count}} / {{.Stats.Day.Bytes}}</td><td style="text-align: right;">{{.Stats.Week.Count}} / {{.Stats.Week.Bytes}}</td></tr>
+{{if .Stats.Log}}<tr><td>offset log</td><td></td><td style="text-align: right;">{{.Stats.Log}}</td><td></td><td></td><td></td></tr>{{end}}
+{{with .Blobs}}<tr><td>blobs</td><td style="text-align: right;">{{.Count}}</td><td style="text-align: right;">{{.Bytes}}</td><td></td>
+<td style="text-align: right;">{{.Day.Count}} / {{.Day.Bytes}}</td><td style="text-align: right;">{{.Week.Count}} / {{.Week.Bytes}}</td></tr>{{end}}
+</table><br>
+<table class="table table-striped table-bordered table-hover">
+<tr><th>module</th><th>buckets</th><th>size</th></tr>
+{{range .Stats.Modules}}
+<tr><td>{{.Module}}</td><td>{{range $i, $b := .Buckets}}{{if $i}}, {{end}}{{$b}}{{end}}</td><td style="text-align: right;">{{.Bytes}}</td></tr>
+{{end}}
+</table><br>
+<table class="table table-striped table-bordered table-hover">
+<tr><th>feed</th><th>messages</th><th>stored bytes</th><th>json bytes</th></tr>
+{{range .Stats.Feeds}}
+<tr><td><a href="/feed?id={{urlquery .Feed}}">{{.Feed}}</a></td><td style="text-align: right;">{{.Messages}}</td><td style="text-align: right;">{{.Compressed}}</td><td style="text-align: right;">{{.Uncompressed}}</td></tr>
+{{end}}
+</table><br>
+<table class="table table-striped table-bordered table-hover">
+<tr><th>type</th><th>messages</th><th>stored bytes</th><th>json bytes</th></tr>
+{{range .Stats.Types}}
+<tr><td>{{.Type}}</td><td style="text-align: right;">{{.Messages}}</td><td style="text-align: right;">{{.Compressed}}</td><td style="text-align: right;">{{.Uncompressed}}</td></tr>
+{{end}}
+</table><br>
+<table class="table table-striped table-bordered table-hover">
 <tr><th>key</th><th>size</th></tr>
-{{range $b, $size := .DBSize}}
+{{range $b, $size := .Stats.Buckets}}
 <tr><td>{{$b}}</td><td style="text-align: right;">{{$size}}</td>
 {{end}}
 </table><br>
+<table class="table table-striped table-bordered table-hover">
+<tr><th>received</th><th>rejected</th><th>committed</th><th>batches</th><th>messages/s</th><th>buffered</th><th>dropped</th><th>evicted</th><th>gap requests</th><th>failed</th></tr>
+<tr><td>{{.Ingest.Received}}</td><td>{{.Ingest.Rejected}}</td><td>{{.Ingest.Committed}}</td><td>{{.Ingest.Batches}}</td><td>{{printf "%.1f" .Ingest.Rate}}</td><td>{{.Ingest.Buffered}}</td><td>{{.Ingest.Dropped}}</td><td>{{.Ingest.Evicted}}</td><td>{{.Ingest.GapRequests}}</td><td>{{.Ingest.Failed}}</td></tr>
+</table><br>
+{{if .Gaps}}
+<table class="table table-striped table-bordered table-hover">
+<tr><th>feed</th><th>waiting for</th><th>buffered from</th><th>buffered</th><th>since</th></tr>
+{{range .Gaps}}
+<tr><td><a href="/feed?id={{urlquery .Feed}}">{{.Feed}}</a></td><td>{{.Next}}</td><td>{{.First}}</td><td>{{.Buffered}}</td><td>{{.Since.Format "2006-01-02 15:04:05"}}</td></tr>
+{{end}}
+</table><br>
+{{end}}
+<table class="table table-striped table-bordered table-hover">
+<tr><th>index</th><th>version</th><th>log offset</th><th>state</th><th>error</th></tr>
+{{range $module, $state := .Indexes}}
+<tr><td>{{$module}}</td><td>{{$state.Version}}</td><td>{{$state.Offset}}</td><td>{{if $state.Paused}}cancelled{{else if $state.Building}}building{{else}}ready{{end}}</td><td>{{$state.Error}}</td></tr>
+{{end}}
+</table><br>
+{{if .Jobs}}
+<table class="table table-striped table-bordered table-hover">
+<tr><th>rebuild</th><th>started</th><th>progress</th><th>log offset</th><th>indexed</th><th>messages/s</th><th>eta</th><th></th></tr>
+{{range .Jobs}}
+<tr><td>{{.Module}}</td><td>{{.Started.Format "2006-01-02 15:04:05"}}</td>
+<td><div class="progress" style="margin-bottom: 0;"><div class="progress-bar" style="width: {{printf "%.1f" .Percent}}%;">{{printf "%.1f" .Percent}}%</div></div></td>
+<td>{{.Offset}} / {{.Head}}</td><td>{{.Indexed}}</td><td>{{printf "%.1f" .Rate}}</td>
+<td>{{if .Done}}done{{else if .Cancelled}}cancelled{{else if .ETA}}{{.ETA}}{{end}}</td>
+<td>{{if .Done}}{{else if .Cancelled}}<a class="btn btn-default btn-xs" href="/rebuild/resume?module={{.Module}}">resume</a>{{else}}<a class="btn btn-default btn-xs" href="/rebuild/cancel?module={{.Module}}">cancel</a>{{end}}</td></tr>
+{{end}}
+</table><br>
+{{end}}
 <a class="btn btn-default" href="/rebuild?module=all">all</a>
 {{range .Modules}}
 <a class="btn btn-default" href="/rebuild?module={{.}}">{{.}}</a>
 {{end}}
+<a class="btn btn-default" href="/forks">forked feeds</a>
+
+{{if .Purged}}
+<table class="table table-striped table-bordered table-hover">
+<tr><th>purged feed</th><th>purged</th><th>messages</th><th></th></tr>
+{{range .Purged}}
+<tr><td>{{.Feed}}</td><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td>{{.Messages}}</td>
+<td><form action="/unblock" method="post"><input type="hidden" name="feed" value="{{.Feed}}"><input type="submit" value="unblock" class="btn btn-default btn-xs"></form></td></tr>
+{{end}}
+</table><br>
+{{end}}
+
+<div class="well">
+{{with .Backup}}<p>Last backup {{.Time.Format "2006-01-02 15:04:05"}}: {{.}}</p>{{end}}
+<a class="btn btn-default" href="/backup">download backup</a>
+{{if .Backup}}<a class="btn btn-default" href="/backup?incremental=1">download incremental backup</a>{{end}}
+</div>
+
+<h3>Identities</h3>
+<table class="table table-condensed">
+{{range $i, $id := .Identities}}<tr><td>{{if $id.Name}}@{{$id.Name}}{{end}}</td><td><a href="/feed?id={{urlquery $id.Ref}}">{{$id.Ref}}</a></td>
+<td>{{if eq $i 0}}primary{{else}}<form action="/identity/delete" method="post" onsubmit="return confirm('Delete this identity? Nothing more can be published to its feed.');"><input type="hidden" name="id" value="{{$id.Ref}}"><input type="submit" value="delete" class="btn btn-default btn-xs"></form>{{end}}</td></tr>
+{{end}}</table>
+<div class="well">
+<form action="/identity/create" method="post" class="form-inline">
+<input type="text" name="name" class="form-control" placeholder="Name (optional)">
+<input type="submit" value="Create Identity" class="btn btn-primary">
+</form>
+<form action="/identity/import" method="post" enctype="multipart/form-data" class="form-inline">
+<input type="file" name="secret" class="form-control">
+<input type="submit" value="Import Identity" class="btn btn-default">
+</form>
+</div>
+
+<div class="well">
+<form action="/purge" method="post" onsubmit="return confirm('Delete every message of this feed and block it?');">
+<div class="form-group">
+<input type="text" name="feed" class="form-control" placeholder="Feed">
+<input type="submit" value="Purge Feed" class="btn btn-danger">
+</div>
+</form>
+</div>
 
 <div class="well">
 <form action="/gossip/add" method="post">
@@ -8,6 +8,9 @@
 
 <div class="row">
 <div class="col-sm-6 col-sm-offset-2">
+{{if .Forked}}
+<div class="alert alert-danger">This feed has been forked by its author and is no longer replicated. <a href="/forks?id={{urlquery .Ref}}">View proof</a></div>
+{{end}}
 {{if .Profile}}
 {{if .Profile.Image}}<img class="avatarwell" src="/blob?id={{urlquery .Profile.Image.Link}}">{{end}}
 <div class="about"><b>@{{.Profile.Name}}</b><p class="ref">{{.Ref}}</p><form action="/publish/follow" method="post">
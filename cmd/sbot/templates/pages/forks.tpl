@@ -0,0 +1,23 @@
+<html>
+<head>
+{{template "header.tpl"}}
+</head>
+<body>
+<div class="container">
+{{template "navbar.tpl"}}
+
+{{range .Proofs}}
+<div class="well">
+<p><a href="/feed?id={{urlquery .Author}}">{{Avatar .Author}}</a> signed two messages with sequence {{.Sequence}}</p>
+{{range .Messages}}
+<p class="ref">{{.Key}}</p>
+<pre>{{printf "%s" .Encode}}</pre>
+{{end}}
+</div>
+{{else}}
+<div class="well">No forked feeds.</div>
+{{end}}
+
+</div>
+</body>
+</html>
@@ -0,0 +1,3 @@
+{{with Identities}}{{if gt (len .) 1}}<select name="as" class="form-control">
+{{range .}}<option value="{{.Ref}}">{{if .Name}}@{{.Name}} {{end}}{{.Ref}}</option>
+{{end}}</select>{{end}}{{end}}
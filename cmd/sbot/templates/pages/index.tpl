@@ -9,7 +9,9 @@
 
 <form class="postingarea" action="/publish/post" method="post">
 <textarea name="text"></textarea><br>
+<input type="text" name="recps" class="form-control" placeholder="Private recipients (optional, up to 6)">
 <input type="hidden" name="returnto" value="/">
+{{template "identity.tpl"}}
 <input type="submit" value="Publish!!" class="btn btn-primary">
 </form>
 
@@ -17,6 +17,7 @@
 <input type="hidden" name="branch" value="{{.Message.Key}}">
 <input type="hidden" name="root" value="{{.Message.Key}}">
 <input type="hidden" name="returnto" value="/post?id={{urlquery .Message.Key}}">
+{{template "identity.tpl"}}
 <input type="submit" value="Publish!" class="btn btn-primary">
 </form>
 </div>
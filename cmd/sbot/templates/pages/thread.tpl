@@ -33,6 +33,7 @@
 <input type="hidden" name="branch" value="{{.Reply.String}}">
 <input type="hidden" name="root" value="{{.Root.Key.String}}">
 </div>
+{{template "identity.tpl"}}
 <input type="submit" value="Publish!" class="postbutton">
 </form>
 </div>
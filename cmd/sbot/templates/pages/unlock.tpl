@@ -0,0 +1,19 @@
+<html>
+<head>
+{{template "header.tpl"}}
+</head>
+<body>
+<div class="container">
+
+<h2>Unlock</h2>
+<div class="well">
+<p>The store is sealed. Enter its passphrase to open it.</p>
+{{if .}}<p class="text-danger">{{.}}</p>{{end}}
+<form action="/" method="post" class="form-inline">
+<input type="password" name="passphrase" class="form-control" autofocus>
+<input type="submit" value="Unlock" class="btn btn-primary">
+</form>
+</div>
+</div>
+</body>
+</html>
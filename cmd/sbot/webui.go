@@ -2,7 +2,9 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
+	"fmt"
 	"html/template"
 	"io"
 	"io/ioutil"
@@ -12,9 +14,9 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/boltdb/bolt"
 	"github.com/microcosm-cc/bluemonday"
 	"github.com/russross/blackfriday"
 
@@ -28,6 +30,7 @@ import (
 	"github.com/andyleap/go-ssb/graph"
 	"github.com/andyleap/go-ssb/search"
 	"github.com/andyleap/go-ssb/social"
+	"github.com/andyleap/go-ssb/storage"
 )
 
 var ContentTemplates = template.New("content")
@@ -45,7 +48,7 @@ func GetURL(link, name string) (string, string) {
 	case ssb.RefMessage:
 		msg := datastore.Get(nil, r)
 		if msg != nil {
-			_, repo := msg.DecodeMessage()
+			_, repo := datastore.DecodeMessage(msg)
 			if _, ok := repo.(*git.RepoRoot); ok {
 				return "/repo?id=" + url.QueryEscape(r.String()), name
 			}
@@ -54,7 +57,7 @@ func GetURL(link, name string) (string, string) {
 
 	case ssb.RefFeed:
 		a := &social.About{}
-		datastore.DB().View(func(tx *bolt.Tx) error {
+		datastore.DB().View(func(tx storage.Tx) error {
 			a = social.GetAbout(tx, r)
 			return nil
 		})
@@ -127,7 +130,7 @@ func init() {
 				return ""
 			}
 			var a *social.About
-			datastore.DB().View(func(tx *bolt.Tx) error {
+			datastore.DB().View(func(tx storage.Tx) error {
 				a = social.GetAbout(tx, ref)
 				return nil
 			})
@@ -142,7 +145,7 @@ func init() {
 			return template.HTML(buf.String())
 		},
 		"GetAbout": func(ref ssb.Ref) (a *social.About) {
-			datastore.DB().View(func(tx *bolt.Tx) error {
+			datastore.DB().View(func(tx storage.Tx) error {
 				a = social.GetAbout(tx, ref)
 				return nil
 			})
@@ -159,8 +162,8 @@ func init() {
 			return datastore.Get(nil, ref)
 		},
 		"GetVotes": func(ref ssb.Ref) (votes []*ssb.SignedMessage) {
-			datastore.DB().View(func(tx *bolt.Tx) error {
-				votes = social.GetVotes(tx, ref)
+			datastore.DB().View(func(tx storage.Tx) error {
+				votes = social.GetVotes(datastore, tx, ref)
 				return nil
 			})
 			return
@@ -172,7 +175,7 @@ func init() {
 			if m == nil {
 				return ""
 			}
-			t, md := m.DecodeMessage()
+			t, md := datastore.DecodeMessage(m)
 			if t == "" {
 				return template.HTML("<!-- BLANK --!>")
 			}
@@ -201,7 +204,7 @@ var PageTemplates = template.Must(template.New("index").Funcs(template.FuncMap{
 			return ""
 		}
 		var a *social.About
-		datastore.DB().View(func(tx *bolt.Tx) error {
+		datastore.DB().View(func(tx storage.Tx) error {
 			a = social.GetAbout(tx, ref)
 			return nil
 		})
@@ -216,7 +219,7 @@ var PageTemplates = template.Must(template.New("index").Funcs(template.FuncMap{
 		return template.HTML(buf.String())
 	},
 	"RenderContent": func(m *ssb.SignedMessage, levels int) template.HTML {
-		t, md := m.DecodeMessage()
+		t, md := datastore.DecodeMessage(m)
 		if t == "" {
 			return template.HTML("<!-- BLANK --!>")
 		}
@@ -239,7 +242,7 @@ var PageTemplates = template.Must(template.New("index").Funcs(template.FuncMap{
 		return blobs.Get(datastore).Has(ref)
 	},
 	"RenderContentTemplate": func(m *ssb.SignedMessage, levels int, tpl string) template.HTML {
-		t, md := m.DecodeMessage()
+		t, md := datastore.DecodeMessage(m)
 		buf := &bytes.Buffer{}
 		err := ContentTemplates.ExecuteTemplate(buf, tpl+".tpl", struct {
 			Message *ssb.SignedMessage
@@ -252,20 +255,48 @@ var PageTemplates = template.Must(template.New("index").Funcs(template.FuncMap{
 		return template.HTML(t + buf.String())
 	},
 	"Decode": func(m *ssb.SignedMessage) interface{} {
-		_, mb := m.DecodeMessage()
+		_, mb := datastore.DecodeMessage(m)
 		return mb
 	},
+	"Identities": identities,
 }).ParseGlob("templates/pages/*.tpl"))
 
+// identity is a local identity as offered to publish as.
+type identity struct {
+	Ref  ssb.Ref
+	Name string
+}
+
+func identities() (ids []identity) {
+	datastore.DB().View(func(tx storage.Tx) error {
+		for _, ref := range datastore.Identities() {
+			id := identity{Ref: ref}
+			if a := social.GetAbout(tx, ref); a != nil {
+				id.Name = a.Name
+			}
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	return
+}
+
+// publisher returns the feed a form publishes to, that of the identity it
+// picked or the primary one.
+func publisher(req *http.Request) (*ssb.Feed, error) {
+	return localFeed(datastore, req.FormValue("as"))
+}
+
 func init() {
 	log.Println(ContentTemplates.DefinedTemplates())
 	log.Println(PageTemplates.DefinedTemplates())
 }
 
 func RegisterWebui() {
-	bi := boltinspect.New(datastore.DB())
-
-	http.HandleFunc("/bolt", bi.InspectEndpoint)
+	if db, ok := datastore.DB().(*storage.BoltDB); ok {
+		bi := boltinspect.New(db.Bolt())
+		http.HandleFunc("/bolt", bi.InspectEndpoint)
+	}
 
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("./static"))))
 
@@ -289,6 +320,15 @@ func RegisterWebui() {
 	http.HandleFunc("/admin", Admin)
 	http.HandleFunc("/addpub", AddPub)
 	http.HandleFunc("/rebuild", Rebuild)
+	http.HandleFunc("/rebuild/cancel", RebuildCancel)
+	http.HandleFunc("/rebuild/resume", RebuildResume)
+	http.HandleFunc("/purge", Purge)
+	http.HandleFunc("/unblock", Unblock)
+	http.HandleFunc("/identity/create", CreateIdentity)
+	http.HandleFunc("/identity/import", ImportIdentity)
+	http.HandleFunc("/identity/delete", DeleteIdentity)
+	http.HandleFunc("/backup", Backup)
+	http.HandleFunc("/forks", Forks)
 
 	http.HandleFunc("/blob", Blob)
 	http.HandleFunc("/blobinfo", BlobInfo)
@@ -300,7 +340,50 @@ func RegisterWebui() {
 
 	http.HandleFunc("/upload", Upload)
 
-	go http.ListenAndServe("localhost:9823", nil)
+	go http.ListenAndServe(webuiAddr, nil)
+}
+
+const webuiAddr = "localhost:9823"
+
+// unlockWebui serves a page asking for the passphrase of a sealed store
+// until open succeeds with one, then stops so the web UI proper can take
+// its place.
+func unlockWebui(open func(passphrase []byte) error) {
+	unlocked := make(chan struct{})
+	var lock sync.Mutex
+	mux := http.NewServeMux()
+	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("./static"))))
+	mux.HandleFunc("/", func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			PageTemplates.ExecuteTemplate(rw, "unlock.tpl", nil)
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		select {
+		case <-unlocked:
+			http.Redirect(rw, req, "/", http.StatusFound)
+			return
+		default:
+		}
+		if err := open([]byte(req.FormValue("passphrase"))); err != nil {
+			PageTemplates.ExecuteTemplate(rw, "unlock.tpl", err.Error())
+			return
+		}
+		close(unlocked)
+		http.Redirect(rw, req, "/", http.StatusFound)
+	})
+	srv := &http.Server{Addr: webuiAddr, Handler: mux}
+	go func() {
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	log.Println("Store is sealed, unlock it at http://" + webuiAddr)
+	<-unlocked
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	srv.Shutdown(ctx)
 }
 
 func Upload(rw http.ResponseWriter, req *http.Request) {
@@ -311,7 +394,7 @@ func Upload(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 	buf, _ := ioutil.ReadAll(f)
-	bs := datastore.ExtraData("blobStore").(*blobs.BlobStore)
+	bs := blobs.Get(datastore)
 	ref := bs.Add(buf)
 	http.Redirect(rw, req, "/blobinfo?id="+url.QueryEscape(ref.String()), http.StatusFound)
 }
@@ -323,8 +406,58 @@ func PublishPost(rw http.ResponseWriter, req *http.Request) {
 	p.Branch = ssb.ParseRef(req.FormValue("branch"))
 	p.Channel = req.FormValue("channel")
 	p.Text = req.FormValue("text")
-	datastore.GetFeed(datastore.PrimaryRef).PublishMessage(p)
-	http.Redirect(rw, req, req.FormValue("returnto"), http.StatusSeeOther)
+	recps := []ssb.Ref{}
+	seen := map[ssb.Ref]bool{}
+	for _, r := range strings.FieldsFunc(req.FormValue("recps"), func(r rune) bool { return r == ',' || r == ' ' }) {
+		ref := ssb.ParseRef(r)
+		if ref.Type != ssb.RefFeed || seen[ref] {
+			continue
+		}
+		seen[ref] = true
+		recps = append(recps, ref)
+	}
+	feed, err := publisher(req)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var m *ssb.SignedMessage
+	if len(recps) > 0 {
+		// The sender is a recipient too, so it can read its own message,
+		// and counts towards the limit.
+		if !seen[feed.ID] {
+			recps = append(recps, feed.ID)
+		}
+		if len(recps) > ssb.MaxRecipients {
+			http.Error(rw, fmt.Sprintf("%s, at most %d besides yourself", ssb.ErrTooManyRecipients, ssb.MaxRecipients-1), http.StatusBadRequest)
+			return
+		}
+		for _, r := range recps {
+			p.Recps = append(p.Recps, social.Link{Link: r})
+		}
+		m, err = feed.PublishPrivateMessageContext(req.Context(), p, recps)
+	} else {
+		m, err = feed.PublishMessageContext(req.Context(), p)
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	waitIndexed(req)
+	returnto := req.FormValue("returnto")
+	if returnto == "" {
+		returnto = "/post?id=" + url.QueryEscape(m.Key().String())
+	}
+	http.Redirect(rw, req, returnto, http.StatusSeeOther)
+}
+
+// waitIndexed holds a redirect after publishing until the indexes have
+// caught up, so the page shows the new message.
+func waitIndexed(req *http.Request) {
+	ctx, cancel := context.WithTimeout(req.Context(), 5*time.Second)
+	defer cancel()
+	datastore.WaitIndexed(ctx, datastore.LogHead())
 }
 
 func PublishVote(rw http.ResponseWriter, req *http.Request) {
@@ -333,24 +466,46 @@ func PublishVote(rw http.ResponseWriter, req *http.Request) {
 	p.Vote.Link = ssb.ParseRef(req.FormValue("link"))
 	p.Vote.Value = 1
 	p.Vote.Reason = ""
-	datastore.GetFeed(datastore.PrimaryRef).PublishMessage(p)
+	feed, err := publisher(req)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	_, err = feed.PublishMessageContext(req.Context(), p)
+	if err != nil {
+		log.Println(err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	waitIndexed(req)
 	http.Redirect(rw, req, req.FormValue("returnto"), http.StatusSeeOther)
 }
 
 func PublishAbout(rw http.ResponseWriter, req *http.Request) {
+	feed, err := publisher(req)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
 	p := &social.About{}
 	p.Type = "about"
-	p.About = datastore.PrimaryRef
+	p.About = feed.ID
 	p.Name = req.FormValue("name")
 	f, _, err := req.FormFile("upload")
 	if err == nil {
 		buf, _ := ioutil.ReadAll(f)
-		bs := datastore.ExtraData("blobStore").(*blobs.BlobStore)
+		bs := blobs.Get(datastore)
 		ref := bs.Add(buf)
 		p.Image = &social.Image{}
 		p.Image.Link = ref
 	}
-	datastore.GetFeed(datastore.PrimaryRef).PublishMessage(p)
+	_, err = feed.PublishMessageContext(req.Context(), p)
+	if err != nil {
+		log.Println(err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	waitIndexed(req)
 	http.Redirect(rw, req, "/profile", http.StatusSeeOther)
 }
 
@@ -364,7 +519,18 @@ func PublishFollow(rw http.ResponseWriter, req *http.Request) {
 	p.Contact = feed
 	following := true
 	p.Following = &following
-	datastore.GetFeed(datastore.PrimaryRef).PublishMessage(p)
+	from, err := publisher(req)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	_, err = from.PublishMessageContext(req.Context(), p)
+	if err != nil {
+		log.Println(err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	waitIndexed(req)
 	http.Redirect(rw, req, req.FormValue("returnto"), http.StatusSeeOther)
 }
 
@@ -451,7 +617,10 @@ func GossipAccept(rw http.ResponseWriter, req *http.Request) {
 		p.Contact = pub.Link
 		following := true
 		p.Following = &following
-		datastore.GetFeed(datastore.PrimaryRef).PublishMessage(p)
+		_, err = datastore.GetFeed(datastore.PrimaryRef).PublishMessageContext(req.Context(), p)
+		if err != nil {
+			log.Println(err)
+		}
 	}
 
 	http.Redirect(rw, req, "/admin", http.StatusSeeOther)
@@ -460,48 +629,203 @@ func GossipAccept(rw http.ResponseWriter, req *http.Request) {
 func Rebuild(rw http.ResponseWriter, req *http.Request) {
 	module := req.FormValue("module")
 	if module != "" {
+		var err error
 		if module == "all" {
-			datastore.RebuildAll()
+			err = datastore.RebuildAll()
 		} else {
-			datastore.Rebuild(module)
+			err = datastore.Rebuild(module)
+		}
+		if err != nil {
+			log.Println(err)
 		}
 	}
 	http.Redirect(rw, req, "/admin", http.StatusSeeOther)
 }
 
-func calcSize(tx *bolt.Tx, b *bolt.Bucket) (size int) {
-	b.ForEach(func(k, v []byte) error {
-		size += len(k)
-		if v == nil {
-			size += calcSize(tx, b.Bucket(k))
-		} else {
-			size += len(v)
-		}
-		return nil
-	})
-	return
+func RebuildCancel(rw http.ResponseWriter, req *http.Request) {
+	err := datastore.CancelRebuild(req.FormValue("module"))
+	if err != nil {
+		log.Println(err)
+	}
+	http.Redirect(rw, req, "/admin", http.StatusSeeOther)
 }
 
-func Admin(rw http.ResponseWriter, req *http.Request) {
-	size := map[string]int{}
-	datastore.DB().View(func(tx *bolt.Tx) error {
-		tx.ForEach(func(k []byte, b *bolt.Bucket) error {
-			size[string(k)] = calcSize(tx, b)
-			return nil
+func RebuildResume(rw http.ResponseWriter, req *http.Request) {
+	err := datastore.ResumeRebuild(req.FormValue("module"))
+	if err != nil {
+		log.Println(err)
+	}
+	http.Redirect(rw, req, "/admin", http.StatusSeeOther)
+}
+
+func Purge(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Redirect(rw, req, "/admin", http.StatusSeeOther)
+		return
+	}
+	err := datastore.PurgeFeed(ssb.ParseRef(req.FormValue("feed")))
+	if err != nil {
+		log.Println(err)
+	}
+	http.Redirect(rw, req, "/admin", http.StatusSeeOther)
+}
+
+func Unblock(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Redirect(rw, req, "/admin", http.StatusSeeOther)
+		return
+	}
+	err := datastore.UnblockFeed(ssb.ParseRef(req.FormValue("feed")))
+	if err != nil {
+		log.Println(err)
+	}
+	http.Redirect(rw, req, "/admin", http.StatusSeeOther)
+}
+
+func CreateIdentity(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Redirect(rw, req, "/admin", http.StatusSeeOther)
+		return
+	}
+	id, err := datastore.CreateIdentity()
+	if err == nil && req.FormValue("name") != "" {
+		_, err = datastore.GetFeed(id).PublishMessageContext(req.Context(), &social.About{
+			MessageBody: ssb.MessageBody{Type: "about"},
+			About:       id,
+			Name:        req.FormValue("name"),
 		})
-		return nil
-	})
+		waitIndexed(req)
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(rw, req, "/admin", http.StatusSeeOther)
+}
+
+func ImportIdentity(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Redirect(rw, req, "/admin", http.StatusSeeOther)
+		return
+	}
+	f, _, err := req.FormFile("secret")
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer f.Close()
+	secret, _ := ioutil.ReadAll(f)
+	if _, err := datastore.ImportIdentity(secret); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(rw, req, "/admin", http.StatusSeeOther)
+}
+
+func DeleteIdentity(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Redirect(rw, req, "/admin", http.StatusSeeOther)
+		return
+	}
+	if err := datastore.DeleteIdentity(ssb.ParseRef(req.FormValue("id"))); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(rw, req, "/admin", http.StatusSeeOther)
+}
+
+func Backup(rw http.ResponseWriter, req *http.Request) {
+	opts := ssb.BackupOptions{Incremental: req.FormValue("incremental") != ""}
+	name := "sbot-backup-" + time.Now().Format("20060102-150405") + ".tar"
+	rw.Header().Set("Content-Type", "application/x-tar")
+	rw.Header().Set("Content-Disposition", "attachment; filename="+name)
+	bi, err := datastore.Backup(rw, opts)
+	if err != nil {
+		log.Println("Backup failed:", err)
+		return
+	}
+	log.Println("Backup downloaded,", bi)
+}
+
+// adminTopFeeds is how many of the largest feeds the admin page lists.
+const adminTopFeeds = 20
+
+func Admin(rw http.ResponseWriter, req *http.Request) {
+	stats, err := datastore.StorageStats()
+	if err != nil {
+		log.Println(err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(stats.Feeds) > adminTopFeeds {
+		stats.Feeds = stats.Feeds[:adminTopFeeds]
+	}
+	var blobStats *blobs.Stats
+	if bs := blobs.Get(datastore); bs != nil {
+		st := bs.Stats()
+		blobStats = &st
+	}
 
 	modules := []string{}
-	for module := range ssb.AddMessageHooks {
-		modules = append(modules, module)
+	for _, m := range datastore.Modules() {
+		if m.Index != nil {
+			modules = append(modules, m.Name)
+		}
 	}
-	err := PageTemplates.ExecuteTemplate(rw, "admin.tpl", struct {
-		Modules []string
-		DBSize  map[string]int
+	jobs := datastore.RebuildJobs()
+	running := false
+	for _, job := range jobs {
+		if !job.Done && !job.Cancelled {
+			running = true
+		}
+	}
+	err = PageTemplates.ExecuteTemplate(rw, "admin.tpl", struct {
+		Modules    []string
+		Stats      ssb.StorageStats
+		Blobs      *blobs.Stats
+		Ingest     ssb.IngestStats
+		Gaps       []ssb.FeedGap
+		Indexes    map[string]ssb.IndexState
+		Jobs       []ssb.RebuildJob
+		Running    bool
+		Purged     []ssb.PurgedFeed
+		Backup     *ssb.BackupInfo
+		Identities []identity
 	}{
 		modules,
-		size,
+		stats,
+		blobStats,
+		datastore.IngestStats(),
+		datastore.Gaps(),
+		datastore.IndexStates(),
+		jobs,
+		running,
+		datastore.PurgedFeeds(),
+		datastore.LastBackup(),
+		identities(),
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func Forks(rw http.ResponseWriter, req *http.Request) {
+	var proofs []*ssb.ForkProof
+	if id := req.FormValue("id"); id != "" {
+		f := datastore.GetFeed(ssb.ParseRef(id))
+		if f == nil {
+			http.NotFound(rw, req)
+			return
+		}
+		proofs = f.ForkProofs(nil)
+	} else {
+		proofs = datastore.ForkProofs(nil)
+	}
+	err := PageTemplates.ExecuteTemplate(rw, "forks.tpl", struct {
+		Proofs []*ssb.ForkProof
+	}{
+		proofs,
 	})
 	if err != nil {
 		log.Println(err)
@@ -539,7 +863,7 @@ func Index(rw http.ResponseWriter, req *http.Request) {
 		f := datastore.GetFeed(datastore.PrimaryRef)
 		messages = f.LatestCount(int(p), 0)
 	} else {
-		messages = datastore.LatestCountFiltered(int(p), int(p-25), graph.GetFollows(datastore, datastore.PrimaryRef, int(dist)))
+		messages = datastore.LatestCountFiltered(int(p), int(p-25), graph.GetFollowsFrom(datastore, datastore.Identities(), int(dist)))
 	}
 	err = PageTemplates.ExecuteTemplate(rw, "index.tpl", struct {
 		Messages []*ssb.SignedMessage
@@ -574,7 +898,7 @@ func FeedPage(rw http.ResponseWriter, req *http.Request) {
 	p := (i * 25) - 25
 
 	var about *social.About
-	datastore.DB().View(func(tx *bolt.Tx) error {
+	datastore.DB().View(func(tx storage.Tx) error {
 		about = social.GetAbout(tx, feed)
 		return nil
 	})
@@ -593,6 +917,7 @@ func FeedPage(rw http.ResponseWriter, req *http.Request) {
 		NextPage string
 		PrevPage string
 		Follows  map[ssb.Ref]int
+		Forked   bool
 	}{
 		messages,
 		about,
@@ -601,6 +926,7 @@ func FeedPage(rw http.ResponseWriter, req *http.Request) {
 		nextPage,
 		prevPage,
 		follows,
+		f.Forked(),
 	})
 	if err != nil {
 		log.Println(err)
@@ -615,14 +941,14 @@ func ThreadPage(rw http.ResponseWriter, req *http.Request) {
 
 	channel := ""
 
-	_, p := root.DecodeMessage()
+	_, p := datastore.DecodeMessage(root)
 
 	if post, ok := p.(*social.Post); ok {
 		channel = post.Channel
 	}
 	var messages []*ssb.SignedMessage
-	datastore.DB().View(func(tx *bolt.Tx) error {
-		messages = social.GetThread(tx, threadRef)
+	datastore.DB().View(func(tx storage.Tx) error {
+		messages = social.GetThread(datastore, tx, threadRef)
 		return nil
 	})
 
@@ -630,7 +956,7 @@ func ThreadPage(rw http.ResponseWriter, req *http.Request) {
 	feed := ssb.ParseRef(feedRaw)
 
 	var about *social.About
-	datastore.DB().View(func(tx *bolt.Tx) error {
+	datastore.DB().View(func(tx storage.Tx) error {
 		about = social.GetAbout(tx, feed)
 		return nil
 	})
@@ -668,7 +994,7 @@ func Post(rw http.ResponseWriter, req *http.Request) {
 		http.NotFound(rw, req)
 		return
 	}
-	_, content := message.DecodeMessage()
+	_, content := datastore.DecodeMessage(message)
 	raw := message.Encode()
 	p, ok := content.(*social.Post)
 	if !ok {
@@ -680,8 +1006,8 @@ func Post(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 	var votes []*ssb.SignedMessage
-	datastore.DB().View(func(tx *bolt.Tx) error {
-		votes = social.GetVotes(tx, message.Key())
+	datastore.DB().View(func(tx storage.Tx) error {
+		votes = social.GetVotes(datastore, tx, message.Key())
 		return nil
 	})
 	err := PageTemplates.ExecuteTemplate(rw, "post.tpl", struct {
@@ -710,7 +1036,7 @@ func Profile(rw http.ResponseWriter, req *http.Request) {
 	dist, _ := strconv.ParseInt(distStr, 10, 64)
 
 	var about *social.About
-	datastore.DB().View(func(tx *bolt.Tx) error {
+	datastore.DB().View(func(tx storage.Tx) error {
 		about = social.GetAbout(tx, feed)
 		return nil
 	})
@@ -792,7 +1118,7 @@ func Search(rw http.ResponseWriter, req *http.Request) {
 	case ssb.RefMessage:
 		msg := datastore.Get(nil, r)
 		if msg != nil {
-			_, repo := msg.DecodeMessage()
+			_, repo := datastore.DecodeMessage(msg)
 			if _, ok := repo.(*git.RepoRoot); ok {
 				http.Redirect(rw, req, "/repo?id="+url.QueryEscape(r.String()), http.StatusFound)
 				return
@@ -823,10 +1149,12 @@ func Blob(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 	r := ssb.ParseRef(id)
-	bs := datastore.ExtraData("blobStore").(*blobs.BlobStore)
+	bs := blobs.Get(datastore)
 	if !bs.Has(r) {
 		bs.Want(r)
-		bs.WaitFor(r)
+		if bs.WaitForContext(req.Context(), r) != nil {
+			return
+		}
 	}
 	rc := bs.Get(r)
 	defer rc.Close()
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"strconv"
 
@@ -120,6 +121,66 @@ func main() {
 				return client.Call("Feed.About", req, &res)
 			},
 		},
+		{
+			Name:    "identity.create",
+			Aliases: []string{"i.c"},
+			Usage:   "create a new identity",
+			Action: func(c *cli.Context) error {
+				res := rpc.CreateIdentityRes{}
+				if err := client.Call("Identity.Create", rpc.CreateIdentityReq{}, &res); err != nil {
+					return err
+				}
+				fmt.Println(res.ID)
+				return nil
+			},
+		},
+		{
+			Name:    "identity.import",
+			Aliases: []string{"i.i"},
+			Usage:   "import the identity of a secret file",
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 1 {
+					return fmt.Errorf("Expected 1 argument")
+				}
+				secret, err := ioutil.ReadFile(c.Args().Get(0))
+				if err != nil {
+					return err
+				}
+				res := rpc.ImportIdentityRes{}
+				if err := client.Call("Identity.Import", rpc.ImportIdentityReq{Secret: string(secret)}, &res); err != nil {
+					return err
+				}
+				fmt.Println(res.ID)
+				return nil
+			},
+		},
+		{
+			Name:    "identity.list",
+			Aliases: []string{"i.l"},
+			Usage:   "list the local identities, the primary one first",
+			Action: func(c *cli.Context) error {
+				res := rpc.ListIdentitiesRes{}
+				if err := client.Call("Identity.List", rpc.ListIdentitiesReq{}, &res); err != nil {
+					return err
+				}
+				for _, id := range res.IDs {
+					fmt.Println(id)
+				}
+				return nil
+			},
+		},
+		{
+			Name:    "identity.delete",
+			Aliases: []string{"i.d"},
+			Usage:   "delete an identity from the keystore",
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 1 {
+					return fmt.Errorf("Expected 1 argument")
+				}
+				res := rpc.DeleteIdentityRes{}
+				return client.Call("Identity.Delete", rpc.DeleteIdentityReq{ID: c.Args().Get(0)}, &res)
+			},
+		},
 	}
 	app.Run(os.Args)
 }
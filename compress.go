@@ -0,0 +1,536 @@
+package ssb
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/andyleap/go-ssb/storage"
+)
+
+var (
+	ErrTooFewMessages = errors.New("Too few messages to train a dictionary")
+	ErrNoGain         = errors.New("Trained dictionary does not compress better")
+	ErrNoDictionary   = errors.New("No dictionary has been trained")
+	ErrRecompressing  = errors.New("Recompression already running")
+)
+
+// formatDict entries are a flate stream compressed with a dictionary
+// trained on the store's own messages:
+//
+//	<3><dictionary id: uint32be><flate data>
+//
+// The id is the start of the sha256 of the dictionary, and the
+// dictionaries are kept in the store's compression bucket.
+const formatDict = 3
+
+const (
+	// maxDictionary is the flate window, a longer dictionary is never
+	// reached.
+	maxDictionary = 32 * 1024
+
+	minTrainSamples     = 100
+	defaultTrainSamples = 5000
+
+	// recompressBatch bounds how many entries are rewritten in each
+	// transaction, and recompressPause how long writers get between them.
+	recompressBatch = 500
+	recompressPause = 20 * time.Millisecond
+)
+
+type dictionary struct {
+	id      uint32
+	data    []byte
+	writers sync.Pool
+}
+
+// dictionaries holds every dictionary loaded by any store, by id, so
+// DecompressMessage can read entries written with them.
+var dictionaries = struct {
+	sync.RWMutex
+	m map[uint32]*dictionary
+}{m: map[uint32]*dictionary{}}
+
+func registerDictionary(data []byte) *dictionary {
+	hash := sha256.Sum256(data)
+	id := binary.BigEndian.Uint32(hash[:])
+	dictionaries.Lock()
+	defer dictionaries.Unlock()
+	if d, ok := dictionaries.m[id]; ok {
+		return d
+	}
+	d := &dictionary{id: id, data: data}
+	dictionaries.m[id] = d
+	return d
+}
+
+func (d *dictionary) compress(buf []byte) []byte {
+	cbuf := &bytes.Buffer{}
+	cbuf.WriteByte(formatDict)
+	var id [4]byte
+	binary.BigEndian.PutUint32(id[:], d.id)
+	cbuf.Write(id[:])
+	w, _ := d.writers.Get().(*flate.Writer)
+	if w == nil {
+		w, _ = flate.NewWriterDict(cbuf, 9, d.data)
+	} else {
+		w.Reset(cbuf)
+	}
+	w.Write(buf)
+	w.Close()
+	d.writers.Put(w)
+	return cbuf.Bytes()
+}
+
+// decompressDict returns the contents of a formatDict entry, or nil if its
+// dictionary is not loaded.
+func decompressDict(cbuf []byte) []byte {
+	if len(cbuf) < 5 {
+		return nil
+	}
+	dictionaries.RLock()
+	d := dictionaries.m[binary.BigEndian.Uint32(cbuf[1:5])]
+	dictionaries.RUnlock()
+	if d == nil {
+		return nil
+	}
+	reader := flate.NewReaderDict(bytes.NewReader(cbuf[5:]), d.data)
+	buf, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return nil
+	}
+	return buf
+}
+
+// DictionaryInfo describes a trained dictionary. Before and After are the
+// sizes of a held out part of the sample compressed the way the store did
+// until then and with the new dictionary.
+type DictionaryInfo struct {
+	ID      uint32 `json:"id"`
+	Size    int    `json:"size"`
+	Samples int    `json:"samples"`
+	Before  int64  `json:"before"`
+	After   int64  `json:"after"`
+}
+
+// CompressionStats reports on recompressing the stored messages with the
+// current dictionary. Before and After are the sizes of the entries that
+// were rewritten.
+type CompressionStats struct {
+	Dictionary uint32    `json:"dictionary"`
+	Started    time.Time `json:"started"`
+	Running    bool      `json:"running"`
+	Entries    int       `json:"entries"`
+	Rewritten  int       `json:"rewritten"`
+	Before     int64     `json:"before"`
+	After      int64     `json:"after"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Saved is how many bytes recompression has saved so far.
+func (cs CompressionStats) Saved() int64 {
+	return cs.Before - cs.After
+}
+
+type compression struct {
+	ds *DataStore
+
+	lock  sync.Mutex
+	dict  *dictionary
+	stats CompressionStats
+
+	quit chan struct{}
+	done sync.WaitGroup
+}
+
+func newCompression(ds *DataStore) *compression {
+	return &compression{ds: ds, quit: make(chan struct{})}
+}
+
+func (c *compression) stop() {
+	close(c.quit)
+	c.done.Wait()
+}
+
+func (ds *DataStore) registerCompressionMethods() {
+	ds.RegisterMethod("compression.Train", ds.TrainDictionary)
+	ds.RegisterMethod("compression.Recompress", ds.Recompress)
+	ds.RegisterMethod("compression.Stats", func() CompressionStats {
+		return ds.CompressionStats()
+	})
+}
+
+// loadDictionaries registers the dictionaries kept in the store, and picks
+// up the one new messages are compressed with.
+func (ds *DataStore) loadDictionaries() error {
+	return ds.db.View(func(tx storage.Tx) error {
+		CompressionBucket := tx.Bucket([]byte("compression"))
+		if CompressionBucket == nil {
+			return nil
+		}
+		current := CompressionBucket.Get([]byte("current"))
+		DictBucket := CompressionBucket.Bucket([]byte("dictionaries"))
+		if DictBucket == nil {
+			return nil
+		}
+		return DictBucket.ForEach(func(k, v []byte) error {
+			d := registerDictionary(append([]byte(nil), v...))
+			if bytes.Equal(k, current) {
+				ds.compression.dict = d
+			}
+			return nil
+		})
+	})
+}
+
+// compress encodes m for a feed's log bucket, with the store's trained
+// dictionary if it has one.
+func (ds *DataStore) compress(m *SignedMessage) []byte {
+	ds.compression.lock.Lock()
+	d := ds.compression.dict
+	ds.compression.lock.Unlock()
+	if d == nil {
+		return m.Compress()
+	}
+	return d.compress(m.Encode())
+}
+
+// TrainDictionary trains a compression dictionary of up to size bytes on a
+// random sample of up to samples messages from the log, with defaults for
+// either when it is 0. If the dictionary compresses better than the store
+// does so far, it is used for new messages from then on, and Recompress
+// applies it to the stored ones.
+func (ds *DataStore) TrainDictionary(samples, size int) (DictionaryInfo, error) {
+	var info DictionaryInfo
+	if samples <= 0 {
+		samples = defaultTrainSamples
+	}
+	if size <= 0 || size > maxDictionary {
+		size = maxDictionary
+	}
+	sample := ds.sampleLog(samples)
+	if len(sample) < minTrainSamples {
+		return info, ErrTooFewMessages
+	}
+	// Every tenth message is held out of training to measure the
+	// dictionary on.
+	var train [][]byte
+	var held []*SignedMessage
+	for i, m := range sample {
+		if i%10 == 0 {
+			held = append(held, m)
+		} else {
+			train = append(train, m.Encode())
+		}
+	}
+	d := registerDictionary(trainDictionary(train, size))
+	info.ID, info.Size, info.Samples = d.id, len(d.data), len(sample)
+	for _, m := range held {
+		info.Before += int64(len(ds.compress(m)))
+		info.After += int64(len(d.compress(m.Encode())))
+	}
+	if info.After >= info.Before {
+		return info, ErrNoGain
+	}
+
+	err := ds.db.Update(func(tx storage.Tx) error {
+		CompressionBucket, err := tx.CreateBucketIfNotExists([]byte("compression"))
+		if err != nil {
+			return err
+		}
+		DictBucket, err := CompressionBucket.CreateBucketIfNotExists([]byte("dictionaries"))
+		if err != nil {
+			return err
+		}
+		var id [4]byte
+		binary.BigEndian.PutUint32(id[:], d.id)
+		if err = DictBucket.Put(id[:], d.data); err != nil {
+			return err
+		}
+		return CompressionBucket.Put([]byte("current"), id[:])
+	})
+	if err != nil {
+		return info, err
+	}
+	ds.compression.lock.Lock()
+	ds.compression.dict = d
+	ds.compression.lock.Unlock()
+	return info, nil
+}
+
+// sampleLog picks up to n messages from the log at random.
+func (ds *DataStore) sampleLog(n int) (sample []*SignedMessage) {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	seen := 0
+	ds.db.View(func(tx storage.Tx) error {
+		c := ds.log.Cursor(tx)
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			m := ds.LogEntry(tx, v)
+			if m == nil {
+				continue
+			}
+			seen++
+			if len(sample) < n {
+				sample = append(sample, m)
+			} else if i := r.Intn(seen); i < n {
+				sample[i] = m
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// trainDictionary builds a dictionary of at most size bytes from samples,
+// after the cover algorithm of zstd. The samples are split into epochs, and
+// from each the segment whose k-grams are found in the most samples is
+// picked. The k-grams of a picked segment then count for nothing, so later
+// segments cover something new.
+func trainDictionary(samples [][]byte, size int) []byte {
+	const k, segment = 8, 64
+	freq := map[string]int{}
+	for _, s := range samples {
+		seen := map[string]bool{}
+		for i := 0; i+k <= len(s); i++ {
+			if g := string(s[i : i+k]); !seen[g] {
+				seen[g] = true
+				freq[g]++
+			}
+		}
+	}
+	type pick struct {
+		data  []byte
+		score int
+	}
+	var picks []pick
+	epochs := size / segment
+	if epochs > len(samples) {
+		epochs = len(samples)
+	}
+	total := 0
+	for e := 0; e < epochs && total < size; e++ {
+		var best pick
+		for _, s := range samples[e*len(samples)/epochs : (e+1)*len(samples)/epochs] {
+			if len(s) < k {
+				continue
+			}
+			// score[i] is the worth of the k-gram at i, summed over a
+			// sliding window of the k-grams that fit in a segment.
+			grams := len(s) - k + 1
+			width := segment - k + 1
+			if width > grams {
+				width = grams
+			}
+			score := make([]int, grams)
+			for i := range score {
+				if n := freq[string(s[i:i+k])]; n > 1 {
+					score[i] = n
+				}
+			}
+			sum := 0
+			for i := 0; i < grams; i++ {
+				sum += score[i]
+				if i >= width {
+					sum -= score[i-width]
+				}
+				if i >= width-1 && sum > best.score {
+					start := i - width + 1
+					best = pick{s[start : start+width+k-1], sum}
+				}
+			}
+		}
+		if best.data == nil {
+			continue
+		}
+		for i := 0; i+k <= len(best.data); i++ {
+			delete(freq, string(best.data[i:i+k]))
+		}
+		picks = append(picks, best)
+		total += len(best.data)
+	}
+	// flate reaches the end of the dictionary with the shortest distances,
+	// so the best segments go last.
+	sort.SliceStable(picks, func(i, j int) bool {
+		return picks[i].score < picks[j].score
+	})
+	dict := make([]byte, 0, total)
+	for _, p := range picks {
+		dict = append(dict, p.data...)
+	}
+	if len(dict) > size {
+		dict = dict[len(dict)-size:]
+	}
+	return dict
+}
+
+// CompressionStats returns the progress of the last recompression.
+func (ds *DataStore) CompressionStats() CompressionStats {
+	ds.compression.lock.Lock()
+	defer ds.compression.lock.Unlock()
+	return ds.compression.stats
+}
+
+// Recompress starts rewriting the messages stored in feed buckets with the
+// current dictionary in the background, a bounded batch at a time, keeping
+// each entry that comes out smaller. Messages kept in an offset log are
+// left as they are.
+func (ds *DataStore) Recompress() error {
+	c := ds.compression
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.stats.Running {
+		return ErrRecompressing
+	}
+	if c.dict == nil {
+		return ErrNoDictionary
+	}
+	c.stats = CompressionStats{Dictionary: c.dict.id, Started: time.Now(), Running: true}
+	c.done.Add(1)
+	go c.run(c.dict)
+	return nil
+}
+
+func (c *compression) run(d *dictionary) {
+	defer c.done.Done()
+	var feed, seq []byte
+	for {
+		select {
+		case <-c.quit:
+			c.finish(nil)
+			return
+		default:
+		}
+		var st CompressionStats
+		err := c.ds.db.Update(func(tx storage.Tx) (err error) {
+			st = CompressionStats{}
+			feed, seq, err = c.batch(tx, d, feed, seq, &st)
+			return
+		})
+		c.lock.Lock()
+		c.stats.Entries += st.Entries
+		c.stats.Rewritten += st.Rewritten
+		c.stats.Before += st.Before
+		c.stats.After += st.After
+		c.lock.Unlock()
+		if err != nil || feed == nil {
+			c.finish(err)
+			return
+		}
+		time.Sleep(recompressPause)
+	}
+}
+
+func (c *compression) finish(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.stats.Running = false
+	if err != nil {
+		c.stats.Error = err.Error()
+		log.Println("Recompression failed:", err)
+		return
+	}
+	log.Printf("Recompressed %d of %d messages, saved %d bytes", c.stats.Rewritten, c.stats.Entries, c.stats.Saved())
+}
+
+// batch recompresses up to recompressBatch entries from seq in feed on, and
+// returns where the next batch starts, or a nil feed once every feed is
+// done.
+func (c *compression) batch(tx storage.Tx, d *dictionary, feed, seq []byte, st *CompressionStats) ([]byte, []byte, error) {
+	FeedsBucket := tx.Bucket([]byte("feeds"))
+	if FeedsBucket == nil {
+		return nil, nil, nil
+	}
+	fc := FeedsBucket.Cursor()
+	k, _ := fc.First()
+	if feed != nil {
+		// The feed may have been purged since the last batch.
+		if k, _ = fc.Seek(feed); !bytes.Equal(k, feed) {
+			seq = nil
+		}
+	}
+	for ; k != nil; k, _ = fc.Next() {
+		FeedBucket := FeedsBucket.Bucket(k)
+		if FeedBucket == nil {
+			seq = nil
+			continue
+		}
+		LogBucket := FeedBucket.Bucket([]byte("log"))
+		if LogBucket == nil {
+			seq = nil
+			continue
+		}
+		// Entries are put back once the cursor is done with the bucket,
+		// as bolt cursors do not survive writes.
+		type rewrite struct{ key, val []byte }
+		var rewrites []rewrite
+		lc := LogBucket.Cursor()
+		sk, v := lc.First()
+		if seq != nil {
+			sk, v = lc.Seek(seq)
+		}
+		for ; sk != nil && st.Entries < recompressBatch; sk, v = lc.Next() {
+			st.Entries++
+			if nv := recompressEntry(d, v); nv != nil {
+				rewrites = append(rewrites, rewrite{append([]byte(nil), sk...), nv})
+				st.Rewritten++
+				st.Before += int64(len(v))
+				st.After += int64(len(nv))
+			}
+		}
+		var next []byte
+		if sk != nil {
+			next = append([]byte(nil), sk...)
+		}
+		LogBucket.SetFillPercent(1)
+		for _, r := range rewrites {
+			if err := LogBucket.Put(r.key, r.val); err != nil {
+				return nil, nil, err
+			}
+		}
+		if next != nil {
+			return append([]byte(nil), k...), next, nil
+		}
+		seq = nil
+		if st.Entries >= recompressBatch {
+			if k, _ = fc.Next(); k == nil {
+				return nil, nil, nil
+			}
+			return append([]byte(nil), k...), nil, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+// recompressEntry returns entry compressed with d, or nil if it is not a
+// compressed message or would not come out smaller. The result is checked
+// to decode to the same message before it is used.
+func recompressEntry(d *dictionary, entry []byte) []byte {
+	if len(entry) == 0 || entry[0] == formatLogPointer && len(entry) == 9 {
+		return nil
+	}
+	if entry[0] == formatDict && len(entry) >= 5 && binary.BigEndian.Uint32(entry[1:5]) == d.id {
+		return nil
+	}
+	m := DecompressMessage(entry)
+	if m == nil {
+		return nil
+	}
+	buf := m.Encode()
+	nv := d.compress(buf)
+	if len(nv) >= len(entry) {
+		return nil
+	}
+	if check := DecompressMessage(nv); check == nil || !bytes.Equal(check.Encode(), buf) {
+		return nil
+	}
+	return nv
+}
@@ -0,0 +1,103 @@
+package ssb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/andyleap/go-ssb/storage"
+)
+
+func TestTrainRecompress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kp := newTestKey()
+	path := filepath.Join(dir, "feeds.db")
+
+	ds, err := OpenDataStore(path, kp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ds.TrainDictionary(0, 0); err != ErrTooFewMessages {
+		t.Errorf("trained on an empty log, %v", err)
+	}
+	f := ds.GetFeed(ds.PrimaryRef)
+	var keys []Ref
+	publish := func(n int) {
+		for i := 0; i < n; i++ {
+			var content map[string]interface{}
+			switch i % 3 {
+			case 0:
+				content = map[string]interface{}{"type": "post", "text": fmt.Sprintf("post number %d about the weather", i), "channel": "weather"}
+			case 1:
+				content = map[string]interface{}{"type": "vote", "vote": map[string]interface{}{"link": keys[len(keys)-1], "value": 1, "expression": "Like"}}
+			case 2:
+				content = map[string]interface{}{"type": "contact", "contact": ds.PrimaryRef, "following": true}
+			}
+			m, err := f.PublishMessage(content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys = append(keys, m.Key())
+		}
+	}
+	publish(300)
+
+	info, err := ds.TrainDictionary(0, 4096)
+	if err != nil {
+		t.Fatalf("training failed, %v: %+v", err, info)
+	}
+	if info.Size == 0 || info.Size > 4096 || info.After >= info.Before {
+		t.Errorf("trained %+v", info)
+	}
+	publish(30)
+	entry := func(seq int) (v []byte) {
+		ds.db.View(func(tx storage.Tx) error {
+			v = append(v, tx.Bucket([]byte("feeds")).Bucket(ds.PrimaryRef.DBKey()).Bucket([]byte("log")).Get(itob(seq))...)
+			return nil
+		})
+		return
+	}
+	if v := entry(1); v[0] != 2 {
+		t.Errorf("old message stored as format %d", v[0])
+	}
+	if v := entry(310); v[0] != formatDict {
+		t.Errorf("new message stored as format %d", v[0])
+	}
+
+	if err := ds.Recompress(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for ds.CompressionStats().Running {
+		if time.Now().After(deadline) {
+			t.Fatal("recompression did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	st := ds.CompressionStats()
+	if st.Error != "" || st.Entries != 330 || st.Rewritten != 300 || st.Saved() <= 0 {
+		t.Errorf("recompressed %+v", st)
+	}
+	if v := entry(1); v[0] != formatDict {
+		t.Errorf("recompressed message stored as format %d", v[0])
+	}
+	ds.Close()
+
+	ds, err = OpenDataStore(path, kp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	for i, key := range keys {
+		if m := ds.Get(nil, key); m == nil || m.Sequence != i+1 {
+			t.Fatalf("message %d reads back as %v", i+1, m)
+		}
+	}
+}
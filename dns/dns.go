@@ -3,9 +3,8 @@ package dns
 import (
 	"encoding/json"
 
-	"github.com/boltdb/bolt"
-
 	"github.com/andyleap/go-ssb"
+	"github.com/andyleap/go-ssb/storage"
 )
 
 type Record struct {
@@ -21,25 +20,39 @@ type DNS struct {
 	Branch []ssb.Ref `json:"branch"`
 }
 
-func init() {
-	ssb.MessageTypes["ssb-dns"] = func() interface{} { return &DNS{} }
-	ssb.RebuildClearHooks["dns"] = func(tx *bolt.Tx) error {
-		tx.DeleteBucket([]byte("dns"))
-	}
-	ssb.AddMessageHooks["dns"] = func(m *ssb.SignedMessage, tx *bolt.Tx) error {
-		_, mb := m.DecodeMessage()
-		if mbr, ok := mb.(*DNS); ok {
-			PubBucket, err := tx.CreateBucketIfNotExists([]byte("dns"))
-			if err != nil {
-				return err
+// Module indexes the DNS records published in messages.
+var Module = &ssb.Module{
+	Name: "dns",
+	MessageTypes: map[string]func(mb ssb.MessageBody) interface{}{
+		"ssb-dns": func(mb ssb.MessageBody) interface{} { return &DNS{MessageBody: mb} },
+	},
+	Index: &ssb.Index{
+		Add: func(ds *ssb.DataStore, m *ssb.SignedMessage, tx storage.Tx) error {
+			_, mb := ds.DecodeMessage(m)
+			if mbr, ok := mb.(*DNS); ok {
+				PubBucket, err := tx.CreateBucketIfNotExists([]byte("dns"))
+				if err != nil {
+					return err
+				}
+				buf, _ := json.Marshal(mbr)
+				err = PubBucket.Put(m.Key().DBKey(), buf)
+				if err != nil {
+					return err
+				}
+				return nil
 			}
-			buf, _ := json.Marshal(mbr)
-			err = PubBucket.Put([]byte(m.Key()), buf)
-			if err != nil {
-				return err
+			return nil
+		},
+		Remove: func(ds *ssb.DataStore, m *ssb.SignedMessage, tx storage.Tx) error {
+			if PubBucket := tx.Bucket([]byte("dns")); PubBucket != nil {
+				return PubBucket.Delete(m.Key().DBKey())
 			}
 			return nil
-		}
-		return nil
-	}
+		},
+		Clear: func(tx storage.Tx) error {
+			tx.DeleteBucket([]byte("dns"))
+			return nil
+		},
+	},
+	Buckets: []string{"dns"},
 }
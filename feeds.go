@@ -1,15 +1,19 @@
 package ssb
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"sync"
 	"time"
 
 	"cryptoscope.co/go/secretstream/secrethandshake"
-	"github.com/boltdb/bolt"
+	"github.com/andyleap/go-ssb/storage"
 	"golang.org/x/crypto/ed25519"
 )
 
@@ -23,91 +27,88 @@ func btoi(b []byte) int {
 	return int(binary.BigEndian.Uint64(b))
 }
 
-var initMethods = []func(ds *DataStore){}
-
-func RegisterInit(f func(ds *DataStore)) {
-	initMethods = append(initMethods, f)
-}
-
 type DataStore struct {
-	db *bolt.DB
+	db  storage.DB
+	log storage.Log
+
+	// primaryLog is set when the global log holds the messages themselves
+	// rather than keys into the per-feed buckets.
+	primaryLog bool
 
 	feedlock sync.Mutex
 	feeds    map[Ref]*Feed
 
+	ingest *ingest
+
+	compression *compression
+
+	// sealer is set when the store is sealed, see WithPassphrase.
+	sealer *storage.Sealer
+
+	indexer *indexer
+
+	stats statsCache
+
 	Topic *MessageTopic
 
 	PrimaryKey *secrethandshake.EdKeyPair
 	PrimaryRef Ref
 
-	extraData     map[string]interface{}
-	extraDataLock sync.Mutex
+	modules      map[string]*Module
+	moduleOrder  []*Module
+	messageTypes map[string]func(mb MessageBody) interface{}
+	indexNames   []string
 
-	Keys map[Ref]Signer
-}
+	methods     map[string]interface{}
+	methodsLock sync.Mutex
 
-func init() {
-	RegisterInit(func(ds *DataStore) {
-		ds.RegisterMethod("feed.Publish", func(feed Ref, message interface{}) error {
-			return ds.GetFeed(feed).PublishMessage(message)
-		})
-		ds.RegisterMethod("feed.Latest", func(feed Ref) *SignedMessage {
-			return ds.GetFeed(feed).Latest()
-		})
-	})
-	/*AddMessageHooks["recompress"] = func(m *SignedMessage, tx *bolt.Tx) error {
-		FeedsBucket, err := tx.CreateBucketIfNotExists([]byte("feeds"))
-		if err != nil {
-			return err
-		}
-		FeedBucket, err := FeedsBucket.CreateBucketIfNotExists(m.Author.DBKey())
-		if err != nil {
-			return err
-		}
-		FeedLogBucket, err := FeedBucket.CreateBucketIfNotExists([]byte("log"))
-		if err != nil {
-			return err
-		}
-		FeedLogBucket.FillPercent = 1
-		buf := m.Compress()
-		err = FeedLogBucket.Put(itob(m.Sequence), buf)
-		if err != nil {
-			return err
-		}
-		return nil
-	}*/
-}
+	values     map[interface{}]interface{}
+	backupDirs map[string]string
+	valuesLock sync.Mutex
 
-func (ds *DataStore) RegisterMethod(name string, method interface{}) {
-	RPCMethods, ok := ds.ExtraData("RPCMethods").(map[string]interface{})
-	if !ok {
-		RPCMethods = map[string]interface{}{}
-	}
-	RPCMethods[name] = method
-	ds.SetExtraData("RPCMethods", RPCMethods)
+	// Keys holds the local identities, the primary one and those of the
+	// keystore, under keysLock.
+	Keys     map[Ref]Signer
+	keysLock sync.RWMutex
+	keystore string
 }
 
-func (ds *DataStore) ExtraData(name string) interface{} {
-	ds.extraDataLock.Lock()
-	defer ds.extraDataLock.Unlock()
-	return ds.extraData[name]
+func (ds *DataStore) registerFeedMethods() {
+	ds.RegisterMethod("feed.Publish", func(feed Ref, message interface{}) (*SignedMessage, error) {
+		return ds.GetFeed(feed).PublishMessage(message)
+	})
+	ds.RegisterMethod("feed.PublishPrivate", func(feed Ref, message interface{}, recps []Ref) (*SignedMessage, error) {
+		return ds.GetFeed(feed).PublishPrivateMessage(message, recps)
+	})
+	ds.RegisterMethod("feed.Latest", func(feed Ref) *SignedMessage {
+		return ds.GetFeed(feed).Latest()
+	})
 }
 
-func (ds *DataStore) SetExtraData(name string, data interface{}) {
-	ds.extraDataLock.Lock()
-	defer ds.extraDataLock.Unlock()
-	ds.extraData[name] = data
+func (ds *DataStore) DB() storage.DB {
+	return ds.db
 }
 
-func (ds *DataStore) DB() *bolt.DB {
-	return ds.db
+// Log returns the global log, which records every message in the order it
+// was received.
+func (ds *DataStore) Log() storage.Log {
+	return ds.log
 }
 
 func (ds *DataStore) Close() {
+	ds.ingest.stop()
+	ds.indexer.stop()
+	ds.compression.stop()
 	err := ds.db.Close()
 	if err != nil {
 		log.Println("error closing db:", err)
 	}
+	if c, ok := ds.log.(io.Closer); ok {
+		err = c.Close()
+		if err != nil {
+			log.Println("error closing log:", err)
+		}
+	}
 }
 
 type Feed struct {
@@ -118,11 +119,23 @@ type Feed struct {
 	LatestSeq int
 	SeqLock   sync.Mutex
 
-	addChan chan *SignedMessage
+	// latestKey and latestTimestamp are those of the message at
+	// LatestSeq, kept under SeqLock so the next message can be checked
+	// without reading the store.
+	latestKey       Ref
+	latestTimestamp float64
+
+	// forked is set, under SeqLock, once a fork proof is stored for the
+	// feed.
+	forked bool
+
+	// purged is set, under SeqLock, while the feed is blocked after a
+	// purge.
+	purged bool
 
-	waiting       map[int]*SignedMessage
-	waitingLock   sync.Mutex
-	waitingSignal *sync.Cond
+	waiting      map[int]waitingMessage
+	waitingLock  sync.Mutex
+	gapRequested time.Time
 }
 
 type Pointer struct {
@@ -146,25 +159,86 @@ func (p *Pointer) Unmarshal(buf []byte) {
 	copy(p.Author, buf[16:])
 }
 
-func OpenDataStore(path string, primaryKey *secrethandshake.EdKeyPair) (*DataStore, error) {
-	db, err := bolt.Open(path, 0600, nil)
+// OpenDataStore opens the DataStore kept in the bolt database at path,
+// with the modules and other options given.
+func OpenDataStore(path string, primaryKey *secrethandshake.EdKeyPair, opts ...Option) (*DataStore, error) {
+	db, err := storage.OpenBolt(path, 0600)
 	if err != nil {
 		return nil, err
 	}
+	return NewDataStore(db, storage.NewBucketLog("log"), primaryKey, opts...)
+}
+
+// NewDataStore builds a DataStore on top of an already opened storage
+// backend, such as storage.NewMemory() for tests.
+func NewDataStore(db storage.DB, log storage.Log, primaryKey *secrethandshake.EdKeyPair, opts ...Option) (*DataStore, error) {
+	return newDataStore(db, log, false, primaryKey, opts)
+}
+
+func newDataStore(db storage.DB, log storage.Log, primaryLog bool, primaryKey *secrethandshake.EdKeyPair, opts []Option) (*DataStore, error) {
 	ds := &DataStore{
-		db:        db,
-		feeds:     map[Ref]*Feed{},
-		Topic:     NewMessageTopic(),
-		extraData: map[string]interface{}{},
-		Keys:      map[Ref]Signer{},
+		db:           db,
+		log:          log,
+		primaryLog:   primaryLog,
+		feeds:        map[Ref]*Feed{},
+		Topic:        NewMessageTopic(),
+		modules:      map[string]*Module{},
+		messageTypes: map[string]func(mb MessageBody) interface{}{},
+		methods:      map[string]interface{}{},
+		values:       map[interface{}]interface{}{},
+		backupDirs:   map[string]string{},
+		Keys:         map[Ref]Signer{},
 	}
 	ds.PrimaryKey = primaryKey
 	ds.PrimaryRef, _ = NewRef(RefFeed, ds.PrimaryKey.Public[:], RefAlgoEd25519)
 	ds.Keys[ds.PrimaryRef] = &SignerEd25519{ed25519.PrivateKey(ds.PrimaryKey.Secret[:])}
+	ds.ingest = newIngest(ds)
+	ds.indexer = newIndexer(ds)
+	ds.compression = newCompression(ds)
+
+	ds.registerFeedMethods()
+	ds.registerForkMethods()
+	ds.registerIngestMethods()
+	ds.registerLogMethods()
+	ds.registerRebuildMethods()
+	ds.registerPurgeMethods()
+	ds.registerBackupMethods()
+	ds.registerCompressionMethods()
+	ds.registerStatsMethods()
+	ds.registerFsckMethods()
+	ds.registerIdentityMethods()
 
-	for _, im := range initMethods {
-		im(ds)
+	var err error
+	for _, opt := range opts {
+		if err = opt(ds); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = ds.checkSealed()
 	}
+	if err == nil {
+		err = ds.loadIdentities()
+	}
+	if err == nil {
+		err = ds.loadDictionaries()
+	}
+	if err == nil {
+		err = ds.initModules()
+	}
+	if err == nil {
+		err = ds.checkIndexes()
+	}
+	if err == nil && primaryLog {
+		err = ds.replayLog()
+	}
+	if err != nil {
+		ds.Close()
+		return nil, err
+	}
+	// Indexes catch up with the log in the background, from wherever
+	// each was left.
+	ds.indexer.start()
 
 	return ds, nil
 }
@@ -179,37 +253,41 @@ func (ds *DataStore) GetFeed(feedID Ref) *Feed {
 		return nil
 	}
 	feed := &Feed{
-		store:         ds,
-		ID:            feedID,
-		Topic:         NewMessageTopic(),
-		addChan:       make(chan *SignedMessage, 10),
-		waiting:       map[int]*SignedMessage{},
-		waitingSignal: sync.NewCond(&sync.Mutex{}),
-	}
-	go func() {
-		for m := range feed.addChan {
-			feed.waitingLock.Lock()
-			feed.SeqLock.Lock()
-			if m.Sequence > feed.LatestSeq {
-				feed.waiting[m.Sequence] = m
-			}
-			feed.SeqLock.Unlock()
-			feed.waitingLock.Unlock()
-			feed.waitingSignal.Broadcast()
-		}
-	}()
-	go feed.processMessageQueue()
-	m := feed.Latest()
-	if m != nil {
-		feed.LatestSeq = m.Sequence
-	}
+		store:   ds,
+		ID:      feedID,
+		Topic:   NewMessageTopic(),
+		waiting: map[int]waitingMessage{},
+	}
+	feed.loadHead()
+	ds.db.View(func(tx storage.Tx) error {
+		feed.forked = ds.forked(tx, feedID)
+		feed.purged = ds.purged(tx, feedID)
+		return nil
+	})
 
 	feed.Topic.Register(ds.Topic.Send, true)
 	ds.feeds[feedID] = feed
 	return feed
 }
 
-func (ds *DataStore) Get(tx *bolt.Tx, post Ref) (m *SignedMessage) {
+// Feeds returns every feed that has messages in the store.
+func (ds *DataStore) Feeds() (feeds []Ref) {
+	ds.db.View(func(tx storage.Tx) error {
+		FeedsBucket := tx.Bucket([]byte("feeds"))
+		if FeedsBucket == nil {
+			return nil
+		}
+		return FeedsBucket.ForEach(func(k, v []byte) error {
+			if FeedBucket := FeedsBucket.Bucket(k); FeedBucket != nil && FeedBucket.Bucket([]byte("log")) != nil {
+				feeds = append(feeds, DBRef(k))
+			}
+			return nil
+		})
+	})
+	return
+}
+
+func (ds *DataStore) Get(tx storage.Tx, post Ref) (m *SignedMessage) {
 	var err error
 	if tx == nil {
 		tx, err = ds.db.Begin(false)
@@ -244,133 +322,115 @@ func (ds *DataStore) Get(tx *bolt.Tx, post Ref) (m *SignedMessage) {
 	if msgdata == nil {
 		return
 	}
-	m = DecompressMessage(msgdata)
+	m = ds.decodeEntry(tx, msgdata)
+	loadPrivate(tx, m)
 	return
 }
 
-func GetMsg(tx *bolt.Tx, post Ref) (m *SignedMessage) {
-	PointerBucket := tx.Bucket([]byte("pointer"))
-	if PointerBucket == nil {
-		return
+// unbox decrypts m if it is addressed to one of our identities and keeps the
+// plaintext in the private bucket so it can be read back later.
+func (ds *DataStore) unbox(tx storage.Tx, m *SignedMessage) error {
+	if m == nil || m.Private != nil {
+		return nil
 	}
-	pdata := PointerBucket.Get(post.DBKey())
-	if pdata == nil {
-		return
+	content, ok := ds.Unbox(m)
+	if !ok {
+		return nil
 	}
-	p := Pointer{}
-	p.Unmarshal(pdata)
-	FeedsBucket := tx.Bucket([]byte("feeds"))
-	if FeedsBucket == nil {
-		return
+	m.Private = content
+	PrivateBucket, err := tx.CreateBucketIfNotExists([]byte("private"))
+	if err != nil {
+		return err
 	}
-	FeedBucket := FeedsBucket.Bucket(p.Author)
-	if FeedBucket == nil {
+	return PrivateBucket.Put(m.Key().DBKey(), content)
+}
+
+func loadPrivate(tx storage.Tx, m *SignedMessage) {
+	if m == nil || !m.IsBoxed() {
 		return
 	}
-	LogBucket := FeedBucket.Bucket([]byte("log"))
-	if LogBucket == nil {
+	PrivateBucket := tx.Bucket([]byte("private"))
+	if PrivateBucket == nil {
 		return
 	}
-	msgdata := LogBucket.Get(itob(p.Sequence))
-	if msgdata == nil {
-		return
+	if content := PrivateBucket.Get(m.Key().DBKey()); content != nil {
+		m.Private = append(json.RawMessage{}, content...)
 	}
-	m = DecompressMessage(msgdata)
-	return
 }
 
-var AddMessageHooks = map[string]func(m *SignedMessage, tx *bolt.Tx) error{}
-
+// AddMessage queues a message received for the feed to be verified and
+// stored once the messages before it are.
 func (f *Feed) AddMessage(m *SignedMessage) error {
-	if m != nil {
-		f.addChan <- m
+	if m != nil && m.Author == f.ID {
+		f.store.ingest.add(f, m)
 	}
 	return nil
 }
 
-func (f *Feed) processMessageQueue() {
-	for {
-		f.waitingSignal.L.Lock()
-		f.waitingSignal.Wait()
-		f.waitingSignal.L.Unlock()
-		newMsgs := []*SignedMessage{}
-		err := f.store.db.Update(func(tx *bolt.Tx) error {
-			f.waitingLock.Lock()
-			f.SeqLock.Lock()
-			defer func() {
-				f.SeqLock.Unlock()
-				f.waitingLock.Unlock()
-			}()
-			for {
-				m, ok := f.waiting[f.LatestSeq+1]
-				delete(f.waiting, f.LatestSeq+1)
-				if !ok {
-					break
-				}
+// head returns what is known of the feed's latest message, or nil if it
+// has none. The caller must hold SeqLock.
+func (f *Feed) head() *feedHead {
+	if f.LatestSeq == 0 {
+		return nil
+	}
+	return &feedHead{f.LatestSeq, f.latestKey, f.latestTimestamp}
+}
 
-				if m.Author != f.ID {
-					continue
-				}
-				if f.store.Get(nil, m.Key()) != nil {
-					continue
-				}
-				err := m.Verify(tx, f)
-				if err != nil {
-					//fmt.Println(err)
-					//fmt.Println((string(m.Message.Content)))
-					fmt.Print("-")
-					return err
-				}
-				err = f.addMessage(tx, m)
-				if err != nil {
-					fmt.Println("Bolt: ", err)
-					return err
-				}
+// setHead records m as the feed's latest message. The caller must hold
+// SeqLock.
+func (f *Feed) setHead(m *SignedMessage) {
+	f.LatestSeq = m.Sequence
+	f.latestKey = m.Key()
+	f.latestTimestamp = m.Timestamp
+}
 
-				f.LatestSeq = m.Sequence
-				fmt.Print("*")
-				newMsgs = append(newMsgs, m)
-			}
-			return nil
-		})
-		if err != nil {
-			continue
-		}
-		for _, m := range newMsgs {
-			f.Topic.Send <- m
-		}
+// loadHead reads the feed's latest message back from the store. The
+// caller must hold SeqLock.
+func (f *Feed) loadHead() {
+	f.LatestSeq, f.latestKey, f.latestTimestamp = 0, Ref{}, 0
+	if m := f.Latest(); m != nil {
+		f.setHead(m)
 	}
 }
 
-func (f *Feed) addMessage(tx *bolt.Tx, m *SignedMessage) error {
-	FeedsBucket, err := tx.CreateBucketIfNotExists([]byte("feeds"))
-	if err != nil {
-		return err
+func (f *Feed) addMessage(tx storage.Tx, m *SignedMessage) error {
+	if f.store.primaryLog {
+		seq, err := f.store.log.Append(tx, encodeLogRecord(m))
+		if err != nil {
+			return err
+		}
+		return f.store.index(tx, m, seq, logPointer(seq))
 	}
-	FeedBucket, err := FeedsBucket.CreateBucketIfNotExists(f.ID.DBKey())
+	seq, err := f.store.log.Append(tx, m.Key().DBKey())
 	if err != nil {
 		return err
 	}
-	FeedLogBucket, err := FeedBucket.CreateBucketIfNotExists([]byte("log"))
+	err = f.store.setReceived(tx, seq, receiveTime())
 	if err != nil {
 		return err
 	}
-	FeedLogBucket.FillPercent = 1
-	buf := m.Compress()
-	err = FeedLogBucket.Put(itob(m.Sequence), buf)
+	return f.store.index(tx, m, seq, f.store.compress(m))
+}
+
+// index records a message that is already in the global log at seq, storing
+// entry under its sequence in the feed's bucket, a pointer to it and its
+// plaintext if it is addressed to us. Module indexes pick the message up
+// from the log afterwards, in the indexer.
+func (ds *DataStore) index(tx storage.Tx, m *SignedMessage, seq int, entry []byte) error {
+	FeedsBucket, err := tx.CreateBucketIfNotExists([]byte("feeds"))
 	if err != nil {
 		return err
 	}
-	LogBucket, err := tx.CreateBucketIfNotExists([]byte("log"))
+	FeedBucket, err := FeedsBucket.CreateBucketIfNotExists(m.Author.DBKey())
 	if err != nil {
 		return err
 	}
-	LogBucket.FillPercent = 1
-	seq, err := LogBucket.NextSequence()
+	FeedLogBucket, err := FeedBucket.CreateBucketIfNotExists([]byte("log"))
 	if err != nil {
 		return err
 	}
-	err = LogBucket.Put(itob(int(seq)), m.Key().DBKey())
+	FeedLogBucket.SetFillPercent(1)
+	err = FeedLogBucket.Put(itob(m.Sequence), entry)
 	if err != nil {
 		return err
 	}
@@ -378,91 +438,23 @@ func (f *Feed) addMessage(tx *bolt.Tx, m *SignedMessage) error {
 	if err != nil {
 		return err
 	}
-	pointer := Pointer{Sequence: m.Sequence, LogKey: int(seq), Author: m.Author.DBKey()}
-	buf = pointer.Marshal()
-	err = PointerBucket.Put(m.Key().DBKey(), buf)
+	pointer := Pointer{Sequence: m.Sequence, LogKey: seq, Author: m.Author.DBKey()}
+	err = PointerBucket.Put(m.Key().DBKey(), pointer.Marshal())
 	if err != nil {
 		return err
 	}
-	for module, hook := range AddMessageHooks {
-		err = hook(m, tx)
-		if err != nil {
-			return fmt.Errorf("Bolt %s hook: %s", module, err)
-		}
-	}
-	return nil
-}
-
-var RebuildClearHooks = map[string]func(tx *bolt.Tx) error{}
-
-func (ds *DataStore) RebuildAll() {
-	log.Println("Starting rebuild of all indexes")
-	count := 0
-	ds.db.Update(func(tx *bolt.Tx) error {
-		for module, hook := range RebuildClearHooks {
-			err := hook(tx)
-			if err != nil {
-				return fmt.Errorf("Bolt %s hook: %s", module, err)
-			}
-		}
-
-		LogBucket, err := tx.CreateBucketIfNotExists([]byte("log"))
+	if ds.primaryLog {
+		err = ds.setIndexedOffset(tx, seq)
 		if err != nil {
 			return err
 		}
-		cursor := LogBucket.Cursor()
-		_, v := cursor.First()
-		for v != nil {
-			for module, hook := range AddMessageHooks {
-				err = hook(ds.Get(tx, DBRef(v)), tx)
-				if err != nil {
-					return fmt.Errorf("Bolt %s hook: %s", module, err)
-				}
-			}
-			count++
-			_, v = cursor.Next()
-		}
-		return nil
-	})
-	log.Println("Finished rebuild of all modules")
-	log.Println("Reindexed", count, "posts")
-}
-
-func (ds *DataStore) Rebuild(module string) {
-	log.Println("Starting rebuild of", module)
-	count := 0
-	ds.db.Update(func(tx *bolt.Tx) error {
-		if clear, ok := RebuildClearHooks[module]; ok {
-			err := clear(tx)
-			if err != nil {
-				return err
-			}
-		}
-
-		LogBucket, err := tx.CreateBucketIfNotExists([]byte("log"))
-		if err != nil {
-			return err
-		}
-		cursor := LogBucket.Cursor()
-		_, v := cursor.First()
-		for v != nil {
-			AddMessageHooks[module](ds.Get(tx, DBRef(v)), tx)
-			count++
-			_, v = cursor.Next()
-		}
-		return nil
-	})
-	log.Println("Finished rebuild of", module)
-	log.Println("Reindexed", count, "messages")
+	}
+	return ds.unbox(tx, m)
 }
 
 func (ds *DataStore) LatestCountFiltered(num int, start int, filter map[Ref]int) (msgs []*SignedMessage) {
-	ds.db.View(func(tx *bolt.Tx) error {
-		LogBucket := tx.Bucket([]byte("log"))
-		if LogBucket == nil {
-			return nil
-		}
-		cur := LogBucket.Cursor()
+	ds.db.View(func(tx storage.Tx) error {
+		cur := ds.log.Cursor(tx)
 		_, val := cur.Last()
 		for len(msgs) < num {
 			for i := 0; i < start; i++ {
@@ -474,7 +466,12 @@ func (ds *DataStore) LatestCountFiltered(num int, start int, filter map[Ref]int)
 			if val == nil {
 				break
 			}
-			msg := ds.Get(tx, DBRef(val))
+			msg := ds.LogEntry(tx, val)
+			if msg == nil {
+				// Erased by a purge.
+				_, val = cur.Prev()
+				continue
+			}
 
 			if _, ok := filter[msg.Author]; ok && msg.Type() != "" {
 				msgs = append(msgs, msg)
@@ -486,49 +483,111 @@ func (ds *DataStore) LatestCountFiltered(num int, start int, filter map[Ref]int)
 	return
 }
 
-func (f *Feed) PublishMessage(body interface{}) error {
-	content, _ := Encode(body)
+// PublishMessage signs body as the feed's next message and stores it,
+// returning the message that was published.
+func (f *Feed) PublishMessage(body interface{}) (*SignedMessage, error) {
+	return f.PublishMessageContext(context.Background(), body)
+}
 
-	m := &Message{
-		Author:    f.ID,
-		Timestamp: float64(time.Now().UnixNano() / int64(time.Millisecond)),
-		Hash:      "sha256",
-		Content:   content,
-		Sequence:  1,
+// PublishMessageContext is PublishMessage, giving up if ctx is done before
+// the message is stored.
+func (f *Feed) PublishMessageContext(ctx context.Context, body interface{}) (*SignedMessage, error) {
+	content, err := Encode(body)
+	if err != nil {
+		return nil, err
 	}
+	return f.publish(ctx, content)
+}
 
-	if l := f.Latest(); l != nil {
-		key := l.Key()
-		m.Previous = &key
-		m.Sequence = l.Sequence + 1
-		for m.Timestamp <= l.Timestamp {
-			m.Timestamp += 0.01
-		}
+// PublishPrivateMessage boxes body to recps, at most MaxRecipients of them,
+// and publishes the result. The publishing feed is not added implicitly,
+// include it in recps to be able to read the message back.
+func (f *Feed) PublishPrivateMessage(body interface{}, recps []Ref) (*SignedMessage, error) {
+	return f.PublishPrivateMessageContext(context.Background(), body, recps)
+}
+
+// PublishPrivateMessageContext is PublishPrivateMessage, giving up if ctx
+// is done before the message is stored.
+func (f *Feed) PublishPrivateMessageContext(ctx context.Context, body interface{}, recps []Ref) (*SignedMessage, error) {
+	content, err := Encode(body)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.Buffer{}
+	err = json.Compact(&buf, content)
+	if err != nil {
+		return nil, err
 	}
+	boxed, err := Box(buf.Bytes(), recps)
+	if err != nil {
+		return nil, err
+	}
+	content, _ = json.Marshal(boxed)
+	return f.publish(ctx, content)
+}
 
-	signer := f.store.Keys[f.ID]
+// publish stores content as the feed's next message. It is written
+// directly rather than through ingest, holding SeqLock until it is
+// committed so nothing else can take the sequence it was signed for.
+func (f *Feed) publish(ctx context.Context, content json.RawMessage) (*SignedMessage, error) {
+	signer := f.store.signer(f.ID)
 	if signer == nil {
-		return fmt.Errorf("Cannot sign message without signing key for feed")
+		return nil, fmt.Errorf("Cannot sign message without signing key for feed")
 	}
-	sm := m.Sign(signer)
-	c := f.Topic.Register(nil, true)
-	err := f.AddMessage(sm)
-	if err != nil {
-		return err
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
-	for newm := range c {
-		if newm.Key() == sm.Key() {
-			f.Topic.Unregister(c)
-			return nil
+	var sm *SignedMessage
+	locked := false
+	err := f.store.db.Update(func(tx storage.Tx) error {
+		f.SeqLock.Lock()
+		locked = true
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if f.forked {
+			return ErrFeedForked
+		}
+		if f.purged {
+			return ErrFeedPurged
 		}
+		m := &Message{
+			Author:    f.ID,
+			Timestamp: float64(time.Now().UnixNano() / int64(time.Millisecond)),
+			Hash:      "sha256",
+			Content:   content,
+			Sequence:  1,
+		}
+		if head := f.head(); head != nil {
+			key := head.Key
+			m.Previous = &key
+			m.Sequence = head.Sequence + 1
+			for m.Timestamp <= head.Timestamp {
+				m.Timestamp += 0.01
+			}
+		}
+		sm = m.Sign(signer)
+		if err := sm.Validate(); err != nil {
+			return err
+		}
+		return f.addMessage(tx, sm)
+	})
+	if err == nil {
+		f.setHead(sm)
 	}
-
-	return nil
+	if locked {
+		f.SeqLock.Unlock()
+	}
+	if err != nil {
+		return nil, err
+	}
+	f.Topic.Send <- sm
+	return sm, nil
 }
 
 func (f *Feed) Latest() (m *SignedMessage) {
-	f.store.db.View(func(tx *bolt.Tx) error {
+	f.store.db.View(func(tx storage.Tx) error {
 		FeedsBucket := tx.Bucket([]byte("feeds"))
 		if FeedsBucket == nil {
 			return nil
@@ -543,14 +602,15 @@ func (f *Feed) Latest() (m *SignedMessage) {
 		}
 		cur := FeedLogBucket.Cursor()
 		_, val := cur.Last()
-		m = DecompressMessage(val)
+		m = f.store.decodeEntry(tx, val)
+		loadPrivate(tx, m)
 		return nil
 	})
 	return
 }
 
 func (f *Feed) LatestCount(num int, start int) (msgs []*SignedMessage) {
-	f.store.db.View(func(tx *bolt.Tx) error {
+	f.store.db.View(func(tx storage.Tx) error {
 		FeedsBucket := tx.Bucket([]byte("feeds"))
 		if FeedsBucket == nil {
 			return nil
@@ -572,7 +632,8 @@ func (f *Feed) LatestCount(num int, start int) (msgs []*SignedMessage) {
 			if val == nil {
 				break
 			}
-			msg := DecompressMessage(val)
+			msg := f.store.decodeEntry(tx, val)
+			loadPrivate(tx, msg)
 			if msg.Type() != "" {
 				msgs = append(msgs, msg)
 			}
@@ -583,7 +644,7 @@ func (f *Feed) LatestCount(num int, start int) (msgs []*SignedMessage) {
 	return
 }
 
-func (f *Feed) GetSeq(tx *bolt.Tx, seq int) (m *SignedMessage) {
+func (f *Feed) GetSeq(tx storage.Tx, seq int) (m *SignedMessage) {
 	if tx == nil {
 		tx, _ = f.store.db.Begin(false)
 		defer tx.Rollback()
@@ -604,64 +665,122 @@ func (f *Feed) GetSeq(tx *bolt.Tx, seq int) (m *SignedMessage) {
 	if val == nil {
 		return nil
 	}
-	m = DecompressMessage(val)
+	m = f.store.decodeEntry(tx, val)
+	loadPrivate(tx, m)
 	return m
 }
 
 var ErrLogClosed = errors.New("LogClosed")
 
+// logSendTimeout is how long Log waits for its reader before giving up
+// and closing the channel.
+const logSendTimeout = time.Second
+
+// Log streams the feed's messages from seq onwards, then new messages as
+// they arrive if live is set. The channel is closed if it is not read for
+// a second.
 func (f *Feed) Log(seq int, live bool) chan *SignedMessage {
+	return f.log(context.Background(), seq, live, logSendTimeout)
+}
+
+// LogContext is Log, closing the channel early once ctx is done rather
+// than when it is not read. The caller must either read until the channel
+// is closed or cancel ctx.
+func (f *Feed) LogContext(ctx context.Context, seq int, live bool) chan *SignedMessage {
+	return f.log(ctx, seq, live, 0)
+}
+
+func (f *Feed) log(ctx context.Context, seq int, live bool, timeout time.Duration) chan *SignedMessage {
+	if seq < 1 {
+		seq = 1
+	}
 	c := make(chan *SignedMessage, 10)
 	go func() {
-		liveChan := make(chan *SignedMessage, 10)
+		defer close(c)
+		var notify chan *SignedMessage
 		if live {
-			f.Topic.Register(liveChan, false)
-		} else {
-			close(liveChan)
+			// Registered before reading so nothing committed in between
+			// is missed. Messages are only sent on the topic once they
+			// are stored, so each one is a hint to read again.
+			notify = f.Topic.Register(nil, false)
+			defer func() {
+				f.Topic.Unregister(notify)
+			}()
 		}
-		err := f.store.db.View(func(tx *bolt.Tx) error {
-			FeedsBucket := tx.Bucket([]byte("feeds"))
-			if FeedsBucket == nil {
-				return nil
-			}
-			FeedBucket := FeedsBucket.Bucket(f.ID.DBKey())
-			if FeedBucket == nil {
-				return nil
-			}
-			FeedLogBucket := FeedBucket.Bucket([]byte("log"))
-			if FeedLogBucket == nil {
-				return nil
+		for {
+			msgs, next, more, err := f.readLog(seq)
+			if err != nil {
+				return
 			}
-			err := FeedLogBucket.ForEach(func(k, v []byte) error {
-				m := DecompressMessage(v)
-				if m.Sequence < seq {
-					return nil
+			for _, m := range msgs {
+				var expired <-chan time.Time
+				if timeout > 0 {
+					expired = time.After(timeout)
 				}
-				seq = m.Sequence
 				select {
 				case c <- m:
-				case <-time.After(1000 * time.Millisecond):
-					close(c)
-					return ErrLogClosed
+				case <-expired:
+					return
+				case <-ctx.Done():
+					return
 				}
-				return nil
-			})
-			if err != nil {
-				return err
 			}
-			return nil
-		})
-		if err != nil {
-			return
-		}
-		for m := range liveChan {
-			if m.Sequence < seq {
+			seq = next
+			if more {
 				continue
 			}
-			seq = m.Sequence
-			c <- m
+			if notify == nil {
+				return
+			}
+			select {
+			case _, ok := <-notify:
+				if !ok {
+					// Dropped for falling behind, the next read
+					// catches up.
+					notify = f.Topic.Register(nil, false)
+				}
+			case <-ctx.Done():
+				return
+			}
 		}
-		close(c)
 	}()
 	return c
 }
+
+// readLog reads up to logStreamBatch of the feed's messages from seq, in a
+// transaction of its own so none is held while they are sent. It returns
+// the sequence to read from next, and whether messages were left over.
+// Entries that cannot be decoded are skipped.
+func (f *Feed) readLog(seq int) (msgs []*SignedMessage, next int, more bool, err error) {
+	next = seq
+	err = f.store.db.View(func(tx storage.Tx) error {
+		FeedsBucket := tx.Bucket([]byte("feeds"))
+		if FeedsBucket == nil {
+			return nil
+		}
+		FeedBucket := FeedsBucket.Bucket(f.ID.DBKey())
+		if FeedBucket == nil {
+			return nil
+		}
+		FeedLogBucket := FeedBucket.Bucket([]byte("log"))
+		if FeedLogBucket == nil {
+			return nil
+		}
+		cur := FeedLogBucket.Cursor()
+		for k, v := cur.Seek(itob(seq)); k != nil; k, v = cur.Next() {
+			if len(msgs) >= logStreamBatch {
+				more = true
+				break
+			}
+			next = btoi(k) + 1
+			m := f.store.decodeEntry(tx, v)
+			if m == nil {
+				continue
+			}
+			loadPrivate(tx, m)
+			msgs = append(msgs, m)
+		}
+		return nil
+	})
+	return
+}
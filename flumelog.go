@@ -0,0 +1,161 @@
+package ssb
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"cryptoscope.co/go/secretstream/secrethandshake"
+
+	"github.com/andyleap/go-ssb/storage"
+)
+
+// LogRecord is the form messages take in a flumedb log, as written by the
+// JS sbot.
+type LogRecord struct {
+	Key       Ref            `json:"key"`
+	Value     *SignedMessage `json:"value"`
+	Timestamp float64        `json:"timestamp"`
+}
+
+const formatLogPointer = 0
+
+// OpenFlumeDataStore opens a DataStore whose messages live in an
+// append-only offset log at logPath, with the bolt database at path only
+// holding indexes. Records in the log that are missing from the indexes,
+// for instance after a crash, are replayed on open.
+func OpenFlumeDataStore(path string, logPath string, primaryKey *secrethandshake.EdKeyPair, opts ...Option) (*DataStore, error) {
+	db, err := storage.OpenBolt(path, 0600)
+	if err != nil {
+		return nil, err
+	}
+	l, err := storage.OpenOffsetLog(logPath)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return newDataStore(db, l, true, primaryKey, opts)
+}
+
+func encodeLogRecord(m *SignedMessage) []byte {
+	buf, _ := json.Marshal(LogRecord{
+		Key:       m.Key(),
+		Value:     m,
+		Timestamp: float64(time.Now().UnixNano() / int64(time.Millisecond)),
+	})
+	return buf
+}
+
+func decodeLogRecord(buf []byte) *LogRecord {
+	var rec *LogRecord
+	if json.Unmarshal(buf, &rec) != nil || rec == nil || rec.Value == nil {
+		return nil
+	}
+	return rec
+}
+
+func logPointer(seq int) []byte {
+	return append([]byte{formatLogPointer}, itob(seq)...)
+}
+
+// logged reports whether the record at seq in a primary log is the one the
+// store points to for key. Records left by a transaction that did not
+// commit, and copies of a message already in the log, are not.
+func (ds *DataStore) logged(tx storage.Tx, key Ref, seq int) bool {
+	PointerBucket := tx.Bucket([]byte("pointer"))
+	if PointerBucket == nil {
+		return false
+	}
+	pdata := PointerBucket.Get(key.DBKey())
+	if pdata == nil {
+		return false
+	}
+	p := Pointer{}
+	p.Unmarshal(pdata)
+	return p.LogKey == seq
+}
+
+// decodeEntry reads a value from a feed's log bucket, which is either a
+// compressed message or a pointer into the global log.
+func (ds *DataStore) decodeEntry(tx storage.Tx, val []byte) *SignedMessage {
+	if len(val) == 0 {
+		return nil
+	}
+	if val[0] == formatLogPointer && len(val) == 9 {
+		rec := decodeLogRecord(ds.log.Get(tx, btoi(val[1:])))
+		if rec == nil {
+			return nil
+		}
+		return rec.Value
+	}
+	return DecompressMessage(val)
+}
+
+// LogEntry resolves a value read from a cursor over the global log to the
+// message it refers to.
+func (ds *DataStore) LogEntry(tx storage.Tx, val []byte) *SignedMessage {
+	if !ds.primaryLog {
+		return ds.Get(tx, DBRef(val))
+	}
+	rec := decodeLogRecord(val)
+	if rec == nil {
+		return nil
+	}
+	loadPrivate(tx, rec.Value)
+	return rec.Value
+}
+
+func (ds *DataStore) indexedOffset(tx storage.Tx) (int, bool) {
+	MetaBucket := tx.Bucket([]byte("flume"))
+	if MetaBucket == nil {
+		return 0, false
+	}
+	val := MetaBucket.Get([]byte("indexed"))
+	if val == nil {
+		return 0, false
+	}
+	return btoi(val), true
+}
+
+func (ds *DataStore) setIndexedOffset(tx storage.Tx, seq int) error {
+	MetaBucket, err := tx.CreateBucketIfNotExists([]byte("flume"))
+	if err != nil {
+		return err
+	}
+	return MetaBucket.Put([]byte("indexed"), itob(seq))
+}
+
+// replayLog indexes any records appended to the log after the last one
+// recorded in the indexes.
+func (ds *DataStore) replayLog() error {
+	count := 0
+	err := ds.db.Update(func(tx storage.Tx) error {
+		cursor := ds.log.Cursor(tx)
+		k, v := cursor.First()
+		if since, ok := ds.indexedOffset(tx); ok {
+			k, v = cursor.Seek(itob(since))
+			if k != nil && btoi(k) == since {
+				k, v = cursor.Next()
+			}
+		}
+		for ; k != nil; k, v = cursor.Next() {
+			rec := decodeLogRecord(v)
+			if rec == nil {
+				continue
+			}
+			if ds.Get(tx, rec.Value.Key()) != nil || ds.purged(tx, rec.Value.Author) {
+				continue
+			}
+			err := ds.index(tx, rec.Value, btoi(k), logPointer(btoi(k)))
+			if err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	if count > 0 {
+		log.Println("Replayed", count, "messages from log")
+	}
+	return err
+}
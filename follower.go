@@ -1,7 +1,39 @@
 package ssb
 
+import "context"
+
+// Follow calls handler with each of the feed's messages from seq onwards,
+// then with new messages as they arrive if live is set, until done is
+// closed.
 func (f *Feed) Follow(seq int, live bool, handler func(m *SignedMessage) error, done chan struct{}) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if done != nil {
+		go func() {
+			select {
+			case <-done:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+	err := f.FollowContext(ctx, seq, live, handler)
+	if err == context.Canceled {
+		return nil
+	}
+	return err
+}
+
+// FollowContext is Follow, stopping when ctx is done. It returns the first
+// error from handler, or the context's error if it stopped because of it.
+func (f *Feed) FollowContext(ctx context.Context, seq int, live bool, handler func(m *SignedMessage) error) error {
+	if seq < 1 {
+		seq = 1
+	}
 	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		f.SeqLock.Lock()
 		if f.LatestSeq >= seq {
 			f.SeqLock.Unlock()
@@ -13,26 +45,41 @@ func (f *Feed) Follow(seq int, live bool, handler func(m *SignedMessage) error,
 				}
 			}
 			seq++
-		} else {
-			if !live {
-				f.SeqLock.Unlock()
+			continue
+		}
+		if !live {
+			f.SeqLock.Unlock()
+			return nil
+		}
+		c := f.Topic.Register(nil, false)
+		f.SeqLock.Unlock()
+		err := f.followLive(ctx, c, &seq, handler)
+		f.Topic.Unregister(c)
+		if err != nil {
+			return err
+		}
+		// The topic dropped us for falling behind, catch up from the
+		// store before listening again.
+	}
+}
+
+func (f *Feed) followLive(ctx context.Context, c chan *SignedMessage, seq *int, handler func(m *SignedMessage) error) error {
+	for {
+		select {
+		case m, ok := <-c:
+			if !ok || m.Sequence > *seq {
 				return nil
 			}
-			c := f.Topic.Register(nil, false)
-			f.SeqLock.Unlock()
-			for {
-				select {
-				case m := <-c:
-					err := handler(m)
-					if err != nil {
-						return nil
-					}
-				case <-done:
-					f.Topic.Unregister(c)
-					return nil
-				}
+			if m.Sequence < *seq {
+				continue
 			}
-
+			err := handler(m)
+			if err != nil {
+				return err
+			}
+			*seq++
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
 }
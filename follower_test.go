@@ -0,0 +1,126 @@
+package ssb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/andyleap/go-ssb/storage"
+)
+
+func TestFollowContext(t *testing.T) {
+	ds := newTestStore(t)
+	defer ds.Close()
+	f := ds.GetFeed(ds.PrimaryRef)
+
+	var published []*SignedMessage
+	for i := 0; i < 3; i++ {
+		m, err := f.PublishMessage(map[string]interface{}{"type": "post", "text": "hello"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Sequence != i+1 || f.GetSeq(nil, m.Sequence).Key() != m.Key() {
+			t.Fatalf("published %d as sequence %d", i+1, m.Sequence)
+		}
+		published = append(published, m)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := f.PublishMessageContext(ctx, map[string]interface{}{"type": "post", "text": "late"}); err != context.Canceled {
+		t.Fatalf("publish with cancelled context returned %v", err)
+	}
+	if f.Latest().Sequence != 3 {
+		t.Fatalf("cancelled publish was stored")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	got := make(chan *SignedMessage, 10)
+	done := make(chan error)
+	go func() {
+		done <- f.FollowContext(ctx, 2, true, func(m *SignedMessage) error {
+			got <- m
+			return nil
+		})
+	}()
+	live, err := f.PublishMessage(map[string]interface{}{"type": "post", "text": "live"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []*SignedMessage{published[1], published[2], live} {
+		select {
+		case m := <-got:
+			if m.Key() != want.Key() {
+				t.Fatalf("followed sequence %d, expected %d", m.Sequence, want.Sequence)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for sequence %d", want.Sequence)
+		}
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("follow returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("follow did not stop when cancelled")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	n := 0
+	for range f.LogContext(ctx, 1, true) {
+		n++
+	}
+	if n != 4 {
+		t.Fatalf("log returned %d messages, expected 4", n)
+	}
+}
+
+func TestLogContextBatches(t *testing.T) {
+	ds := newTestStore(t)
+	defer ds.Close()
+	f := ds.GetFeed(ds.PrimaryRef)
+	count := logStreamBatch*2 + 5
+	for i := 0; i < count; i++ {
+		if _, err := f.PublishMessage(map[string]interface{}{"type": "post", "text": "hello"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// An entry that no longer decodes, as an erased or unknown one.
+	err := ds.db.Update(func(tx storage.Tx) error {
+		return tx.Bucket([]byte("feeds")).Bucket(f.ID.DBKey()).Bucket([]byte("log")).Put(itob(logStreamBatch), []byte("gone"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	live := f.LogContext(ctx, 0, true)
+	last := 0
+	for last < count {
+		select {
+		case m := <-live:
+			if m.Sequence <= last || m.Sequence == logStreamBatch {
+				t.Fatalf("log returned %d after %d", m.Sequence, last)
+			}
+			last = m.Sequence
+		case <-time.After(5 * time.Second):
+			t.Fatalf("log stopped at %d", last)
+		}
+	}
+	m, err := f.PublishMessage(map[string]interface{}{"type": "post", "text": "live"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-live:
+		if got.Key() != m.Key() {
+			t.Fatalf("live log returned %d", got.Sequence)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for live message")
+	}
+}
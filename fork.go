@@ -0,0 +1,169 @@
+package ssb
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+
+	"github.com/andyleap/go-ssb/storage"
+)
+
+var ErrFeedForked = errors.New("Feed is forked")
+
+// ForkProof is a pair of messages signed by the same author with the same
+// sequence, which shows that the author has forked their feed.
+type ForkProof struct {
+	Author   Ref               `json:"author"`
+	Sequence int               `json:"sequence"`
+	Messages [2]*SignedMessage `json:"messages"`
+}
+
+func (ds *DataStore) registerForkMethods() {
+	ds.RegisterMethod("feed.ForkProofs", func(feed Ref) []*ForkProof {
+		f := ds.GetFeed(feed)
+		if f == nil {
+			return nil
+		}
+		return f.ForkProofs(nil)
+	})
+}
+
+// addFork stores the proof carried by a fork error. Once a feed has a
+// proof stored it is treated as forked and no more of its messages are
+// accepted.
+func (ds *DataStore) addFork(tx storage.Tx, fork *ForkError) error {
+	ForksBucket, err := tx.CreateBucketIfNotExists([]byte("forks"))
+	if err != nil {
+		return err
+	}
+	FeedBucket, err := ForksBucket.CreateBucketIfNotExists(fork.Author.DBKey())
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(fork.ForkProof)
+	if err != nil {
+		return err
+	}
+	return FeedBucket.Put(itob(fork.Sequence), buf)
+}
+
+func (ds *DataStore) forked(tx storage.Tx, feed Ref) bool {
+	ForksBucket := tx.Bucket([]byte("forks"))
+	if ForksBucket == nil {
+		return false
+	}
+	return ForksBucket.Bucket(feed.DBKey()) != nil
+}
+
+func forkProofs(b storage.Bucket) (proofs []*ForkProof) {
+	b.ForEach(func(k, v []byte) error {
+		var proof *ForkProof
+		if json.Unmarshal(v, &proof) == nil && proof != nil {
+			proofs = append(proofs, proof)
+		}
+		return nil
+	})
+	return
+}
+
+// ForkProofs returns the proofs of every forked feed.
+func (ds *DataStore) ForkProofs(tx storage.Tx) (proofs []*ForkProof) {
+	if tx == nil {
+		var err error
+		tx, err = ds.db.Begin(false)
+		if err != nil {
+			return
+		}
+		defer tx.Rollback()
+	}
+	ForksBucket := tx.Bucket([]byte("forks"))
+	if ForksBucket == nil {
+		return
+	}
+	ForksBucket.ForEach(func(k, v []byte) error {
+		if FeedBucket := ForksBucket.Bucket(k); FeedBucket != nil {
+			proofs = append(proofs, forkProofs(FeedBucket)...)
+		}
+		return nil
+	})
+	return
+}
+
+// ForkProofs returns the proofs that the feed has been forked, if any.
+func (f *Feed) ForkProofs(tx storage.Tx) (proofs []*ForkProof) {
+	if tx == nil {
+		var err error
+		tx, err = f.store.db.Begin(false)
+		if err != nil {
+			return
+		}
+		defer tx.Rollback()
+	}
+	ForksBucket := tx.Bucket([]byte("forks"))
+	if ForksBucket == nil {
+		return
+	}
+	FeedBucket := ForksBucket.Bucket(f.ID.DBKey())
+	if FeedBucket == nil {
+		return
+	}
+	return forkProofs(FeedBucket)
+}
+
+// Forked reports whether the feed's author has been caught forking it, in
+// which case no more messages are accepted for it.
+func (f *Feed) Forked() bool {
+	f.SeqLock.Lock()
+	defer f.SeqLock.Unlock()
+	return f.forked
+}
+
+func (f *Feed) markForked(fork *ForkError) {
+	log.Println(fork)
+	f.SeqLock.Lock()
+	f.forked = true
+	f.SeqLock.Unlock()
+}
+
+// forkWaiting stores a fork proof for two different messages with the same
+// sequence that arrived before it was stored, and marks the feed forked.
+func (f *Feed) forkWaiting(m1, m2 *SignedMessage) {
+	fork := &ForkError{ForkProof{
+		Author:   m1.Author,
+		Sequence: m1.Sequence,
+		Messages: [2]*SignedMessage{m1, m2},
+	}}
+	err := f.store.db.Update(func(tx storage.Tx) error {
+		return f.store.addFork(tx, fork)
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	f.markForked(fork)
+}
+
+// checkFork looks at a message for a sequence that is already stored,
+// keeping it as a fork proof if it conflicts with the stored message.
+func (f *Feed) checkFork(m *SignedMessage) {
+	existing := f.GetSeq(nil, m.Sequence)
+	if existing == nil || existing.Key() == m.Key() {
+		return
+	}
+	var fork *ForkError
+	err := f.store.db.Update(func(tx storage.Tx) error {
+		err := m.Verify(tx, f)
+		if fe, ok := err.(*ForkError); ok {
+			fork = fe
+			return f.store.addFork(tx, fe)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if fork != nil {
+		f.markForked(fork)
+	}
+}
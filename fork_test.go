@@ -0,0 +1,84 @@
+package ssb
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/andyleap/go-ssb/storage"
+)
+
+func TestVerifyErrors(t *testing.T) {
+	ds := newTestStore(t)
+	defer ds.Close()
+	f := ds.GetFeed(ds.PrimaryRef)
+	signer := ds.Keys[ds.PrimaryRef]
+
+	sign := func(seq int, previous *SignedMessage, text string) *SignedMessage {
+		m := &Message{
+			Author:    f.ID,
+			Sequence:  seq,
+			Timestamp: float64(seq),
+			Hash:      "sha256",
+			Content:   json.RawMessage(`{"type":"post","text":"` + text + `"}`),
+		}
+		if previous != nil {
+			key := previous.Key()
+			m.Previous = &key
+		}
+		return m.Sign(signer)
+	}
+	first := sign(1, nil, "first")
+	second := sign(2, first, "second")
+	conflicting := sign(2, first, "conflicting")
+	err := ds.db.Update(func(tx storage.Tx) error {
+		if err := ds.importMessage(tx, first); err != nil {
+			return err
+		}
+		return ds.importMessage(tx, second)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ds.db.View(func(tx storage.Tx) error {
+		if _, ok := second.Verify(tx, f).(*RepeatedMessageError); !ok {
+			t.Error("expected RepeatedMessageError")
+		}
+		if _, ok := sign(3, first, "third").Verify(tx, f).(*OutOfOrderError); !ok {
+			t.Error("expected OutOfOrderError")
+		}
+		forged := *sign(3, second, "third")
+		forged.Signature = conflicting.Signature
+		forged.raw = nil
+		if _, ok := forged.Verify(tx, f).(*SignatureError); !ok {
+			t.Error("expected SignatureError")
+		}
+		if err := sign(3, second, "third").Verify(tx, f); err != nil {
+			t.Errorf("unexpected error %s", err)
+		}
+		fork, ok := conflicting.Verify(tx, f).(*ForkError)
+		if !ok || fork.Messages[0].Key() != second.Key() || fork.Messages[1].Key() != conflicting.Key() {
+			t.Errorf("expected ForkError, got %v", fork)
+		}
+		return nil
+	})
+
+	f.checkFork(conflicting)
+	if !f.Forked() {
+		t.Fatal("feed not marked forked")
+	}
+	proofs := ds.ForkProofs(nil)
+	if len(proofs) != 1 || proofs[0].Sequence != 2 || proofs[0].Messages[1].Key() != conflicting.Key() {
+		t.Fatalf("unexpected proofs %v", proofs)
+	}
+	err = proofs[0].Messages[1].Verify(nil, f)
+	if _, ok := err.(*ForkError); !ok {
+		t.Errorf("stored proof does not verify as a fork: %v", err)
+	}
+	err = ds.db.Update(func(tx storage.Tx) error {
+		return ds.importMessage(tx, sign(3, second, "third"))
+	})
+	if err != ErrFeedForked {
+		t.Errorf("expected ErrFeedForked, got %v", err)
+	}
+}
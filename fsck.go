@@ -0,0 +1,338 @@
+package ssb
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/andyleap/go-ssb/storage"
+)
+
+// maxFsckProblems bounds how many problems a report lists, a badly broken
+// store would otherwise produce one for nearly every message.
+const maxFsckProblems = 1000
+
+// FsckProblem is an inconsistency found in a store.
+type FsckProblem struct {
+	Feed     Ref    `json:"feed,omitempty"`
+	Sequence int    `json:"sequence,omitempty"`
+	Problem  string `json:"problem"`
+	Repaired bool   `json:"repaired,omitempty"`
+}
+
+func (p FsckProblem) String() string {
+	s := p.Problem
+	if p.Feed.Type != RefInvalid {
+		s = fmt.Sprintf("%s %d: %s", p.Feed, p.Sequence, s)
+	}
+	if p.Repaired {
+		s += " (repaired)"
+	}
+	return s
+}
+
+// FsckReport is what Fsck checked and found. More counts the problems
+// found beyond those listed.
+type FsckReport struct {
+	Feeds      int           `json:"feeds"`
+	Messages   int           `json:"messages"`
+	Pointers   int           `json:"pointers"`
+	LogEntries int           `json:"logEntries"`
+	Erased     int           `json:"erased"`
+	Problems   []FsckProblem `json:"problems"`
+	More       int           `json:"more,omitempty"`
+}
+
+// OK reports whether the store was found coherent, or has been repaired.
+func (r FsckReport) OK() bool {
+	if r.More > 0 {
+		return false
+	}
+	for _, p := range r.Problems {
+		if !p.Repaired {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *FsckReport) problem(feed Ref, seq int, repaired bool, format string, args ...interface{}) {
+	if len(r.Problems) >= maxFsckProblems {
+		r.More++
+		return
+	}
+	r.Problems = append(r.Problems, FsckProblem{feed, seq, fmt.Sprintf(format, args...), repaired})
+}
+
+func (ds *DataStore) registerFsckMethods() {
+	ds.RegisterMethod("storage.Check", ds.Fsck)
+}
+
+// Fsck checks that the store is coherent: the database file itself, that
+// every feed is an unbroken chain of correctly signed messages, that the
+// pointer to each message matches where it is stored, and that every entry
+// in the global log is stored in its feed. The feed heads kept in memory
+// are reloaded from the store as it goes.
+//
+// With repair set, pointers that are wrong, missing or left over are
+// rewritten from the feeds. Broken chains are only reported, as fixing
+// them means dropping messages.
+func (ds *DataStore) Fsck(repair bool) (FsckReport, error) {
+	var r FsckReport
+	run := ds.db.View
+	if repair {
+		run = ds.db.Update
+	}
+	err := run(func(tx storage.Tx) error {
+		c := &fsck{ds: ds, tx: tx, r: &r, repair: repair, fixes: map[string][]byte{}, missing: map[string]Pointer{}}
+		return c.run()
+	})
+	if err != nil {
+		return r, err
+	}
+
+	feeds := ds.Feeds()
+	ds.feedlock.Lock()
+	for id := range ds.feeds {
+		feeds = append(feeds, id)
+	}
+	ds.feedlock.Unlock()
+	seen := map[Ref]bool{}
+	for _, id := range feeds {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		f := ds.GetFeed(id)
+		if f == nil {
+			continue
+		}
+		f.SeqLock.Lock()
+		before := f.LatestSeq
+		f.loadHead()
+		if f.LatestSeq != before {
+			r.problem(id, before, true, "head was out of date, the store has up to %d", f.LatestSeq)
+		}
+		f.SeqLock.Unlock()
+	}
+	return r, nil
+}
+
+// fsck is a check of a store in a single transaction.
+type fsck struct {
+	ds     *DataStore
+	tx     storage.Tx
+	r      *FsckReport
+	repair bool
+
+	// fixes holds the pointers to write, or nil ones to delete, once the
+	// walk is done, as bolt cursors do not survive writes. They are kept
+	// when not repairing too, so each problem is only reported once.
+	fixes         map[string][]byte
+	pointerBucket storage.Bucket
+
+	// missing holds the pointers missing for messages of a store whose
+	// feeds do not record their log keys, until the log walk finds them.
+	missing map[string]Pointer
+}
+
+func (c *fsck) run() error {
+	if checker, ok := c.tx.(storage.Checker); ok {
+		for err := range checker.Check() {
+			c.r.problem(Ref{}, 0, false, "database: %s", err)
+		}
+	}
+	c.pointerBucket = c.tx.Bucket([]byte("pointer"))
+	if c.repair {
+		var err error
+		if c.pointerBucket, err = c.tx.CreateBucketIfNotExists([]byte("pointer")); err != nil {
+			return err
+		}
+	}
+	if FeedsBucket := c.tx.Bucket([]byte("feeds")); FeedsBucket != nil {
+		err := FeedsBucket.ForEach(func(author, v []byte) error {
+			if v != nil {
+				return nil
+			}
+			c.r.Feeds++
+			if LogBucket := FeedsBucket.Bucket(author).Bucket([]byte("log")); LogBucket != nil {
+				c.feed(DBRef(author), LogBucket)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if c.pointerBucket != nil {
+		c.pointers()
+	}
+	c.log()
+	for _, p := range c.missing {
+		c.r.problem(DBRef(p.Author), p.Sequence, false, "message has no pointer, nor an entry in the log")
+	}
+
+	if !c.repair {
+		return nil
+	}
+	for k, pointer := range c.fixes {
+		var err error
+		if pointer == nil {
+			err = c.pointerBucket.Delete([]byte(k))
+		} else {
+			err = c.pointerBucket.Put([]byte(k), pointer)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fix queues the pointer under key to be rewritten, or deleted if pointer
+// is nil, and reports whether it will be.
+func (c *fsck) fix(key, pointer []byte) bool {
+	c.fixes[string(key)] = pointer
+	return c.repair
+}
+
+// pointer returns the pointer stored under key, if any.
+func (c *fsck) pointer(key []byte) *Pointer {
+	if c.pointerBucket == nil {
+		return nil
+	}
+	pdata := c.pointerBucket.Get(key)
+	if pdata == nil {
+		return nil
+	}
+	var p Pointer
+	p.Unmarshal(pdata)
+	return &p
+}
+
+// feed checks the chain of messages in a feed's log bucket, and the
+// pointer to each.
+func (c *fsck) feed(feed Ref, LogBucket storage.Bucket) {
+	r := c.r
+	var head *feedHead
+	LogBucket.ForEach(func(k, v []byte) error {
+		seq := btoi(k)
+		r.Messages++
+		m := c.ds.decodeEntry(c.tx, v)
+		if m == nil {
+			r.problem(feed, seq, false, "message cannot be read")
+			head = nil
+			return nil
+		}
+		if m.Author != feed || m.Sequence != seq {
+			r.problem(feed, seq, false, "holds message %d of %s", m.Sequence, m.Author)
+		}
+		if err := m.VerifySignature(); err != nil {
+			r.problem(feed, seq, false, "%s", err)
+		}
+		if err := m.follows(head); err != nil {
+			r.problem(feed, seq, false, "%s", err)
+		}
+		head = &feedHead{m.Sequence, m.Key(), m.Timestamp}
+
+		// The log key is only known from the entry in a primary log
+		// store; otherwise the pointer is the only record of it.
+		logKey := -1
+		if v[0] == formatLogPointer && len(v) == 9 {
+			logKey = btoi(v[1:])
+		}
+		key := m.Key().DBKey()
+		p := c.pointer(key)
+		if p == nil && logKey < 0 {
+			c.missing[string(key)] = Pointer{Sequence: seq, Author: feed.DBKey()}
+			return nil
+		}
+		if p == nil {
+			r.problem(feed, seq, c.fix(key, Pointer{Sequence: seq, LogKey: logKey, Author: feed.DBKey()}.Marshal()), "message has no pointer")
+			return nil
+		}
+		switch {
+		case p.Sequence != seq || !bytes.Equal(p.Author, feed.DBKey()):
+			if logKey < 0 {
+				logKey = p.LogKey
+			}
+			r.problem(feed, seq, c.fix(key, Pointer{Sequence: seq, LogKey: logKey, Author: feed.DBKey()}.Marshal()), "pointer refers to message %d of %s", p.Sequence, DBRef(p.Author))
+		case logKey >= 0 && p.LogKey != logKey:
+			r.problem(feed, seq, c.fix(key, Pointer{Sequence: seq, LogKey: logKey, Author: feed.DBKey()}.Marshal()), "pointer refers to log entry %d, not %d", p.LogKey, logKey)
+		case logKey < 0 && !bytes.Equal(c.ds.log.Get(c.tx, p.LogKey), key):
+			r.problem(feed, seq, false, "pointer refers to log entry %d, which holds another message", p.LogKey)
+		}
+		return nil
+	})
+}
+
+// pointers looks for pointers to messages that are not stored. Those
+// already fixed while walking the feeds are skipped.
+func (c *fsck) pointers() {
+	FeedsBucket := c.tx.Bucket([]byte("feeds"))
+	c.pointerBucket.ForEach(func(k, v []byte) error {
+		c.r.Pointers++
+		if _, ok := c.fixes[string(k)]; ok {
+			return nil
+		}
+		var p Pointer
+		p.Unmarshal(v)
+		var m *SignedMessage
+		if FeedsBucket != nil {
+			if FeedBucket := FeedsBucket.Bucket(p.Author); FeedBucket != nil {
+				if LogBucket := FeedBucket.Bucket([]byte("log")); LogBucket != nil {
+					if entry := LogBucket.Get(itob(p.Sequence)); entry != nil {
+						m = c.ds.decodeEntry(c.tx, entry)
+					}
+				}
+			}
+		}
+		if m == nil || !bytes.Equal(m.Key().DBKey(), k) {
+			c.r.problem(DBRef(p.Author), p.Sequence, c.fix(k, nil), "pointer to %s, which is not stored", DBRef(k))
+		}
+		return nil
+	})
+}
+
+// log checks that every entry in the global log is stored in its feed.
+// Entries erased from a primary log when their feed was purged are
+// counted, but are not a problem.
+func (c *fsck) log() {
+	r := c.r
+	cursor := c.ds.log.Cursor(c.tx)
+	for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+		seq := btoi(k)
+		r.LogEntries++
+		var key Ref
+		author := Ref{}
+		if c.ds.primaryLog {
+			rec := decodeLogRecord(v)
+			if rec == nil {
+				r.Erased++
+				continue
+			}
+			if c.ds.purged(c.tx, rec.Value.Author) {
+				continue
+			}
+			key, author = rec.Key, rec.Value.Author
+		} else {
+			key = DBRef(v)
+		}
+		p := c.pointer(key.DBKey())
+		if mp, ok := c.missing[string(key.DBKey())]; p == nil && ok {
+			delete(c.missing, string(key.DBKey()))
+			mp.LogKey = seq
+			r.problem(DBRef(mp.Author), mp.Sequence, c.fix(key.DBKey(), mp.Marshal()), "message has no pointer")
+			continue
+		}
+		if _, ok := c.fixes[string(key.DBKey())]; ok {
+			continue
+		}
+		if p == nil {
+			r.problem(author, 0, false, "log entry %d, %s, is not stored in its feed", seq, key)
+			continue
+		}
+		if p.LogKey != seq {
+			r.problem(DBRef(p.Author), p.Sequence, false, "log entry %d is a copy of log entry %d", seq, p.LogKey)
+		}
+	}
+}
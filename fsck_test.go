@@ -0,0 +1,119 @@
+package ssb
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+
+	"github.com/andyleap/go-ssb/storage"
+)
+
+func TestFsck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kp := newTestKey()
+
+	for name, open := range map[string]func() (*DataStore, error){
+		"bucket": func() (*DataStore, error) {
+			return NewDataStore(storage.NewMemory(), storage.NewBucketLog("log"), kp)
+		},
+		"flume": func() (*DataStore, error) {
+			return OpenFlumeDataStore(filepath.Join(dir, "db"), filepath.Join(dir, "log.offset"), kp)
+		},
+	} {
+		ds, err := open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		opub, opriv, _ := ed25519.GenerateKey(rand.Reader)
+		other, _ := NewRef(RefFeed, opub, RefAlgoEd25519)
+		ds.Keys[other] = &SignerEd25519{Private: opriv}
+		var msgs []*SignedMessage
+		for i := 0; i < 5; i++ {
+			m, err := ds.GetFeed(ds.PrimaryRef).PublishMessage(map[string]interface{}{"type": "post", "text": "hello"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			msgs = append(msgs, m)
+		}
+		var others []*SignedMessage
+		for i := 0; i < 2; i++ {
+			m, err := ds.GetFeed(other).PublishMessage(map[string]interface{}{"type": "post", "text": "hello"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			others = append(others, m)
+		}
+
+		r, err := ds.Fsck(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !r.OK() || len(r.Problems) != 0 || r.Feeds != 2 || r.Messages != 7 || r.Pointers != 7 || r.LogEntries != 7 {
+			t.Errorf("%s: fresh store checked as %+v", name, r)
+		}
+
+		// Lose one pointer, point another at the wrong message, leave one
+		// behind for a message that was never stored, and put the head
+		// back.
+		dangling, _ := NewRef(RefMessage, make([]byte, 32), RefAlgoSha256)
+		err = ds.db.Update(func(tx storage.Tx) error {
+			PointerBucket := tx.Bucket([]byte("pointer"))
+			PointerBucket.Delete(msgs[1].Key().DBKey())
+			var p Pointer
+			p.Unmarshal(PointerBucket.Get(msgs[3].Key().DBKey()))
+			p.Sequence = 9
+			PointerBucket.Put(msgs[3].Key().DBKey(), p.Marshal())
+			p.Sequence = 3
+			return PointerBucket.Put(dangling.DBKey(), p.Marshal())
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := ds.GetFeed(ds.PrimaryRef)
+		f.SeqLock.Lock()
+		f.LatestSeq = 2
+		f.SeqLock.Unlock()
+
+		r, _ = ds.Fsck(false)
+		if r.OK() || len(r.Problems) != 4 {
+			t.Errorf("%s: broken store checked as %v", name, r.Problems)
+		}
+		if f.LatestSeq != 5 {
+			t.Errorf("%s: head left at %d", name, f.LatestSeq)
+		}
+		r, _ = ds.Fsck(true)
+		if !r.OK() || len(r.Problems) != 3 {
+			t.Errorf("%s: repair found %v", name, r.Problems)
+		}
+		if r, _ = ds.Fsck(false); !r.OK() || len(r.Problems) != 0 {
+			t.Errorf("%s: repaired store checked as %v", name, r.Problems)
+		}
+		if m := ds.Get(nil, msgs[1].Key()); m == nil || m.Key() != msgs[1].Key() {
+			t.Errorf("%s: message with lost pointer reads as %v", name, m)
+		}
+
+		// A message altered after it was signed cannot be repaired.
+		var altered *SignedMessage
+		json.Unmarshal(bytes.Replace(others[1].Encode(), []byte("hello"), []byte("HELLO"), 1), &altered)
+		err = ds.db.Update(func(tx storage.Tx) error {
+			return tx.Bucket([]byte("feeds")).Bucket(other.DBKey()).Bucket([]byte("log")).Put(itob(2), altered.Compress())
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r, _ = ds.Fsck(true); r.OK() {
+			t.Errorf("%s: altered message passed as %v", name, r.Problems)
+		}
+		ds.Close()
+	}
+}
@@ -1,10 +1,9 @@
 package git
 
 import (
-	"github.com/boltdb/bolt"
-
 	"github.com/andyleap/go-ssb"
 	"github.com/andyleap/go-ssb/blobs"
+	"github.com/andyleap/go-ssb/storage"
 )
 
 type Repo struct {
@@ -66,92 +65,145 @@ type RepoIssue struct {
 	Text    string  `json:"text"`
 }
 
-func init() {
-	ssb.RebuildClearHooks["git"] = func(tx *bolt.Tx) error {
-		tx.DeleteBucket([]byte("repos"))
+// Module indexes git repositories with their updates and issues.
+var Module = &ssb.Module{
+	Name: "git",
+	Deps: []string{"blobs"},
+	MessageTypes: map[string]func(mb ssb.MessageBody) interface{}{
+		"git-repo": func(mb ssb.MessageBody) interface{} {
+			return &RepoRoot{MessageBody: mb}
+		},
+		"git-update": func(mb ssb.MessageBody) interface{} {
+			return &RepoUpdate{MessageBody: mb}
+		},
+		"issue": func(mb ssb.MessageBody) interface{} {
+			return &RepoIssue{MessageBody: mb}
+		},
+	},
+	Index: &ssb.Index{
+		Add:    indexRepo,
+		Remove: removeRepo,
+		Clear: func(tx storage.Tx) error {
+			tx.DeleteBucket([]byte("repos"))
+			return nil
+		},
+	},
+	Buckets: []string{"repos"},
+}
+
+func indexRepo(ds *ssb.DataStore, m *ssb.SignedMessage, tx storage.Tx) error {
+	_, mb := ds.DecodeMessage(m)
+	if _, ok := mb.(*RepoRoot); ok {
+		ReposBucket, err := tx.CreateBucketIfNotExists([]byte("repos"))
+		if err != nil {
+			return err
+		}
+		repoBucket, err := ReposBucket.CreateBucketIfNotExists(m.Key().DBKey())
+		if err != nil {
+			return err
+		}
+		err = repoBucket.Put([]byte("info"), m.Compress())
+		if err != nil {
+			return err
+		}
 		return nil
 	}
-	ssb.AddMessageHooks["git"] = func(m *ssb.SignedMessage, tx *bolt.Tx) error {
-		_, mb := m.DecodeMessage()
-		if _, ok := mb.(*RepoRoot); ok {
-			ReposBucket, err := tx.CreateBucketIfNotExists([]byte("repos"))
-			if err != nil {
-				return err
-			}
-			repoBucket, err := ReposBucket.CreateBucketIfNotExists(m.Key().DBKey())
+	if update, ok := mb.(*RepoUpdate); ok {
+		ReposBucket, err := tx.CreateBucketIfNotExists([]byte("repos"))
+		if err != nil {
+			return err
+		}
+		repoBucket, err := ReposBucket.CreateBucketIfNotExists(update.Repo.DBKey())
+		if err != nil {
+			return err
+		}
+		updateBucket, err := repoBucket.CreateBucketIfNotExists([]byte("updates"))
+		if err != nil {
+			return err
+		}
+		err = updateBucket.Put(m.Key().DBKey(), []byte{})
+		if err != nil {
+			return err
+		}
+		blobBucket, err := repoBucket.CreateBucketIfNotExists([]byte("blobs"))
+		if err != nil {
+			return err
+		}
+		for _, pack := range update.Packs {
+			err = blobBucket.Put(pack.Link.DBKey(), []byte{})
 			if err != nil {
 				return err
 			}
-			err = repoBucket.Put([]byte("info"), m.Compress())
+		}
+		for _, index := range update.Indexes {
+			err = blobBucket.Put(index.Link.DBKey(), []byte{})
 			if err != nil {
 				return err
 			}
+		}
+	}
+	if issue, ok := mb.(*RepoIssue); ok {
+		ReposBucket, err := tx.CreateBucketIfNotExists([]byte("repos"))
+		if err != nil {
+			return err
+		}
+		repoBucket, err := ReposBucket.CreateBucketIfNotExists(issue.Project.DBKey())
+		if err != nil {
+			return err
+		}
+		issueBucket, err := repoBucket.CreateBucketIfNotExists([]byte("issues"))
+		if err != nil {
+			return err
+		}
+		err = issueBucket.Put(m.Key().DBKey(), []byte{})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func removeRepo(ds *ssb.DataStore, m *ssb.SignedMessage, tx storage.Tx) error {
+	ReposBucket := tx.Bucket([]byte("repos"))
+	if ReposBucket == nil {
+		return nil
+	}
+	_, mb := ds.DecodeMessage(m)
+	var repoBucket storage.Bucket
+	switch mb := mb.(type) {
+	case *RepoRoot:
+		if ReposBucket.Bucket(m.Key().DBKey()) == nil {
 			return nil
 		}
-		if update, ok := mb.(*RepoUpdate); ok {
-			ReposBucket, err := tx.CreateBucketIfNotExists([]byte("repos"))
-			if err != nil {
-				return err
-			}
-			repoBucket, err := ReposBucket.CreateBucketIfNotExists(update.Repo.DBKey())
-			if err != nil {
-				return err
-			}
-			updateBucket, err := repoBucket.CreateBucketIfNotExists([]byte("updates"))
-			if err != nil {
-				return err
-			}
-			err = updateBucket.Put(m.Key().DBKey(), []byte{})
-			if err != nil {
-				return err
-			}
-			blobBucket, err := repoBucket.CreateBucketIfNotExists([]byte("blobs"))
+		return ReposBucket.DeleteBucket(m.Key().DBKey())
+	case *RepoUpdate:
+		if repoBucket = ReposBucket.Bucket(mb.Repo.DBKey()); repoBucket == nil {
+			return nil
+		}
+		if updateBucket := repoBucket.Bucket([]byte("updates")); updateBucket != nil {
+			err := updateBucket.Delete(m.Key().DBKey())
 			if err != nil {
 				return err
 			}
-			for _, pack := range update.Packs {
-				err = blobBucket.Put(pack.Link.DBKey(), []byte{})
-				if err != nil {
-					return err
-				}
-			}
-			for _, index := range update.Indexes {
-				err = blobBucket.Put(index.Link.DBKey(), []byte{})
+		}
+		if blobBucket := repoBucket.Bucket([]byte("blobs")); blobBucket != nil {
+			for _, link := range append(mb.Packs, mb.Indexes...) {
+				err := blobBucket.Delete(link.Link.DBKey())
 				if err != nil {
 					return err
 				}
 			}
 		}
-		if issue, ok := mb.(*RepoIssue); ok {
-			ReposBucket, err := tx.CreateBucketIfNotExists([]byte("repos"))
-			if err != nil {
-				return err
-			}
-			repoBucket, err := ReposBucket.CreateBucketIfNotExists(issue.Project.DBKey())
-			if err != nil {
-				return err
-			}
-			issueBucket, err := repoBucket.CreateBucketIfNotExists([]byte("issues"))
-			if err != nil {
-				return err
-			}
-			err = issueBucket.Put(m.Key().DBKey(), []byte{})
-			if err != nil {
-				return err
-			}
+	case *RepoIssue:
+		if repoBucket = ReposBucket.Bucket(mb.Project.DBKey()); repoBucket == nil {
+			return nil
+		}
+		if issueBucket := repoBucket.Bucket([]byte("issues")); issueBucket != nil {
+			return issueBucket.Delete(m.Key().DBKey())
 		}
-
-		return nil
-	}
-	ssb.MessageTypes["git-repo"] = func(mb ssb.MessageBody) interface{} {
-		return &RepoRoot{MessageBody: mb}
-	}
-	ssb.MessageTypes["git-update"] = func(mb ssb.MessageBody) interface{} {
-		return &RepoUpdate{MessageBody: mb}
-	}
-	ssb.MessageTypes["issue"] = func(mb ssb.MessageBody) interface{} {
-		return &RepoIssue{MessageBody: mb}
 	}
+	return nil
 }
 
 func Get(ds *ssb.DataStore, r ssb.Ref) *Repo {
@@ -166,7 +218,7 @@ func Get(ds *ssb.DataStore, r ssb.Ref) *Repo {
 }
 
 func (repo *Repo) WantAll() {
-	repo.ds.DB().View(func(tx *bolt.Tx) error {
+	repo.ds.DB().View(func(tx storage.Tx) error {
 
 		ReposBucket := tx.Bucket([]byte("repos"))
 		if ReposBucket == nil {
@@ -191,7 +243,7 @@ func (repo *Repo) WantAll() {
 }
 
 func (repo *Repo) ListBlobs() (b []ssb.Ref) {
-	repo.ds.DB().View(func(tx *bolt.Tx) error {
+	repo.ds.DB().View(func(tx storage.Tx) error {
 
 		ReposBucket := tx.Bucket([]byte("repos"))
 		if ReposBucket == nil {
@@ -216,7 +268,7 @@ func (repo *Repo) ListBlobs() (b []ssb.Ref) {
 }
 
 func (repo *Repo) ListUpdates() (b []ssb.Ref) {
-	repo.ds.DB().View(func(tx *bolt.Tx) error {
+	repo.ds.DB().View(func(tx storage.Tx) error {
 
 		ReposBucket := tx.Bucket([]byte("repos"))
 		if ReposBucket == nil {
@@ -241,7 +293,7 @@ func (repo *Repo) ListUpdates() (b []ssb.Ref) {
 }
 
 func (repo *Repo) Issues() (issues []*ssb.SignedMessage) {
-	repo.ds.DB().View(func(tx *bolt.Tx) error {
+	repo.ds.DB().View(func(tx storage.Tx) error {
 
 		ReposBucket := tx.Bucket([]byte("repos"))
 		if ReposBucket == nil {
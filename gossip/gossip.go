@@ -2,17 +2,17 @@ package gossip
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
 	"time"
 
-	"github.com/boltdb/bolt"
-
 	"github.com/andyleap/go-ssb"
 	"github.com/andyleap/go-ssb/graph"
 	"github.com/andyleap/go-ssb/muxrpcManager"
+	"github.com/andyleap/go-ssb/storage"
 	"github.com/andyleap/muxrpc"
 	"github.com/andyleap/muxrpc/codec"
 
@@ -32,7 +32,7 @@ type PubAnnounce struct {
 }
 
 func AddPub(ds *ssb.DataStore, pb Pub) {
-	ds.DB().Update(func(tx *bolt.Tx) error {
+	ds.DB().Update(func(tx storage.Tx) error {
 		PubBucket, err := tx.CreateBucketIfNotExists([]byte("pubs"))
 		if err != nil {
 			return err
@@ -88,118 +88,207 @@ var sbotAppKey []byte
 
 func init() {
 	sbotAppKey, _ = base64.StdEncoding.DecodeString("1KHLiKZvAvjbY1ziZEHMXawbCEIM6qwjCDm3VYRan/s=")
-	ssb.RebuildClearHooks["gossip"] = func(tx *bolt.Tx) error {
-		tx.DeleteBucket([]byte("pubs"))
-		return nil
-	}
-	ssb.AddMessageHooks["gossip"] = func(m *ssb.SignedMessage, tx *bolt.Tx) error {
-		_, mb := m.DecodeMessage()
-		if mbp, ok := mb.(*PubAnnounce); ok {
-			if mbp.Pub.Link.Type != ssb.RefFeed {
-				return nil
-			}
-			PubBucket, err := tx.CreateBucketIfNotExists([]byte("pubs"))
-			if err != nil {
-				return err
-			}
-			buf, _ := json.Marshal(mbp.Pub)
-			err = PubBucket.Put(mbp.Pub.Link.DBKey(), buf)
-			if err != nil {
-				return err
-			}
+}
+
+// Module replicates feeds with connected peers, and indexes the pubs
+// announced in messages.
+var Module = &ssb.Module{
+	Name: "gossip",
+	Deps: []string{"muxrpc", "graph"},
+	MessageTypes: map[string]func(mb ssb.MessageBody) interface{}{
+		"pub": func(mb ssb.MessageBody) interface{} { return &PubAnnounce{MessageBody: mb} },
+	},
+	Index: &ssb.Index{
+		Add: indexPub,
+		// Pubs stay known after the feeds announcing them are purged,
+		// rather than rebuilding the index, which would lose the pubs
+		// added by hand.
+		Remove: func(ds *ssb.DataStore, m *ssb.SignedMessage, tx storage.Tx) error {
+			return nil
+		},
+		Clear: func(tx storage.Tx) error {
+			tx.DeleteBucket([]byte("pubs"))
 			return nil
+		},
+	},
+	Gap:     requestGap,
+	Buckets: []string{"pubs"},
+	Init:    initGossip,
+}
+
+func indexPub(ds *ssb.DataStore, m *ssb.SignedMessage, tx storage.Tx) error {
+	_, mb := ds.DecodeMessage(m)
+	if mbp, ok := mb.(*PubAnnounce); ok {
+		if mbp.Pub.Link.Type != ssb.RefFeed {
+			return nil
+		}
+		PubBucket, err := tx.CreateBucketIfNotExists([]byte("pubs"))
+		if err != nil {
+			return err
+		}
+		buf, _ := json.Marshal(mbp.Pub)
+		err = PubBucket.Put(mbp.Pub.Link.DBKey(), buf)
+		if err != nil {
+			return err
 		}
 		return nil
 	}
-	ssb.MessageTypes["pub"] = func(mb ssb.MessageBody) interface{} {
-		return &PubAnnounce{MessageBody: mb}
-	}
+	return nil
+}
 
-	ssb.RegisterInit(func(ds *ssb.DataStore) {
-		handlers, ok := ds.ExtraData("muxrpcHandlers").(map[string]func(conn *muxrpc.Conn, req int32, args json.RawMessage))
-		if !ok {
-			handlers = map[string]func(conn *muxrpc.Conn, req int32, args json.RawMessage){}
-			ds.SetExtraData("muxrpcHandlers", handlers)
+func initGossip(ds *ssb.DataStore) error {
+	muxrpcManager.Handle(ds, "createHistoryStream", func(conn *muxrpc.Conn, req int32, rm json.RawMessage) {
+		params := struct {
+			Id   ssb.Ref `json:"id"`
+			Seq  int     `json:"seq"`
+			Live bool    `json:"live"`
+		}{
+			ssb.Ref{},
+			0,
+			false,
 		}
-		handlers["createHistoryStream"] = func(conn *muxrpc.Conn, req int32, rm json.RawMessage) {
-			params := struct {
-				Id   ssb.Ref `json:"id"`
-				Seq  int     `json:"seq"`
-				Live bool    `json:"live"`
-			}{
-				ssb.Ref{},
-				0,
-				false,
+		args := []interface{}{&params}
+		json.Unmarshal(rm, &args)
+		f := ds.GetFeed(params.Id)
+		go func() {
+			err := f.Follow(params.Seq, params.Live, func(m *ssb.SignedMessage) error {
+				err := conn.Send(&codec.Packet{
+					Req:    -req,
+					Type:   codec.JSON,
+					Body:   m.Encode(),
+					Stream: true,
+				})
+				return err
+			}, conn.Done)
+			if err != nil {
+				log.Println(err)
+				return
 			}
-			args := []interface{}{&params}
-			json.Unmarshal(rm, &args)
-			f := ds.GetFeed(params.Id)
-			go func() {
-				err := f.Follow(params.Seq, params.Live, func(m *ssb.SignedMessage) error {
-					err := conn.Send(&codec.Packet{
-						Req:    -req,
-						Type:   codec.JSON,
-						Body:   m.Encode(),
-						Stream: true,
-					})
-					return err
-				}, conn.Done)
-				if err != nil {
-					log.Println(err)
-					return
+			conn.Send(&codec.Packet{
+				Req:    -req,
+				Type:   codec.JSON,
+				Body:   []byte("true"),
+				Stream: true,
+				EndErr: true,
+			})
+		}()
+	})
+	muxrpcManager.Handle(ds, "createLogStream", func(conn *muxrpc.Conn, req int32, rm json.RawMessage) {
+		params := struct {
+			Gt      *int `json:"gt"`
+			Gte     int  `json:"gte"`
+			Live    bool `json:"live"`
+			Reverse bool `json:"reverse"`
+			Limit   int  `json:"limit"`
+			Keys    bool `json:"keys"`
+		}{Keys: true}
+		args := []interface{}{&params}
+		json.Unmarshal(rm, &args)
+		since := params.Gte
+		if params.Gt != nil {
+			since = *params.Gt + 1
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			select {
+			case <-conn.Done:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		go func() {
+			defer cancel()
+			for e := range ds.LogStreamContext(ctx, since, params.Live, params.Reverse, params.Limit) {
+				body := e.Value.Encode()
+				if params.Keys {
+					body, _ = json.Marshal(e)
 				}
-				conn.Send(&codec.Packet{
+				err := conn.Send(&codec.Packet{
 					Req:    -req,
 					Type:   codec.JSON,
-					Body:   []byte("true"),
+					Body:   body,
 					Stream: true,
-					EndErr: true,
 				})
-			}()
-		}
-		onConnects, ok := ds.ExtraData("muxrpcOnConnect").(map[string]func(conn *muxrpc.Conn))
-		if !ok {
-			onConnects = map[string]func(conn *muxrpc.Conn){}
-			ds.SetExtraData("muxrpcOnConnect", onConnects)
-		}
-		onConnects["replicate"] = func(conn *muxrpc.Conn) {
-			i := 0
-			for feed := range graph.GetFollows(ds, ds.PrimaryRef, 2) {
-				go func(feed ssb.Ref, i int) {
-					time.Sleep(time.Duration(i) * 1 * time.Millisecond)
-					f := ds.GetFeed(feed)
-					if f == nil {
-						return
-					}
-					seq := 0
-					if f.Latest() != nil {
-						seq = f.Latest().Sequence + 1
-					}
-					go func() {
-						reply := func(p *codec.Packet) {
-							if p.Type != codec.JSON {
-								fmt.Println(p, string(p.Body))
-								return
-							}
-							var m *ssb.SignedMessage
-							err := json.Unmarshal(p.Body, &m)
-							if err != nil {
-								fmt.Println(err, p, string(p.Body))
-								return
-							}
-							f.AddMessage(m)
-						}
-						err := conn.Source("createHistoryStream", reply, map[string]interface{}{"id": f.ID, "seq": seq, "live": true, "keys": false})
-						if err != nil {
-							log.Println(err)
-						}
-					}()
-				}(feed, i)
-				i++
+				if err != nil {
+					return
+				}
 			}
+			conn.Send(&codec.Packet{
+				Req:    -req,
+				Type:   codec.JSON,
+				Body:   []byte("true"),
+				Stream: true,
+				EndErr: true,
+			})
+		}()
+	})
+	muxrpcManager.OnConnect(ds, "replicate", func(conn *muxrpc.Conn) {
+		i := 0
+		for feed := range graph.GetFollowsFrom(ds, ds.Identities(), 2) {
+			go func(feed ssb.Ref, i int) {
+				time.Sleep(time.Duration(i) * 1 * time.Millisecond)
+				f := ds.GetFeed(feed)
+				if f == nil || f.Forked() || f.Purged() {
+					return
+				}
+				seq := 0
+				if f.Latest() != nil {
+					seq = f.Latest().Sequence + 1
+				}
+				go func() {
+					err := conn.Source("createHistoryStream", historyReply(f), map[string]interface{}{"id": f.ID, "seq": seq, "live": true, "keys": false})
+					if err != nil {
+						log.Println(err)
+					}
+				}()
+			}(feed, i)
+			i++
 		}
 	})
+	return nil
+}
+
+func historyReply(f *ssb.Feed) func(p *codec.Packet) {
+	return func(p *codec.Packet) {
+		if p.Type != codec.JSON {
+			fmt.Println(p, string(p.Body))
+			return
+		}
+		var m *ssb.SignedMessage
+		err := json.Unmarshal(p.Body, &m)
+		if err != nil {
+			fmt.Println(err, p, string(p.Body))
+			return
+		}
+		f.AddMessage(m)
+	}
+}
 
+// requestGap asks every connected peer for the messages of a feed that are
+// missing before the ones it has buffered.
+func requestGap(ds *ssb.DataStore, feed ssb.Ref, from, to int) {
+	ed := muxrpcManager.Get(ds)
+	if ed == nil {
+		return
+	}
+	f := ds.GetFeed(feed)
+	if f == nil || f.Purged() {
+		return
+	}
+	ed.Lock.Lock()
+	conns := make([]*muxrpc.Conn, 0, len(ed.Conns))
+	for _, conn := range ed.Conns {
+		conns = append(conns, conn)
+	}
+	ed.Lock.Unlock()
+	for _, conn := range conns {
+		go func(conn *muxrpc.Conn) {
+			err := conn.Source("createHistoryStream", historyReply(f), map[string]interface{}{"id": feed, "seq": from, "limit": to - from, "live": false, "keys": false})
+			if err != nil {
+				log.Println(err)
+			}
+		}(conn)
+	}
 }
 
 func Replicate(ds *ssb.DataStore) {
@@ -223,7 +312,7 @@ func Replicate(ds *ssb.DataStore) {
 		}
 	}()
 	go func() {
-		ed := ds.ExtraData("muxrpcConns").(*muxrpcManager.ExtraData)
+		ed := muxrpcManager.Get(ds)
 		ssc, _ := secretstream.NewClient(*ds.PrimaryKey, sbotAppKey)
 		pubList := GetPubs(ds)
 		t := time.NewTicker(5 * time.Second)
@@ -281,7 +370,7 @@ func Replicate(ds *ssb.DataStore) {
 }
 
 func GetPubs(ds *ssb.DataStore) (pds []*Pub) {
-	ds.DB().View(func(tx *bolt.Tx) error {
+	ds.DB().View(func(tx storage.Tx) error {
 		PubBucket := tx.Bucket([]byte("pubs"))
 		if PubBucket == nil {
 			return nil
@@ -328,7 +417,7 @@ func GetPubs(ds *ssb.DataStore) (pds []*Pub) {
 
 	go func() {
 		i := 0
-		for feed := range graph.GetFollows(ds, ds.PrimaryRef, 2) {
+		for feed := range graph.GetFollowsFrom(ds, ds.Identities(), 2) {
 			go func(feed ssb.Ref, i int) {
 				time.Sleep(time.Duration(i) * 50 * time.Millisecond)
 				reply := make(chan *ssb.SignedMessage)
@@ -4,7 +4,7 @@ import (
 	"encoding/json"
 
 	"github.com/andyleap/go-ssb"
-	"github.com/boltdb/bolt"
+	"github.com/andyleap/go-ssb/storage"
 )
 
 type Relation struct {
@@ -19,17 +19,25 @@ type Contact struct {
 	Blocking  *bool   `json:"blocking,omitempty"`
 }
 
-func init() {
-	ssb.RebuildClearHooks["graph"] = func(tx *bolt.Tx) error {
-		tx.DeleteBucket([]byte("graph"))
-		return nil
-	}
-	ssb.AddMessageHooks["graph"] = handleGraph
-	ssb.MessageTypes["contact"] = func(mb ssb.MessageBody) interface{} { return &Contact{MessageBody: mb} }
+// Module indexes who each feed follows and blocks.
+var Module = &ssb.Module{
+	Name: "graph",
+	MessageTypes: map[string]func(mb ssb.MessageBody) interface{}{
+		"contact": func(mb ssb.MessageBody) interface{} { return &Contact{MessageBody: mb} },
+	},
+	Index: &ssb.Index{
+		Add:    handleGraph,
+		Remove: removeGraph,
+		Clear: func(tx storage.Tx) error {
+			tx.DeleteBucket([]byte("graph"))
+			return nil
+		},
+	},
+	Buckets: []string{"graph"},
 }
 
-func handleGraph(m *ssb.SignedMessage, tx *bolt.Tx) error {
-	_, mb := m.DecodeMessage()
+func handleGraph(ds *ssb.DataStore, m *ssb.SignedMessage, tx storage.Tx) error {
+	_, mb := ds.DecodeMessage(m)
 	if mbc, ok := mb.(*Contact); ok {
 		GraphBucket, err := tx.CreateBucketIfNotExists([]byte("graph"))
 		if err != nil {
@@ -59,10 +67,34 @@ func handleGraph(m *ssb.SignedMessage, tx *bolt.Tx) error {
 	return nil
 }
 
+func removeGraph(ds *ssb.DataStore, m *ssb.SignedMessage, tx storage.Tx) error {
+	_, mb := ds.DecodeMessage(m)
+	if mbc, ok := mb.(*Contact); ok {
+		GraphBucket := tx.Bucket([]byte("graph"))
+		if GraphBucket == nil {
+			return nil
+		}
+		FeedBucket := GraphBucket.Bucket(m.Author.DBKey())
+		if FeedBucket == nil {
+			return nil
+		}
+		return FeedBucket.Delete(mbc.Contact.DBKey())
+	}
+	return nil
+}
+
 func GetFollows(ds *ssb.DataStore, feed ssb.Ref, depth int) (follows map[ssb.Ref]int) {
+	return GetFollowsFrom(ds, []ssb.Ref{feed}, depth)
+}
+
+// GetFollowsFrom returns the feeds within depth follows of any of roots,
+// each with the fewest hops it takes to reach it. Roots are 0 hops away.
+func GetFollowsFrom(ds *ssb.DataStore, roots []ssb.Ref, depth int) (follows map[ssb.Ref]int) {
 	follows = map[ssb.Ref]int{}
-	follows[feed] = 0
-	ds.DB().View(func(tx *bolt.Tx) error {
+	for _, feed := range roots {
+		follows[feed] = 0
+	}
+	ds.DB().View(func(tx storage.Tx) error {
 		GraphBucket := tx.Bucket([]byte("graph"))
 		if GraphBucket == nil {
 			return nil
@@ -0,0 +1,29 @@
+package ssb
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"cryptoscope.co/go/secretstream/secrethandshake"
+	"golang.org/x/crypto/ed25519"
+
+	"github.com/andyleap/go-ssb/storage"
+)
+
+// newTestKey returns a new key pair for the primary identity of a store.
+func newTestKey() *secrethandshake.EdKeyPair {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	kp := &secrethandshake.EdKeyPair{}
+	copy(kp.Public[:], pub)
+	copy(kp.Secret[:], priv)
+	return kp
+}
+
+// newTestStore returns an in-memory store with a new primary identity.
+func newTestStore(t *testing.T, opts ...Option) *DataStore {
+	ds, err := NewDataStore(storage.NewMemory(), storage.NewBucketLog("log"), newTestKey(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ds
+}
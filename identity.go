@@ -0,0 +1,294 @@
+package ssb
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ed25519"
+
+	"github.com/andyleap/go-ssb/storage"
+)
+
+var (
+	ErrNoKeystore      = errors.New("Store has no keystore")
+	ErrPrimaryIdentity = errors.New("Primary identity cannot be deleted")
+	ErrUnknownIdentity = errors.New("Not a local identity")
+	ErrBadSecret       = errors.New("Not an ed25519 secret")
+	ErrIdentityKnown   = errors.New("Identity already in the keystore")
+)
+
+// secretFile is the format of secret.json, which the keystore keeps each
+// identity in too.
+type secretFile struct {
+	Curve   string `json:"curve"`
+	ID      Ref    `json:"id"`
+	Private string `json:"private"`
+	Public  string `json:"public"`
+}
+
+func encodeSecret(priv ed25519.PrivateKey) []byte {
+	pub := priv.Public().(ed25519.PublicKey)
+	ref, _ := NewRef(RefFeed, pub, RefAlgoEd25519)
+	buf, _ := Encode(secretFile{
+		Curve:   "ed25519",
+		ID:      ref,
+		Private: base64.StdEncoding.EncodeToString(priv) + ".ed25519",
+		Public:  base64.StdEncoding.EncodeToString(pub) + ".ed25519",
+	})
+	return buf
+}
+
+// ParseSecret reads the private key of an identity from a secret file, as
+// written by sbot or the JS sbot, or from the private key on its own.
+func ParseSecret(secret []byte) (ed25519.PrivateKey, error) {
+	var lines bytes.Buffer
+	s := bufio.NewScanner(bytes.NewReader(secret))
+	for s.Scan() {
+		if !strings.HasPrefix(strings.TrimSpace(s.Text()), "#") {
+			lines.Write(s.Bytes())
+		}
+	}
+	private := strings.TrimSpace(lines.String())
+	var sf secretFile
+	if json.Unmarshal([]byte(private), &sf) == nil {
+		private = sf.Private
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSuffix(private, ".ed25519"))
+	if err != nil || len(raw) != ed25519.PrivateKeySize {
+		return nil, ErrBadSecret
+	}
+	priv := ed25519.NewKeyFromSeed(raw[:ed25519.SeedSize])
+	if !bytes.Equal(priv, raw) {
+		return nil, ErrBadSecret
+	}
+	return priv, nil
+}
+
+func (ds *DataStore) registerIdentityMethods() {
+	ds.RegisterMethod("identity.Create", ds.CreateIdentity)
+	ds.RegisterMethod("identity.Import", func(secret string) (Ref, error) {
+		return ds.ImportIdentity([]byte(secret))
+	})
+	ds.RegisterMethod("identity.List", ds.Identities)
+	ds.RegisterMethod("identity.Delete", ds.DeleteIdentity)
+}
+
+// WithKeystore keeps identities other than the primary one in dir, one
+// secret file each, sealed if the store is. They are loaded as the store
+// opens.
+func WithKeystore(dir string) Option {
+	return func(ds *DataStore) error {
+		ds.keystore = dir
+		return nil
+	}
+}
+
+func (ds *DataStore) keystorePath(id Ref) string {
+	return filepath.Join(ds.keystore, hex.EncodeToString(id.Raw())+".json")
+}
+
+// loadIdentities adds the identities in the keystore to the store's keys.
+// Files that are not sealed are skipped when the store is sealed.
+func (ds *DataStore) loadIdentities() error {
+	if ds.keystore == "" {
+		return nil
+	}
+	files, err := ioutil.ReadDir(ds.keystore)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		if fi.IsDir() || filepath.Ext(fi.Name()) != ".json" {
+			continue
+		}
+		path := filepath.Join(ds.keystore, fi.Name())
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if ds.sealer != nil {
+			if buf, err = ds.sealer.Open(buf); err != nil {
+				log.Printf("keystore %s is not sealed, skipped; import it again to seal it", path)
+				continue
+			}
+		}
+		priv, err := ParseSecret(buf)
+		if err != nil {
+			return fmt.Errorf("keystore %s: %s", path, err)
+		}
+		ds.addIdentity(priv)
+	}
+	return nil
+}
+
+func (ds *DataStore) addIdentity(priv ed25519.PrivateKey) Ref {
+	ref, _ := NewRef(RefFeed, priv.Public().(ed25519.PublicKey), RefAlgoEd25519)
+	ds.keysLock.Lock()
+	ds.Keys[ref] = &SignerEd25519{priv}
+	ds.keysLock.Unlock()
+	return ref
+}
+
+// signer returns the key to sign messages of feed with, or nil if it is
+// not a local identity.
+func (ds *DataStore) signer(feed Ref) Signer {
+	ds.keysLock.RLock()
+	defer ds.keysLock.RUnlock()
+	return ds.Keys[feed]
+}
+
+// IsIdentity reports whether feed is a local identity, one the store can
+// publish to.
+func (ds *DataStore) IsIdentity(feed Ref) bool {
+	return ds.signer(feed) != nil
+}
+
+// Identities returns the local identities, the primary one first.
+func (ds *DataStore) Identities() []Ref {
+	ds.keysLock.RLock()
+	ids := make([]Ref, 0, len(ds.Keys))
+	for id := range ds.Keys {
+		if id != ds.PrimaryRef {
+			ids = append(ids, id)
+		}
+	}
+	ds.keysLock.RUnlock()
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i].String() < ids[j].String()
+	})
+	return append([]Ref{ds.PrimaryRef}, ids...)
+}
+
+// CreateIdentity generates a new identity and saves it in the keystore.
+func (ds *DataStore) CreateIdentity() (Ref, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return Ref{}, err
+	}
+	return ds.saveIdentity(priv)
+}
+
+// ImportIdentity saves the identity of a secret file, or private key, in
+// the keystore. Private messages to it that are already stored are
+// unboxed, and indexed again by the modules that have passed them.
+func (ds *DataStore) ImportIdentity(secret []byte) (Ref, error) {
+	priv, err := ParseSecret(secret)
+	if err != nil {
+		return Ref{}, err
+	}
+	id, err := ds.saveIdentity(priv)
+	if err != nil {
+		return id, err
+	}
+	return id, ds.unboxStored()
+}
+
+// unboxStored unboxes the stored private messages that have no plaintext
+// yet, after an identity is added, a chunk of the log per transaction.
+// Modules whose index has passed a message are given it again, now that
+// they can read it; the others come to it as usual.
+func (ds *DataStore) unboxStored() error {
+	after := -1
+	for {
+		more := false
+		err := ds.db.Update(func(tx storage.Tx) error {
+			states := map[string]IndexState{}
+			for _, module := range ds.indexNames {
+				if st, ok := ds.indexState(tx, module); ok {
+					states[module] = st
+				}
+			}
+			n := 0
+			err := ds.walkLog(tx, after, 0, false, func(e *LogStreamEntry) error {
+				if n >= indexChunk {
+					return errIndexChunk
+				}
+				n++
+				after = e.Seq
+				m := e.Value
+				if !m.IsBoxed() || m.Private != nil {
+					return nil
+				}
+				if err := ds.unbox(tx, m); err != nil || m.Private == nil {
+					return err
+				}
+				for _, module := range ds.indexNames {
+					if st, ok := states[module]; ok && e.Seq <= st.Offset {
+						if err := ds.indexOf(module).Add(ds, m, tx); err != nil {
+							return fmt.Errorf("Bolt %s hook: %s", module, err)
+						}
+					}
+				}
+				return nil
+			})
+			if err == errIndexChunk {
+				more = true
+				return nil
+			}
+			return err
+		})
+		if err != nil || !more {
+			return err
+		}
+	}
+}
+
+func (ds *DataStore) saveIdentity(priv ed25519.PrivateKey) (Ref, error) {
+	if ds.keystore == "" {
+		return Ref{}, ErrNoKeystore
+	}
+	ref, _ := NewRef(RefFeed, priv.Public().(ed25519.PublicKey), RefAlgoEd25519)
+	if ds.IsIdentity(ref) {
+		return ref, ErrIdentityKnown
+	}
+	if err := os.MkdirAll(ds.keystore, 0700); err != nil {
+		return Ref{}, err
+	}
+	buf := encodeSecret(priv)
+	if ds.sealer != nil {
+		buf = ds.sealer.Seal(buf)
+	}
+	path := ds.keystorePath(ref)
+	if err := ioutil.WriteFile(path+".tmp", buf, 0600); err != nil {
+		return Ref{}, err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return Ref{}, err
+	}
+	return ds.addIdentity(priv), nil
+}
+
+// DeleteIdentity removes an identity from the keystore. Its messages are
+// kept, but nothing more can be published to its feed.
+func (ds *DataStore) DeleteIdentity(id Ref) error {
+	if id == ds.PrimaryRef {
+		return ErrPrimaryIdentity
+	}
+	if !ds.IsIdentity(id) {
+		return ErrUnknownIdentity
+	}
+	if ds.keystore != "" {
+		if err := os.Remove(ds.keystorePath(id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	ds.keysLock.Lock()
+	delete(ds.Keys, id)
+	ds.keysLock.Unlock()
+	return nil
+}
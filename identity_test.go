@@ -0,0 +1,180 @@
+package ssb
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+
+	"github.com/andyleap/go-ssb/storage"
+)
+
+func TestIdentities(t *testing.T) {
+	dir, err := ioutil.TempDir("", "identities")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kp := newTestKey()
+	keys := filepath.Join(dir, "keys")
+	open := func(opts ...Option) *DataStore {
+		ds, err := OpenDataStore(filepath.Join(dir, "feeds.db"), kp, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ds
+	}
+
+	ds := open()
+	if _, err := ds.CreateIdentity(); err != ErrNoKeystore {
+		t.Errorf("identity created without a keystore, %v", err)
+	}
+	ds.Close()
+
+	ds = open(WithKeystore(keys))
+	if ids := ds.Identities(); len(ids) != 1 || ids[0] != ds.PrimaryRef {
+		t.Errorf("new store has identities %v", ids)
+	}
+	created, err := ds.CreateIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ds.GetFeed(created).PublishMessage(map[string]interface{}{"type": "post", "text": "hello"}); err != nil {
+		t.Errorf("publishing as a created identity, %v", err)
+	}
+
+	// Secret files of the JS sbot start with comments.
+	_, ipriv, _ := ed25519.GenerateKey(rand.Reader)
+	imported, _ := NewRef(RefFeed, ipriv.Public().(ed25519.PublicKey), RefAlgoEd25519)
+	secret := append([]byte("# this is your SECRET name.\n# keep it safe\n"), encodeSecret(ipriv)...)
+	if id, err := ds.ImportIdentity(secret); err != nil || id != imported {
+		t.Errorf("secret imported as %s, %v", id, err)
+	}
+	if _, err := ds.ImportIdentity(secret); err != ErrIdentityKnown {
+		t.Errorf("secret imported twice, %v", err)
+	}
+	if _, err := ds.ImportIdentity([]byte(base64.StdEncoding.EncodeToString(ipriv[:32]) + ".ed25519")); err != ErrBadSecret {
+		t.Errorf("seed imported as a secret, %v", err)
+	}
+	if ids := ds.Identities(); len(ids) != 3 || ids[0] != ds.PrimaryRef {
+		t.Errorf("identities are %v", ids)
+	}
+
+	m, err := ds.GetFeed(ds.PrimaryRef).PublishPrivateMessage(map[string]interface{}{"type": "post", "text": "psst"}, []Ref{imported})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ds.Unbox(m); !ok {
+		t.Error("message to an imported identity not unboxed")
+	}
+	ds.Close()
+
+	ds = open(WithKeystore(keys))
+	if ids := ds.Identities(); len(ids) != 3 {
+		t.Errorf("identities reloaded as %v", ids)
+	}
+	if err := ds.DeleteIdentity(ds.PrimaryRef); err != ErrPrimaryIdentity {
+		t.Errorf("primary identity deleted, %v", err)
+	}
+	if err := ds.DeleteIdentity(created); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.DeleteIdentity(created); err != ErrUnknownIdentity {
+		t.Errorf("identity deleted twice, %v", err)
+	}
+	if _, err := ds.GetFeed(created).PublishMessage(map[string]interface{}{"type": "post", "text": "again"}); err == nil {
+		t.Error("published as a deleted identity")
+	}
+	ds.Close()
+
+	ds = open(WithKeystore(keys))
+	if ids := ds.Identities(); len(ids) != 2 || ds.IsIdentity(created) || !ds.IsIdentity(imported) {
+		t.Errorf("identities after deleting are %v", ids)
+	}
+	ds.Close()
+
+	sealedKeys := filepath.Join(dir, "sealed")
+	sealed, err := OpenDataStore(filepath.Join(dir, "sealed.db"), kp, WithPassphrase([]byte("secret")), WithKeystore(sealedKeys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sealed.ImportIdentity(secret); err != nil {
+		t.Fatal(err)
+	}
+	sealed.Close()
+	files, _ := ioutil.ReadDir(sealedKeys)
+	for _, fi := range files {
+		if buf, _ := ioutil.ReadFile(filepath.Join(sealedKeys, fi.Name())); bytes.Contains(buf, []byte("ed25519")) {
+			t.Errorf("identity stored in the clear in %s", fi.Name())
+		}
+	}
+	_, cpriv, _ := ed25519.GenerateKey(rand.Reader)
+	clear, _ := NewRef(RefFeed, cpriv.Public().(ed25519.PublicKey), RefAlgoEd25519)
+	ioutil.WriteFile(filepath.Join(sealedKeys, "clear.json"), encodeSecret(cpriv), 0600)
+	sealed, err = OpenDataStore(filepath.Join(dir, "sealed.db"), kp, WithKeystore(sealedKeys), WithPassphrase([]byte("secret")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sealed.IsIdentity(imported) {
+		t.Error("sealed identity not reloaded")
+	}
+	if sealed.IsIdentity(clear) {
+		t.Error("identity left in the clear loaded into a sealed store")
+	}
+	sealed.Close()
+}
+
+func TestImportUnboxesStored(t *testing.T) {
+	dir, err := ioutil.TempDir("", "identities")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var lock sync.Mutex
+	read := map[Ref]bool{}
+	reader := &Module{Name: "reader", Index: &Index{
+		Add: func(ds *DataStore, m *SignedMessage, tx storage.Tx) error {
+			lock.Lock()
+			defer lock.Unlock()
+			read[m.Key()] = m.Private != nil
+			return nil
+		},
+	}}
+	ds := newTestStore(t, WithKeystore(filepath.Join(dir, "keys")), WithModules(reader))
+	defer ds.Close()
+
+	_, ipriv, _ := ed25519.GenerateKey(rand.Reader)
+	imported, _ := NewRef(RefFeed, ipriv.Public().(ed25519.PublicKey), RefAlgoEd25519)
+	m, err := ds.GetFeed(ds.PrimaryRef).PublishPrivateMessage(map[string]interface{}{"type": "post", "text": "for later"}, []Ref{imported})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ds.WaitIndexed(ctx, ds.LogHead()); err != nil {
+		t.Fatal(err)
+	}
+	if got := ds.Get(nil, m.Key()); got.Private != nil {
+		t.Fatal("message read before its recipient was imported")
+	}
+
+	if _, err := ds.ImportIdentity(encodeSecret(ipriv)); err != nil {
+		t.Fatal(err)
+	}
+	if got := ds.Get(nil, m.Key()); got.Private == nil {
+		t.Error("stored message not unboxed on import")
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if !read[m.Key()] {
+		t.Error("unboxed message not indexed again")
+	}
+}
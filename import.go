@@ -0,0 +1,202 @@
+package ssb
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/andyleap/go-ssb/storage"
+)
+
+// ImportProgress is reported after every batch of an import.
+type ImportProgress struct {
+	Offset   int
+	Size     int
+	Imported int
+	Skipped  int
+	Failed   int
+}
+
+func (p ImportProgress) String() string {
+	percent := 100.0
+	if p.Size > 0 {
+		percent = float64(p.Offset) * 100 / float64(p.Size)
+	}
+	return fmt.Sprintf("%.1f%% imported %d, skipped %d, failed %d", percent, p.Imported, p.Skipped, p.Failed)
+}
+
+const importBatchSize = 1000
+
+// ImportFlumeLog copies the messages of a JS sbot's flumedb offset log,
+// usually ~/.ssb/flume/log.offset, into the store. Every message is
+// verified against its feed just as replicated messages are, messages
+// already in the store are skipped, and the position reached is saved
+// with each batch so an interrupted import resumes where it stopped.
+func ImportFlumeLog(ds *DataStore, path string, progress func(p ImportProgress)) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	l, err := storage.OpenOffsetLogReadOnly(abs)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	p := ImportProgress{Size: l.Size()}
+	since := -1
+	ds.db.View(func(tx storage.Tx) error {
+		ImportBucket := tx.Bucket([]byte("import"))
+		if ImportBucket == nil {
+			return nil
+		}
+		if val := ImportBucket.Get([]byte(abs)); val != nil {
+			since = btoi(val)
+		}
+		return nil
+	})
+
+	cursor := l.Cursor(nil)
+	k, v := cursor.First()
+	if since >= 0 {
+		k, v = cursor.Seek(itob(since))
+		if k != nil && btoi(k) == since {
+			k, v = cursor.Next()
+		}
+	}
+
+	for k != nil {
+		var added []*SignedMessage
+		err := ds.db.Update(func(tx storage.Tx) error {
+			added = nil
+			for i := 0; i < importBatchSize && k != nil; i++ {
+				if rec := decodeLogRecord(v); rec == nil {
+					p.Failed++
+				} else {
+					added = append(added, ds.importBatch(tx, []*SignedMessage{rec.Value}, &p)...)
+				}
+				p.Offset = btoi(k)
+				k, v = cursor.Next()
+			}
+			ImportBucket, err := tx.CreateBucketIfNotExists([]byte("import"))
+			if err != nil {
+				return err
+			}
+			return ImportBucket.Put([]byte(abs), itob(p.Offset))
+		})
+		ds.importDone(added, err)
+		if err != nil {
+			return err
+		}
+		if progress != nil {
+			progress(p)
+		}
+	}
+	p.Offset = p.Size
+	if progress != nil {
+		progress(p)
+	}
+	return nil
+}
+
+// ImportMessages stores msgs, which must be in sequence order for each
+// feed, in one transaction. Every message is verified against its feed
+// just as replicated messages are, those already in the store are
+// skipped, and those that fail are left out. The outcome of each is
+// counted in p.
+func (ds *DataStore) ImportMessages(msgs []*SignedMessage, p *ImportProgress) error {
+	var added []*SignedMessage
+	q := *p
+	err := ds.db.Update(func(tx storage.Tx) error {
+		q = *p
+		added = ds.importBatch(tx, msgs, &q)
+		return nil
+	})
+	ds.importDone(added, err)
+	if err == nil {
+		*p = q
+	}
+	return err
+}
+
+// importBatch stores what it can of msgs in tx, returning those added.
+func (ds *DataStore) importBatch(tx storage.Tx, msgs []*SignedMessage, p *ImportProgress) (added []*SignedMessage) {
+	for _, m := range msgs {
+		switch {
+		case m == nil:
+			p.Failed++
+		case ds.Get(tx, m.Key()) != nil:
+			p.Skipped++
+		default:
+			err := ds.importMessage(tx, m)
+			if err != nil {
+				p.Failed++
+				break
+			}
+			p.Imported++
+			added = append(added, m)
+		}
+	}
+	if f, ok := tx.(storage.Finisher); ok && len(added) > 0 {
+		// The heads have moved on with the messages added, put them back
+		// if tx rolls back, before anything else can be written.
+		f.OnRollback(func() {
+			ds.restoreHeads(added)
+		})
+	}
+	return
+}
+
+// restoreHeads reloads the heads of the feeds of msgs from the store.
+func (ds *DataStore) restoreHeads(msgs []*SignedMessage) {
+	done := map[Ref]bool{}
+	for _, m := range msgs {
+		if done[m.Author] {
+			continue
+		}
+		done[m.Author] = true
+		f := ds.GetFeed(m.Author)
+		f.SeqLock.Lock()
+		f.loadHead()
+		f.SeqLock.Unlock()
+	}
+}
+
+// importDone announces the messages added by an import transaction once
+// it is committed. If it failed, their heads were put back as it rolled
+// back.
+func (ds *DataStore) importDone(added []*SignedMessage, err error) {
+	if err != nil {
+		return
+	}
+	for _, m := range added {
+		ds.GetFeed(m.Author).Topic.Send <- m
+	}
+}
+
+func (ds *DataStore) importMessage(tx storage.Tx, m *SignedMessage) error {
+	f := ds.GetFeed(m.Author)
+	if f == nil {
+		return fmt.Errorf("Invalid author %s", m.Author)
+	}
+	f.SeqLock.Lock()
+	defer f.SeqLock.Unlock()
+	if f.forked {
+		return ErrFeedForked
+	}
+	if f.purged {
+		return ErrFeedPurged
+	}
+	if m.Sequence != f.LatestSeq+1 {
+		return &OutOfOrderError{m.Author, m.Sequence, fmt.Sprintf("expected sequence %d", f.LatestSeq+1)}
+	}
+	err := m.Verify(tx, f)
+	if err != nil {
+		return err
+	}
+	err = f.addMessage(tx, m)
+	if err != nil {
+		return err
+	}
+	f.setHead(m)
+	return nil
+}
@@ -0,0 +1,401 @@
+package ssb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/andyleap/go-ssb/storage"
+)
+
+// IndexRetry is how long an index whose hook failed waits before trying
+// the message again, if no new messages arrive sooner.
+var IndexRetry = 10 * time.Second
+
+// indexChunk is how many log entries an index takes on per transaction.
+const indexChunk = 1000
+
+var errIndexChunk = errors.New("chunk full")
+
+// IndexState is what the indexes bucket records about each module's index.
+type IndexState struct {
+	Version int `json:"version"`
+
+	// Offset is the log sequence of the last message indexed, or -1 if
+	// none have been.
+	Offset int `json:"offset"`
+
+	// Building is set while the index is rebuilt from the start of the
+	// log, until it catches up.
+	Building bool `json:"building"`
+
+	// Paused is set when a rebuild is cancelled, and the indexer leaves
+	// the index where it is until it is resumed.
+	Paused bool `json:"paused,omitempty"`
+
+	// Error is why the module's hook last failed, if it is stuck. It is
+	// not stored.
+	Error string `json:"error,omitempty"`
+}
+
+func (ds *DataStore) indexState(tx storage.Tx, module string) (st IndexState, ok bool) {
+	IndexesBucket := tx.Bucket([]byte("indexes"))
+	if IndexesBucket == nil {
+		return
+	}
+	buf := IndexesBucket.Get([]byte(module))
+	if buf == nil {
+		return
+	}
+	return st, json.Unmarshal(buf, &st) == nil
+}
+
+func (ds *DataStore) setIndexState(tx storage.Tx, module string, st IndexState) error {
+	IndexesBucket, err := tx.CreateBucketIfNotExists([]byte("indexes"))
+	if err != nil {
+		return err
+	}
+	st.Error = ""
+	buf, _ := json.Marshal(st)
+	return IndexesBucket.Put([]byte(module), buf)
+}
+
+// IndexStates returns the state of every module's index.
+func (ds *DataStore) IndexStates() map[string]IndexState {
+	states := map[string]IndexState{}
+	ds.db.View(func(tx storage.Tx) error {
+		for _, module := range ds.indexNames {
+			if st, ok := ds.indexState(tx, module); ok {
+				states[module] = st
+			}
+		}
+		return nil
+	})
+	ds.indexer.lock.Lock()
+	defer ds.indexer.lock.Unlock()
+	for module, err := range ds.indexer.errors {
+		if st, ok := states[module]; ok {
+			st.Error = err.Error()
+			states[module] = st
+		}
+	}
+	return states
+}
+
+// resetIndex clears a module's index and marks it to be built from the
+// start of the log.
+func (ds *DataStore) resetIndex(tx storage.Tx, module string) error {
+	index := ds.indexOf(module)
+	if index.Clear != nil {
+		err := index.Clear(tx)
+		if err != nil {
+			return fmt.Errorf("Bolt %s hook: %s", module, err)
+		}
+	}
+	return ds.setIndexState(tx, module, IndexState{Version: index.Version, Offset: -1, Building: true})
+}
+
+// checkIndexes resets the indexes that are missing or were built by
+// another version of their module, for the indexer to build, and tracks
+// them and any rebuilds left unfinished as jobs.
+func (ds *DataStore) checkIndexes() error {
+	defer ds.indexer.reload()
+	building := map[string]int{}
+	err := ds.db.Update(func(tx storage.Tx) error {
+		for _, module := range ds.indexNames {
+			st, ok := ds.indexState(tx, module)
+			if ok && st.Version == ds.indexOf(module).Version {
+				if st.Building {
+					building[module] = st.Offset
+				}
+				continue
+			}
+			log.Println("Index", module, "is missing or out of date, rebuilding")
+			err := ds.resetIndex(tx, module)
+			if err != nil {
+				return err
+			}
+			building[module] = -1
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for module, offset := range building {
+		ds.indexer.track(module, offset, true)
+	}
+	return nil
+}
+
+// LogHead returns the sequence of the last message in the global log, or
+// -1 if it is empty.
+func (ds *DataStore) LogHead() (seq int) {
+	seq = -1
+	ds.db.View(func(tx storage.Tx) error {
+		if k, _ := ds.log.Cursor(tx).Last(); k != nil {
+			seq = btoi(k)
+		}
+		return nil
+	})
+	return
+}
+
+// WaitIndexed blocks until the indexes of modules, or of every module if
+// none are given, have caught up with the global log at offset, or until
+// ctx is done in which case the context's error is returned. Indexes whose
+// rebuild is paused are not waited for unless they are named.
+func (ds *DataStore) WaitIndexed(ctx context.Context, offset int, modules ...string) error {
+	all := len(modules) == 0
+	if all {
+		modules = ds.indexNames
+	}
+	ix := ds.indexer
+	for {
+		ix.lock.Lock()
+		changed := ix.changed
+		caught := true
+		for _, module := range modules {
+			if all && ix.paused[module] {
+				continue
+			}
+			if off, ok := ix.offsets[module]; !ok || off < offset {
+				caught = false
+			}
+		}
+		ix.lock.Unlock()
+		if caught {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// indexer runs each module's hook over the global log in the background,
+// from the offset the module has reached, so a slow or failing hook holds
+// up only its own index rather than the messages being stored.
+type indexer struct {
+	ds   *DataStore
+	wake chan struct{}
+	quit chan struct{}
+	done sync.WaitGroup
+
+	// commit is held from writing offsets to the store until they are
+	// updated in offsets, so waiters only see committed indexes.
+	commit sync.Mutex
+
+	lock    sync.Mutex
+	offsets map[string]int
+	paused  map[string]bool
+	errors  map[string]error
+	jobs    map[string]*rebuildJob
+	// changed is closed and replaced whenever an offset moves.
+	changed chan struct{}
+}
+
+func newIndexer(ds *DataStore) *indexer {
+	return &indexer{
+		ds:      ds,
+		wake:    make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+		offsets: map[string]int{},
+		paused:  map[string]bool{},
+		errors:  map[string]error{},
+		jobs:    map[string]*rebuildJob{},
+		changed: make(chan struct{}),
+	}
+}
+
+func (ix *indexer) start() {
+	// Registered before returning, so no message stored after the store
+	// is open can be missed.
+	c := ix.ds.Topic.Register(nil, false)
+	ix.done.Add(2)
+	go ix.watch(c)
+	go ix.run()
+}
+
+func (ix *indexer) stop() {
+	close(ix.quit)
+	ix.done.Wait()
+}
+
+func (ix *indexer) poke() {
+	select {
+	case ix.wake <- struct{}{}:
+	default:
+	}
+}
+
+// watch wakes the indexer as messages are stored, which are only sent on
+// the topic once they are committed.
+func (ix *indexer) watch(c chan *SignedMessage) {
+	defer ix.done.Done()
+	for {
+		select {
+		case _, ok := <-c:
+			if !ok {
+				c = ix.ds.Topic.Register(nil, false)
+			}
+			ix.poke()
+		case <-ix.quit:
+			ix.ds.Topic.Unregister(c)
+			return
+		}
+	}
+}
+
+func (ix *indexer) run() {
+	defer ix.done.Done()
+	for {
+		for ix.pass() {
+			select {
+			case <-ix.quit:
+				return
+			default:
+			}
+		}
+		select {
+		case <-ix.wake:
+		case <-time.After(IndexRetry):
+		case <-ix.quit:
+			return
+		}
+	}
+}
+
+// pass gives every module a batch, reporting whether any made progress.
+func (ix *indexer) pass() bool {
+	progress := false
+	for _, module := range ix.ds.indexNames {
+		if ix.step(module) > 0 {
+			progress = true
+		}
+	}
+	return progress
+}
+
+// step indexes a batch for module. If its hook fails, the messages before
+// the failing one are still committed, and the module waits there until
+// it is retried.
+func (ix *indexer) step(module string) int {
+	n, err := ix.batch(module, indexChunk)
+	if err != nil && n > 0 {
+		n, _ = ix.batch(module, n)
+	}
+	ix.lock.Lock()
+	defer ix.lock.Unlock()
+	if err == nil {
+		delete(ix.errors, module)
+	} else {
+		if prev, ok := ix.errors[module]; !ok || prev.Error() != err.Error() {
+			log.Println("Index", module, "stuck:", err)
+		}
+		ix.errors[module] = err
+	}
+	return n
+}
+
+// batch runs module's hook over up to limit messages after its offset, in
+// one transaction with the new offset so each message is indexed once. It
+// returns how many messages were indexed, or before the one that failed.
+func (ix *indexer) batch(module string, limit int) (n int, err error) {
+	index := ix.ds.indexOf(module)
+	ix.commit.Lock()
+	defer ix.commit.Unlock()
+	moved, building, finished := false, false, false
+	offset := 0
+	err = ix.ds.db.Update(func(tx storage.Tx) error {
+		n = 0
+		moved, finished = false, false
+		st, ok := ix.ds.indexState(tx, module)
+		if !ok {
+			st = IndexState{Version: index.Version, Offset: -1, Building: true}
+		}
+		if st.Paused {
+			return nil
+		}
+		building = st.Building
+		last := st.Offset
+		err := ix.ds.walkLog(tx, st.Offset, 0, false, func(e *LogStreamEntry) error {
+			if n >= limit {
+				return errIndexChunk
+			}
+			err := index.Add(ix.ds, e.Value, tx)
+			if err != nil {
+				return fmt.Errorf("Bolt %s hook: %s", module, err)
+			}
+			n++
+			last = e.Seq
+			return nil
+		})
+		if err != nil && err != errIndexChunk {
+			return err
+		}
+		caughtUp := err == nil
+		if caughtUp {
+			// Step over records at the end of the log erased by a purge.
+			if k, _ := ix.ds.log.Cursor(tx).Last(); k != nil && btoi(k) > last {
+				last = btoi(k)
+			}
+		}
+		if last == st.Offset && !(st.Building && caughtUp) {
+			return nil
+		}
+		st.Offset = last
+		if caughtUp && st.Building {
+			st.Building = false
+			finished = true
+		}
+		moved, offset = true, last
+		return ix.ds.setIndexState(tx, module, st)
+	})
+	if err == nil && moved {
+		if building {
+			ix.progress(module, n, finished)
+		}
+		ix.setOffset(module, offset)
+	}
+	if err == nil && finished {
+		log.Println("Finished rebuild of", module)
+	}
+	return
+}
+
+func (ix *indexer) setOffset(module string, offset int) {
+	ix.lock.Lock()
+	defer ix.lock.Unlock()
+	ix.offsets[module] = offset
+	close(ix.changed)
+	ix.changed = make(chan struct{})
+}
+
+func (ix *indexer) setPaused(module string, paused bool) {
+	ix.lock.Lock()
+	defer ix.lock.Unlock()
+	ix.paused[module] = paused
+	close(ix.changed)
+	ix.changed = make(chan struct{})
+}
+
+// reload reads the offsets, and which rebuilds are paused, back from the
+// store after indexes are reset.
+func (ix *indexer) reload() {
+	ix.ds.db.View(func(tx storage.Tx) error {
+		for _, module := range ix.ds.indexNames {
+			if st, ok := ix.ds.indexState(tx, module); ok {
+				ix.setOffset(module, st.Offset)
+				ix.setPaused(module, st.Paused)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,343 @@
+package ssb
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+
+	"github.com/andyleap/go-ssb/storage"
+)
+
+func TestIndexVersions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "indexes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kp := newTestKey()
+
+	var indexed []int
+	counter := &Index{
+		Version: 1,
+		Add: func(ds *DataStore, m *SignedMessage, tx storage.Tx) error {
+			indexed = append(indexed, m.Sequence)
+			return nil
+		},
+		Clear: func(tx storage.Tx) error {
+			indexed = nil
+			return nil
+		},
+	}
+
+	open := func() *DataStore {
+		ds, err := OpenDataStore(filepath.Join(dir, "db"), kp, WithModules(&Module{Name: "counter", Index: counter}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ds
+	}
+	wait := func(ds *DataStore) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := ds.WaitIndexed(ctx, ds.LogHead(), "counter"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ds := open()
+	for i := 0; i < 5; i++ {
+		if _, err := ds.GetFeed(ds.PrimaryRef).PublishMessage(map[string]interface{}{"type": "post", "text": "hello"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wait(ds)
+	if st := ds.IndexStates()["counter"]; st != (IndexState{Version: 1, Offset: 5, Building: false}) || len(indexed) != 5 {
+		t.Fatalf("after publishing state is %+v with %d indexed", st, len(indexed))
+	}
+	ds.Close()
+
+	counter.Version = 2
+	indexed = []int{-1}
+	ds = open()
+	wait(ds)
+	if st := ds.IndexStates()["counter"]; st != (IndexState{Version: 2, Offset: 5, Building: false}) || len(indexed) != 5 {
+		t.Fatalf("after version change state is %+v with %d indexed", st, len(indexed))
+	}
+
+	// Leave the index as a crash part way through a rebuild would.
+	err = ds.db.Update(func(tx storage.Tx) error {
+		return ds.setIndexState(tx, "counter", IndexState{Version: 2, Offset: 3, Building: true})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds.Close()
+	indexed = nil
+	ds = open()
+	defer ds.Close()
+	wait(ds)
+	if st := ds.IndexStates()["counter"]; st != (IndexState{Version: 2, Offset: 5, Building: false}) || len(indexed) != 2 || indexed[0] != 4 {
+		t.Fatalf("after resuming state is %+v with %v indexed", st, indexed)
+	}
+
+	m, err := ds.GetFeed(ds.PrimaryRef).PublishMessage(map[string]interface{}{"type": "post", "text": "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wait(ds)
+	if st := ds.IndexStates()["counter"]; st.Offset != 6 || indexed[len(indexed)-1] != m.Sequence {
+		t.Fatalf("after resuming new messages are not indexed: %+v", st)
+	}
+}
+
+func TestIndexerFailingHook(t *testing.T) {
+	var lock sync.Mutex
+	broken := true
+	flaky := &Module{Name: "flaky", Index: &Index{
+		Add: func(ds *DataStore, m *SignedMessage, tx storage.Tx) error {
+			lock.Lock()
+			defer lock.Unlock()
+			if broken && m.Sequence == 3 {
+				return errors.New("broken")
+			}
+			return nil
+		},
+	}}
+	steady := &Module{Name: "steady", Index: &Index{
+		Add: func(ds *DataStore, m *SignedMessage, tx storage.Tx) error {
+			return nil
+		},
+	}}
+
+	ds := newTestStore(t, WithModules(flaky, steady))
+	defer ds.Close()
+	for i := 0; i < 5; i++ {
+		if _, err := ds.GetFeed(ds.PrimaryRef).PublishMessage(map[string]interface{}{"type": "post", "text": "hello"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ds.WaitIndexed(ctx, ds.LogHead(), "steady"); err != nil {
+		t.Fatalf("steady index held up by the failing one: %s", err)
+	}
+	short, cancelShort := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancelShort()
+	if err := ds.WaitIndexed(short, ds.LogHead(), "flaky"); err != context.DeadlineExceeded {
+		t.Fatalf("waiting on the failing index gave %v", err)
+	}
+	if st := ds.IndexStates()["flaky"]; st.Offset != 2 || st.Error == "" {
+		t.Fatalf("failing index state is %+v", st)
+	}
+
+	lock.Lock()
+	broken = false
+	lock.Unlock()
+	if _, err := ds.GetFeed(ds.PrimaryRef).PublishMessage(map[string]interface{}{"type": "post", "text": "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.WaitIndexed(ctx, ds.LogHead()); err != nil {
+		t.Fatalf("index did not recover: %s", err)
+	}
+	if st := ds.IndexStates()["flaky"]; st.Offset != 6 || st.Error != "" {
+		t.Fatalf("recovered index state is %+v", st)
+	}
+}
+
+func TestRebuildCancel(t *testing.T) {
+	var lock sync.Mutex
+	held := false
+	slow := &Module{Name: "slow", Index: &Index{
+		Add: func(ds *DataStore, m *SignedMessage, tx storage.Tx) error {
+			lock.Lock()
+			defer lock.Unlock()
+			if held && m.Sequence == 3 {
+				return errors.New("held")
+			}
+			return nil
+		},
+	}}
+	ds := newTestStore(t, WithModules(slow))
+	defer ds.Close()
+	publish := func() {
+		if _, err := ds.GetFeed(ds.PrimaryRef).PublishMessage(map[string]interface{}{"type": "post", "text": "hello"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		publish()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ds.WaitIndexed(ctx, ds.LogHead()); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.CancelRebuild("slow"); err != ErrNotRebuilding {
+		t.Fatalf("cancelling with no rebuild gave %v", err)
+	}
+	if err := ds.Rebuild("missing"); err != ErrNoIndex {
+		t.Fatalf("rebuilding a missing index gave %v", err)
+	}
+
+	lock.Lock()
+	held = true
+	lock.Unlock()
+	if err := ds.Rebuild("slow"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.WaitIndexed(ctx, 2, "slow"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.CancelRebuild("slow"); err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	held = false
+	lock.Unlock()
+	publish()
+	short, cancelShort := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancelShort()
+	if err := ds.WaitIndexed(short, ds.LogHead(), "slow"); err != context.DeadlineExceeded {
+		t.Fatalf("waiting on the cancelled rebuild gave %v", err)
+	}
+	if err := ds.WaitIndexed(ctx, ds.LogHead()); err != nil {
+		t.Fatalf("waiting on every index held up by the cancelled rebuild: %v", err)
+	}
+	jobs := ds.RebuildJobs()
+	if len(jobs) != 1 || !jobs[0].Cancelled || jobs[0].Done || jobs[0].Offset != 2 || jobs[0].Head != 5 || jobs[0].Progress != 0.4 {
+		t.Fatalf("cancelled jobs are %+v", jobs)
+	}
+
+	if err := ds.ResumeRebuild("slow"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.WaitIndexed(ctx, ds.LogHead(), "slow"); err != nil {
+		t.Fatalf("resumed rebuild did not finish: %s", err)
+	}
+	jobs = ds.RebuildJobs()
+	if len(jobs) != 1 || jobs[0].Cancelled || !jobs[0].Done || jobs[0].Indexed != 5 || jobs[0].Progress != 1 {
+		t.Fatalf("resumed jobs are %+v", jobs)
+	}
+	if st := ds.IndexStates()["slow"]; st.Building || st.Paused {
+		t.Fatalf("resumed index state is %+v", st)
+	}
+}
+
+func TestIndexerSkipsStrayRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "indexes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kp := newTestKey()
+
+	var lock sync.Mutex
+	var indexed []Ref
+	counter := &Module{Name: "counter", Index: &Index{
+		Add: func(ds *DataStore, m *SignedMessage, tx storage.Tx) error {
+			lock.Lock()
+			defer lock.Unlock()
+			indexed = append(indexed, m.Key())
+			return nil
+		},
+	}}
+	ds, err := OpenFlumeDataStore(filepath.Join(dir, "feeds.db"), filepath.Join(dir, "log.offset"), kp, WithModules(counter))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	first, err := ds.GetFeed(ds.PrimaryRef).PublishMessage(map[string]interface{}{"type": "post", "text": "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A copy of a stored message, and one of a message whose transaction
+	// never committed.
+	_, opriv, _ := ed25519.GenerateKey(rand.Reader)
+	author, _ := NewRef(RefFeed, opriv.Public().(ed25519.PublicKey), RefAlgoEd25519)
+	orphan := (&Message{Author: author, Sequence: 1, Hash: "sha256", Content: []byte(`{"type":"post","text":"lost"}`)}).Sign(&SignerEd25519{opriv})
+	for _, m := range []*SignedMessage{first, orphan} {
+		if _, err := ds.log.Append(nil, encodeLogRecord(m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	second, err := ds.GetFeed(ds.PrimaryRef).PublishMessage(map[string]interface{}{"type": "post", "text": "again"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ds.WaitIndexed(ctx, ds.LogHead(), "counter"); err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(indexed) != 2 || indexed[0] != first.Key() || indexed[1] != second.Key() {
+		t.Errorf("indexed %v, expected %s and %s", indexed, first.Key(), second.Key())
+	}
+}
+
+func TestIndexerFlumeBatches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "indexes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var lock sync.Mutex
+	indexed := 0
+	counter := &Module{Name: "counter", Index: &Index{
+		Add: func(ds *DataStore, m *SignedMessage, tx storage.Tx) error {
+			lock.Lock()
+			defer lock.Unlock()
+			indexed++
+			return nil
+		},
+	}}
+	ds, err := OpenFlumeDataStore(filepath.Join(dir, "feeds.db"), filepath.Join(dir, "log.offset"), newTestKey(), WithModules(counter))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+
+	// Ingested rather than published, so they go in a few transactions.
+	count := 2*indexChunk + 10
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	signer := &SignerEd25519{priv}
+	author, _ := NewRef(RefFeed, priv.Public().(ed25519.PublicKey), RefAlgoEd25519)
+	f := ds.GetFeed(author)
+	var previous *Ref
+	for seq := 1; seq <= count; seq++ {
+		m := (&Message{Previous: previous, Author: author, Sequence: seq, Timestamp: float64(seq), Hash: "sha256",
+			Content: []byte(`{"type":"post","text":"hello"}`)}).Sign(signer)
+		key := m.Key()
+		previous = &key
+		f.AddMessage(m)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for ds.IngestStats().Committed < uint64(count) {
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d of %d messages committed", ds.IngestStats().Committed, count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := ds.WaitIndexed(ctx, ds.LogHead(), "counter"); err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if indexed != count {
+		t.Errorf("indexed %d of %d messages", indexed, count)
+	}
+}
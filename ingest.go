@@ -0,0 +1,557 @@
+package ssb
+
+import (
+	"log"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/andyleap/go-ssb/storage"
+)
+
+// Messages from peers go through the ingest pipeline in three steps. A
+// pool of workers checks signatures, which needs nothing but the message
+// itself, and leaves verified messages waiting in their feed. A single
+// committer then takes every feed that has its next message waiting,
+// checks the links against the head of the feed kept in memory, and
+// writes messages from all of them in one transaction.
+//
+// Messages that arrive ahead of a gap wait in a buffer bounded per feed
+// and overall. They are evicted if the gap is not filled in time, and
+// peers are asked for the missing messages while they wait.
+//
+// A batch that fails to commit is put back and retried, up to
+// ingestMaxRetries times in a row, after which its messages are dropped.
+
+const (
+	ingestQueueSize  = 1000
+	ingestBatchSize  = 5000
+	ingestRetryDelay = time.Second
+	ingestMaxRetries = 5
+	rateWindow       = 10
+)
+
+var (
+	// MaxFeedWaiting is how far past a feed's latest message incoming
+	// messages are buffered, anything further ahead is dropped.
+	MaxFeedWaiting = 1000
+	// MaxWaiting caps the number of messages buffered over all feeds.
+	MaxWaiting = 100000
+	// WaitingTimeout is how long a message stays buffered waiting for
+	// the messages before it.
+	WaitingTimeout = 5 * time.Minute
+	// GapTimeout is how long a gap lasts before the missing messages are
+	// requested from peers, and how often the request is repeated.
+	GapTimeout = 10 * time.Second
+)
+
+type waitingMessage struct {
+	m     *SignedMessage
+	added time.Time
+}
+
+type ingestItem struct {
+	f *Feed
+	m *SignedMessage
+}
+
+type ingest struct {
+	ds    *DataStore
+	queue chan ingestItem
+	wake  chan struct{}
+	quit  chan struct{}
+	done  sync.WaitGroup
+
+	readyLock sync.Mutex
+	ready     map[*Feed]bool
+	buffering map[*Feed]bool
+
+	received    uint64
+	rejected    uint64
+	committed   uint64
+	batches     uint64
+	buffered    int64
+	dropped     uint64
+	evicted     uint64
+	gapRequests uint64
+	failed      uint64
+	rate        rateCounter
+
+	// retries counts the batches that failed to commit in a row. Only
+	// the committer uses it.
+	retries int
+}
+
+// IngestStats counts the messages that went through the ingest pipeline
+// since the store was opened.
+type IngestStats struct {
+	Received  uint64
+	Rejected  uint64
+	Committed uint64
+	Batches   uint64
+
+	// Rate is the number of messages committed per second over the last
+	// ten seconds.
+	Rate float64
+
+	// Buffered is the number of messages waiting for the messages before
+	// them. Dropped counts messages refused because the buffer was full
+	// and Evicted those that waited too long.
+	Buffered    int64
+	Dropped     uint64
+	Evicted     uint64
+	GapRequests uint64
+
+	// Failed counts messages dropped because the batch they were in
+	// failed to commit ingestMaxRetries times in a row.
+	Failed uint64
+}
+
+// FeedGap describes the messages a feed has buffered that cannot be stored
+// until the messages before them arrive.
+type FeedGap struct {
+	Feed Ref
+	// Next is the sequence the feed is waiting for, First the lowest
+	// buffered sequence.
+	Next     int
+	First    int
+	Buffered int
+	// Since is when the oldest buffered message arrived.
+	Since time.Time
+}
+
+func (ds *DataStore) registerIngestMethods() {
+	ds.RegisterMethod("ingest.Stats", func() IngestStats {
+		return ds.IngestStats()
+	})
+	ds.RegisterMethod("ingest.Gaps", func() []FeedGap {
+		return ds.Gaps()
+	})
+}
+
+func newIngest(ds *DataStore) *ingest {
+	in := &ingest{
+		ds:        ds,
+		queue:     make(chan ingestItem, ingestQueueSize),
+		wake:      make(chan struct{}, 1),
+		quit:      make(chan struct{}),
+		ready:     map[*Feed]bool{},
+		buffering: map[*Feed]bool{},
+	}
+	workers := runtime.NumCPU()
+	in.done.Add(workers + 2)
+	for i := 0; i < workers; i++ {
+		go in.verifier()
+	}
+	go in.committer()
+	go in.janitor()
+	return in
+}
+
+func (in *ingest) stop() {
+	close(in.quit)
+	in.done.Wait()
+}
+
+func (in *ingest) add(f *Feed, m *SignedMessage) {
+	select {
+	case in.queue <- ingestItem{f, m}:
+		atomic.AddUint64(&in.received, 1)
+	case <-in.quit:
+	}
+}
+
+func (in *ingest) verifier() {
+	defer in.done.Done()
+	for {
+		select {
+		case item := <-in.queue:
+			in.verify(item.f, item.m)
+		case <-in.quit:
+			return
+		}
+	}
+}
+
+func (in *ingest) verify(f *Feed, m *SignedMessage) {
+	f.SeqLock.Lock()
+	latest, forked, purged := f.LatestSeq, f.forked, f.purged
+	f.SeqLock.Unlock()
+	if forked || purged {
+		return
+	}
+	if m.Sequence <= latest {
+		f.checkFork(m)
+		return
+	}
+	if m.Sequence > latest+MaxFeedWaiting || !in.hasRoom(m, latest) {
+		atomic.AddUint64(&in.dropped, 1)
+		return
+	}
+	err := m.VerifySignature()
+	if err != nil {
+		atomic.AddUint64(&in.rejected, 1)
+		log.Println(err)
+		return
+	}
+	f.waitingLock.Lock()
+	if !in.hasRoom(m, latest) {
+		f.waitingLock.Unlock()
+		atomic.AddUint64(&in.dropped, 1)
+		return
+	}
+	other := in.buffer(f, m)
+	f.waitingLock.Unlock()
+	if other != nil {
+		f.forkWaiting(other, m)
+		return
+	}
+	in.markReady(f)
+}
+
+// hasRoom reports whether m can be buffered. The message a feed is
+// waiting for is always let in, as it is about to be committed.
+func (in *ingest) hasRoom(m *SignedMessage, latest int) bool {
+	return m.Sequence == latest+1 || atomic.LoadInt64(&in.buffered) < int64(MaxWaiting)
+}
+
+// buffer adds m to the messages waiting in f. If a different message is
+// already waiting with the same sequence it is kept and returned instead,
+// as the two prove the feed is forked. The caller must hold the feed's
+// waitingLock.
+func (in *ingest) buffer(f *Feed, m *SignedMessage) *SignedMessage {
+	if w, ok := f.waiting[m.Sequence]; ok {
+		if w.m.Key() != m.Key() {
+			return w.m
+		}
+	} else {
+		atomic.AddInt64(&in.buffered, 1)
+	}
+	f.waiting[m.Sequence] = waitingMessage{m, time.Now()}
+	in.readyLock.Lock()
+	in.buffering[f] = true
+	in.readyLock.Unlock()
+	return nil
+}
+
+// take removes and returns the message with sequence seq from those
+// waiting in f. The caller must hold the feed's waitingLock.
+func (in *ingest) take(f *Feed, seq int) *SignedMessage {
+	w, ok := f.waiting[seq]
+	if !ok {
+		return nil
+	}
+	delete(f.waiting, seq)
+	atomic.AddInt64(&in.buffered, -1)
+	return w.m
+}
+
+func (in *ingest) markReady(f *Feed) {
+	in.readyLock.Lock()
+	in.ready[f] = true
+	in.readyLock.Unlock()
+	select {
+	case in.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (in *ingest) committer() {
+	defer in.done.Done()
+	for {
+		select {
+		case <-in.wake:
+		case <-in.quit:
+			return
+		}
+		for in.commit() {
+		}
+	}
+}
+
+type ingestBatch struct {
+	head   *feedHead
+	msgs   []*SignedMessage
+	failed *SignedMessage
+}
+
+// commit writes the waiting messages that are next in sequence for every
+// ready feed, up to ingestBatchSize of them, in one transaction. It
+// reports whether messages were left over for another batch.
+func (in *ingest) commit() bool {
+	in.readyLock.Lock()
+	feeds := in.ready
+	in.ready = map[*Feed]bool{}
+	in.readyLock.Unlock()
+	if len(feeds) == 0 {
+		return false
+	}
+
+	batch := map[*Feed]*ingestBatch{}
+	count := 0
+	more := false
+	err := in.ds.db.Update(func(tx storage.Tx) error {
+		for f := range feeds {
+			if count >= ingestBatchSize {
+				more = true
+				in.markReady(f)
+				continue
+			}
+			// The feed stays locked until the batch is committed or
+			// rolled back, so its head never runs ahead of the store.
+			f.SeqLock.Lock()
+			b := &ingestBatch{head: f.head()}
+			batch[f] = b
+			for !f.forked && !f.purged && count < ingestBatchSize {
+				next := 1
+				if b.head != nil {
+					next = b.head.Sequence + 1
+				}
+				f.waitingLock.Lock()
+				m := in.take(f, next)
+				f.waitingLock.Unlock()
+				if m == nil {
+					break
+				}
+				err := m.follows(b.head)
+				if err != nil {
+					atomic.AddUint64(&in.rejected, 1)
+					log.Println(err)
+					break
+				}
+				err = f.addMessage(tx, m)
+				if err != nil {
+					b.failed = m
+					return err
+				}
+				b.head = &feedHead{m.Sequence, m.Key(), m.Timestamp}
+				b.msgs = append(b.msgs, m)
+				count++
+			}
+			if count >= ingestBatchSize {
+				more = true
+				in.markReady(f)
+			}
+		}
+		return nil
+	})
+
+	evict := false
+	if err != nil {
+		in.retries++
+		evict = in.retries >= ingestMaxRetries
+	} else {
+		in.retries = 0
+	}
+	forks := map[*Feed][2]*SignedMessage{}
+	for f, b := range batch {
+		msgs := b.msgs
+		if b.failed != nil {
+			msgs = append(msgs, b.failed)
+		}
+		switch {
+		case err != nil && evict:
+			atomic.AddUint64(&in.failed, uint64(len(msgs)))
+		case err != nil:
+			// Put the messages back, with the one that failed, to
+			// be retried. One may have arrived for the same sequence
+			// since it was taken.
+			f.waitingLock.Lock()
+			for _, m := range msgs {
+				if other := in.buffer(f, m); other != nil {
+					forks[f] = [2]*SignedMessage{other, m}
+				}
+			}
+			f.waitingLock.Unlock()
+		case len(b.msgs) > 0:
+			f.setHead(b.msgs[len(b.msgs)-1])
+		}
+		f.SeqLock.Unlock()
+	}
+	for f, fork := range forks {
+		f.forkWaiting(fork[0], fork[1])
+	}
+	if err != nil {
+		log.Println("ingest:", err)
+		if evict {
+			log.Printf("ingest: dropped batch after %d failed commits", in.retries)
+			in.retries = 0
+			return false
+		}
+		select {
+		case <-time.After(ingestRetryDelay):
+		case <-in.quit:
+			return false
+		}
+		for f := range batch {
+			in.markReady(f)
+		}
+		return false
+	}
+
+	atomic.AddUint64(&in.batches, 1)
+	atomic.AddUint64(&in.committed, uint64(count))
+	in.rate.add(count)
+	for f, b := range batch {
+		for _, m := range b.msgs {
+			f.Topic.Send <- m
+		}
+	}
+	return more
+}
+
+func (in *ingest) janitor() {
+	defer in.done.Done()
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			in.sweep()
+		case <-in.quit:
+			return
+		}
+	}
+}
+
+// sweep evicts messages that have waited longer than WaitingTimeout, and
+// asks peers for the messages missing before the rest once they have
+// waited longer than GapTimeout.
+func (in *ingest) sweep() {
+	now := time.Now()
+	for _, f := range in.bufferingFeeds() {
+		f.SeqLock.Lock()
+		latest := f.LatestSeq
+		f.SeqLock.Unlock()
+
+		f.waitingLock.Lock()
+		gap := f.gap(latest)
+		for seq, w := range f.waiting {
+			switch {
+			case seq <= latest:
+				in.take(f, seq)
+			case now.Sub(w.added) > WaitingTimeout:
+				in.take(f, seq)
+				atomic.AddUint64(&in.evicted, 1)
+			}
+		}
+		if len(f.waiting) == 0 {
+			in.readyLock.Lock()
+			delete(in.buffering, f)
+			in.readyLock.Unlock()
+		}
+		request := gap.Buffered > 0 && gap.First > gap.Next &&
+			now.Sub(gap.Since) > GapTimeout && now.Sub(f.gapRequested) > GapTimeout
+		if request {
+			f.gapRequested = now
+		}
+		f.waitingLock.Unlock()
+
+		if request {
+			atomic.AddUint64(&in.gapRequests, 1)
+			for _, m := range in.ds.moduleOrder {
+				if m.Gap != nil {
+					m.Gap(in.ds, f.ID, gap.Next, gap.First)
+				}
+			}
+		}
+	}
+}
+
+func (in *ingest) bufferingFeeds() []*Feed {
+	in.readyLock.Lock()
+	defer in.readyLock.Unlock()
+	feeds := make([]*Feed, 0, len(in.buffering))
+	for f := range in.buffering {
+		feeds = append(feeds, f)
+	}
+	return feeds
+}
+
+// gap describes the messages waiting in f after latest. The caller must
+// hold the feed's waitingLock.
+func (f *Feed) gap(latest int) FeedGap {
+	gap := FeedGap{Feed: f.ID, Next: latest + 1}
+	for seq, w := range f.waiting {
+		if seq <= latest {
+			continue
+		}
+		gap.Buffered++
+		if gap.First == 0 || seq < gap.First {
+			gap.First = seq
+		}
+		if gap.Since.IsZero() || w.added.Before(gap.Since) {
+			gap.Since = w.added
+		}
+	}
+	return gap
+}
+
+// IngestStats returns the counters of the ingest pipeline.
+func (ds *DataStore) IngestStats() IngestStats {
+	in := ds.ingest
+	return IngestStats{
+		Received:    atomic.LoadUint64(&in.received),
+		Rejected:    atomic.LoadUint64(&in.rejected),
+		Committed:   atomic.LoadUint64(&in.committed),
+		Batches:     atomic.LoadUint64(&in.batches),
+		Rate:        in.rate.perSecond(),
+		Buffered:    atomic.LoadInt64(&in.buffered),
+		Dropped:     atomic.LoadUint64(&in.dropped),
+		Evicted:     atomic.LoadUint64(&in.evicted),
+		GapRequests: atomic.LoadUint64(&in.gapRequests),
+		Failed:      atomic.LoadUint64(&in.failed),
+	}
+}
+
+// Gaps lists the feeds that have messages buffered behind a gap, which
+// are stuck until the missing messages arrive.
+func (ds *DataStore) Gaps() []FeedGap {
+	gaps := []FeedGap{}
+	for _, f := range ds.ingest.bufferingFeeds() {
+		f.SeqLock.Lock()
+		latest := f.LatestSeq
+		f.SeqLock.Unlock()
+		f.waitingLock.Lock()
+		gap := f.gap(latest)
+		f.waitingLock.Unlock()
+		if gap.Buffered > 0 && gap.First > gap.Next {
+			gaps = append(gaps, gap)
+		}
+	}
+	return gaps
+}
+
+// rateCounter sums counts into one slot per second for the last
+// rateWindow seconds.
+type rateCounter struct {
+	lock    sync.Mutex
+	counts  [rateWindow]int
+	seconds [rateWindow]int64
+}
+
+func (r *rateCounter) add(n int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := time.Now().Unix()
+	i := now % rateWindow
+	if r.seconds[i] != now {
+		r.seconds[i] = now
+		r.counts[i] = 0
+	}
+	r.counts[i] += n
+}
+
+func (r *rateCounter) perSecond() float64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := time.Now().Unix()
+	total := 0
+	for i := range r.counts {
+		if now-r.seconds[i] < rateWindow {
+			total += r.counts[i]
+		}
+	}
+	return float64(total) / rateWindow
+}
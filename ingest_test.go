@@ -0,0 +1,207 @@
+package ssb
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	mrand "math/rand"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestIngest(t *testing.T) {
+	ds := newTestStore(t)
+	defer ds.Close()
+
+	const feeds, length = 20, 30
+	var items []ingestItem
+	var bad []*SignedMessage
+	for i := 0; i < feeds; i++ {
+		pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+		author, _ := NewRef(RefFeed, pub, RefAlgoEd25519)
+		signer := &SignerEd25519{priv}
+		f := ds.GetFeed(author)
+		var previous *Ref
+		for seq := 1; seq <= length; seq++ {
+			m := &Message{
+				Previous:  previous,
+				Author:    author,
+				Sequence:  seq,
+				Timestamp: float64(seq),
+				Hash:      "sha256",
+				Content:   json.RawMessage(`{"type":"post","text":"hello"}`),
+			}
+			sm := m.Sign(signer)
+			key := sm.Key()
+			previous = &key
+			items = append(items, ingestItem{f, sm})
+		}
+		m := &Message{Previous: previous, Author: author, Sequence: length + 1, Timestamp: 0, Hash: "sha256",
+			Content: json.RawMessage(`{"type":"post","text":"too early"}`)}
+		bad = append(bad, m.Sign(signer))
+	}
+	mrand.Shuffle(len(items), func(i, j int) { items[i], items[j] = items[j], items[i] })
+	for _, item := range items {
+		item.f.AddMessage(item.m)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for ds.IngestStats().Committed < feeds*length {
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d of %d messages committed", ds.IngestStats().Committed, feeds*length)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, m := range bad {
+		ds.GetFeed(m.Author).AddMessage(m)
+	}
+	for ds.IngestStats().Rejected < feeds {
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d of %d messages rejected", ds.IngestStats().Rejected, feeds)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, m := range bad {
+		f := ds.GetFeed(m.Author)
+		if l := f.Latest(); l == nil || l.Sequence != length {
+			t.Errorf("feed %s has latest %v", f.ID, l)
+		}
+		if f.LatestSeq != length || f.latestKey != *m.Previous {
+			t.Errorf("feed %s head at %d %s", f.ID, f.LatestSeq, f.latestKey)
+		}
+	}
+	if stats := ds.IngestStats(); stats.Received != feeds*(length+1) || stats.Rate <= 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestIngestGap(t *testing.T) {
+	requested := make(chan [2]int, 1)
+	requester := &Module{
+		Name: "test",
+		Gap: func(ds *DataStore, feed Ref, from, to int) {
+			requested <- [2]int{from, to}
+		},
+	}
+	ds := newTestStore(t, WithModules(requester))
+	defer ds.Close()
+	f := ds.GetFeed(ds.PrimaryRef)
+	signer := ds.Keys[ds.PrimaryRef]
+
+	var msgs []*SignedMessage
+	var previous *Ref
+	for seq := 1; seq <= 10; seq++ {
+		m := &Message{
+			Previous:  previous,
+			Author:    f.ID,
+			Sequence:  seq,
+			Timestamp: float64(seq),
+			Hash:      "sha256",
+			Content:   json.RawMessage(`{"type":"post","text":"hello"}`),
+		}
+		sm := m.Sign(signer)
+		key := sm.Key()
+		previous = &key
+		msgs = append(msgs, sm)
+	}
+
+	defer func(timeout time.Duration, max int) {
+		GapTimeout, MaxFeedWaiting = timeout, max
+	}(GapTimeout, MaxFeedWaiting)
+	GapTimeout = 0
+	MaxFeedWaiting = 8
+	for _, m := range msgs[2:] {
+		f.AddMessage(m)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for ds.IngestStats().Buffered+int64(ds.IngestStats().Dropped) < 8 {
+		if time.Now().After(deadline) {
+			t.Fatalf("messages not buffered: %+v", ds.IngestStats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := ds.IngestStats(); stats.Buffered != 6 || stats.Dropped != 2 {
+		t.Errorf("expected 6 buffered and 2 dropped past MaxFeedWaiting, got %+v", stats)
+	}
+	gaps := ds.Gaps()
+	if len(gaps) != 1 || gaps[0].Next != 1 || gaps[0].First != 3 || gaps[0].Buffered != 6 {
+		t.Fatalf("unexpected gaps %+v", gaps)
+	}
+
+	ds.ingest.sweep()
+	select {
+	case r := <-requested:
+		if r != [2]int{1, 3} {
+			t.Errorf("requested %v", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("gap not requested")
+	}
+
+	for _, m := range msgs[:2] {
+		f.AddMessage(m)
+	}
+	for ds.IngestStats().Committed < 8 {
+		if time.Now().After(deadline) {
+			t.Fatalf("gap not filled: %+v", ds.IngestStats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(ds.Gaps()) != 0 || ds.IngestStats().Buffered != 0 {
+		t.Errorf("buffer not emptied: %+v", ds.IngestStats())
+	}
+
+	defer func(timeout time.Duration) { WaitingTimeout = timeout }(WaitingTimeout)
+	WaitingTimeout = 0
+	f.AddMessage(msgs[9])
+	for ds.IngestStats().Buffered != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("message not buffered: %+v", ds.IngestStats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ds.ingest.sweep()
+	if stats := ds.IngestStats(); stats.Buffered != 0 || stats.Evicted != 1 {
+		t.Errorf("expected message to be evicted, got %+v", stats)
+	}
+}
+
+func TestIngestWaitingFork(t *testing.T) {
+	ds := newTestStore(t)
+	defer ds.Close()
+	f := ds.GetFeed(ds.PrimaryRef)
+	signer := ds.Keys[ds.PrimaryRef]
+
+	// Two different messages for sequence 3, which wait for the first
+	// two that never arrive.
+	var previous *Ref
+	for seq := 1; seq <= 2; seq++ {
+		m := &Message{Previous: previous, Author: f.ID, Sequence: seq, Timestamp: float64(seq), Hash: "sha256",
+			Content: json.RawMessage(`{"type":"post","text":"hello"}`)}
+		key := m.Sign(signer).Key()
+		previous = &key
+	}
+	for _, text := range []string{"one", "other"} {
+		m := &Message{
+			Previous:  previous,
+			Author:    f.ID,
+			Sequence:  3,
+			Timestamp: 3,
+			Hash:      "sha256",
+			Content:   json.RawMessage(`{"type":"post","text":"` + text + `"}`),
+		}
+		f.AddMessage(m.Sign(signer))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !f.Forked() {
+		if time.Now().After(deadline) {
+			t.Fatalf("fork not detected: %+v", ds.IngestStats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if proofs := f.ForkProofs(nil); len(proofs) != 1 || proofs[0].Sequence != 3 {
+		t.Errorf("unexpected fork proofs %+v", proofs)
+	}
+}
@@ -0,0 +1,187 @@
+// Package links indexes every reference to a feed, message or blob found
+// in message content, so the messages linking to something can be found
+// without a bespoke index for each kind of link.
+package links
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/andyleap/go-ssb"
+	"github.com/andyleap/go-ssb/storage"
+)
+
+// Link is a reference from the content of Source to Target, found at the
+// dotted path Rel within the content, such as "vote.link" or "text".
+type Link struct {
+	Source    ssb.Ref `json:"source"`
+	Target    ssb.Ref `json:"target"`
+	Rel       string  `json:"rel"`
+	Author    ssb.Ref `json:"author"`
+	Type      string  `json:"type,omitempty"`
+	Timestamp float64 `json:"timestamp"`
+}
+
+// Filter narrows the links returned by Backlinks. Unset fields match
+// everything.
+type Filter struct {
+	Rel    string  `json:"rel,omitempty"`
+	Author ssb.Ref `json:"author"`
+	Type   string  `json:"type,omitempty"`
+}
+
+var refPattern = regexp.MustCompile(`[@%&][A-Za-z0-9+/]{43}=\.(?:ed25519|sha256)`)
+
+// Module indexes the links in every message, and serves them over RPC.
+var Module = &ssb.Module{
+	Name: "links",
+	Index: &ssb.Index{
+		Add: func(ds *ssb.DataStore, m *ssb.SignedMessage, tx storage.Tx) error {
+			found := Extract(m)
+			if len(found) == 0 {
+				return nil
+			}
+			BacklinksBucket, err := tx.CreateBucketIfNotExists([]byte("backlinks"))
+			if err != nil {
+				return err
+			}
+			for _, l := range found {
+				buf, _ := json.Marshal(l)
+				err = BacklinksBucket.Put(rowKey(l), buf)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Remove: func(ds *ssb.DataStore, m *ssb.SignedMessage, tx storage.Tx) error {
+			BacklinksBucket := tx.Bucket([]byte("backlinks"))
+			if BacklinksBucket == nil {
+				return nil
+			}
+			for _, l := range Extract(m) {
+				err := BacklinksBucket.Delete(rowKey(l))
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Clear: func(tx storage.Tx) error {
+			tx.DeleteBucket([]byte("backlinks"))
+			return nil
+		},
+	},
+	Buckets: []string{"backlinks"},
+	Init: func(ds *ssb.DataStore) error {
+		ds.RegisterMethod("links.Backlinks", func(target ssb.Ref, filter Filter) []*Link {
+			return Backlinks(ds, target, filter)
+		})
+		ds.RegisterMethod("links.Links", func(source ssb.Ref) []*Link {
+			return Links(ds, source)
+		})
+		return nil
+	},
+}
+
+// rowKey orders rows by target so a target's backlinks can be found by
+// prefix. Refs kept by the index always have 32 bytes of data, so their
+// keys have a fixed length.
+func rowKey(l *Link) []byte {
+	key := append(l.Target.DBKey(), l.Source.DBKey()...)
+	return append(key, l.Rel...)
+}
+
+// Extract returns the links in the public content of m, once for each
+// target and path. Private messages have none, so the index cannot reveal
+// who they refer to.
+func Extract(m *ssb.SignedMessage) []*Link {
+	var content map[string]interface{}
+	if json.Unmarshal(m.Content, &content) != nil || content == nil {
+		return nil
+	}
+	typ, _ := content["type"].(string)
+	seen := map[string]bool{}
+	var found []*Link
+	var walk func(v interface{}, path []string)
+	walk = func(v interface{}, path []string) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for k, item := range v {
+				walk(item, append(path, k))
+			}
+		case []interface{}:
+			for _, item := range v {
+				walk(item, path)
+			}
+		case string:
+			rel := strings.Join(path, ".")
+			for _, s := range refPattern.FindAllString(v, -1) {
+				r := ssb.ParseRef(s)
+				if r.Type == ssb.RefInvalid || len(r.Raw()) != 32 || seen[s+" "+rel] {
+					continue
+				}
+				seen[s+" "+rel] = true
+				found = append(found, &Link{
+					Source:    m.Key(),
+					Target:    r,
+					Rel:       rel,
+					Author:    m.Author,
+					Type:      typ,
+					Timestamp: m.Timestamp,
+				})
+			}
+		}
+	}
+	walk(content, nil)
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].Rel != found[j].Rel {
+			return found[i].Rel < found[j].Rel
+		}
+		return found[i].Target.String() < found[j].Target.String()
+	})
+	return found
+}
+
+func (f Filter) matches(l *Link) bool {
+	return (f.Rel == "" || f.Rel == l.Rel) &&
+		(f.Author.Type == ssb.RefInvalid || f.Author == l.Author) &&
+		(f.Type == "" || f.Type == l.Type)
+}
+
+// Backlinks returns the links to target from messages matching filter,
+// oldest first.
+func Backlinks(ds *ssb.DataStore, target ssb.Ref, filter Filter) (found []*Link) {
+	ds.DB().View(func(tx storage.Tx) error {
+		BacklinksBucket := tx.Bucket([]byte("backlinks"))
+		if BacklinksBucket == nil {
+			return nil
+		}
+		prefix := target.DBKey()
+		cursor := BacklinksBucket.Cursor()
+		for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+			var l *Link
+			if json.Unmarshal(v, &l) != nil || l == nil || !filter.matches(l) {
+				continue
+			}
+			found = append(found, l)
+		}
+		return nil
+	})
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].Timestamp < found[j].Timestamp
+	})
+	return
+}
+
+// Links returns the links found in the message source.
+func Links(ds *ssb.DataStore, source ssb.Ref) []*Link {
+	m := ds.Get(nil, source)
+	if m == nil {
+		return nil
+	}
+	return Extract(m)
+}
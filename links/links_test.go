@@ -0,0 +1,73 @@
+package links
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/andyleap/go-ssb"
+	"github.com/andyleap/go-ssb/ssbtest"
+)
+
+func TestBacklinks(t *testing.T) {
+	ds := ssbtest.NewStore(t, ssb.WithModules(Module))
+	defer ds.Close()
+	f := ds.GetFeed(ds.PrimaryRef)
+
+	blob, _ := ssb.NewRef(ssb.RefBlob, make([]byte, 32), ssb.RefAlgoSha256)
+	other, _ := ssb.NewRef(ssb.RefFeed, make([]byte, 32), ssb.RefAlgoEd25519)
+	root, err := f.PublishMessage(map[string]interface{}{"type": "post", "text": "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := f.PublishMessage(map[string]interface{}{
+		"type":     "post",
+		"root":     root.Key(),
+		"text":     fmt.Sprintf("hi [friend](%s), look at ![this](%s) and %s again", other, blob, other),
+		"mentions": []interface{}{map[string]interface{}{"link": other, "name": "friend"}, blob.String()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vote, err := f.PublishMessage(map[string]interface{}{"type": "vote", "vote": map[string]interface{}{"link": root.Key(), "value": 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ds.WaitIndexed(ctx, ds.LogHead(), "links"); err != nil {
+		t.Fatal(err)
+	}
+
+	got := []string{}
+	for _, l := range Links(ds, reply.Key()) {
+		got = append(got, l.Rel+" "+l.Target.String())
+	}
+	want := []string{
+		"mentions " + blob.String(),
+		"mentions.link " + other.String(),
+		"root " + root.Key().String(),
+		"text " + blob.String(),
+		"text " + other.String(),
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("links are %q, expected %q", got, want)
+	}
+
+	backlinks := Backlinks(ds, root.Key(), Filter{})
+	if len(backlinks) != 2 || backlinks[0].Source != reply.Key() || backlinks[1].Source != vote.Key() {
+		t.Fatalf("backlinks to root are %v", backlinks)
+	}
+	backlinks = Backlinks(ds, root.Key(), Filter{Rel: "vote.link", Type: "vote"})
+	if len(backlinks) != 1 || backlinks[0].Source != vote.Key() {
+		t.Errorf("filtered backlinks to root are %v", backlinks)
+	}
+	if backlinks = Backlinks(ds, root.Key(), Filter{Author: other}); len(backlinks) != 0 {
+		t.Errorf("backlinks from another author are %v", backlinks)
+	}
+	if backlinks = Backlinks(ds, blob, Filter{}); len(backlinks) != 2 {
+		t.Errorf("backlinks to blob are %v", backlinks)
+	}
+}
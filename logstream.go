@@ -0,0 +1,209 @@
+package ssb
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/andyleap/go-ssb/storage"
+)
+
+// LogStreamEntry is a message as it sits in the global log, with the
+// sequence it was received at and the time it was received.
+type LogStreamEntry struct {
+	Seq       int            `json:"seq"`
+	Key       Ref            `json:"key"`
+	Value     *SignedMessage `json:"value"`
+	Timestamp float64        `json:"timestamp"`
+}
+
+// logRPCLimit caps how many entries one "log.Stream" call returns, as
+// JSON-RPC replies cannot be streamed.
+const logRPCLimit = 1000
+
+// logStreamBatch is how many entries are read per transaction, so a slow
+// reader does not hold one open.
+const logStreamBatch = 100
+
+var errLogStreamBatch = errors.New("batch full")
+
+func (ds *DataStore) registerLogMethods() {
+	ds.RegisterMethod("log.Stream", func(since int, reverse bool, limit int) []*LogStreamEntry {
+		if limit <= 0 || limit > logRPCLimit {
+			limit = logRPCLimit
+		}
+		entries := []*LogStreamEntry{}
+		for e := range ds.LogStream(since, false, reverse, limit) {
+			entries = append(entries, e)
+		}
+		return entries
+	})
+}
+
+func receiveTime() float64 {
+	return float64(time.Now().UnixNano() / int64(time.Millisecond))
+}
+
+// setReceived records when the message at seq in the global log was
+// received. A primary log keeps this in its records instead.
+func (ds *DataStore) setReceived(tx storage.Tx, seq int, ts float64) error {
+	ReceivedBucket, err := tx.CreateBucketIfNotExists([]byte("received"))
+	if err != nil {
+		return err
+	}
+	ReceivedBucket.SetFillPercent(1)
+	return ReceivedBucket.Put(itob(seq), itob(int(ts)))
+}
+
+// logEntry resolves the value at seq in the global log. Messages stored
+// before receive times were recorded report their own timestamp. Records
+// of a primary log that are not the ones stored for their message, as
+// replayLog would skip, resolve to nil.
+func (ds *DataStore) logEntry(tx storage.Tx, seq int, val []byte) *LogStreamEntry {
+	if ds.primaryLog {
+		rec := decodeLogRecord(val)
+		if rec == nil || !ds.logged(tx, rec.Key, seq) {
+			return nil
+		}
+		loadPrivate(tx, rec.Value)
+		return &LogStreamEntry{seq, rec.Key, rec.Value, rec.Timestamp}
+	}
+	m := ds.Get(tx, DBRef(val))
+	if m == nil {
+		return nil
+	}
+	e := &LogStreamEntry{seq, m.Key(), m, m.Timestamp}
+	if ReceivedBucket := tx.Bucket([]byte("received")); ReceivedBucket != nil {
+		if ts := ReceivedBucket.Get(itob(seq)); ts != nil {
+			e.Timestamp = float64(btoi(ts))
+		}
+	}
+	return e
+}
+
+// walkLog calls fn with the entries of the global log after sequence after
+// up to but not including to, or to the end if to is 0. They are walked
+// oldest first, or newest first if reverse is set, until fn returns an
+// error. Passing the sequence of the last entry seen lets an offset log
+// seek straight to it, where one past it is not the start of a record.
+func (ds *DataStore) walkLog(tx storage.Tx, after, to int, reverse bool, fn func(e *LogStreamEntry) error) error {
+	cursor := ds.log.Cursor(tx)
+	var k, v []byte
+	switch {
+	case !reverse && after < 0:
+		k, v = cursor.First()
+	case !reverse:
+		if k, v = cursor.Seek(itob(after)); k != nil && btoi(k) == after {
+			k, v = cursor.Next()
+		}
+	case to > 0:
+		if k, _ = cursor.Seek(itob(to)); k == nil {
+			k, v = cursor.Last()
+		} else {
+			k, v = cursor.Prev()
+		}
+	default:
+		k, v = cursor.Last()
+	}
+	for k != nil {
+		seq := btoi(k)
+		if seq <= after || (to > 0 && seq >= to) {
+			return nil
+		}
+		if e := ds.logEntry(tx, seq, v); e != nil {
+			err := fn(e)
+			if err != nil {
+				return err
+			}
+		}
+		if reverse {
+			k, v = cursor.Prev()
+		} else {
+			k, v = cursor.Next()
+		}
+	}
+	return nil
+}
+
+// LogStream streams every message in the global log in the order they were
+// received, starting from receive sequence since. To resume a stream, pass
+// one more than the last sequence seen. If reverse is set the newest come
+// first, down to since, and live is ignored. Otherwise if live is set the
+// stream carries on with messages as they arrive. A limit above 0 ends the
+// stream after that many messages.
+func (ds *DataStore) LogStream(since int, live bool, reverse bool, limit int) chan *LogStreamEntry {
+	return ds.LogStreamContext(context.Background(), since, live, reverse, limit)
+}
+
+// LogStreamContext is LogStream, closing the channel early once ctx is
+// done. The caller must either read until the channel is closed or cancel
+// ctx.
+func (ds *DataStore) LogStreamContext(ctx context.Context, since int, live bool, reverse bool, limit int) chan *LogStreamEntry {
+	c := make(chan *LogStreamEntry, 10)
+	go func() {
+		defer close(c)
+		var notify chan *SignedMessage
+		if live && !reverse {
+			// Registered before reading so nothing committed in between
+			// is missed. Messages are only sent on the topic once they
+			// are in the log, so each one is a hint to read again.
+			notify = ds.Topic.Register(nil, false)
+			defer func() {
+				ds.Topic.Unregister(notify)
+			}()
+		}
+		// Forward streams carry on after the last entry sent, which an
+		// offset log can seek to where it cannot seek one past it.
+		after, to := since-1, 0
+		for {
+			var batch []*LogStreamEntry
+			err := ds.db.View(func(tx storage.Tx) error {
+				return ds.walkLog(tx, after, to, reverse, func(e *LogStreamEntry) error {
+					batch = append(batch, e)
+					if len(batch) >= logStreamBatch {
+						return errLogStreamBatch
+					}
+					return nil
+				})
+			})
+			if err != nil && err != errLogStreamBatch {
+				return
+			}
+			for _, e := range batch {
+				select {
+				case c <- e:
+				case <-ctx.Done():
+					return
+				}
+				if reverse {
+					if e.Seq <= since {
+						return
+					}
+					to = e.Seq
+				} else {
+					after = e.Seq
+				}
+				if limit--; limit == 0 {
+					return
+				}
+			}
+			if err == errLogStreamBatch {
+				continue
+			}
+			if notify == nil {
+				return
+			}
+			select {
+			case _, ok := <-notify:
+				if !ok {
+					// Dropped for falling behind, the next read
+					// catches up.
+					notify = ds.Topic.Register(nil, false)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return c
+}
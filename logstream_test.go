@@ -0,0 +1,110 @@
+package ssb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLogStream(t *testing.T) {
+	ds := newTestStore(t)
+	defer ds.Close()
+	testLogStream(t, ds)
+}
+
+// TestFlumeLogStream streams an offset log, whose records are not at
+// consecutive sequences.
+func TestFlumeLogStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ds, err := OpenFlumeDataStore(filepath.Join(dir, "feeds.db"), filepath.Join(dir, "log.offset"), newTestKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	testLogStream(t, ds)
+}
+
+func testLogStream(t *testing.T, ds *DataStore) {
+	f := ds.GetFeed(ds.PrimaryRef)
+
+	const count = 250
+	start := receiveTime()
+	var published []*SignedMessage
+	for i := 0; i < count; i++ {
+		m, err := f.PublishMessage(map[string]interface{}{"type": "post", "text": "hello"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		published = append(published, m)
+	}
+
+	var entries []*LogStreamEntry
+	for e := range ds.LogStream(0, false, false, 0) {
+		entries = append(entries, e)
+	}
+	if len(entries) != count {
+		t.Fatalf("streamed %d entries, expected %d", len(entries), count)
+	}
+	for i, e := range entries {
+		if e.Key != published[i].Key() || e.Value.Key() != e.Key {
+			t.Fatalf("entry %d is %s, expected %s", i, e.Key, published[i].Key())
+		}
+		if e.Timestamp < start || e.Timestamp > receiveTime() {
+			t.Fatalf("entry %d received at %f", i, e.Timestamp)
+		}
+		if i > 0 && e.Seq <= entries[i-1].Seq {
+			t.Fatalf("entry %d has sequence %d after %d", i, e.Seq, entries[i-1].Seq)
+		}
+	}
+
+	resumed := 0
+	for e := range ds.LogStream(entries[99].Seq+1, false, false, 10) {
+		if e.Key != entries[100+resumed].Key {
+			t.Fatalf("resumed entry %d is %s", resumed, e.Key)
+		}
+		resumed++
+	}
+	if resumed != 10 {
+		t.Fatalf("limited stream returned %d entries", resumed)
+	}
+
+	i := count - 1
+	for e := range ds.LogStream(entries[10].Seq, false, true, 0) {
+		if e.Key != entries[i].Key {
+			t.Fatalf("reversed entry %d is %s", i, e.Key)
+		}
+		i--
+	}
+	if i != 9 {
+		t.Fatalf("reversed stream stopped at %d", i)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	live := ds.LogStreamContext(ctx, entries[count-1].Seq, true, false, 0)
+	if e := <-live; e.Key != entries[count-1].Key {
+		t.Fatalf("live stream started at %s", e.Key)
+	}
+	m, err := f.PublishMessage(map[string]interface{}{"type": "post", "text": "live"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-live:
+		if e.Key != m.Key() {
+			t.Fatalf("live stream returned %s, expected %s", e.Key, m.Key())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for live message")
+	}
+	cancel()
+	for range live {
+	}
+}
@@ -9,12 +9,40 @@ import (
 	"io/ioutil"
 	"strings"
 
-	"github.com/boltdb/bolt"
+	"github.com/andyleap/go-ssb/storage"
 )
 
 type SignedMessage struct {
 	Message
 	Signature Signature `json:"signature"`
+
+	// raw is the canonical form of the message as it was received, which
+	// re-marshalling the fields above does not always reproduce.
+	raw []byte
+}
+
+func (m *SignedMessage) UnmarshalJSON(buf []byte) error {
+	type signedMessage SignedMessage
+	err := json.Unmarshal(buf, (*signedMessage)(m))
+	if err != nil {
+		return err
+	}
+	m.raw, err = CanonicalJSON(buf)
+	return err
+}
+
+func (m SignedMessage) MarshalJSON() ([]byte, error) {
+	return m.canonical(), nil
+}
+
+func (m *SignedMessage) canonical() []byte {
+	if m.raw != nil {
+		return m.raw
+	}
+	type signedMessage SignedMessage
+	buf, _ := json.Marshal((*signedMessage)(m))
+	raw, _ := CanonicalJSON(buf)
+	return raw
 }
 
 type Message struct {
@@ -24,6 +52,10 @@ type Message struct {
 	Timestamp float64         `json:"timestamp"`
 	Hash      string          `json:"hash"`
 	Content   json.RawMessage `json:"content"`
+
+	// Private holds the decrypted content of a boxed message, if it was
+	// addressed to one of our identities.
+	Private json.RawMessage `json:"-"`
 }
 
 func Encode(i interface{}) ([]byte, error) {
@@ -38,50 +70,132 @@ func Encode(i interface{}) ([]byte, error) {
 	return bytes.Trim(buf.Bytes(), "\n"), nil
 }
 
-func (m *SignedMessage) Verify(tx *bolt.Tx, f *Feed) error {
-	buf, err := Encode(m.Message)
+// SignatureError is returned by Verify for a message whose signature does
+// not match its author.
+type SignatureError struct {
+	Key Ref
+	Err error
+}
+
+func (e *SignatureError) Error() string {
+	return fmt.Sprintf("Bad signature on %s: %s", e.Key, e.Err)
+}
+
+// OutOfOrderError is returned by Verify for a message that does not follow
+// on from the message before it in the feed.
+type OutOfOrderError struct {
+	Author   Ref
+	Sequence int
+	Reason   string
+}
+
+func (e *OutOfOrderError) Error() string {
+	return fmt.Sprintf("Message %d of %s out of order: %s", e.Sequence, e.Author, e.Reason)
+}
+
+// RepeatedMessageError is returned by Verify for a message that is already
+// stored.
+type RepeatedMessageError struct {
+	Key Ref
+}
+
+func (e *RepeatedMessageError) Error() string {
+	return fmt.Sprintf("Repeated message %s", e.Key)
+}
+
+// ForkError is returned by Verify for a validly signed message with the
+// same author and sequence as a different message that is already stored.
+type ForkError struct {
+	ForkProof
+}
+
+func (e *ForkError) Error() string {
+	return fmt.Sprintf("Feed %s forked at %d: %s and %s", e.Author, e.Sequence, e.Messages[0].Key(), e.Messages[1].Key())
+}
+
+func (m *SignedMessage) Verify(tx storage.Tx, f *Feed) error {
+	err := m.VerifySignature()
 	if err != nil {
 		return err
 	}
-	err = m.Signature.Verify(buf, m.Author)
+	if existing := f.GetSeq(tx, m.Sequence); existing != nil {
+		if existing.Key() == m.Key() {
+			return &RepeatedMessageError{m.Key()}
+		}
+		return &ForkError{ForkProof{
+			Author:   m.Author,
+			Sequence: m.Sequence,
+			Messages: [2]*SignedMessage{existing, m},
+		}}
+	}
+	if m.Sequence == 1 {
+		return nil
+	}
+	var head *feedHead
+	if latest := f.GetSeq(tx, m.Sequence-1); latest != nil {
+		head = &feedHead{latest.Sequence, latest.Key(), latest.Timestamp}
+	}
+	return m.follows(head)
+}
+
+// VerifySignature checks everything about m that does not depend on the
+// rest of its feed, which is its shape and its signature.
+func (m *SignedMessage) VerifySignature() error {
+	err := m.Validate()
 	if err != nil {
 		return err
 	}
+	buf, err := canonicalWithout(m.canonical(), "signature")
+	if err != nil {
+		return &SignatureError{m.Key(), err}
+	}
+	err = m.Signature.Verify(buf, m.Author)
+	if err != nil {
+		return &SignatureError{m.Key(), err}
+	}
+	return nil
+}
+
+// feedHead is what is needed of the latest message in a feed to check
+// that the next message follows on from it.
+type feedHead struct {
+	Sequence  int
+	Key       Ref
+	Timestamp float64
+}
+
+// follows checks that m comes straight after head, which is nil if the
+// message before m is not known.
+func (m *SignedMessage) follows(head *feedHead) error {
+	outOfOrder := func(format string, args ...interface{}) error {
+		return &OutOfOrderError{m.Author, m.Sequence, fmt.Sprintf(format, args...)}
+	}
 	if m.Sequence == 1 {
 		return nil
 	}
-	latest := f.GetSeq(tx, m.Sequence-1)
-	if latest == nil && m.Previous != nil {
-		fmt.Println(string(m.Encode()))
-		return fmt.Errorf("Expected message")
+	if head == nil && m.Previous != nil {
+		return outOfOrder("missing message %d", m.Sequence-1)
 	}
-	if m.Previous == nil && latest == nil {
+	if m.Previous == nil && head == nil {
 		return nil
 	}
-	if m.Previous == nil && latest != nil {
-		fmt.Println(string(m.Encode()))
-		return fmt.Errorf("Error: expected previous %s but found %s", latest.Key(), "")
+	if head.Sequence != m.Sequence-1 {
+		return outOfOrder("expected sequence %d", head.Sequence+1)
 	}
-	if latest != nil && m.Sequence == latest.Sequence {
-		return fmt.Errorf("Error: Repeated message")
+	if m.Previous == nil {
+		return outOfOrder("expected previous %s but found none", head.Key)
 	}
-	if *m.Previous != latest.Key() {
-		/*buf, _ := Encode(latest)
-		buf2 := ToJSBinary(buf)
-
-		buf3, _ := Encode(m)
-		fmt.Printf("\n%q\n%q\n%q\n", string(buf), string(buf2), string(buf3))*/
-		return fmt.Errorf("Error: expected previous %s but found %s", latest.Key(), *m.Previous)
+	if *m.Previous != head.Key {
+		return outOfOrder("expected previous %s but found %s", head.Key, *m.Previous)
 	}
-	if m.Sequence != latest.Sequence+1 || m.Timestamp <= latest.Timestamp {
-		return fmt.Errorf("Error: out of order")
+	if m.Timestamp <= head.Timestamp {
+		return outOfOrder("timestamp %v is not after %v", m.Timestamp, head.Timestamp)
 	}
 	return nil
 }
 
 func (m *SignedMessage) Encode() []byte {
-	buf, _ := Encode(m)
-	return buf
+	return m.canonical()
 }
 
 func (m *SignedMessage) Compress() []byte {
@@ -111,6 +225,10 @@ func DecompressMessage(cbuf []byte) *SignedMessage {
 		var m *SignedMessage
 		json.Unmarshal(buf, &m)
 		return m
+	case formatDict:
+		var m *SignedMessage
+		json.Unmarshal(decompressDict(cbuf), &m)
+		return m
 	default:
 		var m *SignedMessage
 		json.Unmarshal(cbuf, &m)
@@ -123,7 +241,7 @@ func (m *SignedMessage) Key() Ref {
 	if m == nil {
 		return Ref{}
 	}
-	buf, _ := Encode(m)
+	buf := m.canonical()
 	/*enc := RemoveUnsupported(charmap.ISO8859_1.NewEncoder())
 	buf, err := enc.Bytes(buf)
 	if err != nil {
@@ -141,7 +259,10 @@ func (m *SignedMessage) Key() Ref {
 }
 
 func (m *Message) Sign(s Signer) *SignedMessage {
-	content, _ := Encode(m)
+	buf, _ := json.Marshal(m)
+	content, _ := CanonicalJSON(buf)
 	sig := s.Sign(content)
-	return &SignedMessage{Message: *m, Signature: sig}
+	sm := &SignedMessage{Message: *m, Signature: sig}
+	sm.raw = sm.canonical()
+	return sm
 }
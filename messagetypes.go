@@ -9,22 +9,29 @@ type MessageBody struct {
 	Message *Message `json:"-"`
 }
 
-var MessageTypes = map[string]func(mb MessageBody) interface{}{}
+func (m *Message) content() json.RawMessage {
+	if m.Private != nil {
+		return m.Private
+	}
+	return m.Content
+}
 
-func (m *Message) DecodeMessage() (t string, mb interface{}) {
+// DecodeMessage decodes the content of m into the type declared for it by
+// the store's modules, or into a generic value if none did.
+func (ds *DataStore) DecodeMessage(m *SignedMessage) (t string, mb interface{}) {
 	Type := &MessageBody{}
-	json.Unmarshal(m.Content, &Type)
-	Type.Message = m
-	if mf, ok := MessageTypes[Type.Type]; ok {
+	json.Unmarshal(m.content(), &Type)
+	Type.Message = &m.Message
+	if mf, ok := ds.messageTypes[Type.Type]; ok {
 		mb = mf(*Type)
 	}
 	t = Type.Type
-	json.Unmarshal(m.Content, &mb)
+	json.Unmarshal(m.content(), &mb)
 	return
 }
 
 func (m *Message) Type() string {
 	Type := &MessageBody{}
-	json.Unmarshal(m.Content, &Type)
+	json.Unmarshal(m.content(), &Type)
 	return Type.Type
 }
@@ -0,0 +1,198 @@
+package ssb
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/andyleap/go-ssb/storage"
+)
+
+// Module extends a DataStore with message types, an index kept from the
+// global log, and whatever methods it serves. Modules are registered on a
+// store as it is opened, with WithModules.
+type Module struct {
+	// Name identifies the module, and keys the state of its index.
+	Name string
+
+	// Deps names the modules this one needs, which must be registered on
+	// the same store and are set up before it.
+	Deps []string
+
+	// MessageTypes decodes the content of the message types it names, for
+	// DecodeMessage.
+	MessageTypes map[string]func(mb MessageBody) interface{}
+
+	// Index, if set, is kept up to date with every message in the log.
+	Index *Index
+
+	// Buckets names the top level buckets the module keeps its data in,
+	// so the space they take can be reported as the module's.
+	Buckets []string
+
+	// Gap is called with the range of sequences, from inclusive to
+	// exclusive, missing before the messages buffered for a feed, so that
+	// they can be requested from connected peers.
+	Gap func(ds *DataStore, feed Ref, from, to int)
+
+	// Init sets the module up on the store, registering its methods and
+	// any state it keeps with SetValue.
+	Init func(ds *DataStore) error
+}
+
+// Index is an index a module keeps of the messages in the global log.
+type Index struct {
+	// Version is bumped when Add changes, to have the index rebuilt the
+	// next time a store is opened.
+	Version int
+
+	// Add indexes a message, in the same transaction that records it as
+	// indexed.
+	Add func(ds *DataStore, m *SignedMessage, tx storage.Tx) error
+
+	// Clear removes everything the index holds before it is rebuilt.
+	Clear func(tx storage.Tx) error
+
+	// Remove undoes Add for a message that is being purged. Indexes
+	// without it are rebuilt from the log after a purge instead.
+	Remove func(ds *DataStore, m *SignedMessage, tx storage.Tx) error
+}
+
+// Option configures a DataStore as it is opened.
+type Option func(ds *DataStore) error
+
+// WithModules registers modules on the store.
+func WithModules(modules ...*Module) Option {
+	return func(ds *DataStore) error {
+		for _, m := range modules {
+			if _, ok := ds.modules[m.Name]; ok {
+				return fmt.Errorf("module %s registered twice", m.Name)
+			}
+			ds.modules[m.Name] = m
+			ds.moduleOrder = append(ds.moduleOrder, m)
+		}
+		return nil
+	}
+}
+
+// Module returns the module registered on the store under name, or nil.
+func (ds *DataStore) Module(name string) *Module {
+	return ds.modules[name]
+}
+
+// Modules returns the modules registered on the store, each after the
+// modules it depends on.
+func (ds *DataStore) Modules() []*Module {
+	return append([]*Module(nil), ds.moduleOrder...)
+}
+
+// sortModules orders the registered modules so each comes after its
+// dependencies, keeping the order they were registered in otherwise.
+func (ds *DataStore) sortModules() error {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := map[string]int{}
+	sorted := make([]*Module, 0, len(ds.moduleOrder))
+	var visit func(m *Module) error
+	visit = func(m *Module) error {
+		switch state[m.Name] {
+		case visiting:
+			return fmt.Errorf("module %s depends on itself", m.Name)
+		case visited:
+			return nil
+		}
+		state[m.Name] = visiting
+		for _, name := range m.Deps {
+			dep, ok := ds.modules[name]
+			if !ok {
+				return fmt.Errorf("module %s needs module %s", m.Name, name)
+			}
+			err := visit(dep)
+			if err != nil {
+				return err
+			}
+		}
+		state[m.Name] = visited
+		sorted = append(sorted, m)
+		return nil
+	}
+	for _, m := range ds.moduleOrder {
+		err := visit(m)
+		if err != nil {
+			return err
+		}
+	}
+	ds.moduleOrder = sorted
+	return nil
+}
+
+// initModules sets up the registered modules, dependencies first.
+func (ds *DataStore) initModules() error {
+	err := ds.sortModules()
+	if err != nil {
+		return err
+	}
+	for _, m := range ds.moduleOrder {
+		for typ, decode := range m.MessageTypes {
+			if _, ok := ds.messageTypes[typ]; ok {
+				return fmt.Errorf("message type %s declared twice, again by module %s", typ, m.Name)
+			}
+			ds.messageTypes[typ] = decode
+		}
+		if m.Index != nil {
+			ds.indexNames = append(ds.indexNames, m.Name)
+		}
+	}
+	sort.Strings(ds.indexNames)
+	for _, m := range ds.moduleOrder {
+		if m.Init == nil {
+			continue
+		}
+		err := m.Init(ds)
+		if err != nil {
+			return fmt.Errorf("module %s: %s", m.Name, err)
+		}
+	}
+	return nil
+}
+
+// indexOf returns the index kept by module, or nil.
+func (ds *DataStore) indexOf(module string) *Index {
+	if m, ok := ds.modules[module]; ok {
+		return m.Index
+	}
+	return nil
+}
+
+// Value returns the value a module stored on the store under key, or nil.
+// As with context values, keys should be of an unexported type of the
+// module's package, so they cannot collide, and each module should offer
+// a typed accessor.
+func (ds *DataStore) Value(key interface{}) interface{} {
+	ds.valuesLock.Lock()
+	defer ds.valuesLock.Unlock()
+	return ds.values[key]
+}
+
+// SetValue stores a value on the store under key, see Value.
+func (ds *DataStore) SetValue(key, value interface{}) {
+	ds.valuesLock.Lock()
+	defer ds.valuesLock.Unlock()
+	ds.values[key] = value
+}
+
+// RegisterMethod registers a method to be served over JSON-RPC.
+func (ds *DataStore) RegisterMethod(name string, method interface{}) {
+	ds.methodsLock.Lock()
+	defer ds.methodsLock.Unlock()
+	ds.methods[name] = method
+}
+
+// Method returns the JSON-RPC method registered under name.
+func (ds *DataStore) Method(name string) (method interface{}, ok bool) {
+	ds.methodsLock.Lock()
+	defer ds.methodsLock.Unlock()
+	method, ok = ds.methods[name]
+	return
+}
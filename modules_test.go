@@ -0,0 +1,46 @@
+package ssb
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/andyleap/go-ssb/storage"
+)
+
+func TestModules(t *testing.T) {
+	kp := newTestKey()
+	open := func(modules ...*Module) (*DataStore, error) {
+		return NewDataStore(storage.NewMemory(), storage.NewBucketLog("log"), kp, WithModules(modules...))
+	}
+
+	var order []string
+	module := func(name string, deps ...string) *Module {
+		return &Module{Name: name, Deps: deps, Init: func(ds *DataStore) error {
+			order = append(order, name)
+			return nil
+		}}
+	}
+	ds, err := open(module("c", "b"), module("a"), module("b", "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds.Close()
+	if fmt.Sprint(order) != "[a b c]" {
+		t.Errorf("modules set up in order %v", order)
+	}
+
+	for _, modules := range [][]*Module{
+		{module("a", "missing")},
+		{module("a"), module("a")},
+		{module("a", "b"), module("b", "a")},
+		{
+			{Name: "a", MessageTypes: map[string]func(mb MessageBody) interface{}{"post": nil}},
+			{Name: "b", MessageTypes: map[string]func(mb MessageBody) interface{}{"post": nil}},
+		},
+	} {
+		if ds, err := open(modules...); err == nil {
+			ds.Close()
+			t.Errorf("opened with modules %v", modules)
+		}
+	}
+}
@@ -9,22 +9,68 @@ import (
 	"github.com/andyleap/muxrpc"
 )
 
+// Handler serves a muxrpc request on a connection.
+type Handler func(conn *muxrpc.Conn, req int32, args json.RawMessage)
+
+// ExtraData holds the muxrpc connections open on a store, and what is
+// served over them.
 type ExtraData struct {
 	Lock  sync.Mutex
 	Conns map[ssb.Ref]*muxrpc.Conn
+
+	handlers   map[string]func(conn *muxrpc.Conn, req int32, args json.RawMessage)
+	onConnects map[string]func(conn *muxrpc.Conn)
+}
+
+type key struct{}
+
+// Module tracks the muxrpc connections of a store. Modules serving muxrpc
+// methods depend on it.
+var Module = &ssb.Module{
+	Name: "muxrpc",
+	Init: func(ds *ssb.DataStore) error {
+		ds.SetValue(key{}, &ExtraData{
+			Conns:      map[ssb.Ref]*muxrpc.Conn{},
+			handlers:   map[string]func(conn *muxrpc.Conn, req int32, args json.RawMessage){},
+			onConnects: map[string]func(conn *muxrpc.Conn){},
+		})
+		return nil
+	},
+}
+
+// Get returns the muxrpc state of ds, or nil if Module is not registered
+// on it.
+func Get(ds *ssb.DataStore) *ExtraData {
+	ed, _ := ds.Value(key{}).(*ExtraData)
+	return ed
 }
 
-func init() {
-	ssb.RegisterInit(func(ds *ssb.DataStore) {
-		ed := &ExtraData{Conns: map[ssb.Ref]*muxrpc.Conn{}}
-		ds.SetExtraData("muxrpcConns", ed)
-	})
+// Handle serves method with handler on every connection to ds.
+func Handle(ds *ssb.DataStore, method string, handler Handler) {
+	ed := Get(ds)
+	ed.Lock.Lock()
+	defer ed.Lock.Unlock()
+	ed.handlers[method] = handler
+}
+
+// OnConnect has fn called, under name, as each connection to ds opens.
+func OnConnect(ds *ssb.DataStore, name string, fn func(conn *muxrpc.Conn)) {
+	ed := Get(ds)
+	ed.Lock.Lock()
+	defer ed.Lock.Unlock()
+	ed.onConnects[name] = fn
 }
 
 func HandleConn(ds *ssb.DataStore, ref ssb.Ref, conn io.ReadWriteCloser) {
-	ed := ds.ExtraData("muxrpcConns").(*ExtraData)
+	ed := Get(ds)
 
-	handlers := ds.ExtraData("muxrpcHandlers").(map[string]func(conn *muxrpc.Conn, req int32, args json.RawMessage))
+	ed.Lock.Lock()
+	handlers := ed.handlers
+	onConnect := make([]func(conn *muxrpc.Conn), 0, len(ed.onConnects))
+	for _, oc := range ed.onConnects {
+		onConnect = append(onConnect, oc)
+	}
+	ed.Lock.Unlock()
 
 	muxConn := muxrpc.New(conn, handlers)
 
@@ -32,12 +78,8 @@ func HandleConn(ds *ssb.DataStore, ref ssb.Ref, conn io.ReadWriteCloser) {
 	ed.Conns[ref] = muxConn
 	ed.Lock.Unlock()
 
-	onConnect, onConnectOK := ds.ExtraData("muxrpcOnConnect").(map[string]func(conn *muxrpc.Conn))
-
-	if onConnectOK {
-		for _, oc := range onConnect {
-			go oc(muxConn)
-		}
+	for _, oc := range onConnect {
+		go oc(muxConn)
 	}
 
 	muxConn.Handle()
@@ -0,0 +1,207 @@
+package ssb
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// MaxRecipients is the largest number of recipients a private message may
+// be boxed to.
+const MaxRecipients = 7
+
+var (
+	ErrTooManyRecipients = errors.New("Too many recipients")
+	ErrNoRecipients      = errors.New("No recipients")
+	ErrInvalidRecipient  = errors.New("Invalid recipient")
+)
+
+// Unboxer is implemented by signers that can also open private messages
+// addressed to their identity.
+type Unboxer interface {
+	Unbox(boxed []byte) ([]byte, bool)
+}
+
+// Box encrypts content to up to MaxRecipients feeds using the private-box
+// format, returning the string used as the message content.
+func Box(content []byte, recps []Ref) (string, error) {
+	if len(recps) == 0 {
+		return "", ErrNoRecipients
+	}
+	if len(recps) > MaxRecipients {
+		return "", ErrTooManyRecipients
+	}
+	var nonce [24]byte
+	var msgKey [32]byte
+	var ephPriv [32]byte
+	for _, b := range [][]byte{nonce[:], msgKey[:], ephPriv[:]} {
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+	}
+	ephPub, err := curve25519.X25519(ephPriv[:], curve25519.Basepoint)
+	if err != nil {
+		return "", err
+	}
+
+	keyHeader := append([]byte{byte(len(recps))}, msgKey[:]...)
+
+	buf := bytes.Buffer{}
+	buf.Write(nonce[:])
+	buf.Write(ephPub)
+	for _, r := range recps {
+		if r.Type != RefFeed || r.Algo != RefAlgoEd25519 {
+			return "", ErrInvalidRecipient
+		}
+		pub, ok := edPublicToCurve(r.Raw())
+		if !ok {
+			return "", ErrInvalidRecipient
+		}
+		shared, err := curve25519.X25519(ephPriv[:], pub)
+		if err != nil {
+			return "", err
+		}
+		var sharedKey [32]byte
+		copy(sharedKey[:], shared)
+		buf.Write(secretbox.Seal(nil, keyHeader, &nonce, &sharedKey))
+	}
+	buf.Write(secretbox.Seal(nil, content, &nonce, &msgKey))
+
+	return base64.StdEncoding.EncodeToString(buf.Bytes()) + ".box", nil
+}
+
+// Unbox attempts to open a private-box using the curve25519 form of the
+// signer's ed25519 key.
+func (k SignerEd25519) Unbox(boxed []byte) ([]byte, bool) {
+	if len(boxed) < 24+32+49 {
+		return nil, false
+	}
+	var nonce [24]byte
+	copy(nonce[:], boxed[:24])
+	ephPub := boxed[24:56]
+
+	shared, err := curve25519.X25519(edPrivateToCurve(k.Private), ephPub)
+	if err != nil {
+		return nil, false
+	}
+	var sharedKey [32]byte
+	copy(sharedKey[:], shared)
+
+	for i := 0; i < MaxRecipients; i++ {
+		start := 56 + i*49
+		if start+49 > len(boxed) {
+			break
+		}
+		keyHeader, ok := secretbox.Open(nil, boxed[start:start+49], &nonce, &sharedKey)
+		if !ok {
+			continue
+		}
+		var msgKey [32]byte
+		copy(msgKey[:], keyHeader[1:])
+		body := 56 + int(keyHeader[0])*49
+		if body > len(boxed) {
+			return nil, false
+		}
+		return secretbox.Open(nil, boxed[body:], &nonce, &msgKey)
+	}
+	return nil, false
+}
+
+func edPrivateToCurve(priv ed25519.PrivateKey) []byte {
+	h := sha512.Sum512(priv[:32])
+	h[0] &= 248
+	h[31] &= 127
+	h[31] |= 64
+	return h[:32]
+}
+
+var curveP = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+
+// edPublicToCurve maps an ed25519 public key to its montgomery u coordinate,
+// u = (1 + y) / (1 - y).
+func edPublicToCurve(pub []byte) ([]byte, bool) {
+	if len(pub) != ed25519.PublicKeySize {
+		return nil, false
+	}
+	le := make([]byte, 32)
+	copy(le, pub)
+	le[31] &= 127
+	y := new(big.Int).SetBytes(reverse(le))
+	if y.Cmp(curveP) >= 0 {
+		return nil, false
+	}
+	one := big.NewInt(1)
+	num := new(big.Int).Add(one, y)
+	den := new(big.Int).Sub(one, y)
+	den.Mod(den, curveP)
+	if den.Sign() == 0 {
+		return nil, false
+	}
+	den.ModInverse(den, curveP)
+	u := num.Mul(num, den)
+	u.Mod(u, curveP)
+
+	out := make([]byte, 32)
+	ub := u.Bytes()
+	copy(out[32-len(ub):], ub)
+	return reverse(out), true
+}
+
+func reverse(b []byte) []byte {
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return b
+}
+
+// IsBoxed reports whether the message content is an encrypted string.
+func (m *Message) IsBoxed() bool {
+	var s string
+	if json.Unmarshal(m.Content, &s) != nil {
+		return false
+	}
+	return strings.HasSuffix(s, ".box")
+}
+
+func (m *Message) boxed() []byte {
+	var s string
+	if json.Unmarshal(m.Content, &s) != nil {
+		return nil
+	}
+	buf, err := base64.StdEncoding.DecodeString(strings.TrimSuffix(s, ".box"))
+	if err != nil {
+		return nil
+	}
+	return buf
+}
+
+// Unbox tries every local identity against a boxed message and returns the
+// plaintext content if one of them is a recipient.
+func (ds *DataStore) Unbox(m *SignedMessage) ([]byte, bool) {
+	if !m.IsBoxed() {
+		return nil, false
+	}
+	boxed := m.boxed()
+	if boxed == nil {
+		return nil, false
+	}
+	ds.keysLock.RLock()
+	defer ds.keysLock.RUnlock()
+	for _, k := range ds.Keys {
+		if u, ok := k.(Unboxer); ok {
+			if content, ok := u.Unbox(boxed); ok {
+				return content, true
+			}
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,79 @@
+package ssb
+
+import (
+	"bytes"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestBoxRoundTrip(t *testing.T) {
+	var signers []*SignerEd25519
+	var recps []Ref
+	for i := 0; i < 3; i++ {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		curvePub, err := curve25519.X25519(edPrivateToCurve(priv), curve25519.Basepoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		converted, ok := edPublicToCurve(pub)
+		if !ok || !bytes.Equal(converted, curvePub) {
+			t.Fatalf("public key conversion mismatch: %x != %x", converted, curvePub)
+		}
+		ref, _ := NewRef(RefFeed, pub, RefAlgoEd25519)
+		signers = append(signers, &SignerEd25519{priv})
+		recps = append(recps, ref)
+	}
+
+	content := []byte(`{"type":"post","text":"hello"}`)
+	boxed, err := Box(content, recps[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(boxed, ".box") {
+		t.Fatalf("expected .box suffix, got %q", boxed)
+	}
+	m := &Message{Content: []byte(`"` + boxed + `"`)}
+	if !m.IsBoxed() {
+		t.Fatal("expected message to be boxed")
+	}
+	for i, s := range signers {
+		plain, ok := s.Unbox(m.boxed())
+		if i < 2 && (!ok || !bytes.Equal(plain, content)) {
+			t.Errorf("recipient %d could not unbox", i)
+		}
+		if i == 2 && ok {
+			t.Errorf("non-recipient unboxed message")
+		}
+	}
+
+	_, err = Box(content, make([]Ref, MaxRecipients+1))
+	if err != ErrTooManyRecipients {
+		t.Errorf("expected ErrTooManyRecipients, got %v", err)
+	}
+}
+
+// boxVector was boxed in JS, by private-box's multibox written out over
+// tweetnacl, to the feeds with ed25519 seeds of all 1s and all 2s.
+const boxVector = "+EcExcl9sxkBo8oEo/GeNyS80xh+WU64p4qZ3ziHPBAmR4I/joY+lqTWMopwyA7PmbTYq/vzfWWxUk0ZTfCJPhjSscTexhqVlBBd/PzzCgupra+l4xR/7r8PfCRZDBWHZfG09JRqc0kWLtT9KgqtTEYfl9zZ8eP9dJfa9CIS80VDbhlzEOJoUuNlk2obDU+BrvvlbhFeBtWX0p7XUu6EYrkCKqTp9KxCQoeO/xOm8X5kbP2rqWXk8S5rX0Q5yyaQj5b0gudSGFekiX0vKvpQ9d90f21ZMvzp6g==.box"
+
+func TestUnboxVector(t *testing.T) {
+	m := &Message{Content: []byte(`"` + boxVector + `"`)}
+	content := []byte(`{"type":"post","text":"hello from private-box"}`)
+	for i := byte(1); i <= 3; i++ {
+		s := &SignerEd25519{ed25519.NewKeyFromSeed(bytes.Repeat([]byte{i}, ed25519.SeedSize))}
+		plain, ok := s.Unbox(m.boxed())
+		if i <= 2 && (!ok || !bytes.Equal(plain, content)) {
+			t.Errorf("recipient %d could not unbox: %q", i, plain)
+		}
+		if i == 3 && ok {
+			t.Errorf("non-recipient unboxed message")
+		}
+	}
+}
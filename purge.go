@@ -0,0 +1,274 @@
+package ssb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/andyleap/go-ssb/storage"
+)
+
+var ErrFeedPurged = errors.New("Feed is purged")
+
+// PurgedFeed is what is kept of a feed once it is purged.
+type PurgedFeed struct {
+	Feed     Ref       `json:"feed"`
+	Time     time.Time `json:"time"`
+	Messages int       `json:"messages"`
+}
+
+func (ds *DataStore) registerPurgeMethods() {
+	ds.RegisterMethod("feed.Purge", ds.PurgeFeed)
+	ds.RegisterMethod("feed.Unblock", ds.UnblockFeed)
+	ds.RegisterMethod("feed.Purged", func() []PurgedFeed {
+		return ds.PurgedFeeds()
+	})
+}
+
+func (ds *DataStore) purged(tx storage.Tx, feed Ref) bool {
+	PurgedBucket := tx.Bucket([]byte("purged"))
+	if PurgedBucket == nil {
+		return false
+	}
+	return PurgedBucket.Get(feed.DBKey()) != nil
+}
+
+// PurgedFeeds returns the feeds that have been purged and not unblocked.
+func (ds *DataStore) PurgedFeeds() (feeds []PurgedFeed) {
+	ds.db.View(func(tx storage.Tx) error {
+		PurgedBucket := tx.Bucket([]byte("purged"))
+		if PurgedBucket == nil {
+			return nil
+		}
+		return PurgedBucket.ForEach(func(k, v []byte) error {
+			var p PurgedFeed
+			if json.Unmarshal(v, &p) == nil {
+				feeds = append(feeds, p)
+			}
+			return nil
+		})
+	})
+	return
+}
+
+// PurgeFeed deletes every message of feed from the store, along with what
+// the indexes hold for them, and erases them from the global log. The feed
+// is then blocked, so none of its messages are stored again until
+// UnblockFeed is called for it.
+func (ds *DataStore) PurgeFeed(feed Ref) error {
+	f := ds.GetFeed(feed)
+	if f == nil {
+		return fmt.Errorf("Cannot purge %s, not a feed", feed)
+	}
+	if ds.IsIdentity(feed) {
+		return fmt.Errorf("Cannot purge %s, it is one of ours", feed)
+	}
+	ix := ds.indexer
+	// Holding commit keeps the indexer from moving past the messages
+	// while they are removed from the indexes.
+	ix.commit.Lock()
+	defer ix.commit.Unlock()
+
+	var reset []string
+	var erase []int
+	locked := false
+	err := ds.db.Update(func(tx storage.Tx) error {
+		f.SeqLock.Lock()
+		locked = true
+		reset = nil
+
+		offsets := map[string]int{}
+		for _, module := range ds.indexNames {
+			st, ok := ds.indexState(tx, module)
+			if !ok {
+				st.Offset = -1
+			}
+			offsets[module] = st.Offset
+		}
+
+		msgs, logKeys := ds.feedMessages(tx, feed)
+		erase = logKeys
+		rebuild := map[string]bool{}
+		for i, m := range msgs {
+			for _, module := range ds.indexNames {
+				if offsets[module] < logKeys[i] {
+					continue
+				}
+				index := ds.indexOf(module)
+				if index.Remove == nil {
+					rebuild[module] = true
+					continue
+				}
+				err := index.Remove(ds, m, tx)
+				if err != nil {
+					return fmt.Errorf("Bolt %s hook: %s", module, err)
+				}
+			}
+			err := ds.purgeMessage(tx, m, logKeys[i])
+			if err != nil {
+				return err
+			}
+		}
+
+		if FeedsBucket := tx.Bucket([]byte("feeds")); FeedsBucket != nil && FeedsBucket.Bucket(feed.DBKey()) != nil {
+			err := FeedsBucket.DeleteBucket(feed.DBKey())
+			if err != nil {
+				return err
+			}
+		}
+		if ForksBucket := tx.Bucket([]byte("forks")); ForksBucket != nil && ForksBucket.Bucket(feed.DBKey()) != nil {
+			err := ForksBucket.DeleteBucket(feed.DBKey())
+			if err != nil {
+				return err
+			}
+		}
+		for _, module := range ds.indexNames {
+			if rebuild[module] {
+				err := ds.resetIndex(tx, module)
+				if err != nil {
+					return err
+				}
+				reset = append(reset, module)
+			}
+		}
+
+		PurgedBucket, err := tx.CreateBucketIfNotExists([]byte("purged"))
+		if err != nil {
+			return err
+		}
+		buf, _ := json.Marshal(PurgedFeed{Feed: feed, Time: time.Now(), Messages: len(msgs)})
+		return PurgedBucket.Put(feed.DBKey(), buf)
+	})
+	if err == nil {
+		f.LatestSeq, f.latestKey, f.latestTimestamp = 0, Ref{}, 0
+		f.forked = false
+		f.purged = true
+	}
+	if locked {
+		f.SeqLock.Unlock()
+	}
+	if err != nil {
+		return err
+	}
+
+	f.waitingLock.Lock()
+	for seq := range f.waiting {
+		ds.ingest.take(f, seq)
+	}
+	f.waitingLock.Unlock()
+
+	// The records are only erased once nothing refers to them, as an
+	// offset log is not rolled back with a failed transaction.
+	if eraser, ok := ds.log.(storage.Eraser); ok {
+		err = ds.db.Update(func(tx storage.Tx) error {
+			for _, seq := range erase {
+				err := eraser.Erase(tx, seq)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Println("Purged", len(erase), "messages of", feed)
+	if len(reset) > 0 {
+		ix.reload()
+		for _, module := range reset {
+			ix.track(module, -1, true)
+		}
+		ix.poke()
+	}
+	return nil
+}
+
+// feedMessages returns the messages stored for feed, with where each is
+// in the global log.
+func (ds *DataStore) feedMessages(tx storage.Tx, feed Ref) (msgs []*SignedMessage, logKeys []int) {
+	FeedsBucket := tx.Bucket([]byte("feeds"))
+	if FeedsBucket == nil {
+		return
+	}
+	FeedBucket := FeedsBucket.Bucket(feed.DBKey())
+	if FeedBucket == nil {
+		return
+	}
+	FeedLogBucket := FeedBucket.Bucket([]byte("log"))
+	if FeedLogBucket == nil {
+		return
+	}
+	PointerBucket := tx.Bucket([]byte("pointer"))
+	FeedLogBucket.ForEach(func(k, v []byte) error {
+		m := ds.decodeEntry(tx, v)
+		if m == nil || PointerBucket == nil {
+			return nil
+		}
+		pdata := PointerBucket.Get(m.Key().DBKey())
+		if pdata == nil {
+			return nil
+		}
+		p := Pointer{}
+		p.Unmarshal(pdata)
+		loadPrivate(tx, m)
+		msgs = append(msgs, m)
+		logKeys = append(logKeys, p.LogKey)
+		return nil
+	})
+	return
+}
+
+// purgeMessage deletes what the store keeps for m, at seq in the global
+// log, outside its feed's bucket and the log itself.
+func (ds *DataStore) purgeMessage(tx storage.Tx, m *SignedMessage, seq int) error {
+	key := m.Key().DBKey()
+	for _, name := range []string{"pointer", "private"} {
+		if b := tx.Bucket([]byte(name)); b != nil {
+			err := b.Delete(key)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if ReceivedBucket := tx.Bucket([]byte("received")); ReceivedBucket != nil {
+		return ReceivedBucket.Delete(itob(seq))
+	}
+	return nil
+}
+
+// UnblockFeed lets the messages of a purged feed be stored again.
+func (ds *DataStore) UnblockFeed(feed Ref) error {
+	f := ds.GetFeed(feed)
+	if f == nil {
+		return fmt.Errorf("Cannot unblock %s, not a feed", feed)
+	}
+	locked := false
+	err := ds.db.Update(func(tx storage.Tx) error {
+		f.SeqLock.Lock()
+		locked = true
+		PurgedBucket := tx.Bucket([]byte("purged"))
+		if PurgedBucket == nil {
+			return nil
+		}
+		return PurgedBucket.Delete(feed.DBKey())
+	})
+	if err == nil {
+		f.purged = false
+	}
+	if locked {
+		f.SeqLock.Unlock()
+	}
+	return err
+}
+
+// Purged reports whether the feed has been purged, in which case its
+// messages are not stored until it is unblocked.
+func (f *Feed) Purged() bool {
+	f.SeqLock.Lock()
+	defer f.SeqLock.Unlock()
+	return f.purged
+}
@@ -0,0 +1,186 @@
+package ssb
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+
+	"github.com/andyleap/go-ssb/storage"
+)
+
+func TestPurgeFeed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "purge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kp := newTestKey()
+
+	var lock sync.Mutex
+	keys := map[Ref]bool{}
+	plain := 0
+	modules := WithModules(
+		&Module{Name: "keys", Index: &Index{
+			Add: func(ds *DataStore, m *SignedMessage, tx storage.Tx) error {
+				lock.Lock()
+				defer lock.Unlock()
+				keys[m.Key()] = true
+				return nil
+			},
+			Remove: func(ds *DataStore, m *SignedMessage, tx storage.Tx) error {
+				lock.Lock()
+				defer lock.Unlock()
+				delete(keys, m.Key())
+				return nil
+			},
+		}},
+		&Module{Name: "plain", Index: &Index{
+			Add: func(ds *DataStore, m *SignedMessage, tx storage.Tx) error {
+				lock.Lock()
+				defer lock.Unlock()
+				plain++
+				return nil
+			},
+			Clear: func(tx storage.Tx) error {
+				lock.Lock()
+				defer lock.Unlock()
+				plain = 0
+				return nil
+			},
+		}},
+	)
+
+	opub, opriv, _ := ed25519.GenerateKey(rand.Reader)
+	other, _ := NewRef(RefFeed, opub, RefAlgoEd25519)
+	var msgs []*SignedMessage
+	var previous *Ref
+	for seq := 1; seq <= 3; seq++ {
+		m := &Message{
+			Previous:  previous,
+			Author:    other,
+			Sequence:  seq,
+			Timestamp: float64(seq),
+			Hash:      "sha256",
+			Content:   json.RawMessage(`{"type":"post","text":"spam"}`),
+		}
+		sm := m.Sign(&SignerEd25519{opriv})
+		key := sm.Key()
+		previous = &key
+		msgs = append(msgs, sm)
+	}
+
+	for name, open := range map[string]func() (*DataStore, error){
+		"bucket": func() (*DataStore, error) {
+			return NewDataStore(storage.NewMemory(), storage.NewBucketLog("log"), kp, modules)
+		},
+		"flume": func() (*DataStore, error) {
+			return OpenFlumeDataStore(filepath.Join(dir, "db"), filepath.Join(dir, "log.offset"), kp, modules)
+		},
+	} {
+		keys, plain = map[Ref]bool{}, 0
+		ds, err := open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		wait := func() {
+			if err := ds.WaitIndexed(ctx, ds.LogHead()); err != nil {
+				t.Fatalf("%s: %s", name, err)
+			}
+		}
+
+		for i := 0; i < 2; i++ {
+			if _, err := ds.GetFeed(ds.PrimaryRef).PublishMessage(map[string]interface{}{"type": "post", "text": "hello"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		f := ds.GetFeed(other)
+		for _, m := range msgs {
+			f.AddMessage(m)
+		}
+		for f.Latest() == nil || f.Latest().Sequence != 3 {
+			if ctx.Err() != nil {
+				t.Fatalf("%s: messages not stored", name)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		wait()
+
+		if err := ds.PurgeFeed(ds.PrimaryRef); err == nil {
+			t.Errorf("%s: purged our own feed", name)
+		}
+		if err := ds.PurgeFeed(other); err != nil {
+			t.Fatal(err)
+		}
+		wait()
+		check := func(when string) {
+			lock.Lock()
+			defer lock.Unlock()
+			if len(keys) != 2 || plain != 2 {
+				t.Errorf("%s %s: indexes hold %d keys and %d messages", name, when, len(keys), plain)
+			}
+			for _, m := range msgs {
+				if ds.Get(nil, m.Key()) != nil || keys[m.Key()] {
+					t.Errorf("%s %s: message %d still stored", name, when, m.Sequence)
+				}
+			}
+			if f.Latest() != nil {
+				t.Errorf("%s %s: feed still has messages", name, when)
+			}
+			n := 0
+			for e := range ds.LogStream(0, false, false, 0) {
+				if e.Value.Author == other {
+					t.Errorf("%s %s: log still has message %d", name, when, e.Value.Sequence)
+				}
+				n++
+			}
+			if n != 2 {
+				t.Errorf("%s %s: log has %d messages", name, when, n)
+			}
+		}
+		check("after purge")
+		if purged := ds.PurgedFeeds(); len(purged) != 1 || purged[0].Feed != other || purged[0].Messages != 3 {
+			t.Errorf("%s: purged feeds are %+v", name, purged)
+		}
+
+		ds.ingest.verify(f, msgs[0])
+		if stats := ds.IngestStats(); stats.Buffered != 0 {
+			t.Errorf("%s: message of purged feed buffered", name)
+		}
+
+		if name == "flume" {
+			ds.Close()
+			keys, plain = map[Ref]bool{}, 0
+			if ds, err = open(); err != nil {
+				t.Fatal(err)
+			}
+			ds.RebuildAll()
+			wait()
+			f = ds.GetFeed(other)
+			check("after reopening")
+		}
+
+		if err := ds.UnblockFeed(other); err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range msgs {
+			f.AddMessage(m)
+		}
+		for f.Latest() == nil || f.Latest().Sequence != 3 {
+			if ctx.Err() != nil {
+				t.Fatalf("%s: messages not stored after unblocking", name)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		ds.Close()
+	}
+}
@@ -0,0 +1,205 @@
+package query
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"math"
+	"strings"
+
+	"github.com/andyleap/go-ssb"
+	"github.com/andyleap/go-ssb/storage"
+)
+
+// Indexes declares the secondary indexes kept for queries, by name. Each
+// index is keyed by the values of its fields in order, then by message
+// timestamp, so it can answer queries that fix all of those fields.
+// Fields are "author" or a dotted path into the content such as
+// "content.vote.link". Other packages may add indexes from their init, they
+// are built from the log the first time a store is opened with them.
+var Indexes = map[string][]string{
+	"time":        {},
+	"author":      {"author"},
+	"type":        {"content.type"},
+	"author_type": {"author", "content.type"},
+	"channel":     {"content.channel"},
+	"root":        {"content.root"},
+}
+
+var index = &ssb.Index{
+	Add: func(ds *ssb.DataStore, m *ssb.SignedMessage, tx storage.Tx) error {
+		IndexBucket, err := tx.CreateBucketIfNotExists([]byte("queryindex"))
+		if err != nil {
+			return err
+		}
+		content := decodeContent(m)
+		for name, fields := range Indexes {
+			b, err := IndexBucket.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return err
+			}
+			err = addEntry(b, m, content, fields)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	Remove: func(ds *ssb.DataStore, m *ssb.SignedMessage, tx storage.Tx) error {
+		IndexBucket := tx.Bucket([]byte("queryindex"))
+		if IndexBucket == nil {
+			return nil
+		}
+		content := decodeContent(m)
+		for name, fields := range Indexes {
+			b := IndexBucket.Bucket([]byte(name))
+			if b == nil {
+				continue
+			}
+			if key := entryKey(m, content, fields); key != nil {
+				err := b.Delete(key)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	},
+	Clear: func(tx storage.Tx) error {
+		tx.DeleteBucket([]byte("queryindex"))
+		return nil
+	},
+}
+
+// decodeContent parses the public content of m. Private messages are only
+// indexed by author and time, so queries cannot reveal what they hold.
+func decodeContent(m *ssb.SignedMessage) map[string]interface{} {
+	var content map[string]interface{}
+	json.Unmarshal(m.Content, &content)
+	return content
+}
+
+// fieldValue returns the encoded value of field in m, and false if m does
+// not have a value for it that can be indexed.
+func fieldValue(m *ssb.SignedMessage, content map[string]interface{}, field string) ([]byte, bool) {
+	if field == "author" {
+		return encodeValue(m.Author.String()), true
+	}
+	if !strings.HasPrefix(field, "content.") {
+		return nil, false
+	}
+	var v interface{} = content
+	for _, part := range strings.Split(strings.TrimPrefix(field, "content."), ".") {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = obj[part]; !ok {
+			return nil, false
+		}
+	}
+	switch v.(type) {
+	case map[string]interface{}, []interface{}:
+		return nil, false
+	}
+	return encodeValue(v), true
+}
+
+// encodeValue encodes a scalar JSON value, tagged so that a string never
+// matches a number or literal with the same text.
+func encodeValue(v interface{}) []byte {
+	if s, ok := v.(string); ok {
+		return append([]byte{'s'}, s...)
+	}
+	buf, _ := json.Marshal(v)
+	return append([]byte{'j'}, buf...)
+}
+
+// prefix joins the values of an index's fields into the start of its keys.
+func prefix(values [][]byte) []byte {
+	var p []byte
+	for _, v := range values {
+		var l [4]byte
+		binary.BigEndian.PutUint32(l[:], uint32(len(v)))
+		p = append(p, l[:]...)
+		p = append(p, v...)
+	}
+	return p
+}
+
+// timeKey encodes ts so that keys sort in timestamp order.
+func timeKey(ts float64) []byte {
+	bits := math.Float64bits(ts)
+	if ts >= 0 {
+		bits ^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, bits)
+	return b
+}
+
+func entryKey(m *ssb.SignedMessage, content map[string]interface{}, fields []string) []byte {
+	values := make([][]byte, 0, len(fields))
+	for _, field := range fields {
+		v, ok := fieldValue(m, content, field)
+		if !ok {
+			return nil
+		}
+		values = append(values, v)
+	}
+	key := prefix(values)
+	key = append(key, timeKey(m.Timestamp)...)
+	return append(key, m.Key().DBKey()...)
+}
+
+func addEntry(b storage.Bucket, m *ssb.SignedMessage, content map[string]interface{}, fields []string) error {
+	key := entryKey(m, content, fields)
+	if key == nil {
+		return nil
+	}
+	return b.Put(key, m.Key().DBKey())
+}
+
+// ensureIndexes builds any declared index that the store does not have yet,
+// or whose fields have changed since it was built.
+func ensureIndexes(ds *ssb.DataStore, tx storage.Tx) error {
+	DefsBucket, err := tx.CreateBucketIfNotExists([]byte("query"))
+	if err != nil {
+		return err
+	}
+	IndexBucket, err := tx.CreateBucketIfNotExists([]byte("queryindex"))
+	if err != nil {
+		return err
+	}
+	for name, fields := range Indexes {
+		def, _ := json.Marshal(fields)
+		if bytes.Equal(DefsBucket.Get([]byte(name)), def) {
+			continue
+		}
+		log.Println("Building query index", name)
+		IndexBucket.DeleteBucket([]byte(name))
+		b, err := IndexBucket.CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return err
+		}
+		cursor := ds.Log().Cursor(tx)
+		for _, v := cursor.First(); v != nil; _, v = cursor.Next() {
+			m := ds.LogEntry(tx, v)
+			if m == nil {
+				continue
+			}
+			err = addEntry(b, m, decodeContent(m), fields)
+			if err != nil {
+				return err
+			}
+		}
+		err = DefsBucket.Put([]byte(name), def)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,342 @@
+// Package query answers queries over the messages in a DataStore from
+// secondary indexes declared in Indexes.
+package query
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/andyleap/go-ssb"
+	"github.com/andyleap/go-ssb/muxrpcManager"
+	"github.com/andyleap/go-ssb/storage"
+	"github.com/andyleap/muxrpc"
+	"github.com/andyleap/muxrpc/codec"
+)
+
+var (
+	ErrInvalidCursor = errors.New("Invalid query cursor")
+	ErrMissingValue  = errors.New("Query field given without a value")
+)
+
+// DefaultLimit is how many messages a query returns when it sets no limit.
+var DefaultLimit = 100
+
+// MaxScan is how many index entries one read looks at before returning
+// what it has found with a cursor to carry on from, so that a query whose
+// filters are not covered by an index cannot tie up the store.
+var MaxScan = 10000
+
+// Query selects messages by author, content type, channel and the value
+// of a dotted path into the content, within a range of message timestamps.
+// Unset fields match everything.
+type Query struct {
+	Author  ssb.Ref `json:"author"`
+	Type    string  `json:"type,omitempty"`
+	Channel string  `json:"channel,omitempty"`
+
+	// Field is a dotted path into the content, such as "vote.link",
+	// which must equal Value.
+	Field string          `json:"field,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+
+	// Since and Until bound the message timestamp, Since inclusive and
+	// Until exclusive. Zero leaves that end open.
+	Since float64 `json:"since,omitempty"`
+	Until float64 `json:"until,omitempty"`
+
+	// Reverse returns the newest messages first.
+	Reverse bool `json:"reverse,omitempty"`
+	Limit   int  `json:"limit,omitempty"`
+
+	// Cursor continues a previous read of the same query.
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// Result is a page of messages matching a query. Cursor is set when there
+// may be more, and is passed in the query to read them.
+type Result struct {
+	Messages []*ssb.SignedMessage `json:"messages"`
+	Cursor   string               `json:"cursor,omitempty"`
+}
+
+// Module indexes messages by the fields in Indexes, and serves queries
+// over them.
+var Module = &ssb.Module{
+	Name:    "query",
+	Deps:    []string{"muxrpc"},
+	Index:   index,
+	Buckets: []string{"query", "queryindex"},
+	Init: func(ds *ssb.DataStore) error {
+		err := ds.DB().Update(func(tx storage.Tx) error {
+			return ensureIndexes(ds, tx)
+		})
+		if err != nil {
+			log.Println("query:", err)
+		}
+
+		ds.RegisterMethod("query.Read", func(q Query) (*Result, error) {
+			return Read(ds, q)
+		})
+		muxrpcManager.Handle(ds, "query.read", func(conn *muxrpc.Conn, req int32, rm json.RawMessage) {
+			var q Query
+			args := []interface{}{&q}
+			json.Unmarshal(rm, &args)
+			go readStream(ds, conn, req, q)
+		})
+		return nil
+	},
+}
+
+// readStream sends every message matching q, or the first q.Limit of
+// them, reading a page at a time.
+func readStream(ds *ssb.DataStore, conn *muxrpc.Conn, req int32, q Query) {
+	limited, remaining := q.Limit > 0, q.Limit
+	for {
+		q.Limit = DefaultLimit
+		if limited && remaining < q.Limit {
+			q.Limit = remaining
+		}
+		res, err := Read(ds, q)
+		if err != nil {
+			buf, _ := json.Marshal(map[string]string{"message": err.Error(), "name": "Error"})
+			conn.Send(&codec.Packet{
+				Req:    -req,
+				Type:   codec.JSON,
+				Body:   buf,
+				Stream: true,
+				EndErr: true,
+			})
+			return
+		}
+		for _, m := range res.Messages {
+			buf, _ := json.Marshal(struct {
+				Key   ssb.Ref            `json:"key"`
+				Value *ssb.SignedMessage `json:"value"`
+			}{m.Key(), m})
+			err := conn.Send(&codec.Packet{
+				Req:    -req,
+				Type:   codec.JSON,
+				Body:   buf,
+				Stream: true,
+			})
+			if err != nil {
+				return
+			}
+		}
+		remaining -= len(res.Messages)
+		if res.Cursor == "" || (limited && remaining <= 0) {
+			break
+		}
+		select {
+		case <-conn.Done:
+			return
+		default:
+		}
+		q.Cursor = res.Cursor
+	}
+	conn.Send(&codec.Packet{
+		Req:    -req,
+		Type:   codec.JSON,
+		Body:   []byte("true"),
+		Stream: true,
+		EndErr: true,
+	})
+}
+
+// filters returns the values q requires, by field.
+func (q Query) filters() (map[string][]byte, error) {
+	eq := map[string][]byte{}
+	if q.Author.Type != ssb.RefInvalid {
+		eq["author"] = encodeValue(q.Author.String())
+	}
+	if q.Type != "" {
+		eq["content.type"] = encodeValue(q.Type)
+	}
+	if q.Channel != "" {
+		eq["content.channel"] = encodeValue(q.Channel)
+	}
+	if q.Field != "" {
+		if len(q.Value) == 0 {
+			return nil, ErrMissingValue
+		}
+		var v interface{}
+		err := json.Unmarshal(q.Value, &v)
+		if err != nil {
+			return nil, err
+		}
+		eq["content."+strings.TrimPrefix(q.Field, "content.")] = encodeValue(v)
+	}
+	return eq, nil
+}
+
+// plan picks the index covering the most of the filters, preferring the
+// name that sorts first on a tie so a query always uses the same one.
+func plan(eq map[string][]byte) (name string, fields []string) {
+	best := -1
+	for n, f := range Indexes {
+		covered := true
+		for _, field := range f {
+			if _, ok := eq[field]; !ok {
+				covered = false
+				break
+			}
+		}
+		if !covered || len(f) < best || (len(f) == best && n > name) {
+			continue
+		}
+		name, fields, best = n, f, len(f)
+	}
+	return
+}
+
+// Read returns a page of the messages matching q, in timestamp order.
+func Read(ds *ssb.DataStore, q Query) (res *Result, err error) {
+	err = ds.DB().View(func(tx storage.Tx) error {
+		res, err = read(ds, tx, q)
+		return err
+	})
+	return
+}
+
+func read(ds *ssb.DataStore, tx storage.Tx, q Query) (*Result, error) {
+	eq, err := q.filters()
+	if err != nil {
+		return nil, err
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	name, fields := plan(eq)
+	values := make([][]byte, len(fields))
+	for i, field := range fields {
+		values[i] = eq[field]
+	}
+	p := prefix(values)
+
+	var after []byte
+	if q.Cursor != "" {
+		after, err = decodeCursor(q.Cursor, name, p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res := &Result{Messages: []*ssb.SignedMessage{}}
+	IndexBucket := tx.Bucket([]byte("queryindex"))
+	if IndexBucket == nil {
+		return res, nil
+	}
+	b := IndexBucket.Bucket([]byte(name))
+	if b == nil {
+		return res, nil
+	}
+
+	var lower, upper []byte
+	if q.Since != 0 {
+		lower = append(append([]byte{}, p...), timeKey(q.Since)...)
+	}
+	if q.Until != 0 {
+		upper = append(append([]byte{}, p...), timeKey(q.Until)...)
+	}
+
+	cursor := b.Cursor()
+	var k, v []byte
+	switch {
+	case q.Reverse && after != nil:
+		k, v = before(cursor, after)
+	case q.Reverse && upper != nil:
+		k, v = before(cursor, upper)
+	case q.Reverse:
+		k, v = before(cursor, successor(p))
+	case after != nil:
+		if k, v = cursor.Seek(after); bytes.Equal(k, after) {
+			k, v = cursor.Next()
+		}
+	case lower != nil:
+		k, v = cursor.Seek(lower)
+	default:
+		k, v = cursor.Seek(p)
+	}
+
+	var last []byte
+	for scanned := 0; k != nil; scanned++ {
+		if !bytes.HasPrefix(k, p) ||
+			(lower != nil && bytes.Compare(k, lower) < 0) ||
+			(upper != nil && bytes.Compare(k, upper) >= 0) {
+			break
+		}
+		if len(res.Messages) >= limit || scanned >= MaxScan {
+			res.Cursor = encodeCursor(name, last)
+			break
+		}
+		last = append(last[:0], k...)
+		if m := ds.Get(tx, ssb.DBRef(v)); m != nil && matches(m, eq) {
+			res.Messages = append(res.Messages, m)
+		}
+		if q.Reverse {
+			k, v = cursor.Prev()
+		} else {
+			k, v = cursor.Next()
+		}
+	}
+	return res, nil
+}
+
+// before positions cursor on the last key below key, or the last key of
+// all if key is nil.
+func before(cursor storage.Cursor, key []byte) ([]byte, []byte) {
+	if key == nil {
+		return cursor.Last()
+	}
+	if k, _ := cursor.Seek(key); k == nil {
+		return cursor.Last()
+	}
+	return cursor.Prev()
+}
+
+func matches(m *ssb.SignedMessage, eq map[string][]byte) bool {
+	content := decodeContent(m)
+	for field, want := range eq {
+		v, ok := fieldValue(m, content, field)
+		if !ok || !bytes.Equal(v, want) {
+			return false
+		}
+	}
+	return true
+}
+
+// successor returns the first key after every key starting with p, or nil
+// if there is none.
+func successor(p []byte) []byte {
+	s := append([]byte{}, p...)
+	for i := len(s) - 1; i >= 0; i-- {
+		if s[i] < 0xff {
+			s[i]++
+			return s[:i+1]
+		}
+	}
+	return nil
+}
+
+func encodeCursor(index string, key []byte) string {
+	return index + "." + base64.RawURLEncoding.EncodeToString(key)
+}
+
+// decodeCursor checks that a cursor was made by the same query before
+// returning the key it holds.
+func decodeCursor(c string, index string, p []byte) ([]byte, error) {
+	i := strings.LastIndex(c, ".")
+	if i < 0 || c[:i] != index {
+		return nil, ErrInvalidCursor
+	}
+	key, err := base64.RawURLEncoding.DecodeString(c[i+1:])
+	if err != nil || !bytes.HasPrefix(key, p) {
+		return nil, ErrInvalidCursor
+	}
+	return key, nil
+}
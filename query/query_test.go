@@ -0,0 +1,137 @@
+package query
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+
+	"github.com/andyleap/go-ssb"
+	"github.com/andyleap/go-ssb/muxrpcManager"
+	"github.com/andyleap/go-ssb/ssbtest"
+	"github.com/andyleap/go-ssb/storage"
+)
+
+func keys(msgs []*ssb.SignedMessage) (keys []ssb.Ref) {
+	for _, m := range msgs {
+		keys = append(keys, m.Key())
+	}
+	return
+}
+
+func TestRead(t *testing.T) {
+	ds := ssbtest.NewStore(t, ssb.WithModules(muxrpcManager.Module, Module))
+	defer ds.Close()
+
+	var authors []*ssb.Feed
+	for i := 0; i < 3; i++ {
+		pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+		ref, _ := ssb.NewRef(ssb.RefFeed, pub, ssb.RefAlgoEd25519)
+		ds.Keys[ref] = &ssb.SignerEd25519{Private: priv}
+		authors = append(authors, ds.GetFeed(ref))
+	}
+
+	var all, posts, golang []*ssb.SignedMessage
+	for i := 0; i < 30; i++ {
+		f := authors[i%3]
+		content := map[string]interface{}{"type": "post", "text": fmt.Sprint(i)}
+		if i%2 == 0 {
+			content["channel"] = "golang"
+		}
+		vote := i > 0 && i%5 == 0
+		if vote {
+			content = map[string]interface{}{"type": "vote", "vote": map[string]interface{}{"link": all[0].Key(), "value": 1}}
+		}
+		// Keep timestamps distinct across authors so the expected order
+		// is the order of publishing.
+		time.Sleep(2 * time.Millisecond)
+		m, err := f.PublishMessage(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, m)
+		if !vote {
+			if f == authors[0] {
+				posts = append(posts, m)
+			}
+			if i%2 == 0 {
+				golang = append(golang, m)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ds.WaitIndexed(ctx, ds.LogHead(), "query"); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(q Query) []ssb.Ref {
+		res, err := Read(ds, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return keys(res.Messages)
+	}
+	check := func(name string, got []ssb.Ref, want []*ssb.SignedMessage) {
+		if fmt.Sprint(got) != fmt.Sprint(keys(want)) {
+			t.Errorf("%s: got %d messages, expected %d", name, len(got), len(want))
+		}
+	}
+
+	check("author and type", read(Query{Author: authors[0].ID, Type: "post"}), posts)
+	check("channel", read(Query{Channel: "golang"}), golang)
+	link, _ := json.Marshal(all[0].Key())
+	check("field", read(Query{Type: "vote", Field: "vote.link", Value: link}), []*ssb.SignedMessage{all[5], all[10], all[15], all[20], all[25]})
+	check("time range", read(Query{Since: all[3].Timestamp, Until: all[7].Timestamp}), all[3:7])
+
+	reversed := []*ssb.SignedMessage{}
+	for i := len(all) - 1; i >= 0; i-- {
+		reversed = append(reversed, all[i])
+	}
+	for _, reverse := range []bool{false, true} {
+		var paged []ssb.Ref
+		q := Query{Limit: 7, Reverse: reverse}
+		for {
+			res, err := Read(ds, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			paged = append(paged, keys(res.Messages)...)
+			if res.Cursor == "" {
+				break
+			}
+			q.Cursor = res.Cursor
+		}
+		if reverse {
+			check("reverse pages", paged, reversed)
+		} else {
+			check("pages", paged, all)
+		}
+	}
+
+	res, _ := Read(ds, Query{Limit: 1})
+	if _, err := Read(ds, Query{Type: "post", Cursor: res.Cursor}); err != ErrInvalidCursor {
+		t.Errorf("cursor from another query gave %v", err)
+	}
+	if _, err := Read(ds, Query{Field: "text"}); err != ErrMissingValue {
+		t.Errorf("field without value gave %v", err)
+	}
+
+	Indexes["text"] = []string{"content.text"}
+	defer delete(Indexes, "text")
+	err := ds.DB().Update(func(tx storage.Tx) error {
+		return ensureIndexes(ds, tx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, _ := plan(map[string][]byte{"content.text": encodeValue("3")}); name != "text" {
+		t.Errorf("planned %s for text query", name)
+	}
+	check("new index", read(Query{Field: "text", Value: json.RawMessage(`"3"`)}), all[3:4])
+}
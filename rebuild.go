@@ -0,0 +1,260 @@
+package ssb
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/andyleap/go-ssb/storage"
+)
+
+var (
+	ErrNoIndex       = errors.New("No such index")
+	ErrNotRebuilding = errors.New("Index is not being rebuilt")
+)
+
+// RebuildJob reports how far the rebuild of a module's index has got.
+type RebuildJob struct {
+	Module  string    `json:"module"`
+	Started time.Time `json:"started"`
+
+	// Offset is the log offset the index has reached, and Head the last
+	// offset in the log.
+	Offset int `json:"offset"`
+	Head   int `json:"head"`
+
+	// Indexed is how many messages have been indexed since the job
+	// started, and Rate how many a second over the last few seconds.
+	Indexed int     `json:"indexed"`
+	Rate    float64 `json:"rate"`
+
+	// Progress is the fraction of the log indexed, from 0 to 1.
+	Progress float64 `json:"progress"`
+
+	// ETA is how long the rest of the log should take at the rate it has
+	// gone since the job started or was resumed, or 0 if it is not known.
+	ETA time.Duration `json:"eta"`
+
+	Cancelled bool   `json:"cancelled"`
+	Done      bool   `json:"done"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Percent is Progress as a percentage.
+func (j RebuildJob) Percent() float64 {
+	return j.Progress * 100
+}
+
+type rebuildJob struct {
+	started time.Time
+	indexed int
+	rate    rateCounter
+	done    bool
+
+	// since and from are when and at what offset the job was last started
+	// or resumed, which the ETA is reckoned from.
+	since time.Time
+	from  int
+}
+
+// track starts a job for module's rebuild at offset, or restarts the ETA
+// of the one running if fresh is not set.
+func (ix *indexer) track(module string, offset int, fresh bool) {
+	ix.lock.Lock()
+	defer ix.lock.Unlock()
+	job, ok := ix.jobs[module]
+	if fresh || !ok || job.done {
+		job = &rebuildJob{started: time.Now()}
+		ix.jobs[module] = job
+	}
+	job.since, job.from = time.Now(), offset
+}
+
+// progress records n messages indexed by module's rebuild.
+func (ix *indexer) progress(module string, n int, finished bool) {
+	ix.lock.Lock()
+	defer ix.lock.Unlock()
+	job, ok := ix.jobs[module]
+	if !ok {
+		return
+	}
+	job.indexed += n
+	job.rate.add(n)
+	if finished {
+		job.done = true
+	}
+}
+
+// logBounds returns the first and last offsets in the global log, or -1
+// for both if it is empty.
+func (ds *DataStore) logBounds() (first, head int) {
+	first, head = -1, -1
+	ds.db.View(func(tx storage.Tx) error {
+		c := ds.log.Cursor(tx)
+		if k, _ := c.First(); k != nil {
+			first = btoi(k)
+		}
+		if k, _ := c.Last(); k != nil {
+			head = btoi(k)
+		}
+		return nil
+	})
+	return
+}
+
+// logFraction is how much of the log from first to head is covered up to
+// offset.
+func logFraction(first, head, offset int) float64 {
+	if first < 0 || offset >= head {
+		return 1
+	}
+	if offset < first {
+		return 0
+	}
+	return float64(offset-first+1) / float64(head-first+1)
+}
+
+// RebuildJobs returns the rebuilds running, cancelled or finished since the
+// store was opened, ordered by module.
+func (ds *DataStore) RebuildJobs() []RebuildJob {
+	states := ds.IndexStates()
+	first, head := ds.logBounds()
+	ix := ds.indexer
+	ix.lock.Lock()
+	defer ix.lock.Unlock()
+	jobs := []RebuildJob{}
+	for _, module := range ds.indexNames {
+		job, ok := ix.jobs[module]
+		if !ok {
+			continue
+		}
+		st := states[module]
+		rj := RebuildJob{
+			Module:    module,
+			Started:   job.started,
+			Offset:    st.Offset,
+			Head:      head,
+			Indexed:   job.indexed,
+			Rate:      job.rate.perSecond(),
+			Cancelled: st.Paused,
+			Done:      job.done,
+			Error:     st.Error,
+		}
+		if off, ok := ix.offsets[module]; ok {
+			rj.Offset = off
+		}
+		rj.Progress = logFraction(first, head, rj.Offset)
+		if job.done {
+			rj.Progress = 1
+		} else if from := logFraction(first, head, job.from); !st.Paused && rj.Progress > from {
+			elapsed := time.Since(job.since)
+			eta := float64(elapsed) * (1 - rj.Progress) / (rj.Progress - from)
+			rj.ETA = time.Duration(eta).Round(time.Second)
+		}
+		jobs = append(jobs, rj)
+	}
+	return jobs
+}
+
+// RebuildAll clears every index and has them rebuilt from the log in the
+// background.
+func (ds *DataStore) RebuildAll() error {
+	return ds.rebuild(append([]string(nil), ds.indexNames...))
+}
+
+// Rebuild clears the index kept by module and has it rebuilt from the log
+// in the background.
+func (ds *DataStore) Rebuild(module string) error {
+	if ds.indexOf(module) == nil {
+		return ErrNoIndex
+	}
+	return ds.rebuild([]string{module})
+}
+
+func (ds *DataStore) rebuild(modules []string) error {
+	sort.Strings(modules)
+	log.Println("Starting rebuild of", strings.Join(modules, ", "))
+	ds.indexer.commit.Lock()
+	defer ds.indexer.commit.Unlock()
+	err := ds.db.Update(func(tx storage.Tx) error {
+		for _, module := range modules {
+			err := ds.resetIndex(tx, module)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	ds.indexer.reload()
+	if err != nil {
+		return err
+	}
+	for _, module := range modules {
+		ds.indexer.track(module, -1, true)
+	}
+	ds.indexer.poke()
+	return nil
+}
+
+// CancelRebuild stops the rebuild of module's index where it has got to.
+// The index is left incomplete, across restarts too, until ResumeRebuild
+// or Rebuild is called for it.
+func (ds *DataStore) CancelRebuild(module string) error {
+	_, err := ds.pauseRebuild(module, true)
+	if err == nil {
+		log.Println("Cancelled rebuild of", module)
+	}
+	return err
+}
+
+// ResumeRebuild carries on a cancelled rebuild of module's index from
+// where it stopped.
+func (ds *DataStore) ResumeRebuild(module string) error {
+	offset, err := ds.pauseRebuild(module, false)
+	if err != nil {
+		return err
+	}
+	log.Println("Resuming rebuild of", module)
+	ds.indexer.track(module, offset, false)
+	ds.indexer.poke()
+	return nil
+}
+
+// pauseRebuild sets whether the indexer passes over module while it is
+// being rebuilt. Holding commit means no batch is part way through.
+func (ds *DataStore) pauseRebuild(module string, paused bool) (offset int, err error) {
+	if ds.indexOf(module) == nil {
+		return 0, ErrNoIndex
+	}
+	ds.indexer.commit.Lock()
+	defer ds.indexer.commit.Unlock()
+	err = ds.db.Update(func(tx storage.Tx) error {
+		st, ok := ds.indexState(tx, module)
+		if !ok || !st.Building {
+			return ErrNotRebuilding
+		}
+		offset = st.Offset
+		st.Paused = paused
+		return ds.setIndexState(tx, module, st)
+	})
+	if err == nil {
+		ds.indexer.setPaused(module, paused)
+	}
+	return
+}
+
+func (ds *DataStore) registerRebuildMethods() {
+	ds.RegisterMethod("index.Jobs", func() []RebuildJob {
+		return ds.RebuildJobs()
+	})
+	ds.RegisterMethod("index.Rebuild", func(module string) error {
+		if module == "" {
+			return ds.RebuildAll()
+		}
+		return ds.Rebuild(module)
+	})
+	ds.RegisterMethod("index.Cancel", ds.CancelRebuild)
+	ds.RegisterMethod("index.Resume", ds.ResumeRebuild)
+}
@@ -38,14 +38,7 @@ func ServeConn(datastore *ssb.DataStore, conn io.ReadWriteCloser) {
 		if err != nil {
 			return
 		}
-		RPCMethods, ok := datastore.ExtraData("RPCMethods").(map[string]interface{})
-		if !ok {
-			if req.ID != nil {
-				resp <- Response{Result: nil, Error: "No such method", ID: req.ID}
-			}
-			continue
-		}
-		method, ok := RPCMethods[req.Method]
+		method, ok := datastore.Method(req.Method)
 		if !ok {
 			if req.ID != nil {
 				resp <- Response{Result: nil, Error: "No such method", ID: req.ID}
@@ -0,0 +1,158 @@
+package ssb
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+
+	"github.com/andyleap/go-ssb/storage"
+	"golang.org/x/crypto/scrypt"
+)
+
+var (
+	ErrStoreSealed     = errors.New("Store is sealed, a passphrase is needed to open it")
+	ErrStoreNotSealed  = errors.New("Store was not sealed when it was created")
+	ErrWrongPassphrase = errors.New("Wrong passphrase for sealed store")
+)
+
+// A sealed store keeps the salt its key is derived with, and a value sealed
+// with that key to check passphrases against, in the "seal" bucket. The
+// bucket itself is not sealed.
+var (
+	sealBucket = []byte("seal")
+	sealSalt   = []byte("salt")
+	sealCheck  = []byte("check")
+	sealText   = []byte("go-ssb sealed store")
+)
+
+const sealSaltSize = 16
+
+// sealKey derives the key a store is sealed with from a passphrase.
+func sealKey(passphrase, salt []byte) (*[32]byte, error) {
+	dk, err := scrypt.Key(passphrase, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	var key [32]byte
+	copy(key[:], dk)
+	return &key, nil
+}
+
+// WithPassphrase seals everything the store writes with a key derived from
+// passphrase: the values in its database, the records of its log and, with
+// the blobs module, the files of the blob directory. Keys and bucket names
+// are not sealed, nor are message refs, which are hashes of the messages
+// as signed.
+//
+// A new store is sealed when it is first opened with a passphrase. A store
+// that was created without one cannot be sealed afterwards; export its
+// feeds and import them into a new sealed store instead.
+func WithPassphrase(passphrase []byte) Option {
+	return func(ds *DataStore) error {
+		var key *[32]byte
+		err := ds.db.Update(func(tx storage.Tx) error {
+			b := tx.Bucket(sealBucket)
+			if b == nil {
+				if !ds.empty(tx) {
+					return ErrStoreNotSealed
+				}
+				var err error
+				if b, err = tx.CreateBucketIfNotExists(sealBucket); err != nil {
+					return err
+				}
+				salt := make([]byte, sealSaltSize)
+				if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+					return err
+				}
+				if key, err = sealKey(passphrase, salt); err != nil {
+					return err
+				}
+				if err := b.Put(sealSalt, salt); err != nil {
+					return err
+				}
+				return b.Put(sealCheck, storage.NewSealer(key).Seal(sealText))
+			}
+			var err error
+			if key, err = sealKey(passphrase, b.Get(sealSalt)); err != nil {
+				return err
+			}
+			if text, err := storage.NewSealer(key).Open(b.Get(sealCheck)); err != nil || !bytes.Equal(text, sealText) {
+				return ErrWrongPassphrase
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		ds.sealer = storage.NewSealer(key)
+		ds.db = storage.SealDB(ds.db, ds.sealer)
+		if l, ok := ds.log.(*storage.OffsetLog); ok {
+			l.SetSealer(ds.sealer)
+		}
+		return nil
+	}
+}
+
+// SealSecret seals a secret file, such as sbot's secret.json, with a key
+// derived from passphrase. Unlike the store's data it carries its own salt,
+// as the key it holds is needed before the store can be opened.
+func SealSecret(passphrase, secret []byte) ([]byte, error) {
+	salt := make([]byte, sealSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	key, err := sealKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	return append(salt, storage.NewSealer(key).Seal(secret)...), nil
+}
+
+// OpenSecret opens a secret file sealed by SealSecret.
+func OpenSecret(passphrase, sealed []byte) ([]byte, error) {
+	if len(sealed) < sealSaltSize {
+		return nil, ErrWrongPassphrase
+	}
+	key, err := sealKey(passphrase, sealed[:sealSaltSize])
+	if err != nil {
+		return nil, err
+	}
+	secret, err := storage.NewSealer(key).Open(sealed[sealSaltSize:])
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return secret, nil
+}
+
+// empty reports whether nothing has been written to the store yet.
+func (ds *DataStore) empty(tx storage.Tx) bool {
+	empty := true
+	tx.ForEach(func(name []byte, b storage.Bucket) error {
+		empty = false
+		return nil
+	})
+	if k, _ := ds.log.Cursor(tx).First(); k != nil {
+		empty = false
+	}
+	return empty
+}
+
+// checkSealed refuses to open a sealed store without its passphrase.
+func (ds *DataStore) checkSealed() error {
+	if ds.sealer != nil {
+		return nil
+	}
+	return ds.db.View(func(tx storage.Tx) error {
+		if tx.Bucket(sealBucket) != nil {
+			return ErrStoreSealed
+		}
+		return nil
+	})
+}
+
+// Sealer returns what the store seals its data with, or nil if it is not
+// sealed. Modules keeping data outside the store seal it with the same.
+func (ds *DataStore) Sealer() *storage.Sealer {
+	return ds.sealer
+}
@@ -0,0 +1,118 @@
+package ssb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andyleap/go-ssb/storage"
+)
+
+func TestSealedStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kp := newTestKey()
+	passphrase := []byte("correct horse battery staple")
+
+	for _, flume := range []bool{false, true} {
+		name := "bolt"
+		if flume {
+			name = "flume"
+		}
+		root := filepath.Join(dir, name)
+		os.MkdirAll(root, 0700)
+		open := func(opts ...Option) (*DataStore, error) {
+			if flume {
+				return OpenFlumeDataStore(filepath.Join(root, "feeds.db"), filepath.Join(root, "log.offset"), kp, opts...)
+			}
+			return OpenDataStore(filepath.Join(root, "feeds.db"), kp, opts...)
+		}
+
+		ds, err := open(WithPassphrase(passphrase))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := ds.GetFeed(ds.PrimaryRef).PublishMessage(map[string]interface{}{"type": "post", "text": "hello"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ds.Close()
+
+		db, err := storage.OpenBolt(filepath.Join(root, "feeds.db"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.View(func(tx storage.Tx) error {
+			if p := tx.Bucket([]byte("pointer")).Get(m.Key().DBKey()); len(p) != len(Pointer{Author: m.Author.DBKey()}.Marshal())+storage.SealOverhead {
+				t.Errorf("%s: pointer stored as %x", name, p)
+			}
+			return nil
+		})
+		db.Close()
+		if flume {
+			l, err := storage.OpenOffsetLogReadOnly(filepath.Join(root, "log.offset"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec := decodeLogRecord(l.Get(nil, 0)); rec != nil {
+				t.Errorf("%s: log record stored as %s", name, rec.Key)
+			}
+			l.Close()
+		}
+
+		if _, err := open(); err != ErrStoreSealed {
+			t.Errorf("%s: opened without a passphrase, %v", name, err)
+		}
+		if _, err := open(WithPassphrase([]byte("wrong"))); err != ErrWrongPassphrase {
+			t.Errorf("%s: opened with the wrong passphrase, %v", name, err)
+		}
+		ds, err = open(WithPassphrase(passphrase))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ds.Get(nil, m.Key()); got == nil || got.Key() != m.Key() {
+			t.Errorf("%s: message reads back as %v", name, got)
+		}
+		if _, err := ds.GetFeed(ds.PrimaryRef).PublishMessage(map[string]interface{}{"type": "post", "text": "again"}); err != nil {
+			t.Errorf("%s: publishing after reopening, %v", name, err)
+		}
+		if r, _ := ds.Fsck(false); !r.OK() || r.Messages != 2 {
+			t.Errorf("%s: reopened store checked as %v", name, r.Problems)
+		}
+		ds.Close()
+	}
+
+	ds, err := OpenDataStore(filepath.Join(dir, "plain.db"), kp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ds.GetFeed(ds.PrimaryRef).PublishMessage(map[string]interface{}{"type": "post", "text": "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	ds.Close()
+	if _, err := OpenDataStore(filepath.Join(dir, "plain.db"), kp, WithPassphrase(passphrase)); err != ErrStoreNotSealed {
+		t.Errorf("sealed a store that was in use, %v", err)
+	}
+}
+
+func TestSealSecret(t *testing.T) {
+	secret := []byte(`{"curve":"ed25519"}`)
+	sealed, err := SealSecret([]byte("passphrase"), secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, secret) {
+		t.Fatal("secret not sealed")
+	}
+	if _, err := OpenSecret([]byte("wrong"), sealed); err != ErrWrongPassphrase {
+		t.Errorf("opened with the wrong passphrase: %v", err)
+	}
+	if got, err := OpenSecret([]byte("passphrase"), sealed); err != nil || !bytes.Equal(got, secret) {
+		t.Errorf("got %q, %v", got, err)
+	}
+}
@@ -5,21 +5,21 @@ import (
 
 	"github.com/andyleap/go-ssb"
 	"github.com/andyleap/go-ssb/social"
-	"github.com/boltdb/bolt"
+	"github.com/andyleap/go-ssb/storage"
 )
 
 func Search(ds *ssb.DataStore, term string, max int) (found []*ssb.SignedMessage) {
-	ds.DB().View(func(tx *bolt.Tx) error {
+	ds.DB().View(func(tx storage.Tx) error {
 
-		LogBucket := tx.Bucket([]byte("log"))
-		if LogBucket == nil {
-			return nil
-		}
-		cursor := LogBucket.Cursor()
+		cursor := ds.Log().Cursor(tx)
 		_, v := cursor.Last()
 		for v != nil {
-			m := ds.Get(tx, ssb.DBRef(v))
-			_, md := m.DecodeMessage()
+			m := ds.LogEntry(tx, v)
+			if m == nil {
+				_, v = cursor.Prev()
+				continue
+			}
+			_, md := ds.DecodeMessage(m)
 			if post, ok := md.(*social.Post); ok {
 				if strings.Contains(post.Text, term) {
 					found = append(found, m)
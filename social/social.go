@@ -6,7 +6,7 @@ import (
 	"time"
 
 	"github.com/andyleap/go-ssb"
-	"github.com/boltdb/bolt"
+	"github.com/andyleap/go-ssb/storage"
 )
 
 func itob(v int) []byte {
@@ -69,109 +69,189 @@ type Vote struct {
 	} `json:"vote"`
 }
 
-func init() {
-	ssb.MessageTypes["post"] = func(mb ssb.MessageBody) interface{} { return &Post{MessageBody: mb} }
-	ssb.MessageTypes["about"] = func(mb ssb.MessageBody) interface{} { return &About{MessageBody: mb} }
-	ssb.MessageTypes["vote"] = func(mb ssb.MessageBody) interface{} { return &Vote{MessageBody: mb} }
-	ssb.RebuildClearHooks["social"] = func(tx *bolt.Tx) error {
-		tx.DeleteBucket([]byte("votes"))
-		tx.DeleteBucket([]byte("threads"))
-		b, _ := tx.CreateBucketIfNotExists([]byte("feeds"))
-		b.ForEach(func(k, v []byte) error {
-			b.Bucket(k).Delete([]byte("about"))
+// Module indexes the names and images feeds give themselves, votes, and
+// the posts in each thread.
+var Module = &ssb.Module{
+	Name: "social",
+	MessageTypes: map[string]func(mb ssb.MessageBody) interface{}{
+		"post":  func(mb ssb.MessageBody) interface{} { return &Post{MessageBody: mb} },
+		"about": func(mb ssb.MessageBody) interface{} { return &About{MessageBody: mb} },
+		"vote":  func(mb ssb.MessageBody) interface{} { return &Vote{MessageBody: mb} },
+	},
+	Index: &ssb.Index{
+		// Version 1 records where each post sits in its thread, so a
+		// purge removes it without scanning the thread.
+		Version: 1,
+		Add:     indexSocial,
+		Remove:  removeSocial,
+		Clear: func(tx storage.Tx) error {
+			tx.DeleteBucket([]byte("votes"))
+			tx.DeleteBucket([]byte("threads"))
+			b, _ := tx.CreateBucketIfNotExists([]byte("feeds"))
+			b.ForEach(func(k, v []byte) error {
+				b.Bucket(k).Delete([]byte("about"))
+				return nil
+			})
+
 			return nil
-		})
+		},
+	},
+	Buckets: []string{"threads", "votes"},
+}
 
-		return nil
+func indexSocial(ds *ssb.DataStore, m *ssb.SignedMessage, tx storage.Tx) error {
+	_, mb := ds.DecodeMessage(m)
+	if mba, ok := mb.(*About); ok {
+		if mba.About == m.Author {
+			FeedsBucket, err := tx.CreateBucketIfNotExists([]byte("feeds"))
+			if err != nil {
+				return err
+			}
+			FeedBucket, err := FeedsBucket.CreateBucketIfNotExists(m.Author.DBKey())
+			if err != nil {
+				return err
+			}
+			aboutdata := FeedBucket.Get([]byte("about"))
+			var a About
+			if aboutdata != nil {
+				json.Unmarshal(aboutdata, &a)
+			}
+			if mba.Name != "" {
+				a.Name = mba.Name
+			}
+			if mba.Image != nil {
+				a.Image = mba.Image
+			}
+			buf, err := json.Marshal(a)
+			if err != nil {
+				return err
+			}
+			err = FeedBucket.Put([]byte("about"), buf)
+			if err != nil {
+				return err
+			}
+		}
 	}
-	ssb.AddMessageHooks["social"] = func(m *ssb.SignedMessage, tx *bolt.Tx) error {
-		_, mb := m.DecodeMessage()
-		if mba, ok := mb.(*About); ok {
-			if mba.About == m.Author {
-				FeedsBucket, err := tx.CreateBucketIfNotExists([]byte("feeds"))
-				if err != nil {
-					return err
-				}
-				FeedBucket, err := FeedsBucket.CreateBucketIfNotExists(m.Author.DBKey())
-				if err != nil {
-					return err
-				}
-				aboutdata := FeedBucket.Get([]byte("about"))
-				var a About
-				if aboutdata != nil {
-					json.Unmarshal(aboutdata, &a)
-				}
-				if mba.Name != "" {
-					a.Name = mba.Name
-				}
-				if mba.Image != nil {
-					a.Image = mba.Image
-				}
-				buf, err := json.Marshal(a)
-				if err != nil {
-					return err
-				}
-				err = FeedBucket.Put([]byte("about"), buf)
-				if err != nil {
-					return err
-				}
-			}
-		}
-		if vote, ok := mb.(*Vote); ok {
-			VotesBucket, err := tx.CreateBucketIfNotExists([]byte("votes"))
+	if vote, ok := mb.(*Vote); ok {
+		VotesBucket, err := tx.CreateBucketIfNotExists([]byte("votes"))
+		if err != nil {
+			return err
+		}
+		votesRaw := VotesBucket.Get(vote.Vote.Link.DBKey())
+		var votes []ssb.Ref
+		if votesRaw != nil {
+			json.Unmarshal(votesRaw, &votes)
+		}
+		votes = append(votes, m.Key())
+		buf, _ := json.Marshal(votes)
+
+		err = VotesBucket.Put(vote.Vote.Link.DBKey(), buf)
+		if err != nil {
+			return err
+		}
+	}
+	if post, ok := mb.(*Post); ok {
+		if post.Root.Type != ssb.RefInvalid {
+			ThreadsBucket, err := tx.CreateBucketIfNotExists([]byte("threads"))
+			if err != nil {
+				return err
+			}
+			ThreadBucket, err := ThreadsBucket.CreateBucketIfNotExists(post.Root.DBKey())
+			if err != nil {
+				return err
+			}
+			logBucket, err := ThreadBucket.CreateBucketIfNotExists([]byte("log"))
+			if err != nil {
+				return err
+			}
+			logBucket.SetFillPercent(1)
+			seq, err := logBucket.NextSequence()
 			if err != nil {
 				return err
 			}
-			votesRaw := VotesBucket.Get(vote.Vote.Link.DBKey())
-			var votes []ssb.Ref
-			if votesRaw != nil {
-				json.Unmarshal(votesRaw, &votes)
+			logKeys, err := ThreadBucket.CreateBucketIfNotExists([]byte("logkeys"))
+			if err != nil {
+				return err
+			}
+			err = storage.PutEntry(logBucket, logKeys, itob(int(seq)), m.Key().DBKey())
+			if err != nil {
+				return err
 			}
-			votes = append(votes, m.Key())
-			buf, _ := json.Marshal(votes)
 
-			err = VotesBucket.Put(vote.Vote.Link.DBKey(), buf)
+			timeBucket, err := ThreadBucket.CreateBucketIfNotExists([]byte("time"))
+			if err != nil {
+				return err
+			}
+			i := int(m.Timestamp * float64(time.Millisecond))
+			for timeBucket.Get(itob(i)) != nil {
+				i++
+			}
+			timeKeys, err := ThreadBucket.CreateBucketIfNotExists([]byte("timekeys"))
+			if err != nil {
+				return err
+			}
+			err = storage.PutEntry(timeBucket, timeKeys, itob(i), m.Key().DBKey())
 			if err != nil {
 				return err
 			}
 		}
-		if post, ok := mb.(*Post); ok {
-			if post.Root.Type != ssb.RefInvalid {
-				ThreadsBucket, err := tx.CreateBucketIfNotExists([]byte("threads"))
-				if err != nil {
-					return err
-				}
-				ThreadBucket, err := ThreadsBucket.CreateBucketIfNotExists(post.Root.DBKey())
-				if err != nil {
-					return err
-				}
-				logBucket, err := ThreadBucket.CreateBucketIfNotExists([]byte("log"))
-				if err != nil {
-					return err
-				}
-				logBucket.FillPercent = 1
-				seq, err := logBucket.NextSequence()
-				if err != nil {
-					return err
-				}
-				logBucket.Put(itob(int(seq)), m.Key().DBKey())
-
-				timeBucket, err := ThreadBucket.CreateBucketIfNotExists([]byte("time"))
-				if err != nil {
-					return err
-				}
-				i := int(m.Timestamp * float64(time.Millisecond))
-				for timeBucket.Get(itob(i)) != nil {
-					i++
-				}
-				timeBucket.Put(itob(i), m.Key().DBKey())
+	}
+	return nil
+}
+
+func removeSocial(ds *ssb.DataStore, m *ssb.SignedMessage, tx storage.Tx) error {
+	_, mb := ds.DecodeMessage(m)
+	if mba, ok := mb.(*About); ok && mba.About == m.Author {
+		// The about is built up from all the author's messages, which are
+		// purged together.
+		if FeedsBucket := tx.Bucket([]byte("feeds")); FeedsBucket != nil {
+			if FeedBucket := FeedsBucket.Bucket(m.Author.DBKey()); FeedBucket != nil {
+				return FeedBucket.Delete([]byte("about"))
 			}
 		}
-		return nil
 	}
+	if vote, ok := mb.(*Vote); ok {
+		VotesBucket := tx.Bucket([]byte("votes"))
+		if VotesBucket == nil {
+			return nil
+		}
+		var votes []ssb.Ref
+		json.Unmarshal(VotesBucket.Get(vote.Vote.Link.DBKey()), &votes)
+		kept := votes[:0]
+		for _, r := range votes {
+			if r != m.Key() {
+				kept = append(kept, r)
+			}
+		}
+		if len(kept) == 0 {
+			return VotesBucket.Delete(vote.Vote.Link.DBKey())
+		}
+		buf, _ := json.Marshal(kept)
+		return VotesBucket.Put(vote.Vote.Link.DBKey(), buf)
+	}
+	if post, ok := mb.(*Post); ok && post.Root.Type != ssb.RefInvalid {
+		ThreadsBucket := tx.Bucket([]byte("threads"))
+		if ThreadsBucket == nil {
+			return nil
+		}
+		ThreadBucket := ThreadsBucket.Bucket(post.Root.DBKey())
+		if ThreadBucket == nil {
+			return nil
+		}
+		key := m.Key().DBKey()
+		if logBucket, logKeys := ThreadBucket.Bucket([]byte("log")), ThreadBucket.Bucket([]byte("logkeys")); logBucket != nil && logKeys != nil {
+			if err := storage.RemoveEntry(logBucket, logKeys, key); err != nil {
+				return err
+			}
+		}
+		if timeBucket, timeKeys := ThreadBucket.Bucket([]byte("time")), ThreadBucket.Bucket([]byte("timekeys")); timeBucket != nil && timeKeys != nil {
+			return storage.RemoveEntry(timeBucket, timeKeys, key)
+		}
+	}
+	return nil
 }
 
-func GetAbout(tx *bolt.Tx, ref ssb.Ref) (a *About) {
+func GetAbout(tx storage.Tx, ref ssb.Ref) (a *About) {
 	FeedsBucket := tx.Bucket([]byte("feeds"))
 	if FeedsBucket == nil {
 		return
@@ -188,7 +268,7 @@ func GetAbout(tx *bolt.Tx, ref ssb.Ref) (a *About) {
 	return
 }
 
-func GetVotes(tx *bolt.Tx, ref ssb.Ref) []*ssb.SignedMessage {
+func GetVotes(ds *ssb.DataStore, tx storage.Tx, ref ssb.Ref) []*ssb.SignedMessage {
 	VotesBucket := tx.Bucket([]byte("votes"))
 	if VotesBucket == nil {
 		return nil
@@ -200,7 +280,7 @@ func GetVotes(tx *bolt.Tx, ref ssb.Ref) []*ssb.SignedMessage {
 	}
 	votes := make([]*ssb.SignedMessage, 0, len(voteRefs))
 	for _, r := range voteRefs {
-		msg := ssb.GetMsg(tx, r)
+		msg := ds.Get(tx, r)
 		if msg == nil {
 			continue
 		}
@@ -209,7 +289,7 @@ func GetVotes(tx *bolt.Tx, ref ssb.Ref) []*ssb.SignedMessage {
 	return votes
 }
 
-func GetThread(tx *bolt.Tx, ref ssb.Ref) []*ssb.SignedMessage {
+func GetThread(ds *ssb.DataStore, tx storage.Tx, ref ssb.Ref) []*ssb.SignedMessage {
 	ThreadsBucket := tx.Bucket([]byte("threads"))
 	if ThreadsBucket == nil {
 		return nil
@@ -224,7 +304,7 @@ func GetThread(tx *bolt.Tx, ref ssb.Ref) []*ssb.SignedMessage {
 	}
 	thread := []*ssb.SignedMessage{}
 	timeBucket.ForEach(func(k, v []byte) error {
-		msg := ssb.GetMsg(tx, ssb.DBRef(v))
+		msg := ds.Get(tx, ssb.DBRef(v))
 		if msg != nil {
 			thread = append(thread, msg)
 		}
@@ -0,0 +1,33 @@
+// Package ssbtest opens throwaway stores for the tests of packages built on
+// a DataStore.
+package ssbtest
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"cryptoscope.co/go/secretstream/secrethandshake"
+	"golang.org/x/crypto/ed25519"
+
+	"github.com/andyleap/go-ssb"
+	"github.com/andyleap/go-ssb/storage"
+)
+
+// NewKey returns a new key pair for the primary identity of a store.
+func NewKey() *secrethandshake.EdKeyPair {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	kp := &secrethandshake.EdKeyPair{}
+	copy(kp.Public[:], pub)
+	copy(kp.Secret[:], priv)
+	return kp
+}
+
+// NewStore returns an in-memory store with a new primary identity, failing
+// t if it cannot be opened.
+func NewStore(t testing.TB, opts ...ssb.Option) *ssb.DataStore {
+	ds, err := ssb.NewDataStore(storage.NewMemory(), storage.NewBucketLog("log"), NewKey(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ds
+}
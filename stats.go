@@ -0,0 +1,191 @@
+package ssb
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/andyleap/go-ssb/storage"
+)
+
+// StatsTTL is how long StorageStats are kept before the store is walked
+// again.
+var StatsTTL = time.Minute
+
+// Growth is how much was added to a store over a period.
+type Growth struct {
+	Count int   `json:"count"`
+	Bytes int64 `json:"bytes"`
+}
+
+// SpaceStats counts messages and the space they take, as stored and as
+// their signed JSON.
+type SpaceStats struct {
+	Messages     int   `json:"messages"`
+	Compressed   int64 `json:"compressed"`
+	Uncompressed int64 `json:"uncompressed"`
+}
+
+func (s *SpaceStats) add(stored, encoded int) {
+	s.Messages++
+	s.Compressed += int64(stored)
+	s.Uncompressed += int64(encoded)
+}
+
+// FeedSpace is the space the messages of a feed take.
+type FeedSpace struct {
+	Feed Ref `json:"feed"`
+	SpaceStats
+}
+
+// TypeSpace is the space the messages of a content type take. Private
+// messages have the type "private".
+type TypeSpace struct {
+	Type string `json:"type"`
+	SpaceStats
+}
+
+// ModuleSpace is the space the buckets of a module take.
+type ModuleSpace struct {
+	Module  string   `json:"module"`
+	Buckets []string `json:"buckets"`
+	Bytes   int64    `json:"bytes"`
+}
+
+// StorageStats reports what a store holds and where its space goes. Feeds
+// and Types are ordered by the space they take, largest first. Day and
+// Week count the messages received over the last day and week.
+type StorageStats struct {
+	SpaceStats
+	Log     int64            `json:"log,omitempty"`
+	Feeds   []FeedSpace      `json:"feeds"`
+	Types   []TypeSpace      `json:"types"`
+	Modules []ModuleSpace    `json:"modules"`
+	Buckets map[string]int64 `json:"buckets"`
+	Day     Growth           `json:"day"`
+	Week    Growth           `json:"week"`
+}
+
+type statsCache struct {
+	lock  sync.Mutex
+	stats StorageStats
+	taken time.Time
+}
+
+func (ds *DataStore) registerStatsMethods() {
+	ds.RegisterMethod("storage.Stats", ds.StorageStats)
+}
+
+// StorageStats reports the space the store takes, by feed, content type,
+// module and bucket. Walking the store is slow, so the result is reused for
+// StatsTTL.
+func (ds *DataStore) StorageStats() (StorageStats, error) {
+	c := &ds.stats
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.taken.IsZero() && time.Since(c.taken) < StatsTTL {
+		return c.stats, nil
+	}
+	st, err := ds.walkStats()
+	if err != nil {
+		return st, err
+	}
+	c.stats, c.taken = st, time.Now()
+	return st, nil
+}
+
+func (ds *DataStore) walkStats() (StorageStats, error) {
+	st := StorageStats{Buckets: map[string]int64{}}
+	feeds := map[Ref]*FeedSpace{}
+	types := map[string]*TypeSpace{}
+	now := receiveTime()
+	day := now - float64(24*time.Hour/time.Millisecond)
+	week := now - float64(7*24*time.Hour/time.Millisecond)
+
+	err := ds.db.View(func(tx storage.Tx) error {
+		err := tx.ForEach(func(k []byte, b storage.Bucket) error {
+			st.Buckets[string(k)] = storage.BucketSize(b)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		FeedsBucket := tx.Bucket([]byte("feeds"))
+		c := ds.log.Cursor(tx)
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			e := ds.logEntry(tx, btoi(k), v)
+			if e == nil {
+				continue
+			}
+			m := e.Value
+			stored := len(v)
+			if !ds.primaryLog && FeedsBucket != nil {
+				if FeedBucket := FeedsBucket.Bucket(m.Author.DBKey()); FeedBucket != nil {
+					if LogBucket := FeedBucket.Bucket([]byte("log")); LogBucket != nil {
+						stored = len(LogBucket.Get(itob(m.Sequence)))
+					}
+				}
+			}
+			encoded := len(m.Encode())
+			st.add(stored, encoded)
+
+			fs := feeds[m.Author]
+			if fs == nil {
+				fs = &FeedSpace{Feed: m.Author}
+				feeds[m.Author] = fs
+			}
+			fs.add(stored, encoded)
+
+			t := m.Type()
+			if m.IsBoxed() {
+				t = "private"
+			}
+			ts := types[t]
+			if ts == nil {
+				ts = &TypeSpace{Type: t}
+				types[t] = ts
+			}
+			ts.add(stored, encoded)
+
+			if e.Timestamp >= week {
+				st.Week.Count++
+				st.Week.Bytes += int64(stored)
+				if e.Timestamp >= day {
+					st.Day.Count++
+					st.Day.Bytes += int64(stored)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return st, err
+	}
+	if l, ok := ds.log.(*storage.OffsetLog); ok {
+		st.Log = int64(l.Size())
+	}
+
+	for _, fs := range feeds {
+		st.Feeds = append(st.Feeds, *fs)
+	}
+	sort.Slice(st.Feeds, func(i, j int) bool {
+		return st.Feeds[i].Compressed > st.Feeds[j].Compressed
+	})
+	for _, ts := range types {
+		st.Types = append(st.Types, *ts)
+	}
+	sort.Slice(st.Types, func(i, j int) bool {
+		return st.Types[i].Compressed > st.Types[j].Compressed
+	})
+	for _, m := range ds.moduleOrder {
+		if len(m.Buckets) == 0 {
+			continue
+		}
+		ms := ModuleSpace{Module: m.Name, Buckets: m.Buckets}
+		for _, b := range m.Buckets {
+			ms.Bytes += st.Buckets[b]
+		}
+		st.Modules = append(st.Modules, ms)
+	}
+	return st, nil
+}
@@ -0,0 +1,84 @@
+package ssb
+
+import (
+	"context"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+
+	"github.com/andyleap/go-ssb/storage"
+)
+
+func TestStorageStats(t *testing.T) {
+	ds := newTestStore(t, WithModules(&Module{
+		Name: "counter",
+		Index: &Index{
+			Add: func(ds *DataStore, m *SignedMessage, tx storage.Tx) error {
+				b, err := tx.CreateBucketIfNotExists([]byte("counted"))
+				if err != nil {
+					return err
+				}
+				return b.Put(m.Key().DBKey(), []byte("counted"))
+			},
+		},
+		Buckets: []string{"counted"},
+	}))
+	defer ds.Close()
+
+	opub, opriv, _ := ed25519.GenerateKey(rand.Reader)
+	other, _ := NewRef(RefFeed, opub, RefAlgoEd25519)
+	ds.Keys[other] = &SignerEd25519{Private: opriv}
+	for i := 0; i < 3; i++ {
+		if _, err := ds.GetFeed(ds.PrimaryRef).PublishMessage(map[string]interface{}{"type": "post", "text": "a longer post than the other feed writes"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := ds.GetFeed(ds.PrimaryRef).PublishPrivateMessage(map[string]interface{}{"type": "post", "text": "secret"}, []Ref{ds.PrimaryRef}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ds.GetFeed(other).PublishMessage(map[string]interface{}{"type": "vote"}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ds.WaitIndexed(ctx, ds.LogHead()); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := ds.StorageStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Messages != 5 || st.Compressed == 0 || st.Uncompressed <= st.Compressed {
+		t.Errorf("store holds %+v", st.SpaceStats)
+	}
+	if st.Day.Count != 5 || st.Week.Count != 5 || st.Day.Bytes != st.Compressed {
+		t.Errorf("store grew by %+v in a day and %+v in a week", st.Day, st.Week)
+	}
+	if len(st.Feeds) != 2 || st.Feeds[0].Feed != ds.PrimaryRef || st.Feeds[0].Messages != 4 || st.Feeds[1].Messages != 1 {
+		t.Errorf("feeds hold %+v", st.Feeds)
+	}
+	types := map[string]int{}
+	for _, ts := range st.Types {
+		types[ts.Type] = ts.Messages
+	}
+	if len(types) != 3 || types["post"] != 3 || types["private"] != 1 || types["vote"] != 1 {
+		t.Errorf("types are %v", types)
+	}
+	if len(st.Modules) != 1 || st.Modules[0].Module != "counter" || st.Modules[0].Bytes != st.Buckets["counted"] || st.Buckets["counted"] == 0 {
+		t.Errorf("modules take %+v of %v", st.Modules, st.Buckets)
+	}
+
+	if _, err := ds.GetFeed(other).PublishMessage(map[string]interface{}{"type": "vote"}); err != nil {
+		t.Fatal(err)
+	}
+	if st, _ := ds.StorageStats(); st.Messages != 5 {
+		t.Errorf("cached stats count %d messages", st.Messages)
+	}
+	ds.stats.taken = time.Now().Add(-StatsTTL)
+	if st, _ := ds.StorageStats(); st.Messages != 6 {
+		t.Errorf("expired stats count %d messages", st.Messages)
+	}
+}
@@ -0,0 +1,299 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// BoltDB is a DB backed by a boltdb file.
+type BoltDB struct {
+	db *bolt.DB
+}
+
+func OpenBolt(path string, mode os.FileMode) (*BoltDB, error) {
+	db, err := bolt.Open(path, mode, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &BoltDB{db: db}, nil
+}
+
+func NewBolt(db *bolt.DB) *BoltDB {
+	return &BoltDB{db: db}
+}
+
+// Bolt returns the underlying bolt database, for tools that only work with
+// bolt directly.
+func (b *BoltDB) Bolt() *bolt.DB {
+	return b.db
+}
+
+func (b *BoltDB) Begin(writable bool) (Tx, error) {
+	tx, err := b.db.Begin(writable)
+	if err != nil {
+		return nil, err
+	}
+	return boltTx{tx, &txHooks{}}, nil
+}
+
+// Update runs fn in a writable transaction, committed if fn returns nil.
+// It does what bolt's Update does, through Begin so the hooks of the
+// transaction run.
+func (b *BoltDB) Update(fn func(tx Tx) error) error {
+	tx, err := b.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (b *BoltDB) View(fn func(tx Tx) error) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx, &txHooks{}})
+	})
+}
+
+func (b *BoltDB) Close() error {
+	return b.db.Close()
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+	*txHooks
+}
+
+func (t boltTx) Bucket(name []byte) Bucket {
+	return wrapBucket(t.tx.Bucket(name))
+}
+
+func (t boltTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	b, err := t.tx.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+	return boltBucket{b}, nil
+}
+
+func (t boltTx) DeleteBucket(name []byte) error {
+	return t.tx.DeleteBucket(name)
+}
+
+func (t boltTx) ForEach(fn func(name []byte, b Bucket) error) error {
+	return t.tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		return fn(name, boltBucket{b})
+	})
+}
+
+func (t boltTx) Writable() bool {
+	return t.tx.Writable()
+}
+
+func (t boltTx) Commit() error {
+	return t.commit(t.tx.Commit, t.tx.Rollback)
+}
+
+func (t boltTx) Rollback() error {
+	t.rolledBack()
+	return t.tx.Rollback()
+}
+
+func (t boltTx) Size() int64 {
+	return t.tx.Size()
+}
+
+func (t boltTx) WriteTo(w io.Writer) (int64, error) {
+	return t.tx.WriteTo(w)
+}
+
+func (t boltTx) Check() <-chan error {
+	return t.tx.Check()
+}
+
+type boltBucket struct {
+	b *bolt.Bucket
+}
+
+// wrapBucket keeps a missing bolt bucket as a nil interface, so callers can
+// keep comparing against nil.
+func wrapBucket(b *bolt.Bucket) Bucket {
+	if b == nil {
+		return nil
+	}
+	return boltBucket{b}
+}
+
+// Size is the space allocated to the bucket's pages in the file.
+func (b boltBucket) Size() int64 {
+	st := b.b.Stats()
+	return int64(st.BranchAlloc + st.LeafAlloc)
+}
+
+func (b boltBucket) Get(key []byte) []byte {
+	return b.b.Get(key)
+}
+
+func (b boltBucket) Put(key []byte, value []byte) error {
+	return b.b.Put(key, value)
+}
+
+func (b boltBucket) Delete(key []byte) error {
+	return b.b.Delete(key)
+}
+
+func (b boltBucket) Bucket(name []byte) Bucket {
+	return wrapBucket(b.b.Bucket(name))
+}
+
+func (b boltBucket) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	nb, err := b.b.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+	return boltBucket{nb}, nil
+}
+
+func (b boltBucket) DeleteBucket(name []byte) error {
+	return b.b.DeleteBucket(name)
+}
+
+func (b boltBucket) NextSequence() (uint64, error) {
+	return b.b.NextSequence()
+}
+
+func (b boltBucket) ForEach(fn func(k, v []byte) error) error {
+	return b.b.ForEach(fn)
+}
+
+func (b boltBucket) Cursor() Cursor {
+	return b.b.Cursor()
+}
+
+func (b boltBucket) SetFillPercent(fill float64) {
+	b.b.FillPercent = fill
+}
+
+// compactTxSize is how many bytes CompactBolt writes in each transaction,
+// so copying a large database does not hold it all in memory.
+const compactTxSize = 64 << 20
+
+// CompactBolt copies the bolt database at src into a new database at dst.
+// Bolt never gives the pages it frees back to the file system, so the copy
+// leaves out the free space src has gathered. src must not be open, and dst
+// must not exist. It returns the sizes of both files.
+func CompactBolt(src, dst string) (before, after int64, err error) {
+	sdb, err := bolt.Open(src, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return 0, 0, err
+	}
+	defer sdb.Close()
+	if _, err := os.Stat(dst); err == nil {
+		return 0, 0, os.ErrExist
+	}
+	ddb, err := bolt.Open(dst, 0600, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	c := &compactor{db: ddb}
+	err = sdb.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			return c.bucket([][]byte{name}, b)
+		})
+	})
+	if err == nil {
+		err = c.commit()
+	} else if c.tx != nil {
+		c.tx.Rollback()
+	}
+	if cerr := ddb.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return 0, 0, err
+	}
+	si, err := os.Stat(src)
+	if err != nil {
+		return 0, 0, err
+	}
+	di, err := os.Stat(dst)
+	if err != nil {
+		return 0, 0, err
+	}
+	return si.Size(), di.Size(), nil
+}
+
+// compactor writes to the destination of CompactBolt, starting a new
+// transaction whenever compactTxSize bytes have been written.
+type compactor struct {
+	db   *bolt.DB
+	tx   *bolt.Tx
+	size int
+}
+
+func (c *compactor) commit() error {
+	if c.tx == nil {
+		return nil
+	}
+	err := c.tx.Commit()
+	c.tx, c.size = nil, 0
+	return err
+}
+
+// dest returns the destination bucket at path, creating it as needed.
+func (c *compactor) dest(path [][]byte) (*bolt.Bucket, error) {
+	if c.tx != nil && c.size >= compactTxSize {
+		if err := c.commit(); err != nil {
+			return nil, err
+		}
+	}
+	if c.tx == nil {
+		tx, err := c.db.Begin(true)
+		if err != nil {
+			return nil, err
+		}
+		c.tx = tx
+	}
+	b, err := c.tx.CreateBucketIfNotExists(path[0])
+	for _, name := range path[1:] {
+		if err != nil {
+			break
+		}
+		b, err = b.CreateBucketIfNotExists(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Keys are written in order, so pages can be filled completely.
+	b.FillPercent = 1
+	return b, nil
+}
+
+func (c *compactor) bucket(path [][]byte, src *bolt.Bucket) error {
+	b, err := c.dest(path)
+	if err != nil {
+		return err
+	}
+	if err = b.SetSequence(src.Sequence()); err != nil {
+		return err
+	}
+	return src.ForEach(func(k, v []byte) error {
+		if v == nil {
+			sub := append(append([][]byte(nil), path...), append([]byte(nil), k...))
+			return c.bucket(sub, src.Bucket(k))
+		}
+		b, err := c.dest(path)
+		if err != nil {
+			return err
+		}
+		c.size += len(k) + len(v)
+		return b.Put(k, v)
+	})
+}
@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCompactBolt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src, dst := filepath.Join(dir, "src.db"), filepath.Join(dir, "dst.db")
+
+	db, err := OpenBolt(src, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := bytes.Repeat([]byte("v"), 1000)
+	err = db.Update(func(tx Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("feeds"))
+		if err != nil {
+			return err
+		}
+		nb, err := b.CreateBucketIfNotExists([]byte("a"))
+		if err != nil {
+			return err
+		}
+		if _, err := nb.NextSequence(); err != nil {
+			return err
+		}
+		for i := 0; i < 2000; i++ {
+			if err := nb.Put(itob(i), value); err != nil {
+				return err
+			}
+		}
+		junk, err := tx.CreateBucketIfNotExists([]byte("junk"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 2000; i++ {
+			if err := junk.Put(itob(i), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		err = db.Update(func(tx Tx) error {
+			return tx.DeleteBucket([]byte("junk"))
+		})
+	}
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before, after, err := CompactBolt(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after >= before {
+		t.Errorf("compacted %d bytes to %d", before, after)
+	}
+	if _, _, err := CompactBolt(src, dst); err == nil {
+		t.Error("compacted over an existing file")
+	}
+
+	db, err = OpenBolt(dst, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.View(func(tx Tx) error {
+		if tx.Bucket([]byte("junk")) != nil {
+			t.Error("deleted bucket copied")
+		}
+		b := tx.Bucket([]byte("feeds")).Bucket([]byte("a"))
+		n := 0
+		b.ForEach(func(k, v []byte) error {
+			if btoi(k) != n || !bytes.Equal(v, value) {
+				t.Errorf("entry %d copied as %d", n, btoi(k))
+			}
+			n++
+			return nil
+		})
+		if n != 2000 {
+			t.Errorf("copied %d entries", n)
+		}
+		for err := range tx.(Checker).Check() {
+			t.Error(err)
+		}
+		return nil
+	})
+	db.Update(func(tx Tx) error {
+		if seq, _ := tx.Bucket([]byte("feeds")).Bucket([]byte("a")).NextSequence(); seq != 2 {
+			t.Errorf("bucket sequence copied as %d", seq-1)
+		}
+		return nil
+	})
+}
+
+func TestRollbackHooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bdb, err := OpenBolt(filepath.Join(dir, "hooks.db"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bdb.Close()
+
+	errFail := errors.New("fail")
+	for name, db := range map[string]DB{"memory": NewMemory(), "bolt": bdb} {
+		began := make(chan struct{})
+		locked := false
+		err := db.Update(func(tx Tx) error {
+			tx.(Finisher).OnRollback(func() {
+				go func() {
+					if tx, err := db.Begin(true); err == nil {
+						tx.Rollback()
+					}
+					close(began)
+				}()
+				select {
+				case <-began:
+				case <-time.After(50 * time.Millisecond):
+					locked = true
+				}
+			})
+			return errFail
+		})
+		if err != errFail {
+			t.Fatalf("%s: got %v", name, err)
+		}
+		<-began
+		if !locked {
+			t.Errorf("%s: another transaction began before the rollback hook ran", name)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package storage
+
+// BucketLog is a Log kept in a top level bucket of the DB it is used with,
+// keyed by the bucket's sequence.
+type BucketLog struct {
+	Name []byte
+}
+
+func NewBucketLog(name string) *BucketLog {
+	return &BucketLog{Name: []byte(name)}
+}
+
+func (l *BucketLog) Append(tx Tx, data []byte) (int, error) {
+	LogBucket, err := tx.CreateBucketIfNotExists(l.Name)
+	if err != nil {
+		return 0, err
+	}
+	LogBucket.SetFillPercent(1)
+	seq, err := LogBucket.NextSequence()
+	if err != nil {
+		return 0, err
+	}
+	err = LogBucket.Put(itob(int(seq)), data)
+	if err != nil {
+		return 0, err
+	}
+	return int(seq), nil
+}
+
+func (l *BucketLog) Get(tx Tx, offset int) []byte {
+	LogBucket := tx.Bucket(l.Name)
+	if LogBucket == nil {
+		return nil
+	}
+	return LogBucket.Get(itob(offset))
+}
+
+func (l *BucketLog) Cursor(tx Tx) Cursor {
+	LogBucket := tx.Bucket(l.Name)
+	if LogBucket == nil {
+		return emptyCursor{}
+	}
+	return LogBucket.Cursor()
+}
+
+// Erase deletes the record at offset.
+func (l *BucketLog) Erase(tx Tx, offset int) error {
+	LogBucket := tx.Bucket(l.Name)
+	if LogBucket == nil {
+		return nil
+	}
+	return LogBucket.Delete(itob(offset))
+}
@@ -0,0 +1,370 @@
+package storage
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+)
+
+// MemoryDB is a DB held entirely in memory. Writers copy the nodes they
+// touch, so readers keep a consistent snapshot for the length of their
+// transaction.
+type MemoryDB struct {
+	lock   sync.Mutex
+	wlock  sync.Mutex
+	root   *memNode
+	gen    uint64
+	closed bool
+}
+
+func NewMemory() *MemoryDB {
+	return &MemoryDB{root: newMemNode(0)}
+}
+
+type memNode struct {
+	gen     uint64
+	seq     uint64
+	values  map[string][]byte
+	buckets map[string]*memNode
+}
+
+func newMemNode(gen uint64) *memNode {
+	return &memNode{
+		gen:     gen,
+		values:  map[string][]byte{},
+		buckets: map[string]*memNode{},
+	}
+}
+
+func (n *memNode) clone(gen uint64) *memNode {
+	c := newMemNode(gen)
+	c.seq = n.seq
+	for k, v := range n.values {
+		c.values[k] = v
+	}
+	for k, b := range n.buckets {
+		c.buckets[k] = b
+	}
+	return c
+}
+
+func (db *MemoryDB) Begin(writable bool) (Tx, error) {
+	if writable {
+		db.wlock.Lock()
+	}
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.closed {
+		if writable {
+			db.wlock.Unlock()
+		}
+		return nil, ErrTxClosed
+	}
+	tx := &memTx{db: db, root: db.root, writable: writable, txHooks: &txHooks{}}
+	if writable {
+		db.gen++
+		tx.gen = db.gen
+	}
+	return tx, nil
+}
+
+func (db *MemoryDB) Update(fn func(tx Tx) error) error {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *MemoryDB) View(fn func(tx Tx) error) error {
+	tx, err := db.Begin(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	return fn(tx)
+}
+
+func (db *MemoryDB) Close() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.closed = true
+	return nil
+}
+
+type memTx struct {
+	db       *MemoryDB
+	root     *memNode
+	gen      uint64
+	writable bool
+	closed   bool
+	*txHooks
+}
+
+func (tx *memTx) node(path []string, write bool) *memNode {
+	if write && tx.root.gen != tx.gen {
+		tx.root = tx.root.clone(tx.gen)
+	}
+	n := tx.root
+	for _, p := range path {
+		c := n.buckets[p]
+		if c == nil {
+			return nil
+		}
+		if write && c.gen != tx.gen {
+			c = c.clone(tx.gen)
+			n.buckets[p] = c
+		}
+		n = c
+	}
+	return n
+}
+
+func (tx *memTx) bucket() *memBucket {
+	return &memBucket{tx: tx}
+}
+
+func (tx *memTx) Bucket(name []byte) Bucket {
+	return tx.bucket().Bucket(name)
+}
+
+func (tx *memTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	return tx.bucket().CreateBucketIfNotExists(name)
+}
+
+func (tx *memTx) DeleteBucket(name []byte) error {
+	return tx.bucket().DeleteBucket(name)
+}
+
+func (tx *memTx) ForEach(fn func(name []byte, b Bucket) error) error {
+	root := tx.bucket()
+	return root.ForEach(func(k, v []byte) error {
+		return fn(k, root.Bucket(k))
+	})
+}
+
+func (tx *memTx) Writable() bool {
+	return tx.writable
+}
+
+func (tx *memTx) Commit() error {
+	if tx.closed {
+		return ErrTxClosed
+	}
+	if !tx.writable {
+		return ErrTxNotWritable
+	}
+	return tx.commit(func() error {
+		tx.db.lock.Lock()
+		tx.db.root = tx.root
+		tx.db.lock.Unlock()
+		tx.close()
+		return nil
+	}, tx.Rollback)
+}
+
+func (tx *memTx) Rollback() error {
+	if tx.closed {
+		return ErrTxClosed
+	}
+	tx.rolledBack()
+	tx.close()
+	return nil
+}
+
+func (tx *memTx) close() {
+	tx.closed = true
+	if tx.writable {
+		tx.db.wlock.Unlock()
+	}
+}
+
+type memBucket struct {
+	tx   *memTx
+	path []string
+}
+
+func (b *memBucket) child(name []byte) []string {
+	path := make([]string, len(b.path), len(b.path)+1)
+	copy(path, b.path)
+	return append(path, string(name))
+}
+
+func (b *memBucket) Get(key []byte) []byte {
+	n := b.tx.node(b.path, false)
+	if n == nil {
+		return nil
+	}
+	return n.values[string(key)]
+}
+
+func (b *memBucket) Put(key []byte, value []byte) error {
+	if !b.tx.writable {
+		return ErrTxNotWritable
+	}
+	n := b.tx.node(b.path, true)
+	if n == nil {
+		return ErrBucketNotFound
+	}
+	if _, ok := n.buckets[string(key)]; ok {
+		return ErrIncompatibleItem
+	}
+	n.values[string(key)] = append([]byte{}, value...)
+	return nil
+}
+
+func (b *memBucket) Delete(key []byte) error {
+	if !b.tx.writable {
+		return ErrTxNotWritable
+	}
+	n := b.tx.node(b.path, true)
+	if n == nil {
+		return ErrBucketNotFound
+	}
+	if _, ok := n.buckets[string(key)]; ok {
+		return ErrIncompatibleItem
+	}
+	delete(n.values, string(key))
+	return nil
+}
+
+func (b *memBucket) Bucket(name []byte) Bucket {
+	n := b.tx.node(b.path, false)
+	if n == nil {
+		return nil
+	}
+	if _, ok := n.buckets[string(name)]; !ok {
+		return nil
+	}
+	return &memBucket{tx: b.tx, path: b.child(name)}
+}
+
+func (b *memBucket) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	if !b.tx.writable {
+		return nil, ErrTxNotWritable
+	}
+	n := b.tx.node(b.path, true)
+	if n == nil {
+		return nil, ErrBucketNotFound
+	}
+	if _, ok := n.values[string(name)]; ok {
+		return nil, ErrIncompatibleItem
+	}
+	if _, ok := n.buckets[string(name)]; !ok {
+		n.buckets[string(name)] = newMemNode(b.tx.gen)
+	}
+	return &memBucket{tx: b.tx, path: b.child(name)}, nil
+}
+
+func (b *memBucket) DeleteBucket(name []byte) error {
+	if !b.tx.writable {
+		return ErrTxNotWritable
+	}
+	n := b.tx.node(b.path, true)
+	if n == nil {
+		return ErrBucketNotFound
+	}
+	if _, ok := n.buckets[string(name)]; !ok {
+		return ErrBucketNotFound
+	}
+	delete(n.buckets, string(name))
+	return nil
+}
+
+func (b *memBucket) NextSequence() (uint64, error) {
+	if !b.tx.writable {
+		return 0, ErrTxNotWritable
+	}
+	n := b.tx.node(b.path, true)
+	if n == nil {
+		return 0, ErrBucketNotFound
+	}
+	n.seq++
+	return n.seq, nil
+}
+
+func (b *memBucket) ForEach(fn func(k, v []byte) error) error {
+	c := b.cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *memBucket) Cursor() Cursor {
+	return b.cursor()
+}
+
+func (b *memBucket) cursor() *memCursor {
+	c := &memCursor{}
+	n := b.tx.node(b.path, false)
+	if n == nil {
+		return c
+	}
+	for k, v := range n.values {
+		c.items = append(c.items, memItem{[]byte(k), v})
+	}
+	for k := range n.buckets {
+		c.items = append(c.items, memItem{[]byte(k), nil})
+	}
+	sort.Slice(c.items, func(i, j int) bool {
+		return bytes.Compare(c.items[i].k, c.items[j].k) < 0
+	})
+	return c
+}
+
+func (b *memBucket) SetFillPercent(fill float64) {}
+
+type memItem struct {
+	k, v []byte
+}
+
+// memCursor iterates over a snapshot of a bucket's keys taken when the
+// cursor was created.
+type memCursor struct {
+	items []memItem
+	pos   int
+}
+
+func (c *memCursor) at(i int) ([]byte, []byte) {
+	c.pos = i
+	if i < 0 || i >= len(c.items) {
+		return nil, nil
+	}
+	return c.items[i].k, c.items[i].v
+}
+
+func (c *memCursor) First() ([]byte, []byte) {
+	return c.at(0)
+}
+
+func (c *memCursor) Last() ([]byte, []byte) {
+	return c.at(len(c.items) - 1)
+}
+
+func (c *memCursor) Next() ([]byte, []byte) {
+	if c.pos >= len(c.items) {
+		return nil, nil
+	}
+	return c.at(c.pos + 1)
+}
+
+func (c *memCursor) Prev() ([]byte, []byte) {
+	if c.pos < 0 {
+		return nil, nil
+	}
+	return c.at(c.pos - 1)
+}
+
+func (c *memCursor) Seek(seek []byte) ([]byte, []byte) {
+	return c.at(sort.Search(len(c.items), func(i int) bool {
+		return bytes.Compare(c.items[i].k, seek) >= 0
+	}))
+}
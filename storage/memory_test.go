@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMemoryIsolation(t *testing.T) {
+	db := NewMemory()
+	err := db.Update(func(tx Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("feeds"))
+		if err != nil {
+			return err
+		}
+		fb, err := b.CreateBucketIfNotExists([]byte("a"))
+		if err != nil {
+			return err
+		}
+		return fb.Put([]byte("k"), []byte("v1"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	read, _ := db.Begin(false)
+	defer read.Rollback()
+
+	err = db.Update(func(tx Tx) error {
+		return tx.Bucket([]byte("feeds")).Bucket([]byte("a")).Put([]byte("k"), []byte("v2"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := read.Bucket([]byte("feeds")).Bucket([]byte("a")).Get([]byte("k")); !bytes.Equal(v, []byte("v1")) {
+		t.Errorf("reader saw %q, expected snapshot value v1", v)
+	}
+	db.View(func(tx Tx) error {
+		if v := tx.Bucket([]byte("feeds")).Bucket([]byte("a")).Get([]byte("k")); !bytes.Equal(v, []byte("v2")) {
+			t.Errorf("expected committed value v2, got %q", v)
+		}
+		return nil
+	})
+
+	db.Update(func(tx Tx) error {
+		tx.Bucket([]byte("feeds")).Bucket([]byte("a")).Put([]byte("k"), []byte("v3"))
+		return ErrBucketNotFound
+	})
+	db.View(func(tx Tx) error {
+		if v := tx.Bucket([]byte("feeds")).Bucket([]byte("a")).Get([]byte("k")); !bytes.Equal(v, []byte("v2")) {
+			t.Errorf("rolled back write leaked: %q", v)
+		}
+		return nil
+	})
+}
+
+func TestBucketLogCursor(t *testing.T) {
+	db := NewMemory()
+	l := NewBucketLog("log")
+	db.Update(func(tx Tx) error {
+		for _, d := range []string{"a", "b", "c"} {
+			if _, err := l.Append(tx, []byte(d)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	db.View(func(tx Tx) error {
+		c := l.Cursor(tx)
+		var got []byte
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			got = append(got, v...)
+		}
+		if string(got) != "cba" {
+			t.Errorf("expected cba, got %q", got)
+		}
+		if k, v := c.Seek(itob(2)); btoi(k) != 2 || string(v) != "b" {
+			t.Errorf("seek returned %v %q", k, v)
+		}
+		if v := l.Get(tx, 3); string(v) != "c" {
+			t.Errorf("expected c, got %q", v)
+		}
+		return nil
+	})
+}
+
+func TestRemoveEntry(t *testing.T) {
+	db := NewMemory()
+	err := db.Update(func(tx Tx) error {
+		b, _ := tx.CreateBucketIfNotExists([]byte("time"))
+		keys, _ := tx.CreateBucketIfNotExists([]byte("timekeys"))
+		for i, m := range []string{"a", "b", "c"} {
+			if err := PutEntry(b, keys, itob(i), []byte(m)); err != nil {
+				return err
+			}
+		}
+		if err := RemoveEntry(b, keys, []byte("b")); err != nil {
+			return err
+		}
+		if err := RemoveEntry(b, keys, []byte("missing")); err != nil {
+			return err
+		}
+		var got []byte
+		b.ForEach(func(k, v []byte) error {
+			got = append(got, v...)
+			return nil
+		})
+		if string(got) != "ac" || keys.Get([]byte("b")) != nil {
+			t.Errorf("entries left are %q", got)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,360 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+var ErrLogReadOnly = errors.New("Log opened read only")
+
+// OffsetLog is an append-only log file using the framing of the JS
+// flumelog-offset module:
+//
+//	<length: uint32be><data><length: uint32be><next offset: uint32be>
+//
+// A record's offset is the byte position of its frame in the file. The
+// trailing length allows reading backwards, and the trailing offset marks
+// a complete write.
+//
+// Records appended in a transaction are only read by others once it
+// commits. Until then end is where they start and pending where they
+// finish.
+type OffsetLog struct {
+	lock     sync.Mutex
+	f        *os.File
+	end      int
+	pending  int
+	tx       Tx
+	readOnly bool
+	sealer   *Sealer
+}
+
+const frameOverhead = 12
+
+func OpenOffsetLog(path string) (*OffsetLog, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return newOffsetLog(f, false)
+}
+
+// OpenOffsetLogReadOnly opens an existing log without modifying it, so it
+// is safe to use on a log another process is still writing to. A partial
+// frame at the end is ignored rather than truncated.
+func OpenOffsetLogReadOnly(path string) (*OffsetLog, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return newOffsetLog(f, true)
+}
+
+func newOffsetLog(f *os.File, readOnly bool) (*OffsetLog, error) {
+	l := &OffsetLog{f: f, readOnly: readOnly}
+	end, err := l.recover()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	l.end, l.pending = end, end
+	return l, nil
+}
+
+// recover finds the end of the last complete frame, truncating anything
+// written after it by an interrupted append unless the log is read only.
+func (l *OffsetLog) recover() (int, error) {
+	fi, err := l.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := int(fi.Size())
+	if size == 0 {
+		return 0, nil
+	}
+	if size >= frameOverhead {
+		var tail [8]byte
+		if _, err := l.f.ReadAt(tail[:], int64(size-8)); err != nil {
+			return 0, err
+		}
+		length := int(binary.BigEndian.Uint32(tail[0:]))
+		next := int(binary.BigEndian.Uint32(tail[4:]))
+		if next == size && l.valid(size-length-frameOverhead, size) {
+			return size, nil
+		}
+	}
+	end := 0
+	for end < size {
+		length, err := l.length(end)
+		if err != nil || !l.valid(end, size) {
+			break
+		}
+		end += length + frameOverhead
+	}
+	if l.readOnly {
+		return end, nil
+	}
+	return end, l.f.Truncate(int64(end))
+}
+
+func (l *OffsetLog) valid(offset, size int) bool {
+	if offset < 0 || offset+frameOverhead > size {
+		return false
+	}
+	length, err := l.length(offset)
+	if err != nil || offset+length+frameOverhead > size {
+		return false
+	}
+	var tail [8]byte
+	if _, err := l.f.ReadAt(tail[:], int64(offset+4+length)); err != nil {
+		return false
+	}
+	return int(binary.BigEndian.Uint32(tail[0:])) == length &&
+		int(binary.BigEndian.Uint32(tail[4:])) == offset+length+frameOverhead
+}
+
+// SetSealer seals the records appended from then on with s, and opens
+// those read. Records erased stay zeros, and are read back as such.
+func (l *OffsetLog) SetSealer(s *Sealer) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.sealer = s
+}
+
+func (l *OffsetLog) open(buf []byte) []byte {
+	if l.sealer == nil {
+		return buf
+	}
+	for _, b := range buf {
+		if b != 0 {
+			return l.sealer.open(buf)
+		}
+	}
+	return buf
+}
+
+func (l *OffsetLog) length(offset int) (int, error) {
+	var head [4]byte
+	if _, err := l.f.ReadAt(head[:], int64(offset)); err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint32(head[:])), nil
+}
+
+func (l *OffsetLog) read(offset int) ([]byte, int, error) {
+	length, err := l.length(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	buf := make([]byte, length)
+	if _, err := l.f.ReadAt(buf, int64(offset+4)); err != nil {
+		return nil, 0, err
+	}
+	return buf, offset + length + frameOverhead, nil
+}
+
+// Append writes data as a new frame. If tx is a Finisher the file is synced
+// once before it commits, and the frames it appended are truncated if it
+// rolls back. Otherwise the file is synced before returning.
+func (l *OffsetLog) Append(tx Tx, data []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.readOnly {
+		return 0, ErrLogReadOnly
+	}
+	if l.sealer != nil {
+		data = l.sealer.Seal(data)
+	}
+	offset := l.pending
+	next := offset + len(data) + frameOverhead
+	buf := make([]byte, len(data)+frameOverhead)
+	binary.BigEndian.PutUint32(buf[0:], uint32(len(data)))
+	copy(buf[4:], data)
+	binary.BigEndian.PutUint32(buf[4+len(data):], uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[8+len(data):], uint32(next))
+	if _, err := l.f.WriteAt(buf, int64(offset)); err != nil {
+		return 0, err
+	}
+	f, ok := tx.(Finisher)
+	if !ok {
+		if err := l.f.Sync(); err != nil {
+			return 0, err
+		}
+		l.end, l.pending = next, next
+		return offset, nil
+	}
+	if l.tx == nil {
+		l.tx = tx
+		f.BeforeCommit(l.f.Sync)
+		f.OnCommit(l.commit)
+		f.OnRollback(l.rollback)
+	}
+	l.pending = next
+	return offset, nil
+}
+
+func (l *OffsetLog) commit() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.end, l.tx = l.pending, nil
+}
+
+func (l *OffsetLog) rollback() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.f.Truncate(int64(l.end))
+	l.pending, l.tx = l.end, nil
+}
+
+// visible returns the end of the frames tx can read, which includes those
+// it appended itself.
+func (l *OffsetLog) visible(tx Tx) int {
+	if tx != nil && tx == l.tx {
+		return l.pending
+	}
+	return l.end
+}
+
+// Erase overwrites the data of the record at offset with zeros. The frame
+// is kept so the offsets of later records do not change, and the file is
+// synced before returning.
+func (l *OffsetLog) Erase(tx Tx, offset int) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.readOnly {
+		return ErrLogReadOnly
+	}
+	if !l.valid(offset, l.end) {
+		return nil
+	}
+	length, err := l.length(offset)
+	if err != nil {
+		return err
+	}
+	if _, err := l.f.WriteAt(make([]byte, length), int64(offset+4)); err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
+
+func (l *OffsetLog) Get(tx Tx, offset int) []byte {
+	l.lock.Lock()
+	end := l.visible(tx)
+	l.lock.Unlock()
+	if offset < 0 || offset >= end {
+		return nil
+	}
+	buf, _, err := l.read(offset)
+	if err != nil {
+		return nil
+	}
+	return l.open(buf)
+}
+
+// Cursor walks the frames committed before it was created, and those tx
+// appended itself.
+func (l *OffsetLog) Cursor(tx Tx) Cursor {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return &offsetCursor{l: l, end: l.visible(tx), pos: -1}
+}
+
+// Size returns the number of bytes of complete frames in the log.
+func (l *OffsetLog) Size() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.end
+}
+
+// CopyTo writes the first size bytes of the log to w. Records are never
+// moved once written, so a size taken from Size earlier gives a copy of the
+// log as it was then, apart from records erased since.
+func (l *OffsetLog) CopyTo(w io.Writer, size int) (int64, error) {
+	return io.Copy(w, io.NewSectionReader(l.f, 0, int64(size)))
+}
+
+func (l *OffsetLog) Close() error {
+	return l.f.Close()
+}
+
+type offsetCursor struct {
+	l   *OffsetLog
+	end int
+	pos int
+}
+
+func (c *offsetCursor) at(offset int) ([]byte, []byte) {
+	if offset < 0 || offset >= c.end {
+		c.pos = -1
+		return nil, nil
+	}
+	buf, _, err := c.l.read(offset)
+	if err != nil {
+		c.pos = -1
+		return nil, nil
+	}
+	c.pos = offset
+	return itob(offset), c.l.open(buf)
+}
+
+func (c *offsetCursor) First() ([]byte, []byte) {
+	return c.at(0)
+}
+
+func (c *offsetCursor) Last() ([]byte, []byte) {
+	return c.prevFrom(c.end)
+}
+
+func (c *offsetCursor) Next() ([]byte, []byte) {
+	if c.pos < 0 {
+		return nil, nil
+	}
+	length, err := c.l.length(c.pos)
+	if err != nil {
+		return nil, nil
+	}
+	return c.at(c.pos + length + frameOverhead)
+}
+
+func (c *offsetCursor) Prev() ([]byte, []byte) {
+	if c.pos <= 0 {
+		c.pos = -1
+		return nil, nil
+	}
+	return c.prevFrom(c.pos)
+}
+
+func (c *offsetCursor) prevFrom(offset int) ([]byte, []byte) {
+	if offset < frameOverhead {
+		c.pos = -1
+		return nil, nil
+	}
+	var tail [4]byte
+	if _, err := c.l.f.ReadAt(tail[:], int64(offset-8)); err != nil && err != io.EOF {
+		c.pos = -1
+		return nil, nil
+	}
+	length := int(binary.BigEndian.Uint32(tail[:]))
+	return c.at(offset - length - frameOverhead)
+}
+
+// Seek positions the cursor on the frame at offset, or the first frame
+// after it if offset is not the start of a frame.
+func (c *offsetCursor) Seek(seek []byte) ([]byte, []byte) {
+	offset := btoi(seek)
+	if offset >= c.end {
+		c.pos = -1
+		return nil, nil
+	}
+	if c.l.valid(offset, c.end) {
+		return c.at(offset)
+	}
+	k, v := c.First()
+	for k != nil && btoi(k) < offset {
+		k, v = c.Next()
+	}
+	return k, v
+}
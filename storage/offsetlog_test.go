@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOffsetLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "offsetlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "log.offset")
+
+	l, err := OpenOffsetLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offsets := []int{}
+	for _, d := range []string{"one", "two", "three"} {
+		off, err := l.Append(nil, []byte(d))
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, off)
+	}
+	if offsets[1] != 3+frameOverhead || offsets[2] != 6+2*frameOverhead {
+		t.Fatalf("unexpected offsets %v", offsets)
+	}
+	l.Close()
+
+	raw, _ := ioutil.ReadFile(path)
+	if next := binary.BigEndian.Uint32(raw[len(raw)-4:]); int(next) != len(raw) {
+		t.Errorf("trailer %d does not match file size %d", next, len(raw))
+	}
+
+	// simulate an interrupted append
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	f.Write([]byte{0, 0, 0, 9, 'p', 'a', 'r'})
+	f.Close()
+
+	l, err = OpenOffsetLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if l.Size() != len(raw) {
+		t.Fatalf("expected partial frame to be truncated to %d, got %d", len(raw), l.Size())
+	}
+
+	c := l.Cursor(nil)
+	var got string
+	for k, v := c.Last(); k != nil; k, v = c.Prev() {
+		got += string(v) + ","
+	}
+	if got != "three,two,one," {
+		t.Errorf("reverse walk returned %q", got)
+	}
+	if k, v := c.Seek(itob(offsets[1])); btoi(k) != offsets[1] || string(v) != "two" {
+		t.Errorf("seek returned %v %q", k, v)
+	}
+	if k, v := c.Seek(itob(offsets[1] + 1)); btoi(k) != offsets[2] || string(v) != "three" {
+		t.Errorf("seek between frames returned %v %q", k, v)
+	}
+	if v := l.Get(nil, offsets[0]); string(v) != "one" {
+		t.Errorf("get returned %q", v)
+	}
+
+	if err := l.Erase(nil, offsets[1]); err != nil {
+		t.Fatal(err)
+	}
+	if v := l.Get(nil, offsets[1]); string(v) != "\x00\x00\x00" {
+		t.Errorf("erased record is %q", v)
+	}
+	if k, v := c.Seek(itob(offsets[1])); btoi(k) != offsets[1] {
+		t.Errorf("seek to erased record returned %v %q", k, v)
+	}
+	if _, v := c.Next(); string(v) != "three" {
+		t.Errorf("record after erased one is %q", v)
+	}
+}
+
+func TestOffsetLogTx(t *testing.T) {
+	dir, err := ioutil.TempDir("", "offsetlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := OpenOffsetLog(filepath.Join(dir, "log.offset"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	db, err := OpenBolt(filepath.Join(dir, "db"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var kept int
+	err = db.Update(func(tx Tx) error {
+		kept, err = l.Append(tx, []byte("kept"))
+		if err != nil {
+			return err
+		}
+		if v := l.Get(tx, kept); string(v) != "kept" {
+			t.Errorf("record read in its transaction as %q", v)
+		}
+		if v := l.Get(nil, kept); v != nil {
+			t.Errorf("record read before its transaction committed as %q", v)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := l.Size()
+	if size != len("kept")+frameOverhead {
+		t.Errorf("log is %d bytes after a commit", size)
+	}
+
+	rollback := errors.New("rollback")
+	var dropped int
+	err = db.Update(func(tx Tx) error {
+		l.Append(tx, []byte("dropped"))
+		dropped, _ = l.Append(tx, []byte("twice"))
+		return rollback
+	})
+	if err != rollback {
+		t.Fatal(err)
+	}
+	if fi, _ := l.f.Stat(); l.Size() != size || fi.Size() != int64(size) {
+		t.Errorf("log is %d bytes, %d on disk, after a rollback", l.Size(), fi.Size())
+	}
+	if v := l.Get(nil, dropped); v != nil {
+		t.Errorf("rolled back record read as %q", v)
+	}
+	if off, _ := l.Append(nil, []byte("next")); off != size {
+		t.Errorf("record after a rollback appended at %d", off)
+	}
+}
@@ -0,0 +1,281 @@
+package storage
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+var ErrSealBroken = errors.New("Sealed value cannot be opened")
+
+// SealOverhead is how much longer a sealed value is than its contents.
+const SealOverhead = 24 + secretbox.Overhead
+
+// Sealer seals values with a secret key, so they can only be read back with
+// the same key. Each value gets a random nonce, stored in front of it.
+type Sealer struct {
+	key [32]byte
+}
+
+func NewSealer(key *[32]byte) *Sealer {
+	return &Sealer{key: *key}
+}
+
+func (s *Sealer) Seal(data []byte) []byte {
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		panic(err)
+	}
+	return secretbox.Seal(nonce[:], data, &nonce, &s.key)
+}
+
+func (s *Sealer) Open(sealed []byte) ([]byte, error) {
+	if len(sealed) < SealOverhead {
+		return nil, ErrSealBroken
+	}
+	var nonce [24]byte
+	copy(nonce[:], sealed)
+	data, ok := secretbox.Open([]byte{}, sealed[24:], &nonce, &s.key)
+	if !ok {
+		return nil, ErrSealBroken
+	}
+	return data, nil
+}
+
+// open returns the contents of a sealed value, or nil if it cannot be
+// opened.
+func (s *Sealer) open(sealed []byte) []byte {
+	if sealed == nil {
+		return nil
+	}
+	data, err := s.Open(sealed)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// SealDB returns a view of db whose values are sealed with s as they are
+// written and opened as they are read. Keys and bucket names are left as
+// they are, so buckets keep their order; they should not hold anything
+// secret.
+func SealDB(db DB, s *Sealer) DB {
+	return &sealedDB{db, s}
+}
+
+type sealedDB struct {
+	db DB
+	s  *Sealer
+}
+
+func (db *sealedDB) wrap(tx Tx) Tx {
+	stx := sealedTx{tx, db.s}
+	if _, ok := tx.(Snapshotter); ok {
+		return sealedBoltTx{stx}
+	}
+	return stx
+}
+
+func (db *sealedDB) Begin(writable bool) (Tx, error) {
+	tx, err := db.db.Begin(writable)
+	if err != nil {
+		return nil, err
+	}
+	return db.wrap(tx), nil
+}
+
+func (db *sealedDB) Update(fn func(tx Tx) error) error {
+	return db.db.Update(func(tx Tx) error {
+		return fn(db.wrap(tx))
+	})
+}
+
+func (db *sealedDB) View(fn func(tx Tx) error) error {
+	return db.db.View(func(tx Tx) error {
+		return fn(db.wrap(tx))
+	})
+}
+
+func (db *sealedDB) Close() error {
+	return db.db.Close()
+}
+
+type sealedTx struct {
+	tx Tx
+	s  *Sealer
+}
+
+func (t sealedTx) wrapBucket(b Bucket) Bucket {
+	if b == nil {
+		return nil
+	}
+	return sealedBucket{b, t.s}
+}
+
+func (t sealedTx) Bucket(name []byte) Bucket {
+	return t.wrapBucket(t.tx.Bucket(name))
+}
+
+func (t sealedTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	b, err := t.tx.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+	return t.wrapBucket(b), nil
+}
+
+func (t sealedTx) DeleteBucket(name []byte) error {
+	return t.tx.DeleteBucket(name)
+}
+
+func (t sealedTx) ForEach(fn func(name []byte, b Bucket) error) error {
+	return t.tx.ForEach(func(name []byte, b Bucket) error {
+		return fn(name, t.wrapBucket(b))
+	})
+}
+
+func (t sealedTx) Writable() bool {
+	return t.tx.Writable()
+}
+
+func (t sealedTx) Commit() error {
+	return t.tx.Commit()
+}
+
+func (t sealedTx) Rollback() error {
+	return t.tx.Rollback()
+}
+
+func (t sealedTx) BeforeCommit(fn func() error) {
+	t.tx.(Finisher).BeforeCommit(fn)
+}
+
+func (t sealedTx) OnCommit(fn func()) {
+	t.tx.(Finisher).OnCommit(fn)
+}
+
+func (t sealedTx) OnRollback(fn func()) {
+	t.tx.(Finisher).OnRollback(fn)
+}
+
+// sealedBoltTx passes snapshots and checks through to a bolt transaction.
+// Both work on the file as stored, so a snapshot stays sealed.
+type sealedBoltTx struct {
+	sealedTx
+}
+
+func (t sealedBoltTx) Size() int64 {
+	return t.tx.(Snapshotter).Size()
+}
+
+func (t sealedBoltTx) WriteTo(w io.Writer) (int64, error) {
+	return t.tx.(Snapshotter).WriteTo(w)
+}
+
+func (t sealedBoltTx) Check() <-chan error {
+	return t.tx.(Checker).Check()
+}
+
+type sealedBucket struct {
+	b Bucket
+	s *Sealer
+}
+
+func (b sealedBucket) Get(key []byte) []byte {
+	return b.s.open(b.b.Get(key))
+}
+
+func (b sealedBucket) Put(key []byte, value []byte) error {
+	return b.b.Put(key, b.s.Seal(value))
+}
+
+func (b sealedBucket) Delete(key []byte) error {
+	return b.b.Delete(key)
+}
+
+func (b sealedBucket) Bucket(name []byte) Bucket {
+	nb := b.b.Bucket(name)
+	if nb == nil {
+		return nil
+	}
+	return sealedBucket{nb, b.s}
+}
+
+func (b sealedBucket) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	nb, err := b.b.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+	return sealedBucket{nb, b.s}, nil
+}
+
+func (b sealedBucket) DeleteBucket(name []byte) error {
+	return b.b.DeleteBucket(name)
+}
+
+func (b sealedBucket) NextSequence() (uint64, error) {
+	return b.b.NextSequence()
+}
+
+// ForEach opens each value before passing it on. Values that cannot be
+// opened are passed on as empty, so they are not mistaken for nested
+// buckets.
+func (b sealedBucket) ForEach(fn func(k, v []byte) error) error {
+	return b.b.ForEach(func(k, v []byte) error {
+		return fn(k, b.openValue(v))
+	})
+}
+
+func (b sealedBucket) Cursor() Cursor {
+	return sealedCursor{b.b.Cursor(), b}
+}
+
+func (b sealedBucket) SetFillPercent(fill float64) {
+	b.b.SetFillPercent(fill)
+}
+
+// Size is the space the bucket takes as stored, seals included.
+func (b sealedBucket) Size() int64 {
+	return BucketSize(b.b)
+}
+
+func (b sealedBucket) openValue(v []byte) []byte {
+	if v == nil {
+		return nil
+	}
+	if data := b.s.open(v); data != nil {
+		return data
+	}
+	return []byte{}
+}
+
+type sealedCursor struct {
+	c Cursor
+	b sealedBucket
+}
+
+func (c sealedCursor) open(k, v []byte) ([]byte, []byte) {
+	return k, c.b.openValue(v)
+}
+
+func (c sealedCursor) First() ([]byte, []byte) {
+	return c.open(c.c.First())
+}
+
+func (c sealedCursor) Last() ([]byte, []byte) {
+	return c.open(c.c.Last())
+}
+
+func (c sealedCursor) Next() ([]byte, []byte) {
+	return c.open(c.c.Next())
+}
+
+func (c sealedCursor) Prev() ([]byte, []byte) {
+	return c.open(c.c.Prev())
+}
+
+func (c sealedCursor) Seek(seek []byte) ([]byte, []byte) {
+	return c.open(c.c.Seek(seek))
+}
@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSealDB(t *testing.T) {
+	var key [32]byte
+	key[0] = 1
+	s := NewSealer(&key)
+	raw := NewMemory()
+	db := SealDB(raw, s)
+	err := db.Update(func(tx Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("feeds"))
+		if err != nil {
+			return err
+		}
+		if _, err := b.CreateBucketIfNotExists([]byte("nested")); err != nil {
+			return err
+		}
+		return b.Put([]byte("k"), []byte("value"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw.View(func(tx Tx) error {
+		if v := tx.Bucket([]byte("feeds")).Get([]byte("k")); len(v) != len("value")+SealOverhead || bytes.Contains(v, []byte("value")) {
+			t.Errorf("value stored as %q", v)
+		}
+		return nil
+	})
+	db.View(func(tx Tx) error {
+		b := tx.Bucket([]byte("feeds"))
+		if v := b.Get([]byte("k")); string(v) != "value" {
+			t.Errorf("value read as %q", v)
+		}
+		if k, v := b.Cursor().First(); string(k) != "k" || string(v) != "value" {
+			t.Errorf("cursor read %q as %q", k, v)
+		}
+		b.ForEach(func(k, v []byte) error {
+			if string(k) == "nested" && v != nil {
+				t.Errorf("nested bucket read as %q", v)
+			}
+			return nil
+		})
+		return nil
+	})
+
+	var other [32]byte
+	if err := SealDB(raw, NewSealer(&other)).View(func(tx Tx) error {
+		if v := tx.Bucket([]byte("feeds")).Get([]byte("k")); v != nil {
+			t.Errorf("value opened with the wrong key as %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSealedOffsetLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sealedlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var key [32]byte
+	l, err := OpenOffsetLog(filepath.Join(dir, "log.offset"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.SetSealer(NewSealer(&key))
+	first, _ := l.Append(nil, []byte("first"))
+	second, _ := l.Append(nil, []byte("second"))
+	if err := l.Erase(nil, first); err != nil {
+		t.Fatal(err)
+	}
+
+	if v := l.Get(nil, second); string(v) != "second" {
+		t.Errorf("record read as %q", v)
+	}
+	c := l.Cursor(nil)
+	if k, v := c.First(); btoi(k) != first || len(v) != len("first")+SealOverhead || !bytes.Equal(v, make([]byte, len(v))) {
+		t.Errorf("erased record read as %q", v)
+	}
+	if k, v := c.Next(); btoi(k) != second || string(v) != "second" {
+		t.Errorf("cursor read %d as %q", btoi(k), v)
+	}
+}
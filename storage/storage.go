@@ -0,0 +1,221 @@
+// Package storage defines the transactional key/value and log interfaces a
+// DataStore is built on, along with bolt and in-memory implementations.
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var (
+	ErrTxNotWritable    = errors.New("Transaction not writable")
+	ErrTxClosed         = errors.New("Transaction closed")
+	ErrBucketNotFound   = errors.New("Bucket not found")
+	ErrIncompatibleItem = errors.New("Incompatible value")
+)
+
+// DB is a key/value store made up of nested buckets, accessed through
+// transactions.
+type DB interface {
+	Begin(writable bool) (Tx, error)
+	Update(fn func(tx Tx) error) error
+	View(fn func(tx Tx) error) error
+	Close() error
+}
+
+// Tx is a read-only or read-write transaction against a DB.
+type Tx interface {
+	Bucket(name []byte) Bucket
+	CreateBucketIfNotExists(name []byte) (Bucket, error)
+	DeleteBucket(name []byte) error
+	ForEach(fn func(name []byte, b Bucket) error) error
+	Writable() bool
+	Commit() error
+	Rollback() error
+}
+
+// Bucket is a sorted collection of key/value pairs and nested buckets. As
+// with bolt, ForEach and Cursor report nested buckets with a nil value.
+type Bucket interface {
+	Get(key []byte) []byte
+	Put(key []byte, value []byte) error
+	Delete(key []byte) error
+	Bucket(name []byte) Bucket
+	CreateBucketIfNotExists(name []byte) (Bucket, error)
+	DeleteBucket(name []byte) error
+	NextSequence() (uint64, error)
+	ForEach(fn func(k, v []byte) error) error
+	Cursor() Cursor
+	SetFillPercent(fill float64)
+}
+
+// Cursor walks the keys of a bucket in order.
+type Cursor interface {
+	First() (key []byte, value []byte)
+	Last() (key []byte, value []byte)
+	Next() (key []byte, value []byte)
+	Prev() (key []byte, value []byte)
+	Seek(seek []byte) (key []byte, value []byte)
+}
+
+// Log is an append-only sequence of records addressed by increasing
+// offsets. Cursors over a log return the offset as an 8 byte big endian key.
+type Log interface {
+	Append(tx Tx, data []byte) (int, error)
+	Get(tx Tx, offset int) []byte
+	Cursor(tx Tx) Cursor
+}
+
+// Eraser is a Log whose records can be erased, for data that must not be
+// kept.
+type Eraser interface {
+	Erase(tx Tx, offset int) error
+}
+
+// Snapshotter is a Tx that can write a consistent copy of its whole
+// database, as it was when the transaction began, without blocking writers.
+// WriteTo writes exactly Size bytes.
+type Snapshotter interface {
+	Size() int64
+	WriteTo(w io.Writer) (int64, error)
+}
+
+// Checker is a Tx that can check the structure of its database's file.
+// Check sends each problem it finds and closes the channel when done.
+type Checker interface {
+	Check() <-chan error
+}
+
+// Finisher is a writable Tx that runs functions as it finishes, so writes
+// kept outside the database, such as to an OffsetLog, can follow it.
+// Functions passed to BeforeCommit fail the commit if they return an error,
+// those passed to OnCommit run once the transaction is committed. Those
+// passed to OnRollback run as it rolls back, before another writable
+// transaction can begin, except when bolt fails to write the commit and
+// rolls back on its own.
+type Finisher interface {
+	BeforeCommit(fn func() error)
+	OnCommit(fn func())
+	OnRollback(fn func())
+}
+
+// txHooks implements Finisher for the transactions of this package.
+type txHooks struct {
+	beforeCommit []func() error
+	onCommit     []func()
+	onRollback   []func()
+}
+
+func (h *txHooks) BeforeCommit(fn func() error) {
+	h.beforeCommit = append(h.beforeCommit, fn)
+}
+
+func (h *txHooks) OnCommit(fn func()) {
+	h.onCommit = append(h.onCommit, fn)
+}
+
+func (h *txHooks) OnRollback(fn func()) {
+	h.onRollback = append(h.onRollback, fn)
+}
+
+// commit commits with the hooks run around it, rolling back instead if one
+// of those to run first fails.
+func (h *txHooks) commit(commit func() error, rollback func() error) error {
+	for _, fn := range h.beforeCommit {
+		if err := fn(); err != nil {
+			h.rolledBack()
+			rollback()
+			return err
+		}
+	}
+	if err := commit(); err != nil {
+		h.rolledBack()
+		return err
+	}
+	onCommit := h.onCommit
+	h.reset()
+	for _, fn := range onCommit {
+		fn()
+	}
+	return nil
+}
+
+func (h *txHooks) rolledBack() {
+	onRollback := h.onRollback
+	h.reset()
+	for _, fn := range onRollback {
+		fn()
+	}
+}
+
+func (h *txHooks) reset() {
+	h.beforeCommit, h.onCommit, h.onRollback = nil, nil, nil
+}
+
+// Sizer is a Bucket that knows how much space it takes, nested buckets
+// included.
+type Sizer interface {
+	Size() int64
+}
+
+// BucketSize returns the space b takes. Buckets that are not a Sizer are
+// measured by the length of their keys and values.
+func BucketSize(b Bucket) int64 {
+	if s, ok := b.(Sizer); ok {
+		return s.Size()
+	}
+	var size int64
+	b.ForEach(func(k, v []byte) error {
+		size += int64(len(k))
+		if v == nil {
+			if nb := b.Bucket(k); nb != nil {
+				size += BucketSize(nb)
+			}
+		} else {
+			size += int64(len(v))
+		}
+		return nil
+	})
+	return size
+}
+
+// PutEntry stores value under key in b, an index bucket mapping an
+// ordering key to the message it refers to, and key under value in keys so
+// RemoveEntry can find it again.
+func PutEntry(b, keys Bucket, key, value []byte) error {
+	if err := b.Put(key, value); err != nil {
+		return err
+	}
+	return keys.Put(value, key)
+}
+
+// RemoveEntry deletes the entry of b that PutEntry stored for value.
+func RemoveEntry(b, keys Bucket, value []byte) error {
+	key := keys.Get(value)
+	if key == nil {
+		return nil
+	}
+	if err := b.Delete(key); err != nil {
+		return err
+	}
+	return keys.Delete(value)
+}
+
+func itob(v int) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(v))
+	return b
+}
+
+func btoi(b []byte) int {
+	return int(binary.BigEndian.Uint64(b))
+}
+
+type emptyCursor struct{}
+
+func (emptyCursor) First() ([]byte, []byte)      { return nil, nil }
+func (emptyCursor) Last() ([]byte, []byte)       { return nil, nil }
+func (emptyCursor) Next() ([]byte, []byte)       { return nil, nil }
+func (emptyCursor) Prev() ([]byte, []byte)       { return nil, nil }
+func (emptyCursor) Seek([]byte) ([]byte, []byte) { return nil, nil }
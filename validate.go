@@ -0,0 +1,148 @@
+package ssb
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// MaxMessageSize is the largest a message may be, counted in UTF-16 code
+// units of its canonical encoding as JS peers count it.
+const MaxMessageSize = 8192
+
+// ValidationError is returned for a message that breaks the rules on size
+// and shape that every peer enforces, before its signature is checked.
+type ValidationError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("Invalid message: %s", e.Reason)
+	}
+	return fmt.Sprintf("Invalid message %s: %s", e.Field, e.Reason)
+}
+
+// messageFields is the order fields must appear in, except that author and
+// sequence may be swapped as some early clients wrote them that way.
+var messageFields = []string{"previous", "author", "sequence", "timestamp", "hash", "content", "signature"}
+
+var boxedContent = regexp.MustCompile(`^[0-9A-Za-z/+]+={0,2}\.box`)
+
+// Validate checks m against the limits JS peers apply to every message, so
+// that malformed messages are rejected rather than stored, and ours are not
+// published only to be refused by everyone else.
+func (m *SignedMessage) Validate() error {
+	raw := m.canonical()
+	if size := jsLength(raw); size > MaxMessageSize {
+		return &ValidationError{"", fmt.Sprintf("size %d is over the limit of %d", size, MaxMessageSize)}
+	}
+	v, err := parseJS(raw)
+	if err != nil || v.kind != jsObject {
+		return &ValidationError{"", "not a JSON object"}
+	}
+	fields := map[string]*jsValue{}
+	for i, key := range v.keys {
+		name := string(utf16.Decode(key))
+		expected := ""
+		if i < len(messageFields) {
+			expected = messageFields[i]
+		}
+		switch {
+		case name == expected:
+		case i == 1 && name == "sequence", i == 2 && name == "author":
+		case i >= len(messageFields) || !knownField(name):
+			return &ValidationError{name, "unknown field"}
+		default:
+			return &ValidationError{name, fmt.Sprintf("out of place, expected %s", expected)}
+		}
+		fields[name] = v.items[i]
+	}
+	for _, name := range messageFields {
+		if fields[name] == nil {
+			return &ValidationError{name, "missing"}
+		}
+	}
+
+	seq := fields["sequence"]
+	if seq.kind != jsNumber || seq.num < 1 || seq.num != math.Trunc(seq.num) {
+		return &ValidationError{"sequence", "must be a positive integer"}
+	}
+	previous := fields["previous"]
+	switch {
+	case seq.num == 1 && previous.kind != jsNull:
+		return &ValidationError{"previous", "must be null for the first message"}
+	case seq.num > 1 && !isRef(previous, RefMessage, RefAlgoSha256):
+		return &ValidationError{"previous", "must be a sha256 message id"}
+	}
+	if !isRef(fields["author"], RefFeed, RefAlgoEd25519) {
+		return &ValidationError{"author", "must be an ed25519 feed id"}
+	}
+	if fields["timestamp"].kind != jsNumber {
+		return &ValidationError{"timestamp", "must be a number"}
+	}
+	if hash := fields["hash"]; hash.kind != jsString || string(utf16.Decode(hash.str)) != "sha256" {
+		return &ValidationError{"hash", "must be sha256"}
+	}
+	sig := fields["signature"]
+	if sig.kind != jsString || Signature(string(utf16.Decode(sig.str))).Algo() != SigAlgoEd25519 ||
+		len(Signature(string(utf16.Decode(sig.str))).Raw()) != 64 {
+		return &ValidationError{"signature", "must be an ed25519 signature"}
+	}
+
+	content := fields["content"]
+	switch content.kind {
+	case jsString:
+		if !boxedContent.MatchString(string(utf16.Decode(content.str))) {
+			return &ValidationError{"content", "string content must be boxed"}
+		}
+	case jsObject:
+		var typ *jsValue
+		for i, key := range content.keys {
+			if string(utf16.Decode(key)) == "type" {
+				typ = content.items[i]
+			}
+		}
+		if typ == nil || typ.kind != jsString || len(typ.str) < 3 || len(typ.str) > 52 {
+			return &ValidationError{"content", "type must be a string of 3 to 52 characters"}
+		}
+	default:
+		return &ValidationError{"content", "must be an object or a boxed string"}
+	}
+	return nil
+}
+
+func knownField(name string) bool {
+	for _, f := range messageFields {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+func isRef(v *jsValue, typ RefType, algo RefAlgo) bool {
+	if v.kind != jsString {
+		return false
+	}
+	s := string(utf16.Decode(v.str))
+	r := ParseRef(s)
+	return r.Type == typ && r.Algo == algo && len(r.Data) == 32 && r.String() == s
+}
+
+// jsLength is the length JS gives a string holding buf.
+func jsLength(buf []byte) int {
+	n := 0
+	for len(buf) > 0 {
+		r, size := utf8.DecodeRune(buf)
+		n++
+		if r > 0xffff {
+			n++
+		}
+		buf = buf[size:]
+	}
+	return n
+}
@@ -0,0 +1,74 @@
+package ssb
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	const (
+		author    = `"@6kpsY+KcUgq+9VB7Ey7F+ZVHdq6+vnuSQh7qaRRG0iw=.ed25519"`
+		previous  = `"%1F5q9u4UidFy1/w0s5aNFK7z46gXUYEIADCN5cJj/cA=.sha256"`
+		signature = `"SCCXtFGfF/N8UF9gQGSzUfgXOR/oVPno1MKz5E7K/mORnWf8irNlcdm2b1MQFEvwAYuy7MZ3qhyi8fyCVXUVAg==.sig.ed25519"`
+	)
+	msg := func(fields ...string) string {
+		return "{" + strings.Join(fields, ",") + "}"
+	}
+	valid := []string{
+		`"previous":` + previous, `"author":` + author, `"sequence":2`, `"timestamp":1500000000000`,
+		`"hash":"sha256"`, `"content":{"type":"post","text":"hello"}`, `"signature":` + signature,
+	}
+	with := func(i int, field string) string {
+		fields := append([]string{}, valid...)
+		fields[i] = field
+		return msg(fields...)
+	}
+
+	for _, raw := range []string{
+		msg(valid...),
+		with(5, `"content":"c2VjcmV0.box"`),
+		msg(`"previous":null`, `"sequence":1`, `"author":`+author, valid[3], valid[4], valid[5], valid[6]),
+		with(5, `"content":{"type":"`+strings.Repeat("x", 52)+`"}`),
+	} {
+		var m *SignedMessage
+		if err := json.Unmarshal([]byte(raw), &m); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Validate(); err != nil {
+			t.Errorf("%s: unexpected error %s", raw, err)
+		}
+	}
+
+	for _, c := range []struct {
+		field string
+		raw   string
+	}{
+		{"", with(5, `"content":{"type":"post","text":"`+strings.Repeat("é", MaxMessageSize)+`"}`)},
+		{"extra", msg(append(append([]string{}, valid...), `"extra":1`)...)},
+		{"hash", msg(valid[0], valid[1], valid[2], valid[4], valid[3], valid[5], valid[6])},
+		{"hash", with(4, `"hash":"sha512"`)},
+		{"previous", with(0, `"previous":null`)},
+		{"previous", with(0, `"previous":"%abc.sha256"`)},
+		{"author", with(1, `"author":"@abc.ed25519"`)},
+		{"sequence", with(2, `"sequence":0`)},
+		{"content", with(5, `"content":{"text":"no type"}`)},
+		{"signature", with(6, `"signature":"abc.sig.ed25519"`)},
+	} {
+		var m *SignedMessage
+		if err := json.Unmarshal([]byte(c.raw), &m); err != nil {
+			t.Fatal(err)
+		}
+		err, ok := m.Validate().(*ValidationError)
+		if !ok || err.Field != c.field {
+			t.Errorf("expected error in %q, got %v", c.field, err)
+		}
+	}
+	for _, content := range []string{`{"type":"ab"}`, `"not boxed"`, `[1]`, `{"type":1}`} {
+		var m *SignedMessage
+		json.Unmarshal([]byte(with(5, `"content":`+content)), &m)
+		if err, ok := m.Validate().(*ValidationError); !ok || err.Field != "content" {
+			t.Errorf("expected error in content for %s, got %v", content, err)
+		}
+	}
+}